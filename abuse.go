@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// abuseReason is the error reason of Google Drive for files that were
+// flagged as malware or spam
+const abuseReason = "cannotDownloadAbusiveFile"
+
+var acknowledgeAbuse bool
+
+// abuseWarnings holds the objects the abuse flag was already logged for
+var abuseWarnings = struct {
+	lock    sync.Mutex
+	objects map[string]bool
+}{
+	objects: make(map[string]bool),
+}
+
+// SetAcknowledgeAbuse enables downloading files Google Drive flagged as
+// abusive by acknowledging the risk. This bypasses a safety check of
+// Google, so only enable it for files you trust.
+func SetAcknowledgeAbuse(enabled bool) {
+	acknowledgeAbuse = enabled
+}
+
+// isAbuseFlagged checks if a request failed because the object was flagged
+// as abusive
+func isAbuseFlagged(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && http.StatusForbidden == statusErr.StatusCode && abuseReason == statusErr.Reason
+}
+
+// retryAbuseFlagged logs that an object was flagged as abusive once and
+// checks if the request should be retried with the acknowledgement
+func retryAbuseFlagged(object *APIObject) bool {
+	abuseWarnings.lock.Lock()
+	warned := abuseWarnings.objects[object.ObjectID]
+	abuseWarnings.objects[object.ObjectID] = true
+	abuseWarnings.lock.Unlock()
+
+	if !warned {
+		if acknowledgeAbuse {
+			Log.Warningf("Google Drive flagged %v as abusive, downloading it anyway", safeName(object.Name))
+		} else {
+			Log.Warningf("Google Drive flagged %v as abusive, use --acknowledge-abuse to download it anyway", safeName(object.Name))
+		}
+	}
+	return acknowledgeAbuse
+}
+
+// acknowledgeURL adds the abuse acknowledgement to a download url
+func acknowledgeURL(url string) string {
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	return url + separator + "acknowledgeAbuse=true"
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	gdrive "google.golang.org/api/drive/v2"
+)
+
+// accountBackoff is the time an account rests after it hit a download
+// limit, it doubles with every further limit till accountMaxBackoff
+const accountBackoff = time.Minute
+
+// accountMaxBackoff is the longest time an account rests, the download
+// quota of Google Drive resets within a day
+const accountMaxBackoff = 24 * time.Hour
+
+// downloadAccount is an account chunks are downloaded with
+type downloadAccount struct {
+	name     string
+	client   *http.Client
+	failures uint
+	resting  time.Time
+}
+
+// accounts holds the accounts downloads rotate through, the first one is
+// the account of the mount. It is empty without --account-file.
+var accounts = struct {
+	lock sync.Mutex
+	pool []*downloadAccount
+}{}
+
+// AccountStats describes an account downloads rotate through
+type AccountStats struct {
+	Name     string        `json:"name"`
+	Failures uint          `json:"failures"`
+	Resting  time.Duration `json:"resting"`
+}
+
+// LoadAccounts adds the service account keys and OAuth tokens in the JSON
+// files of a directory to the account of the mount. Once the account a
+// file is downloaded with hits a download limit (e.g. downloadQuotaExceeded
+// or a 429), the download is retried with the next account that doesn't
+// rest. OAuth tokens are refreshed with the client id of the mount.
+func (d *Drive) LoadAccounts(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read account directory %v", dir)
+	}
+
+	pool := []*downloadAccount{{name: "mount", client: d.getNativeClient()}}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		client, err := d.accountClient(path)
+		if nil != err {
+			Log.Warningf("%v", err)
+			continue
+		}
+		pool = append(pool, &downloadAccount{name: file.Name(), client: client})
+	}
+	Log.Infof("Loaded %v accounts from %v", len(pool)-1, dir)
+
+	accounts.lock.Lock()
+	defer accounts.lock.Unlock()
+
+	accounts.pool = pool
+	return nil
+}
+
+// LoadObjectAccounts downloads objects shared by other accounts with the
+// credentials of these accounts: every JSON file of the directory is a
+// service account key or an OAuth token named by the id of the object it
+// downloads (e.g. <object id>.json). The chunks of these objects are cached
+// for the tenant of their file.
+func (d *Drive) LoadObjectAccounts(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read object account directory %v", dir)
+	}
+
+	loaded := 0
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		client, err := d.accountClient(filepath.Join(dir, file.Name()))
+		if nil != err {
+			Log.Warningf("%v", err)
+			continue
+		}
+		SetClientTenant(client, file.Name())
+		SetObjectClient(strings.TrimSuffix(file.Name(), ".json"), client)
+		loaded++
+	}
+	Log.Infof("Loaded %v object accounts from %v", loaded, dir)
+	return nil
+}
+
+// accountClient creates the http client of a service account key or an
+// OAuth token file. It shares the cookies and the transport of the download
+// requests like the client of the mount.
+func (d *Drive) accountClient(path string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read account file %v", path)
+	}
+	var key struct {
+		Type         string `json:"type"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &key); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not decode account file %v", path)
+	}
+
+	ctx := d.context
+	if nil != downloadTransport {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: downloadTransport})
+	}
+	var source oauth2.TokenSource
+	switch {
+	case "service_account" == key.Type:
+		config, err := google.JWTConfigFromJSON(data, gdrive.DriveScope)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not read service account key %v", path)
+		}
+		source = config.TokenSource(ctx)
+	case "" != key.RefreshToken:
+		var token oauth2.Token
+		if err := json.Unmarshal(data, &token); nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not decode token %v", path)
+		}
+		source = d.config.TokenSource(ctx, &token)
+	default:
+		return nil, fmt.Errorf("Account file %v is neither a service account key nor an OAuth token", path)
+	}
+
+	client := oauth2.NewClient(ctx, source)
+	client.Jar = downloadCookies
+	return client, nil
+}
+
+// GetAccountStats returns the accounts downloads rotate through
+func GetAccountStats() []AccountStats {
+	accounts.lock.Lock()
+	defer accounts.lock.Unlock()
+
+	now := time.Now()
+	stats := []AccountStats{}
+	for _, account := range accounts.pool {
+		stat := AccountStats{Name: account.name, Failures: account.failures}
+		if account.resting.After(now) {
+			stat.Resting = account.resting.Sub(now)
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// isAccountLimited checks if a response rejected the request because the
+// account hit a download limit, another account may still download
+func isAccountLimited(err *StatusError) bool {
+	reason := strings.ToLower(err.Reason)
+	return http.StatusTooManyRequests == err.StatusCode ||
+		(http.StatusForbidden == err.StatusCode &&
+			(strings.HasSuffix(reason, "limitexceeded") || strings.HasSuffix(reason, "quotaexceeded")))
+}
+
+// downloadClient returns the client a new buffer downloads with: the given
+// client of the mount, unless the account of the mount rests
+func downloadClient(client *http.Client) *http.Client {
+	accounts.lock.Lock()
+	defer accounts.lock.Unlock()
+
+	now := time.Now()
+	if 0 == len(accounts.pool) || !accounts.pool[0].resting.After(now) {
+		return client
+	}
+	for _, account := range accounts.pool[1:] {
+		if !account.resting.After(now) {
+			return account.client
+		}
+	}
+	return client
+}
+
+// accountIndex returns the account of a client, clients that are not in
+// the pool belong to the mount. The lock must be held.
+func accountIndex(client *http.Client) int {
+	for i, account := range accounts.pool {
+		if account.client == client {
+			return i
+		}
+	}
+	return 0
+}
+
+// restAccount lets the account of a client rest after it hit a download
+// limit and returns the client of the next account that doesn't rest
+func restAccount(client *http.Client) (*http.Client, bool) {
+	accounts.lock.Lock()
+	defer accounts.lock.Unlock()
+
+	if len(accounts.pool) < 2 {
+		return nil, false
+	}
+	i := accountIndex(client)
+	account := accounts.pool[i]
+	backoff := accountBackoff << account.failures
+	if backoff > accountMaxBackoff || backoff <= 0 {
+		backoff = accountMaxBackoff
+	}
+	account.failures++
+	account.resting = time.Now().Add(backoff)
+	Log.Warningf("Account %v hit a download limit, resting it for %v", account.name, backoff)
+
+	now := time.Now()
+	for j := 1; j < len(accounts.pool); j++ {
+		next := accounts.pool[(i+j)%len(accounts.pool)]
+		if !next.resting.After(now) {
+			return next.client, true
+		}
+	}
+	return nil, false
+}
+
+// accountSucceeded resets the backoff of the account of a client after a
+// download succeeded
+func accountSucceeded(client *http.Client) {
+	accounts.lock.Lock()
+	defer accounts.lock.Unlock()
+
+	if 0 == len(accounts.pool) {
+		return
+	}
+	accounts.pool[accountIndex(client)].failures = 0
+}
+
+// httpClient returns the client the buffer downloads with
+func (b *Buffer) httpClient() *http.Client {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	return b.client
+}
+
+// rotateAccount switches the buffer to the next account that doesn't rest,
+// if a download failed because its account hit a download limit. Objects
+// downloaded with the credentials of the account that shared them stay on
+// their client.
+func (b *Buffer) rotateAccount(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	if !ok || !isAccountLimited(statusErr) || nil != objectClient(b.object.ObjectID, nil) {
+		return false
+	}
+
+	next, ok := restAccount(b.httpClient())
+	if !ok {
+		return false
+	}
+	Log.Infof("Retrying object %v with the next account", b.object.ObjectID)
+	b.clientLock.Lock()
+	b.client = next
+	b.clientLock.Unlock()
+	return true
+}
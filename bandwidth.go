@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// BandwidthFairStream shares the bandwidth limit equally between the
+	// files that are played
+	BandwidthFairStream = "stream"
+	// BandwidthFairUser shares the bandwidth limit equally between the
+	// users that play files
+	BandwidthFairUser = "user"
+)
+
+// bandwidthSlice is the time the bandwidth limit is shared in
+const bandwidthSlice = 100 * time.Millisecond
+
+// bandwidthWaiting is the time a stream that got less than it asked for
+// keeps its share in the following slices without asking again, in case it
+// stopped reading
+const bandwidthWaiting = 2 * time.Second
+
+var bandwidth = struct {
+	lock       sync.Mutex
+	rate       int64
+	fairness   string
+	sliceStart time.Time
+	sliceUsed  int64
+	used       map[string]int64
+	demand     map[string]bool
+	waiting    map[string]time.Time
+}{
+	fairness: BandwidthFairStream,
+	used:     make(map[string]int64),
+	demand:   make(map[string]bool),
+	waiting:  make(map[string]time.Time),
+}
+
+// SetBandwidthLimit limits the downloads of all files together to rate
+// bytes per second (0 = unlimited). Every stream that is played gets an
+// equal share of the limit, per file or per user depending on the
+// fairness. A stream may use the shares the others leave unused, preloads
+// and background reads only get what is left after all streams.
+func SetBandwidthLimit(rate int64, fairness string) error {
+	if BandwidthFairStream != fairness && BandwidthFairUser != fairness {
+		return fmt.Errorf("Invalid bandwidth fairness %v", fairness)
+	}
+
+	bandwidth.lock.Lock()
+	defer bandwidth.lock.Unlock()
+
+	bandwidth.rate = rate
+	bandwidth.fairness = fairness
+	return nil
+}
+
+// bandwidthReader limits the body of a response to the share of its stream
+type bandwidthReader struct {
+	io.ReadCloser
+	buffer   *Buffer
+	key      string
+	priority ReadPriority
+}
+
+// bandwidthBody wraps the body of a response for the given offset, if the
+// bandwidth is limited. The priority of the read downloading the offset
+// decides if the response gets a share of the limit.
+func (b *Buffer) bandwidthBody(body io.ReadCloser, offset int64) io.ReadCloser {
+	bandwidth.lock.Lock()
+	rate := bandwidth.rate
+	fairness := bandwidth.fairness
+	bandwidth.lock.Unlock()
+	if rate <= 0 {
+		return body
+	}
+
+	priority := ReadForeground
+	if fetch, exists := b.fetchOf(offset); exists {
+		priority = fetch.priority
+	}
+	key := b.object.ObjectID
+	if BandwidthFairUser == fairness {
+		key = fmt.Sprintf("uid %v", b.readerUID())
+	}
+	return &bandwidthReader{ReadCloser: body, buffer: b, key: key, priority: priority}
+}
+
+func (r *bandwidthReader) Read(p []byte) (int, error) {
+	granted := r.buffer.takeBandwidth(r.key, r.priority, int64(len(p)))
+	if granted <= 0 {
+		// the buffer was closed, the request is canceled anyway
+		return r.ReadCloser.Read(p)
+	}
+	n, err := r.ReadCloser.Read(p[:granted])
+	if int64(n) < granted {
+		returnBandwidth(r.key, r.priority, granted-int64(n))
+	}
+	return n, err
+}
+
+// takeBandwidth waits till the stream may download bytes and returns how
+// many, at most size (0 = the buffer was closed)
+func (b *Buffer) takeBandwidth(key string, priority ReadPriority, size int64) int64 {
+	for {
+		granted, wait := reserveBandwidth(key, priority, size)
+		if granted > 0 {
+			return granted
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-b.ctx.Done():
+			timer.Stop()
+			stopWaiting(key)
+			return 0
+		}
+	}
+}
+
+// reserveBandwidth reserves up to size bytes of the current slice for a
+// stream. Shares are only reserved for the streams that asked for bandwidth
+// in the slice and for the streams still waiting for bandwidth from the
+// slices before. A stream may use its share and what the other streams
+// don't reserve, a read that is not played only what no stream reserves.
+// If nothing is left, it returns the time till the next slice.
+func reserveBandwidth(key string, priority ReadPriority, size int64) (int64, time.Duration) {
+	bandwidth.lock.Lock()
+	defer bandwidth.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(bandwidth.sliceStart) >= bandwidthSlice {
+		bandwidth.sliceStart = now
+		bandwidth.sliceUsed = 0
+		bandwidth.used = make(map[string]int64)
+		bandwidth.demand = make(map[string]bool)
+		for stream, since := range bandwidth.waiting {
+			if now.Sub(since) > bandwidthWaiting {
+				delete(bandwidth.waiting, stream)
+				continue
+			}
+			bandwidth.demand[stream] = true
+		}
+	}
+	if ReadForeground == priority {
+		bandwidth.demand[key] = true
+	}
+
+	capacity := bandwidth.rate * int64(bandwidthSlice) / int64(time.Second)
+	if capacity < 1 {
+		capacity = 1
+	}
+	var share int64
+	if len(bandwidth.demand) > 0 {
+		share = capacity / int64(len(bandwidth.demand))
+	}
+	free := capacity - bandwidth.sliceUsed
+	for stream := range bandwidth.demand {
+		if stream == key && ReadForeground == priority {
+			continue
+		}
+		if reserved := share - bandwidth.used[stream]; reserved > 0 {
+			free -= reserved
+		}
+	}
+
+	granted := size
+	if granted > free {
+		granted = free
+	}
+	if ReadForeground == priority {
+		// a stream that got less than it asked for waits for the next
+		// slice, its share is kept for it
+		if granted < size {
+			bandwidth.waiting[key] = now
+		} else {
+			delete(bandwidth.waiting, key)
+		}
+	}
+	if granted <= 0 {
+		return 0, bandwidthSlice - now.Sub(bandwidth.sliceStart)
+	}
+
+	bandwidth.sliceUsed += granted
+	if ReadForeground == priority {
+		bandwidth.used[key] += granted
+	}
+	return granted, 0
+}
+
+// stopWaiting drops the share kept for a stream that stopped waiting for
+// bandwidth, e.g. because its buffer was closed
+func stopWaiting(key string) {
+	bandwidth.lock.Lock()
+	defer bandwidth.lock.Unlock()
+
+	delete(bandwidth.waiting, key)
+	delete(bandwidth.demand, key)
+}
+
+// returnBandwidth gives back reserved bytes a stream didn't download
+func returnBandwidth(key string, priority ReadPriority, size int64) {
+	bandwidth.lock.Lock()
+	defer bandwidth.lock.Unlock()
+
+	if bandwidth.sliceUsed -= size; bandwidth.sliceUsed < 0 {
+		bandwidth.sliceUsed = 0
+	}
+	if ReadForeground != priority {
+		return
+	}
+	if bandwidth.used[key] -= size; bandwidth.used[key] < 0 {
+		bandwidth.used[key] = 0
+	}
+}
+
+// setReaderUID records the user that opened the buffer last, the bandwidth
+// is shared between users by it
+func (b *Buffer) setReaderUID(uid uint32) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.uid = uid
+}
+
+// readerUID returns the user that opened the buffer last
+func (b *Buffer) readerUID() uint32 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.uid
+}
@@ -1,48 +1,173 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
-
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/claudetech/loggo/default"
 	"github.com/orcaman/concurrent-map"
 )
 
+const (
+	// WriteFailureStream serves chunks without caching if they can not be written
+	WriteFailureStream = "stream"
+	// WriteFailureFail fails the read if a chunk can not be written
+	WriteFailureFail = "fail"
+)
+
+const (
+	// PartialReadReturn returns the bytes read so far if a read spanning
+	// multiple chunks fails after the first chunk
+	PartialReadReturn = "partial"
+	// PartialReadFail fails the whole read if one of its chunks fails
+	PartialReadFail = "fail"
+)
+
+// minCachedChunks is the minimum number of chunks the chunk directory holds
+// if its size is limited
+const minCachedChunks = 4
+
+// chunkWriteRetryInterval is the time to wait till writing chunks is
+// tried again after a write failure
+const chunkWriteRetryInterval = 30 * time.Second
+
 var instances cmap.ConcurrentMap
 var chunkPath string
 var chunkSize int64
 var chunkDirMaxSize int64
 
+// chunkLimits serializes changes of the chunk size and the maximum size of
+// the chunk directory, both are read atomically
+var chunkLimits sync.Mutex
+var minReadSize int64
+var chunkWriteFailure = WriteFailureStream
+var partialReadFailure = PartialReadReturn
+var chunkWrites chunkWriteState
+var preloadThreshold float64
+var preloadTriggerOffset int64
+var preloadMinReads int64
+var preloadMinOpen time.Duration
+var chunkReadOnly bool
+var maxOpenBuffers int
+
+// bufferSlots counts the buffers that are being created, each of them holds
+// a slot of the maximum number of open buffers till it is registered
+var bufferSlots = struct {
+	lock     sync.Mutex
+	creating int
+}{}
+var bufferLinger = 5 * time.Second
+var preloadWhileLingering bool
+
 func init() {
 	instances = cmap.New()
 }
 
-// Buffer is a buffered stream
+// Buffer is a buffered stream. The atomic counters are the first fields to
+// be 64 bit aligned on 32 bit platforms.
 type Buffer struct {
-	numberOfInstances int
-	client            *http.Client
-	object            *APIObject
-	tempDir           string
-	preload           bool
-	chunkDir          string
+	requestedBytes     int64
+	cachedBytes        int64
+	reads              int64
+	numberOfInstances  int
+	client             *http.Client
+	object             *APIObject
+	tempDir            string
+	preload            bool
+	chunkDir           string
+	lock               sync.Mutex
+	store              ChunkStore
+	slab               []byte
+	slabOffset         int64
+	preloadTriggered   int64
+	verifiedGeneration int64
+	fullDownload       bool
+	downloadDone       *sync.Cond
+	serialLock         sync.Mutex
+	lastOffset         int64
+	recentReads        []int64
+	downloads          map[int64]int
+	requests           map[string]RequestState
+	generation         int64
+	tenant             string
+	lastRead           time.Time
+	stopKeepalive      chan struct{}
+	ctx                context.Context
+	cancel             context.CancelFunc
+	closed             bool
+	downloadSlots      chan struct{}
+	chunkSize          int64
+	rampChunk          int64
+	readRate           float64
+	rateSampled        time.Time
+	rateOffset         int64
+	rampDepth          int
+	lingerTimer        *time.Timer
+	lingerPreload      bool
+	subRanges          map[int64]subRange
+	staged             map[int64]stagedChunk
+	streamed           stagedChunk
+	streamedOffset     int64
+	earlyRead          bool
+	mirror             *APIObject
+	urlObject          *APIObject
+	migrationStore     ChunkStore
+	sourceFailures     int
+	refreshed          time.Time
+	repaired           bool
+	created            time.Time
+	softStartBytes     int64
+	fetches            map[*fetchRange]bool
+	uid                uint32
+	inflight           map[*inflightRange]bool
+	nonce              [24]byte
+	nonceRead          bool
+	clientLock         sync.Mutex
 }
 
 // GetBufferInstance gets a singleton instance of buffer
 func GetBufferInstance(client *http.Client, object *APIObject) (*Buffer, error) {
+	// a replaced object must not share the buffer and the cached chunks of
+	// its old version, which still serves its current readers
+	if instance, exists := instances.Get(object.ObjectID); exists {
+		if old := instance.(*Buffer).object; objectChanged(old, object) {
+			Log.Infof("%v changed (%v bytes, modified %v), invalidating cache", safeName(object.Name), object.Size, object.LastModified)
+			InvalidateObject(object.ObjectID)
+		} else if instance.(*Buffer).tenant != clientTenant(objectClient(object.ObjectID, client)) {
+			// the buffer of another tenant keeps its readers, the new buffer
+			// claims the object for the tenant of the client
+			instances.Remove(object.ObjectID)
+		}
+	}
+
 	if !instances.Has(object.ObjectID) {
-		i, err := newBuffer(client, object)
+		if err := waitForBufferCreation(); nil != err {
+			return nil, err
+		}
+		release, err := makeRoomForBuffer()
+		if nil != err {
+			return nil, err
+		}
+		i, err := newBuffer(objectClient(object.ObjectID, client), object)
 		if nil != err {
+			release()
 			return nil, err
 		}
 
 		instances.Set(object.ObjectID, i)
+		release()
+		if headCacheSize > 0 {
+			i.Prefetch(0, headCacheSize)
+		}
+		i.prefetchTail()
 	}
 
 	instance, ok := instances.Get(object.ObjectID)
@@ -54,10 +179,91 @@ func GetBufferInstance(client *http.Client, object *APIObject) (*Buffer, error)
 		}
 		instance = i
 	}
-	instance.(*Buffer).numberOfInstances++
+	instance.(*Buffer).attach()
 	return instance.(*Buffer), nil
 }
 
+// objectChanged checks if an object is another version than the old one,
+// by its size, its modification time and its md5 checksum if both have one
+func objectChanged(old, object *APIObject) bool {
+	return old.Size != object.Size || !old.LastModified.Equal(object.LastModified) ||
+		("" != old.MD5Checksum && "" != object.MD5Checksum && old.MD5Checksum != object.MD5Checksum)
+}
+
+// TooManyBuffersError is returned if a file can not be opened, because the
+// maximum number of open buffers is reached
+type TooManyBuffersError struct {
+	Limit int
+}
+
+func (e *TooManyBuffersError) Error() string {
+	return fmt.Sprintf("Reached the maximum of %v open buffers", e.Limit)
+}
+
+// SetBufferLinger sets how long the buffer of a closed file is kept before
+// it is shut down (0 = shut down right away). Reopening the file within
+// that time reuses the buffer, optionally with preloading continued.
+func SetBufferLinger(linger time.Duration, preload bool) {
+	bufferLinger = linger
+	preloadWhileLingering = preload
+}
+
+// SetMaxOpenBuffers sets the maximum number of buffers open at once
+// (0 = unlimited)
+func SetMaxOpenBuffers(max int) {
+	maxOpenBuffers = max
+}
+
+// makeRoomForBuffer reserves a slot for a new buffer and closes the least
+// recently read idle buffer if the maximum number of open buffers is
+// reached. Without an idle buffer the new buffer is rejected. The returned
+// func releases the slot once the buffer is registered or failed.
+func makeRoomForBuffer() (func(), error) {
+	if maxOpenBuffers <= 0 {
+		return func() {}, nil
+	}
+
+	bufferSlots.lock.Lock()
+	defer bufferSlots.lock.Unlock()
+
+	if err := closeIdleBuffer(); nil != err {
+		return nil, err
+	}
+	bufferSlots.creating++
+	return func() {
+		bufferSlots.lock.Lock()
+		bufferSlots.creating--
+		bufferSlots.lock.Unlock()
+	}, nil
+}
+
+// closeIdleBuffer closes the least recently read idle buffer if all slots
+// are taken by open buffers and buffers being created. The bufferSlots lock
+// must be held.
+func closeIdleBuffer() error {
+	if instances.Count()+bufferSlots.creating < maxOpenBuffers {
+		return nil
+	}
+
+	var idle *Buffer
+	for item := range instances.IterBuffered() {
+		b, ok := item.Val.(*Buffer)
+		if !ok || b.numberOfInstances > 0 {
+			continue
+		}
+		if nil == idle || b.lastReadTime().Before(idle.lastReadTime()) {
+			idle = b
+		}
+	}
+	if nil == idle {
+		return &TooManyBuffersError{Limit: maxOpenBuffers}
+	}
+
+	Log.Debugf("Closing idle buffer of object %v to open another file", idle.object.ObjectID)
+	idle.shutdown()
+	return nil
+}
+
 // SetChunkPath sets the global chunk path
 func SetChunkPath(path string) {
 	chunkPath = path
@@ -65,170 +271,1221 @@ func SetChunkPath(path string) {
 
 // SetChunkSize sets the global chunk size
 func SetChunkSize(size int64) {
-	chunkSize = size
+	chunkLimits.Lock()
+	defer chunkLimits.Unlock()
+
+	atomic.StoreInt64(&chunkSize, size)
+	clampChunkDirMaxSize()
 }
 
 // SetChunkDirMaxSize sets the maximum size of the chunk directory
 func SetChunkDirMaxSize(size int64) {
-	chunkDirMaxSize = size
+	chunkLimits.Lock()
+	defer chunkLimits.Unlock()
+
+	atomic.StoreInt64(&chunkDirMaxSize, size)
+	clampChunkDirMaxSize()
+}
+
+// currentChunkSize returns the global chunk size, which may be changed at
+// runtime. Buffers keep the chunk size they were created with.
+func currentChunkSize() int64 {
+	return atomic.LoadInt64(&chunkSize)
+}
+
+// currentChunkDirMaxSize returns the maximum size of the chunk directory,
+// which may be changed at runtime
+func currentChunkDirMaxSize() int64 {
+	return atomic.LoadInt64(&chunkDirMaxSize)
+}
+
+// clampChunkDirMaxSize raises the maximum size of the chunk directory to
+// hold at least a few chunks. Otherwise every download would evict the
+// chunk that was just written. The chunk limits lock must be held.
+func clampChunkDirMaxSize() {
+	size, maxSize := currentChunkSize(), currentChunkDirMaxSize()
+	minSize := minCachedChunks * size
+	if maxSize <= 0 || maxSize >= minSize {
+		return
+	}
+
+	Log.Warningf("The maximum chunk directory size of %v bytes can not hold %v chunks of %v bytes, using %v bytes",
+		maxSize, minCachedChunks, size, minSize)
+	atomic.StoreInt64(&chunkDirMaxSize, minSize)
+}
+
+// SetChunkMmap enables memory mapped reads of cached chunks, if the mmap
+// chunk store is compiled in
+func SetChunkMmap(enabled bool) {
+	if !enabled {
+		return
+	}
+	if err := SetChunkStore("mmap"); nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Memory mapped reads are not available (build with -tags mmap on linux / mac)")
+	}
+}
+
+// SetMinReadSize sets the minimum size of a read, smaller reads are
+// served from one larger read
+func SetMinReadSize(size int64) {
+	minReadSize = size
+}
+
+// SetPreloadThreshold sets the fraction of a chunk that has to be read
+// before the next chunk is preloaded
+func SetPreloadThreshold(threshold float64) {
+	preloadThreshold = threshold
+}
+
+// SetPreloadTriggerOffset sets the distance to the end of a chunk the
+// reader has to come within before the next chunk is preloaded (in byte,
+// 0 = use the preload threshold). It replaces the preload threshold, so
+// that the next chunk gets the same lead time for every chunk size.
+func SetPreloadTriggerOffset(offset int64) {
+	preloadTriggerOffset = offset
+}
+
+// SetPreloadActivation delays the preloads of a buffer till it was read the
+// given number of times or was open for the given time, so that a file a
+// player only probes is not preloaded (0 = preload on the first read). With
+// both set, either one activates the preloads.
+func SetPreloadActivation(reads int64, openTime time.Duration) {
+	preloadMinReads = reads
+	preloadMinOpen = openTime
+}
+
+// preloadInactive checks if the buffer was neither read often nor open long
+// enough to preload yet
+func (b *Buffer) preloadInactive() bool {
+	if preloadMinReads <= 1 && preloadMinOpen <= 0 {
+		return false
+	}
+	readEnough := preloadMinReads > 1 && atomic.LoadInt64(&b.reads) >= preloadMinReads
+	openEnough := preloadMinOpen > 0 && time.Since(b.created) >= preloadMinOpen
+	return !readEnough && !openEnough
+}
+
+// preloadTrigger returns how many bytes of the chunk of the given range
+// have to be read before the next chunk is preloaded (-1 = preload once
+// the chunk was downloaded)
+func preloadTrigger(offset, offsetEnd int64) float64 {
+	if preloadTriggerOffset > 0 {
+		return math.Max(0, float64(offsetEnd-offset-preloadTriggerOffset))
+	}
+	if preloadThreshold <= 0 {
+		return -1
+	}
+	return preloadThreshold * float64(offsetEnd-offset)
+}
+
+// SetChunkReadOnly treats the chunk directory as a read-only cache that
+// is populated by another instance. Chunks are never written or evicted,
+// misses are streamed from the API without caching them.
+func SetChunkReadOnly(readOnly bool) {
+	chunkReadOnly = readOnly
+}
+
+// SetChunkWriteFailure sets the behavior if chunks can not be written
+func SetChunkWriteFailure(behavior string) error {
+	if WriteFailureStream != behavior && WriteFailureFail != behavior {
+		return fmt.Errorf("Invalid chunk write failure behavior %v", behavior)
+	}
+	chunkWriteFailure = behavior
+	return nil
+}
+
+// SetPartialReadFailure sets the behavior if a read spanning multiple
+// chunks fails after the first chunk
+func SetPartialReadFailure(behavior string) error {
+	if PartialReadReturn != behavior && PartialReadFail != behavior {
+		return fmt.Errorf("Invalid partial read failure behavior %v", behavior)
+	}
+	partialReadFailure = behavior
+	return nil
+}
+
+// chunkWriteState tracks if the chunk directory is currently writable
+type chunkWriteState struct {
+	lock        sync.Mutex
+	failing     bool
+	lastFailure time.Time
+}
+
+// shouldTry checks if a chunk write should be tried
+func (s *chunkWriteState) shouldTry() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return !s.failing || time.Since(s.lastFailure) > chunkWriteRetryInterval
+}
+
+// failed records a failed chunk write
+func (s *chunkWriteState) failed() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.failing {
+		Log.Warningf("Could not write chunks to %v, streaming without cache", chunkPath)
+	}
+	s.failing = true
+	s.lastFailure = time.Now()
+}
+
+// succeeded records a successful chunk write
+func (s *chunkWriteState) succeeded() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.failing {
+		Log.Infof("Chunk directory %v is writable again, caching enabled", chunkPath)
+	}
+	s.failing = false
 }
 
 // NewBuffer creates a new buffer instance
 func newBuffer(client *http.Client, object *APIObject) (*Buffer, error) {
-	Log.Infof("Starting playback of %v", object.Name)
+	Log.Infof("Starting playback of %v", safeName(object.Name))
 	Log.Debugf("Creating buffer for object %v", object.ObjectID)
 
 	tempDir := filepath.Join(chunkPath, object.ObjectID)
-	if err := os.MkdirAll(tempDir, 0777); nil != err {
+	if chunkReadOnly {
+		Log.Debugf("Using read-only chunk directory for object %v", object.ObjectID)
+	} else if err := os.MkdirAll(tempDir, 0777); nil != err {
 		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not create temp path for object %v", object.ObjectID)
+		if WriteFailureFail == chunkWriteFailure {
+			return nil, fmt.Errorf("Could not create temp path for object %v", object.ObjectID)
+		}
+		chunkWrites.failed()
 	}
-
-	if 0 == chunkSize {
+	if 0 == currentChunkSize() {
 		Log.Debugf("ChunkSize was 0, setting to default (5 MB)")
-		chunkSize = 5 * 1024 * 1024
+		SetChunkSize(5 * 1024 * 1024)
 	}
 
+	size := probedChunkSize(client, object)
+	if size != currentChunkSize() {
+		Log.Debugf("Using chunk size %v for object %v", size, object.ObjectID)
+	}
+	chunks.setChunkSize(object.ObjectID, size)
+	chunks.load(object.ObjectID)
+	tenant := clientTenant(client)
+	claimTenant(object.ObjectID, tenant)
+	generation := chunks.pin(object.ObjectID)
+
 	buffer := Buffer{
-		numberOfInstances: 0,
-		client:            client,
-		object:            object,
-		tempDir:           tempDir,
-		preload:           true,
+		numberOfInstances:  0,
+		client:             client,
+		object:             object,
+		tempDir:            tempDir,
+		chunkSize:          size,
+		preload:            true,
+		store:              newChunkStore(tempDir),
+		verifiedGeneration: -1,
+		downloads:          make(map[int64]int),
+		requests:           make(map[string]RequestState),
+		generation:         generation,
+		tenant:             tenant,
+		refreshed:          time.Now(),
+		created:            time.Now(),
+	}
+
+	buffer.downloadDone = sync.NewCond(&buffer.lock)
+	buffer.ctx, buffer.cancel = context.WithCancel(context.Background())
+	if maxObjectDownloads > 0 {
+		buffer.downloadSlots = make(chan struct{}, maxObjectDownloads)
+	}
+	if keepaliveIdle > 0 {
+		buffer.lastRead = time.Now()
+		buffer.stopKeepalive = make(chan struct{})
+		go buffer.keepalive(buffer.stopKeepalive)
 	}
 
 	return &buffer, nil
 }
 
+// attach adds a handle to the buffer. A lingering buffer is reused.
+func (b *Buffer) attach() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.numberOfInstances++
+	if nil != b.lingerTimer {
+		b.lingerTimer.Stop()
+		Log.Debugf("Reattaching to buffer of object %v", b.object.ObjectID)
+		b.preload = b.lingerPreload && !b.closed
+	}
+	b.lingerTimer = nil
+}
+
 // Close all handles
 func (b *Buffer) Close() error {
+	b.lock.Lock()
 	b.numberOfInstances--
-	if 0 == b.numberOfInstances {
-		Log.Infof("Stopping playback of %v", b.object.Name)
-		Log.Debugf("Stop buffering for object %v", b.object.ObjectID)
+	idle := 0 == b.numberOfInstances
+	if idle {
+		b.recordAccess()
+	}
+	linger := idle && bufferLinger > 0 && !b.closed
+	if linger {
+		Log.Debugf("Keeping buffer of object %v for %v", b.object.ObjectID, bufferLinger)
+		b.lingerPreload = b.preload
+		if !preloadWhileLingering {
+			b.preload = false
+		}
+		b.lingerTimer = time.AfterFunc(bufferLinger, b.closeIdle)
+	}
+	b.lock.Unlock()
 
-		b.preload = false
-		instances.Remove(b.object.ObjectID)
+	if idle && !linger {
+		b.closeIdle()
 	}
 	return nil
 }
 
-// ReadBytes on a specific location
-func (b *Buffer) ReadBytes(start, size int64, isPreload bool) ([]byte, error) {
-	fOffset := start % chunkSize
-	offset := start - fOffset
-	offsetEnd := offset + chunkSize
+// closeIdle shuts down the buffer unless it was opened again
+func (b *Buffer) closeIdle() {
+	b.lock.Lock()
+	reopened := b.numberOfInstances > 0
+	b.lingerTimer = nil
+	b.lock.Unlock()
+	if reopened || b.startRepair() {
+		return
+	}
+
+	Log.Infof("Stopping playback of %v", safeName(b.object.Name))
+	Log.Debugf("Stop buffering for object %v", b.object.ObjectID)
+	b.recordResumePosition()
+
+	b.shutdown()
+	b.evictOnRelease()
+}
+
+// shutdown stops preloads, cancels running downloads and frees all
+// resources of the buffer. Reads of a buffer that was shut down fail.
+func (b *Buffer) shutdown() {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	b.preload = false
+	b.cancel()
+	b.downloadDone.Broadcast()
+	generation := b.generation
+	b.lock.Unlock()
+
+	if instance, exists := instances.Get(b.object.ObjectID); exists && instance == b {
+		instances.Remove(b.object.ObjectID)
+	}
+	chunks.unpin(b.object.ObjectID, generation)
+	chunks.closed(b.object.ObjectID)
+	b.shedMemory()
+	if nil != b.stopKeepalive {
+		close(b.stopKeepalive)
+	}
+
+	if err := b.store.Close(); nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not close chunk store of object %v", b.object.ObjectID)
+	}
+	b.lock.Lock()
+	migrationStore := b.migrationStore
+	b.lock.Unlock()
+	if nil != migrationStore {
+		migrationStore.Close()
+	}
+}
+
+// CachedFraction returns the fraction (0.0 - 1.0) of the object that is
+// currently cached
+func (b *Buffer) CachedFraction() float64 {
+	size := int64(b.object.Size)
+	total := (size + b.chunkSize - 1) / b.chunkSize
+	if 0 == total {
+		return 1
+	}
+
+	return float64(chunks.count(b.object.ObjectID, size)) / float64(total)
+}
+
+// ReadBytes on a specific location with the given priority. Only foreground
+// reads count as reads of a player, preloads and background reads neither
+// track the read position nor preload further chunks.
+func (b *Buffer) ReadBytes(start, size int64, priority ReadPriority) ([]byte, error) {
+	if ReadForeground == priority {
+		atomic.AddInt64(&b.requestedBytes, size)
+		atomic.AddInt64(&b.reads, 1)
+		if slowReadThreshold > 0 {
+			defer b.logSlowRead(start, size, b.chunkCached(start), time.Now())
+		}
+		b.refreshIfOld()
+		b.trackRead(start)
+		b.dropBehind(start)
+	}
+	return b.read(start, size, priority)
+}
+
+// ReadInto reads into p starting at a specific location. Chunks found in
+// the cache are read directly into p, so that the hot read path doesn't
+// allocate. Objects encrypted by rclone crypt are decrypted, start is an
+// offset within the decrypted content then.
+func (b *Buffer) ReadInto(p []byte, start int64) (int, error) {
+	if b.object.Encrypted {
+		return b.readDecrypted(p, start)
+	}
+	atomic.AddInt64(&b.requestedBytes, int64(len(p)))
+	atomic.AddInt64(&b.reads, 1)
+	if slowReadThreshold > 0 {
+		defer b.logSlowRead(start, int64(len(p)), b.chunkCached(start), time.Now())
+	}
+	b.refreshIfOld()
+	b.trackRead(start)
+	b.dropBehind(start)
+
+	if int64(len(p)) >= minReadSize {
+		if n, cached := b.readCachedInto(p, start); cached {
+			if n == len(p) || 0 == n || uint64(start+int64(n)) >= b.object.Size {
+				return n, nil
+			}
+
+			// the read spans the next chunk
+			rest, err := b.read(start+int64(n), int64(len(p)-n), ReadForeground)
+			if nil != err {
+				if PartialReadFail == partialReadFailure {
+					return 0, err
+				}
+				return n, nil
+			}
+			return n + copy(p[n:], rest), nil
+		}
+	}
+
+	bytes, err := b.read(start, int64(len(p)), ReadForeground)
+	if nil != err {
+		return 0, err
+	}
+	return copy(p, bytes), nil
+}
+
+// waitRunningDownload waits till running downloads of the chunk at the
+// given offset finished and reports if it waited
+func (b *Buffer) waitRunningDownload(offset int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
-	Log.Debugf("Getting object %v bytes %v - %v (is preload: %v)", b.object.ObjectID, offset, offsetEnd, isPreload)
+	waited := false
+	for b.downloads[offset] > 0 && !b.closed {
+		waited = true
+		b.downloadDone.Wait()
+	}
+	return waited
+}
 
-	filename := filepath.Join(b.tempDir, strconv.Itoa(int(offset)))
-	if f, err := os.Open(filename); nil == err {
-		defer f.Close()
-		buf := make([]byte, size)
-		if n, err := f.ReadAt(buf, fOffset); nil == err && n > 0 {
-			Log.Debugf("Found object %v bytes %v - %v in cache", b.object.ObjectID, offset, offsetEnd)
+// Prefetch downloads the chunks of a range the reader is going to read in
+// the background, instead of one chunk after another as they are read. It
+// is best-effort, cached chunks are skipped and failures are ignored.
+func (b *Buffer) Prefetch(start, length int64) {
+	if !b.preload || chunkReadOnly || isSerial(b.object) {
+		return
+	}
 
-			// update the last modified time for files that are often in use
-			if err := os.Chtimes(filename, time.Now(), time.Now()); nil != err {
-				Log.Warningf("Could not update last modified time for %v", filename)
+	end := int64(math.Min(float64(start+length), float64(b.object.Size)))
+	for offset := start - start%b.chunkSize; offset < end; offset += b.chunkSize {
+		offset := offset
+		startPreload(b.object.ObjectID, func() {
+			if _, err := b.readBytes(offset, b.chunkSize, ReadPrefetch); nil != err {
+				Log.Debugf("%v", err)
 			}
+		})
+	}
+}
+
+// errPrefetchCancelled is returned by PrefetchHandle.Wait if the prefetch
+// was cancelled before all chunks were cached
+var errPrefetchCancelled = fmt.Errorf("Prefetch was cancelled")
+
+// PrefetchHandle controls a prefetch started by PrefetchAsync
+type PrefetchHandle struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	err    error
+}
+
+// PrefetchAsync downloads the chunks of a range one after another in the
+// background like preloads. The handle waits for the chunks or cancels the
+// chunks that are not downloaded yet, e.g. when the reader seeks away.
+func (b *Buffer) PrefetchAsync(start, size int64) *PrefetchHandle {
+	ctx, cancel := context.WithCancel(b.ctx)
+	handle := &PrefetchHandle{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(handle.done)
+		defer cancel()
 
-			return buf[:size], nil
+		end := int64(math.Min(float64(start+size), float64(b.object.Size)))
+		for offset := start - start%b.chunkSize; offset < end; offset += b.chunkSize {
+			if nil != ctx.Err() {
+				handle.err = errPrefetchCancelled
+				return
+			}
+			if _, err := b.readBytesContext(ctx, offset, b.chunkSize, ReadPrefetch); nil != err {
+				handle.err = err
+				if nil != ctx.Err() {
+					handle.err = errPrefetchCancelled
+				}
+				return
+			}
 		}
+	}()
+	return handle
+}
+
+// Wait waits till the prefetch finished and returns the first error
+func (h *PrefetchHandle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+// Cancel stops the prefetch. A chunk that is downloading already is still
+// cached, the following chunks are not requested and take no download slot.
+func (h *PrefetchHandle) Cancel() {
+	h.cancel()
+}
+
+// Warm downloads the chunks of a range one after another in the background,
+// e.g. for a file that is going to be played next. The buffer stays open
+// till all chunks are cached.
+func (b *Buffer) Warm(start, length int64) {
+	if chunkReadOnly {
+		return
 	}
 
-	if chunkDirMaxSize > 0 {
-		if err := cleanChunkDir(chunkPath); nil != err {
+	b.attach()
+	go func() {
+		defer b.Close()
+		b.warm(start, length)
+	}()
+}
+
+// warm downloads the chunks of a range one after another
+func (b *Buffer) warm(start, length int64) {
+	end := int64(math.Min(float64(start+length), float64(b.object.Size)))
+	for offset := start - start%b.chunkSize; offset < end; offset += b.chunkSize {
+		if _, err := b.readBytes(offset, b.chunkSize, ReadBackground); nil != err {
 			Log.Debugf("%v", err)
-			return nil, fmt.Errorf("Could not delete oldest chunk")
+			return
 		}
 	}
+	Log.Debugf("Warmed object %v bytes %v - %v", b.object.ObjectID, start, end)
+}
+
+// readSpan reads the bytes of all chunks the range spans. If a chunk after
+// the first one fails, the bytes read so far are returned as short read
+// unless partial reads are configured to fail.
+func (b *Buffer) readSpan(start, size int64) ([]byte, error) {
+	bytes, err := b.readBytes(start, size, ReadForeground)
+	if nil != err || int64(len(bytes)) >= size || 0 == len(bytes) {
+		return bytes, err
+	}
+
+	// the remaining chunks are downloaded in parallel
+	b.Prefetch(start+int64(len(bytes)), size-int64(len(bytes)))
+
+	// the chunk store may return slices of its own memory
+	result := make([]byte, len(bytes), size)
+	copy(result, bytes)
+	for int64(len(result)) < size {
+		position := start + int64(len(result))
+		next, err := b.readBytes(position, size-int64(len(result)), ReadForeground)
+		if nil != err {
+			if PartialReadFail == partialReadFailure {
+				return nil, err
+			}
+			recordError(b.object.ObjectID, err)
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not read object %v at offset %v, returning %v bytes", b.object.ObjectID, position, len(result))
+			return result, nil
+		}
+		if 0 == len(next) {
+			break
+		}
+		result = append(result, next...)
+	}
+	return result, nil
+}
+
+// trackRead records a read of the player for the preload
+func (b *Buffer) trackRead(start int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.measureReadRate(start, time.Now())
+	b.lastOffset = start
+	b.lastRead = time.Now()
+	b.ramp(start)
+	b.recentReads = append(b.recentReads, start)
+	if len(b.recentReads) > recentReadCount {
+		b.recentReads = b.recentReads[len(b.recentReads)-recentReadCount:]
+	}
+}
 
-	Log.Debugf("Requesting object %v bytes %v - %v from API", b.object.ObjectID, offset, offsetEnd)
-	req, err := http.NewRequest("GET", b.object.DownloadURL, nil)
+// read reads the bytes and records the errors. Only foreground reads are
+// coalesced and span chunks, the others keep their priority.
+func (b *Buffer) read(start, size int64, priority ReadPriority) ([]byte, error) {
+	var bytes []byte
+	var err error
+	if ReadForeground != priority {
+		bytes, err = b.readBytes(start, size, priority)
+	} else if size < minReadSize {
+		bytes, err = b.readMinSize(start, size)
+	} else {
+		bytes, err = b.readSpan(start, size)
+	}
+	if nil != err && errPreloadDropped != err {
+		recordError(b.object.ObjectID, err)
+	}
+	return bytes, err
+}
+
+// readCachedInto reads a cached chunk into p if the chunk store supports
+// it, all other reads go through readBytes. Reads of chunks kept in memory
+// go through readBytes as well.
+func (b *Buffer) readCachedInto(p []byte, start int64) (int, bool) {
+	store, ok := b.store.(ChunkReaderInto)
+	if !ok || nil != b.ctx.Err() || memoryOnly() || hotChunksEnabled() {
+		return 0, false
+	}
+	if uint64(start) >= b.object.Size {
+		return 0, true
+	}
+
+	offset, fOffset, offsetEnd, _ := computeChunkRange(start, int64(len(p)), b.chunkSize, int64(b.object.Size))
+
+	generation := b.cacheGeneration()
+	filename := filepath.Join(b.tempDir, chunkName(generation, b.chunkSize, offset))
+	b.waitFullDownload(generation, offset)
+	if !b.isFresh(generation, offset) {
+		return 0, false
+	}
+	b.decompress(filename, generation, offset)
+	started := time.Now()
+	n, err := store.ReadInto(filename, p, fOffset)
 	if nil != err {
-		return nil, err
+		return 0, false
 	}
+	recordDiskRead(time.Since(started))
+
+	Log.Debugf("Found object %v bytes %v - %v in cache", b.object.ObjectID, offset, offsetEnd)
+	chunks.touch(b.object.ObjectID, generation, offset)
+	recordRead(true)
+	b.preloadNext(offset, offsetEnd, start+int64(n), int64(len(p)), false)
+	return n, true
+}
 
-	req.Header.Add("Range", fmt.Sprintf("bytes=%v-%v", offset, offsetEnd))
+// readMinSize serves tiny reads from a slab of at least minReadSize bytes,
+// so that consecutive small reads don't need a chunk lookup each
+func (b *Buffer) readMinSize(start, size int64) ([]byte, error) {
+	b.lock.Lock()
+	slab := b.slab
+	slabOffset := b.slabOffset
+	b.lock.Unlock()
 
-	Log.Tracef("Sending HTTP Request %v", req)
+	slabEnd := slabOffset + int64(len(slab))
+	if nil != slab && start >= slabOffset && start < slabEnd &&
+		(start+size <= slabEnd || uint64(slabEnd) >= b.object.Size) {
+		end := int64(math.Min(float64(start+size), float64(slabEnd)))
+		return slab[start-slabOffset : end-slabOffset], nil
+	}
+
+	readSize := minReadSize
+	if remaining := int64(b.object.Size) - start; remaining < readSize {
+		readSize = int64(math.Max(float64(remaining), float64(size)))
+	}
 
-	res, err := b.client.Do(req)
+	bytes, err := b.readBytes(start, readSize, ReadForeground)
 	if nil != err {
 		return nil, err
 	}
 
-	if res.StatusCode != 206 {
-		return nil, fmt.Errorf("Wrong status code %v", res)
+	b.setSlab(bytes, start)
+
+	return bytes[:int64(math.Min(float64(size), float64(len(bytes))))], nil
+}
+
+// computeChunkRange returns the offset of the chunk holding start, the
+// offset of start within the chunk, the exclusive end of the chunk, which is
+// never beyond the end of the object, and the number of bytes a read of size
+// bytes returns from the chunk. Reads at or beyond the end of the object
+// return no bytes.
+func computeChunkRange(start, size, chunkSize, objectSize int64) (int64, int64, int64, int64) {
+	fileOffset := start % chunkSize
+	chunkOffset := start - fileOffset
+	rangeEnd := int64(math.Min(float64(chunkOffset+chunkSize), float64(objectSize)))
+
+	returnLen := int64(math.Min(float64(size), float64(rangeEnd-start)))
+	if returnLen < 0 {
+		returnLen = 0
 	}
+	return chunkOffset, fileOffset, rangeEnd, returnLen
+}
 
-	bytes, err := ioutil.ReadAll(res.Body)
-	if nil != err {
+// readBytes reads the bytes from cache or the API
+func (b *Buffer) readBytes(start, size int64, priority ReadPriority) ([]byte, error) {
+	return b.readBytesContext(b.ctx, start, size, priority)
+}
+
+// readBytesContext reads the bytes like readBytes, a wait for a download
+// slot ends when the context is done
+func (b *Buffer) readBytesContext(ctx context.Context, start, size int64, priority ReadPriority) ([]byte, error) {
+	if nil != b.ctx.Err() {
+		return nil, &BufferClosedError{ObjectID: b.object.ObjectID}
+	}
+	if uint64(start) >= b.object.Size {
+		return []byte{}, nil
+	}
+
+	offset, fOffset, offsetEnd, returnLen := computeChunkRange(start, size, b.chunkSize, int64(b.object.Size))
+
+	Log.Debugf("Getting object %v bytes %v - %v (priority: %v)", b.object.ObjectID, offset, offsetEnd, priority)
+
+	generation := b.cacheGeneration()
+	filename := filepath.Join(b.tempDir, chunkName(generation, b.chunkSize, offset))
+	b.waitFullDownload(generation, offset)
+	if bytes, err := b.readCache(filename, generation, offset, fOffset, size); nil == err {
+		Log.Debugf("Found object %v bytes %v - %v in cache", b.object.ObjectID, offset, offsetEnd)
+		chunks.touch(b.object.ObjectID, generation, offset)
+		if ReadForeground == priority {
+			recordRead(true)
+			b.preloadNext(offset, offsetEnd, start+int64(len(bytes)), size, false)
+		}
+		return bytes, nil
+	}
+
+	if ReadForeground == priority {
+		recordRead(false)
+	}
+	if goneObjects.has(b.source().ObjectID) && !b.failOver(&ObjectGoneError{ObjectID: b.object.ObjectID}) {
+		return nil, &ObjectGoneError{ObjectID: b.object.ObjectID}
+	}
+	// readers of an outdated generation only get cached chunks, because
+	// the API serves the new version of the object
+	if generation != chunks.generation(b.object.ObjectID) {
+		return nil, &ObjectChangedError{ObjectID: b.object.ObjectID, Offset: offset}
+	}
+
+	// objects in serial mode download one chunk at a time, a read waiting
+	// for the lock may find its chunk cached by the previous download
+	if isSerial(b.object) {
+		b.serialLock.Lock()
+		defer b.serialLock.Unlock()
+
+		if bytes, err := b.readCache(filename, generation, offset, fOffset, size); nil == err {
+			chunks.touch(b.object.ObjectID, generation, offset)
+			return bytes, nil
+		}
+	}
+
+	// the bytes of a chunk that another read is receiving are used as soon
+	// as they arrived, otherwise once the chunk is cached. A read gives up
+	// on a stalled download and downloads the chunk itself.
+	received, ok, stalled := b.readInflight(generation, start, returnLen)
+	if ok {
+		Log.Debugf("Got object %v bytes %v - %v from a running download", b.object.ObjectID, start, start+returnLen)
+		return received, nil
+	}
+	if !stalled && b.waitRunningDownload(offset) {
+		if bytes, err := b.readCache(filename, generation, offset, fOffset, size); nil == err {
+			chunks.touch(b.object.ObjectID, generation, offset)
+			return bytes, nil
+		}
+	}
+
+	// chunks cached before the chunk size changed may cover the range
+	if bytes, ok := b.readOtherSizes(generation, offset, offsetEnd); ok {
+		if err := b.storeChunk(filename, generation, offset, bytes); nil != err {
+			return nil, err
+		}
+		result := bytes[fOffset : fOffset+returnLen]
+		if ReadForeground == priority {
+			b.preloadNext(offset, offsetEnd, start+int64(len(result)), size, true)
+		}
+		return result, nil
+	}
+
+	// another plexdrive instance may have the chunk cached already
+	if bytes, ok := b.readPeers(offset, offsetEnd); ok {
+		if err := b.storeChunk(filename, generation, offset, bytes); nil != err {
+			return nil, err
+		}
+		result := bytes[fOffset : fOffset+returnLen]
+		if ReadForeground == priority {
+			b.preloadNext(offset, offsetEnd, start+int64(len(result)), size, true)
+		}
+		return result, nil
+	}
+
+	if isOffline() {
+		return nil, &OfflineError{ObjectID: b.object.ObjectID, Offset: offset}
+	}
+	if quotaExceeded() {
+		return nil, &QuotaExceededError{ObjectID: b.object.ObjectID, Offset: offset}
+	}
+	if err := b.waitUnpaused(offset, priority); nil != err {
 		return nil, err
 	}
 
-	f, err := os.Create(filename)
-	if nil != err {
+	// a thrashing cache would evict the chunk right away
+	bypass := bypassCache()
+	if bypass && ReadPrefetch == priority {
+		return nil, errPreloadDropped
+	}
+
+	if currentChunkDirMaxSize() > 0 && !chunkReadOnly && !bypass {
+		if err := reserveChunkSpace(b.chunkSize); nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not delete oldest chunk")
+		}
+	}
+
+	if ReadPrefetch == priority && !connectionIdle() {
+		Log.Debugf("Dropping preload of object %v bytes %v - %v, foreground reads are downloading", b.object.ObjectID, offset, offsetEnd)
+		return nil, errPreloadDropped
+	}
+	if err := b.acquireDownload(ctx, offset, priority); nil != err {
 		return nil, err
 	}
-	defer f.Close()
 
-	_, err = f.Write(bytes)
+	b.lock.Lock()
+	b.downloads[offset]++
+	b.lock.Unlock()
+
+	if ReadForeground == priority {
+		atomic.AddInt64(&foregroundDownloads, 1)
+	}
+	fetchStart, fetchEnd := b.alignRange(offset, offsetEnd)
+	endFetch := b.startFetch(fetchStart, fetchEnd, priority)
+	// the first read returns once its bytes arrived, the chunk is cached
+	// in the background
+	if ReadForeground == priority && !bypass {
+		if head, ok := b.downloadEarly(generation, offset, offsetEnd, fOffset+returnLen); ok {
+			endFetch()
+			atomic.AddInt64(&foregroundDownloads, -1)
+			result := head[fOffset:]
+			b.preloadNext(offset, offsetEnd, start+int64(len(result)), size, true)
+			return result, nil
+		}
+	}
+	fetched, err := b.downloadParallel(generation, fetchStart, fetchEnd)
+	endFetch()
+	b.releaseDownload()
+	if ReadForeground == priority {
+		atomic.AddInt64(&foregroundDownloads, -1)
+	}
+
+	b.lock.Lock()
+	if b.downloads[offset]--; 0 == b.downloads[offset] {
+		delete(b.downloads, offset)
+	}
+	b.downloadDone.Broadcast()
+	b.lock.Unlock()
 	if nil != err {
+		// a stale chunk is better than none while the API is unreachable
+		if servesStale() {
+			if bytes, err := b.readCache(filename, generation, offset, fOffset, size); nil == err {
+				chunks.touch(b.object.ObjectID, generation, offset)
+				return bytes, nil
+			}
+		}
 		return nil, err
 	}
+	accountDownload(int64(len(fetched)))
+
+	if int64(len(fetched)) < offsetEnd-fetchStart {
+		return nil, fmt.Errorf("Got incomplete chunk for object %v bytes %v - %v", b.object.ObjectID, offset, offsetEnd)
+	}
+	bytes := fetched[offset-fetchStart : offsetEnd-fetchStart]
+	if 0 == len(bytes) {
+		return nil, fmt.Errorf("Got empty chunk for object %v bytes %v - %v", b.object.ObjectID, offset, offsetEnd)
+	}
+	if bypass {
+		b.streamChunk(generation, offset, bytes)
+	} else {
+		b.storeAligned(generation, offset, fetchStart, fetched)
+	}
+
+	if !bypass && !b.stageChunk(filename, generation, offset, bytes) {
+		if err := b.storeChunk(filename, generation, offset, bytes); nil != err {
+			return nil, err
+		}
+	}
+	if !bypass {
+		b.keepHot(generation, offset, bytes)
+	}
+
+	result := bytes[fOffset : fOffset+returnLen]
 
-	if !isPreload && b.preload && uint64(offsetEnd) < b.object.Size {
-		go func() {
-			b.ReadBytes(offsetEnd+1, size, true)
-		}()
+	if ReadForeground == priority {
+		b.preloadNext(offset, offsetEnd, start+int64(len(result)), size, true)
 	}
 
-	return bytes[fOffset:int64(math.Min(float64(fOffset+size), float64(len(bytes))))], nil
+	return result, nil
 }
 
-// cleanChunkDir checks if the chunk folder is grown to big and clears the oldest file if necessary
-func cleanChunkDir(chunkPath string) error {
-	chunkDirSize, err := dirSize(chunkPath)
-	if nil != err {
-		return err
+// preloadNext preloads the chunks the prefetch predictor chooses, as many
+// as the preload schedule allows at the moment. Without a preload threshold the
+// preload starts right after a download, otherwise once the reader consumed
+// the threshold of the current chunk. Read-only caches are not preloaded,
+// because preloaded chunks could not be stored.
+func (b *Buffer) preloadNext(offset, offsetEnd, position, size int64, downloaded bool) {
+	if !b.preload || chunkReadOnly || uint64(offsetEnd) >= b.object.Size || isSerial(b.object) || b.suppressPreload() || b.preloadInactive() {
+		return
 	}
 
-	if chunkDirSize+chunkSize > chunkDirMaxSize {
-		if err := deleteOldestFile(chunkPath); nil != err {
-			return err
+	if trigger := preloadTrigger(offset, offsetEnd); trigger < 0 {
+		if !downloaded {
+			return
+		}
+	} else {
+		if float64(position-offset) < trigger {
+			return
+		}
+
+		b.lock.Lock()
+		triggered := b.preloadTriggered == offsetEnd
+		b.preloadTriggered = offsetEnd
+		b.lock.Unlock()
+		if triggered {
+			return
 		}
 	}
 
+	b.lock.Lock()
+	reads := make([]int64, len(b.recentReads))
+	copy(reads, b.recentReads)
+	b.lock.Unlock()
+
+	offsets := b.chunkOffsets(prefetchPredictor().Predict(b.object, reads, b.preloadDepth()), offset)
+	// the chunk after the current one is always preloaded, the cap must not
+	// disable preloading of larger chunk sizes
+	if preloadMaxAhead > 0 {
+		var ahead []int64
+		for _, preloadOffset := range offsets {
+			if preloadOffset <= offsetEnd || preloadOffset < position+preloadMaxAhead {
+				ahead = append(ahead, preloadOffset)
+			}
+		}
+		offsets = ahead
+	}
+	startPreload(b.object.ObjectID, func() {
+		for _, preloadOffset := range offsets {
+			if !b.preload {
+				return
+			}
+			if _, err := b.readBytes(preloadOffset, size, ReadPrefetch); nil != err {
+				Log.Debugf("%v", err)
+				if errPreloadDropped != err {
+					recordError(b.object.ObjectID, err)
+				}
+				return
+			}
+		}
+	})
+}
+
+// ramp updates the preload ramp with a read, the lock must be held. The
+// depth doubles when the reader moves on to the next chunk and starts over
+// when the reader seeks.
+func (b *Buffer) ramp(start int64) {
+	chunk := start - start%b.chunkSize
+	switch {
+	case 0 == b.rampDepth || (chunk != b.rampChunk && chunk != b.rampChunk+b.chunkSize):
+		b.rampDepth = preloadRampInitial
+	case chunk == b.rampChunk+b.chunkSize:
+		b.rampDepth *= 2
+	}
+	if preloadRampMax > 0 && b.rampDepth > preloadRampMax {
+		b.rampDepth = preloadRampMax
+	}
+	b.rampChunk = chunk
+}
+
+// preloadDepth returns the number of chunks to preload. With the preload
+// ramp enabled the ramped depth is used, capped by the depth of a matching
+// preload window.
+func (b *Buffer) preloadDepth() int {
+	if depth, measured := b.leadDepth(); measured {
+		if scheduled, ok := scheduledDepth(time.Now()); ok && scheduled < depth {
+			return scheduled
+		}
+		return depth
+	}
+	if preloadRampMax <= 0 {
+		return preloadDepth(time.Now())
+	}
+
+	b.lock.Lock()
+	depth := b.rampDepth
+	b.lock.Unlock()
+
+	if scheduled, ok := scheduledDepth(time.Now()); ok && scheduled < depth {
+		return scheduled
+	}
+	return depth
+}
+
+// storeAligned stores the other complete chunks of an aligned range
+func (b *Buffer) storeAligned(generation, offset, fetchStart int64, fetched []byte) {
+	fetchEnd := fetchStart + int64(len(fetched))
+	first := (fetchStart + b.chunkSize - 1) / b.chunkSize * b.chunkSize
+	for chunkOffset := first; chunkOffset < fetchEnd; chunkOffset += b.chunkSize {
+		chunkEnd := int64(math.Min(float64(chunkOffset+b.chunkSize), float64(b.object.Size)))
+		if chunkOffset == offset || chunkEnd > fetchEnd {
+			continue
+		}
+
+		filename := filepath.Join(b.tempDir, chunkName(generation, b.chunkSize, chunkOffset))
+		if err := b.storeChunk(filename, generation, chunkOffset, fetched[chunkOffset-fetchStart:chunkEnd-fetchStart]); nil != err {
+			Log.Debugf("%v", err)
+			return
+		}
+	}
+}
+
+// storeChunk writes a downloaded chunk to the cache. Depending on the
+// configured write failure behavior a failed write only disables caching
+// until the chunk directory is writable again.
+func (b *Buffer) storeChunk(filename string, generation, offset int64, bytes []byte) error {
+	if chunkReadOnly || nil != b.ctx.Err() || !chunkWrites.shouldTry() || memoryOnly() {
+		return nil
+	}
+	// a cached chunk never exceeds the chunk size, the offset math and the
+	// eviction accounting depend on it
+	if int64(len(bytes)) > b.chunkSize {
+		Log.Warningf("Chunk %v has %v bytes, truncating it to the chunk size", filename, len(bytes))
+		bytes = bytes[:b.chunkSize]
+	}
+
+	started := time.Now()
+	err := b.store.Write(filename, bytes)
+	if isNoSpaceError(err) && evictForFullDisk() {
+		err = b.store.Write(filename, bytes)
+	}
+	// a full disk never fails the read, the chunk is served without
+	// caching it and the next write evicts again
+	if isNoSpaceError(err) {
+		Log.Debugf("%v", err)
+		Log.Warningf("The disk of %v is full, serving chunk %v without caching it", chunkPath, filename)
+		return nil
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		if WriteFailureFail == chunkWriteFailure {
+			return fmt.Errorf("Could not write chunk %v", filename)
+		}
+		chunkWrites.failed()
+		return nil
+	}
+
+	chunkWrites.succeeded()
+	recordDiskWrite(time.Since(started))
+	chunkWritten(int64(len(bytes)))
+	atomic.AddInt64(&b.cachedBytes, int64(len(bytes)))
+	chunks.add(b.object.ObjectID, generation, offset, int64(len(bytes)))
+	b.verifyIfCached(generation)
+	b.notifyIfFullyCached(generation)
 	return nil
 }
 
-// deleteOldestFile deletes the oldest file in the directory
-func deleteOldestFile(path string) error {
-	var fpath string
-	lastMod := time.Now()
+// cleanChunkDir checks if the chunk folder is grown to big and clears the
+// oldest files till the next chunk of the given size fits. It returns the
+// remaining size.
+func cleanChunkDir(chunkPath string, chunk int64) (int64, error) {
+	chunkDirSize, err := dirSize(chunkPath)
+	if nil != err {
+		return 0, err
+	}
+	size, _, err := evictOldest(chunkPath, chunkDirSize, chunk, false)
+	return size, err
+}
 
-	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			modTime := info.ModTime()
-			if modTime.Before(lastMod) {
-				lastMod = modTime
-				fpath = file
+// evictOldest clears the oldest files till the next chunk of the given size
+// fits into the chunk directory of the given size and returns the remaining
+// size. The chunks are picked from the chunk index if indexed is set,
+// otherwise by walking the directory. It reports if it stopped because no
+// chunk was left to evict.
+func evictOldest(chunkPath string, chunkDirSize, chunk int64, indexed bool) (int64, bool, error) {
+	maxSize := currentChunkDirMaxSize()
+	for chunkDirSize+chunk > maxSize {
+		removed, pinned, err := deleteOldest(chunkPath, true, indexed)
+		if nil == err && pinned {
+			if notifyEvictionPressure(chunkDirSize + chunk - maxSize) {
+				// the pin manager releases pins first
+				break
 			}
+			releaseOldestTailPin()
+			removed, _, err = deleteOldest(chunkPath, false, indexed)
+		} else if nil == err {
+			endEvictionPressure()
 		}
-		return err
-	})
+		if nil != err {
+			return chunkDirSize, false, err
+		}
+		if 0 == removed {
+			return chunkDirSize, true, nil
+		}
+		chunkDirSize -= removed
+	}
+
+	return chunkDirSize, false, nil
+}
+
+// deleteOldestFile deletes the chunk file the eviction policy picks among
+// the objects with the lowest priority in the directory and returns its size.
+// Chunks of cache partitions within their quota are only deleted if no
+// other chunk is left, chunks of the cached heads and pinned tails of
+// objects and exempt chunks of open objects after them. If only these
+// pinned chunks are left and they are kept, nothing is deleted and it
+// reports that.
+func deleteOldestFile(path string, keepPinned bool) (int64, bool, error) {
+	return deleteOldest(path, keepPinned, evictionIndexed())
+}
+
+// deleteOldest deletes the chunk file deleteOldestFile picks, from the
+// chunk index if indexed is set, otherwise by walking the directory
+func deleteOldest(path string, keepPinned, indexed bool) (int64, bool, error) {
+	policy := evictionPolicy()
+	if _, lru := policy.(LRUPolicy); lru && indexed && !prioritiesSet() && !partitionsConfigured() {
+		return deleteLeastRecentlyUsed(keepPinned)
+	}
+
+	var victim *EvictionCandidate
+	lowest := 0
+	victimRank := 0
+	used := make(map[string]int64)
+
+	consider := func(candidate *EvictionCandidate) {
+		priority := DefaultPriority
+		if "" != candidate.ObjectID {
+			priority = objectPriority(candidate.ObjectID)
+		}
+
+		if tag := objectTag(candidate.ObjectID); "" != tag {
+			used[tag] += candidate.Size
+		}
+
+		file := candidate.Path
+		rank := partitionRank(candidate.ObjectID)
+		if isPinnedChunk(file) {
+			rank = 2
+		}
+		if nil == victim || rank < victimRank ||
+			(rank == victimRank && (priority < lowest || (priority == lowest && policy.Before(candidate, victim)))) {
+			lowest = priority
+			victim = candidate
+			victimRank = rank
+		}
+	}
+
+	var err error
+	if indexed {
+		// the chunk index knows all chunks, no need to walk the directory
+		for _, candidate := range chunks.evictionCandidates() {
+			consider(candidate)
+		}
+	} else {
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if vanished(info, err) {
+				return nil
+			}
+			if !info.IsDir() {
+				consider(evictionCandidate(file, info))
+			}
+			return err
+		})
+	}
+	if nil == err {
+		measurePartitions(used)
+	}
+	if nil != err || nil == victim {
+		return 0, false, err
+	}
+	if keepPinned && 2 == victimRank {
+		return 0, true, nil
+	}
+
+	if err := removeChunk(victim.Path); nil != err {
+		return 0, false, err
+	}
+	partitionEvicted(victim.ObjectID, victim.Size)
+	recordEviction()
+	return victim.Size, false, nil
+}
 
-	os.Remove(fpath)
+// deleteLeastRecentlyUsed deletes the least recently used chunk of the
+// chunk index like deleteOldestFile, without looking at all other chunks.
+// It is used if neither eviction priorities nor cache partitions rank the
+// chunks.
+func deleteLeastRecentlyUsed(keepPinned bool) (int64, bool, error) {
+	victim, pinned := chunks.oldest(isPinnedChunk)
+	if nil == victim {
+		return 0, false, nil
+	}
+	if keepPinned && pinned {
+		return 0, true, nil
+	}
 
-	return err
+	if err := removeChunk(victim.Path); nil != err {
+		return 0, false, err
+	}
+	partitionEvicted(victim.ObjectID, victim.Size)
+	recordEviction()
+	return victim.Size, false, nil
+}
+
+// removeChunk deletes a chunk file, drops it from the chunk index and
+// releases resources the chunk store holds for it. Sparse files are
+// deleted together with their chunk map.
+func removeChunk(path string) error {
+	objectID, generation, chunkSize, offset, ok := parseChunkPath(path)
+	if !ok {
+		return os.Remove(path)
+	}
+	if sparseOffset == offset {
+		dropHotObject(objectID)
+	} else {
+		dropHot(objectID, generation, chunkSize, offset)
+	}
+
+	if instance, exists := instances.Get(objectID); exists {
+		instance.(*Buffer).store.Release(path)
+	}
+
+	chunks.removePath(path)
+	if sparseOffset == offset {
+		sparse := strings.TrimSuffix(path, sparseMapName(""))
+		if err := os.Remove(sparseMapName(sparse)); nil != err && !os.IsNotExist(err) {
+			return err
+		}
+		path = sparse
+	}
+	if err := os.Remove(path); nil != err && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 // dirSize gets the total directory size
 func dirSize(path string) (int64, error) {
 	var size int64
 	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if vanished(info, err) {
+			return nil
+		}
 		if !info.IsDir() {
 			size += info.Size()
 		}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// testChunkSize is the chunk size of the test buffers, small enough that
+// test objects span several chunks
+const testChunkSize = 64 * 1024
+
+// testServer serves the content of a test object with range support and
+// records the requested ranges
+type testServer struct {
+	*httptest.Server
+	content  []byte
+	requests int64
+	lock     sync.Mutex
+	ranges   []string
+}
+
+// newTestServer starts a server of random content of the given size. The
+// handler, if set, answers instead of the range server.
+func newTestServer(size int, handler http.HandlerFunc) *testServer {
+	s := &testServer{content: testContent(size)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.requests, 1)
+		s.lock.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.lock.Unlock()
+		if nil != handler {
+			handler(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+	}))
+	return s
+}
+
+// requestCount returns the number of requests the server got
+func (s *testServer) requestCount() int64 {
+	return atomic.LoadInt64(&s.requests)
+}
+
+// requestedRanges returns the Range headers of the requests
+func (s *testServer) requestedRanges() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// object returns the test object served by the server
+func (s *testServer) object(objectID string) *APIObject {
+	return &APIObject{
+		ObjectID:     objectID,
+		Name:         objectID + ".mkv",
+		Size:         uint64(len(s.content)),
+		LastModified: time.Unix(1500000000, 0),
+		DownloadURL:  s.URL + "/" + objectID,
+	}
+}
+
+// testContent returns reproducible random bytes
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	return content
+}
+
+// setupChunkDir resets the chunk cache to an empty temporary chunk
+// directory with the test chunk size and returns the function removing it
+func setupChunkDir(t testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "plexdrive-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	SetChunkPath(dir)
+	SetChunkSize(testChunkSize)
+	SetChunkDirMaxSize(1024 * 1024 * 1024)
+	if err := ResetCache(); nil != err {
+		t.Fatal(err)
+	}
+	// a failed fallback to the API of an earlier test must not leave the
+	// tests offline
+	offline.lock.Lock()
+	offline.until = time.Time{}
+	offline.since = time.Time{}
+	offline.lock.Unlock()
+	return dir, func() {
+		ResetCache()
+		os.RemoveAll(dir)
+	}
+}
+
+// openTestBuffer opens the buffer of an object
+func openTestBuffer(t testing.TB, object *APIObject) *Buffer {
+	buffer, err := GetBufferInstance(http.DefaultClient, object)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return buffer
+}
+
+// readAll reads the whole object through the buffer like a player
+func readAll(t testing.TB, buffer *Buffer, readSize int) []byte {
+	result := []byte{}
+	p := make([]byte, readSize)
+	for int64(len(result)) < int64(buffer.object.Size) {
+		n, err := buffer.ReadInto(p, int64(len(result)))
+		if nil != err {
+			t.Fatalf("read at %v failed: %v", len(result), err)
+		}
+		if 0 == n {
+			t.Fatalf("read at %v returned nothing", len(result))
+		}
+		result = append(result, p[:n]...)
+	}
+	return result
+}
+
+// eventually waits up to a few seconds for a condition, e.g. for the
+// chunks downloaded in the background to be written
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestReadThroughCache(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	server := newTestServer(5*testChunkSize+123, nil)
+	defer server.Close()
+	buffer := openTestBuffer(t, server.object("read"))
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes that don't match the content", len(got))
+	}
+	requests := server.requestCount()
+
+	// a second read is served from the cache
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("cached read %v bytes that don't match the content", len(got))
+	}
+	if server.requestCount() != requests {
+		t.Fatalf("cached read requested %v more ranges", server.requestCount()-requests)
+	}
+}
+
+func TestReadsSucceedWhenChunkWritesFail(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	defer func() { chunkWrites = chunkWriteState{} }()
+	server := newTestServer(3*testChunkSize, nil)
+	defer server.Close()
+
+	// a file in place of the chunk directory of the object fails all writes
+	blocked := filepath.Join(dir, "readonly")
+	if err := ioutil.WriteFile(blocked, []byte{}, 0644); nil != err {
+		t.Fatal(err)
+	}
+	buffer := openTestBuffer(t, server.object("readonly"))
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes that don't match the content while chunk writes fail", len(got))
+	}
+	if cached := chunks.cachedBytes("readonly", int64(len(server.content))); 0 != cached {
+		t.Fatalf("cached %v bytes although chunk writes fail", cached)
+	}
+
+	// caching resumes once the directory is writable and the retry interval passed
+	if err := os.Remove(blocked); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(blocked, 0777); nil != err {
+		t.Fatal(err)
+	}
+	chunkWrites.lock.Lock()
+	chunkWrites.lastFailure = time.Now().Add(-2 * chunkWriteRetryInterval)
+	chunkWrites.lock.Unlock()
+	InvalidateObject("readonly")
+	buffer.Close()
+	buffer = openTestBuffer(t, server.object("readonly"))
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes that don't match the content after writes recovered", len(got))
+	}
+	if !eventually(func() bool {
+		return int64(len(server.content)) == chunks.cachedBytes("readonly", int64(len(server.content)))
+	}) {
+		t.Fatalf("cached %v of %v bytes after writes recovered", chunks.cachedBytes("readonly", int64(len(server.content))), len(server.content))
+	}
+}
+
+func TestPreloadStopsAtLastChunk(t *testing.T) {
+	for _, size := range []int{3 * testChunkSize, 3*testChunkSize + 1, 3*testChunkSize - 1} {
+		testPreloadBoundary(t, size)
+	}
+}
+
+// testPreloadBoundary reads an object of the given size up to its end and
+// checks that the preloads requested and cached nothing beyond it
+func testPreloadBoundary(t *testing.T, size int) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	server := newTestServer(size, nil)
+	defer server.Close()
+	objectID := fmt.Sprintf("boundary%v", size)
+	buffer := openTestBuffer(t, server.object(objectID))
+
+	// reads right before the end of the object trigger the preloads
+	for _, start := range []int{0, size - testChunkSize, size - 1} {
+		p := make([]byte, 1)
+		if _, err := buffer.ReadInto(p, int64(start)); nil != err {
+			t.Fatalf("read at %v of %v failed: %v", start, size, err)
+		}
+		if server.content[start] != p[0] {
+			t.Fatalf("read at %v of %v doesn't match the content", start, size)
+		}
+	}
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes of %v that don't match the content", len(got), size)
+	}
+	if !eventually(func() bool { return int64(size) == chunks.cachedBytes(objectID, int64(size)) }) {
+		t.Fatalf("cached %v of %v bytes", chunks.cachedBytes(objectID, int64(size)), size)
+	}
+	buffer.Close()
+
+	for _, requested := range server.requestedRanges() {
+		var start, end int
+		if _, err := fmt.Sscanf(requested, "bytes=%d-%d", &start, &end); nil != err {
+			t.Fatalf("requested range %v that is not explicit", requested)
+		}
+		if start >= size || end >= size {
+			t.Fatalf("requested range %v beyond the end of %v bytes", requested, size)
+		}
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, objectID))
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if 0 == file.Size() {
+			t.Fatalf("cached the empty chunk %v for %v bytes", file.Name(), size)
+		}
+	}
+	if expected := (size + testChunkSize - 1) / testChunkSize; expected != len(files) {
+		t.Fatalf("cached %v chunk files for %v bytes instead of %v", len(files), size, expected)
+	}
+}
+
+func TestChangedSizeGetsNewBuffer(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	old := newTestServer(3*testChunkSize, nil)
+	defer old.Close()
+	replaced := newTestServer(2*testChunkSize+500, nil)
+	defer replaced.Close()
+
+	oldBuffer := openTestBuffer(t, old.object("replaced"))
+	defer oldBuffer.Close()
+	readAll(t, oldBuffer, 10000)
+
+	// the second open carries the size of the replaced file
+	buffer := openTestBuffer(t, replaced.object("replaced"))
+	defer buffer.Close()
+	if buffer == oldBuffer {
+		t.Fatalf("object of another size got the buffer of the old size")
+	}
+	if uint64(len(replaced.content)) != buffer.object.Size {
+		t.Fatalf("buffer has size %v instead of %v", buffer.object.Size, len(replaced.content))
+	}
+	if got := readAll(t, buffer, 10000); !bytes.Equal(replaced.content, got) {
+		t.Fatalf("read %v bytes that don't match the replaced content", len(got))
+	}
+	if 0 == replaced.requestCount() {
+		t.Fatalf("replaced content was served from the chunks of the old size")
+	}
+
+	// readers of the old version keep reading it
+	if got := readAll(t, oldBuffer, 10000); !bytes.Equal(old.content, got) {
+		t.Fatalf("read %v bytes that don't match the old content", len(got))
+	}
+}
+
+func TestComputeChunkRange(t *testing.T) {
+	tests := []struct {
+		start, size, chunkSize, objectSize           int64
+		chunkOffset, fileOffset, rangeEnd, returnLen int64
+	}{
+		{0, 10, 100, 1000, 0, 0, 100, 10},
+		{150, 10, 100, 1000, 100, 50, 200, 10},
+		// reads end with the chunk
+		{150, 100, 100, 1000, 100, 50, 200, 50},
+		// the last chunk is short
+		{950, 100, 100, 990, 900, 50, 990, 40},
+		{989, 100, 100, 990, 900, 89, 990, 1},
+		// reads at the end return nothing
+		{990, 100, 100, 990, 900, 90, 990, 0},
+		{1000, 100, 100, 1000, 1000, 0, 1000, 0},
+		{0, 0, 100, 1000, 0, 0, 100, 0},
+	}
+	for _, test := range tests {
+		chunkOffset, fileOffset, rangeEnd, returnLen := computeChunkRange(test.start, test.size, test.chunkSize, test.objectSize)
+		if chunkOffset != test.chunkOffset || fileOffset != test.fileOffset || rangeEnd != test.rangeEnd || returnLen != test.returnLen {
+			t.Errorf("computeChunkRange(%v, %v, %v, %v) = %v, %v, %v, %v, expected %v, %v, %v, %v",
+				test.start, test.size, test.chunkSize, test.objectSize,
+				chunkOffset, fileOffset, rangeEnd, returnLen,
+				test.chunkOffset, test.fileOffset, test.rangeEnd, test.returnLen)
+		}
+	}
+}
+
+func TestComputeChunkRangeProperties(t *testing.T) {
+	property := func(start, size uint32, chunkSize uint16, objectSize uint32) bool {
+		chunk := int64(chunkSize) + 1
+		chunkOffset, fileOffset, rangeEnd, returnLen := computeChunkRange(int64(start), int64(size), chunk, int64(objectSize))
+		if chunkOffset%chunk != 0 || chunkOffset+fileOffset != int64(start) || fileOffset >= chunk {
+			return false
+		}
+		if rangeEnd > chunkOffset+chunk || rangeEnd > int64(objectSize) {
+			return false
+		}
+		if returnLen < 0 || returnLen > int64(size) {
+			return false
+		}
+		// a read never returns bytes beyond the chunk or the object
+		if returnLen > 0 && int64(start)+returnLen > rangeEnd {
+			return false
+		}
+		// a read within the object returns bytes unless it is empty
+		return !(int64(start) < int64(objectSize) && size > 0 && 0 == returnLen)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 100000}); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestFinalPartialChunkIsReadFromCache(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	server := newTestServer(2*testChunkSize+123, nil)
+	defer server.Close()
+	buffer := openTestBuffer(t, server.object("tail"))
+	readAll(t, buffer, 10000)
+	size := int64(len(server.content))
+	if !eventually(func() bool { return size == chunks.cachedBytes("tail", size) }) {
+		t.Fatalf("cached %v of %v bytes", chunks.cachedBytes("tail", size), size)
+	}
+	buffer.Close()
+	requests := server.requestCount()
+
+	// reads of the tail ask for more than the chunk holds
+	buffer = openTestBuffer(t, server.object("tail"))
+	defer buffer.Close()
+	for _, readSize := range []int{1, 100, testChunkSize} {
+		for _, start := range []int64{2 * testChunkSize, size - 100, size - 1} {
+			p := make([]byte, readSize)
+			n, err := buffer.ReadInto(p, start)
+			if nil != err {
+				t.Fatalf("read of %v bytes at %v failed: %v", readSize, start, err)
+			}
+			expected := server.content[start:int64(math.Min(float64(start)+float64(readSize), float64(size)))]
+			if !bytes.Equal(expected, p[:n]) {
+				t.Fatalf("read %v of %v bytes at %v that don't match the content", n, readSize, start)
+			}
+		}
+	}
+	if server.requestCount() != requests {
+		t.Fatalf("downloaded the cached final chunk %v times", server.requestCount()-requests)
+	}
+}
+
+// fullDiskStore fails chunk writes with ENOSPC while failures are left
+type fullDiskStore struct {
+	ChunkStore
+	failures *int32
+}
+
+func (s *fullDiskStore) Write(filename string, data []byte) error {
+	if atomic.AddInt32(s.failures, -1) >= 0 {
+		return &os.PathError{Op: "write", Path: filename, Err: syscall.ENOSPC}
+	}
+	return s.ChunkStore.Write(filename, data)
+}
+
+// useFullDisk makes new buffers write through a store failing the given
+// number of writes with ENOSPC and returns the function restoring the store
+func useFullDisk(t testing.TB, failures *int32) func() {
+	chunkStores["fulldisk"] = func(dir string) ChunkStore {
+		return &fullDiskStore{ChunkStore: newFileStore(dir), failures: failures}
+	}
+	name := chunkStoreName
+	if err := SetChunkStore("fulldisk"); nil != err {
+		t.Fatal(err)
+	}
+	return func() {
+		SetChunkStore(name)
+		delete(chunkStores, "fulldisk")
+	}
+}
+
+func TestFullDiskServesReads(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	failures := int32(1 << 30)
+	defer useFullDisk(t, &failures)()
+	server := newTestServer(3*testChunkSize+10, nil)
+	defer server.Close()
+	buffer := openTestBuffer(t, server.object("fulldisk"))
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes that don't match the content while the disk is full", len(got))
+	}
+	if cached := chunks.cachedBytes("fulldisk", int64(len(server.content))); 0 != cached {
+		t.Fatalf("cached %v bytes on a full disk", cached)
+	}
+}
+
+func TestFullDiskEvictsAndCaches(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	old := newTestServer(2*testChunkSize, nil)
+	defer old.Close()
+	oldBuffer := openTestBuffer(t, old.object("evicted"))
+	readAll(t, oldBuffer, 10000)
+	if !eventually(func() bool { return 2*testChunkSize == chunks.cachedBytes("evicted", 2*testChunkSize) }) {
+		t.Fatalf("old object was not cached")
+	}
+	oldBuffer.Close()
+
+	// the first write fails, the eviction of the old chunks makes room
+	failures := int32(1)
+	defer useFullDisk(t, &failures)()
+	server := newTestServer(testChunkSize, nil)
+	defer server.Close()
+	buffer := openTestBuffer(t, server.object("evicting"))
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes that don't match the content after the disk was full", len(got))
+	}
+	if !eventually(func() bool { return testChunkSize == chunks.cachedBytes("evicting", testChunkSize) }) {
+		t.Fatalf("chunk was not cached after the eviction")
+	}
+	if chunks.cachedBytes("evicted", 2*testChunkSize) >= 2*testChunkSize {
+		t.Fatalf("full disk evicted none of the old chunks")
+	}
+}
+
+// BenchmarkBufferReadInto measures the allocations of cached reads within a
+// chunk, read into the buffer of the caller and returned as new slices
+func BenchmarkBufferReadInto(b *testing.B) {
+	_, cleanup := setupChunkDir(b)
+	defer cleanup()
+	server := newTestServer(4*testChunkSize, nil)
+	defer server.Close()
+	buffer := openTestBuffer(b, server.object("readinto"))
+	defer buffer.Close()
+	size := int64(len(server.content))
+	readAll(b, buffer, 10000)
+	if !eventually(func() bool { return size == chunks.cachedBytes("readinto", size) }) {
+		b.Fatalf("cached %v of %v bytes", chunks.cachedBytes("readinto", size), size)
+	}
+	const readSize = 16 * 1024
+
+	b.Run("ReadInto", func(b *testing.B) {
+		p := make([]byte, readSize)
+		b.ReportAllocs()
+		b.SetBytes(readSize)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			if _, err := buffer.ReadInto(p, int64(n*readSize)%size); nil != err {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ReadBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(readSize)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			if _, err := buffer.ReadBytes(int64(n*readSize)%size, readSize, ReadForeground); nil != err {
+				b.Fatal(err)
+			}
+		}
+	})
+}
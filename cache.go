@@ -41,10 +41,27 @@ type APIObject struct {
 	Size         uint64
 	LastModified time.Time
 	DownloadURL  string
+	ContentLink  string
+	ExportURL    string
+	MD5Checksum  string
+	Encrypted    bool
 	Parents      string `gorm:"index"`
 	CreatedAt    time.Time
 }
 
+// DownloadURLs returns the download endpoints of the object in the
+// order they should be tried
+func (o *APIObject) DownloadURLs() []string {
+	urls := []string{o.DownloadURL}
+	if mediaURL := fmt.Sprintf("https://www.googleapis.com/drive/v2/files/%v?alt=media", o.ObjectID); mediaURL != o.DownloadURL {
+		urls = append(urls, mediaURL)
+	}
+	if "" != o.ContentLink {
+		urls = append(urls, o.ContentLink)
+	}
+	return urls
+}
+
 // LargestChangeID is the last change id
 type LargestChangeID struct {
 	gorm.Model
@@ -176,7 +193,7 @@ func (c *Cache) GetObjectsByParent(parent string) ([]*APIObject, error) {
 
 // GetObjectByParentAndName finds a child element by name and its parent id
 func (c *Cache) GetObjectByParentAndName(parent, name string) (*APIObject, error) {
-	Log.Debugf("Getting object %v in parent %v", name, parent)
+	Log.Debugf("Getting object %v in parent %v", safeName(name), parent)
 
 	var object APIObject
 	c.db.Where("parents LIKE ? AND name = ?", fmt.Sprintf("%%|%v|%%", parent), name).First(&object)
@@ -187,7 +204,7 @@ func (c *Cache) GetObjectByParentAndName(parent, name string) (*APIObject, error
 		return &object, nil
 	}
 
-	return nil, fmt.Errorf("Could not find object with name %v in parent %v", name, parent)
+	return nil, fmt.Errorf("Could not find object with name %v in parent %v", safeName(name), parent)
 }
 
 // DeleteObject deletes an object by id
@@ -208,6 +225,15 @@ func (c *Cache) UpdateObject(object *APIObject) error {
 	return nil
 }
 
+// DeleteObjects deletes all cached objects and the change id, so that all
+// objects are fetched again by the next refresh
+func (c *Cache) DeleteObjects() {
+	Log.Debugf("Deleting all objects from cache")
+
+	c.db.Delete(&APIObject{})
+	c.db.Delete(&LargestChangeID{})
+}
+
 // StoreLargestChangeID stores the largest change id
 func (c *Cache) StoreLargestChangeID(changeID int64) error {
 	Log.Debugf("Storing change id %v in cache", changeID)
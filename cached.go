@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// FullyCachedFunc is called the first time all chunks of an object are
+// cached, e.g. to mark the object as available offline
+type FullyCachedFunc func(object *APIObject)
+
+var fullyCached = struct {
+	lock     sync.Mutex
+	fn       FullyCachedFunc
+	notified map[string]int64
+}{
+	notified: make(map[string]int64),
+}
+
+// OnObjectFullyCached registers the function that is called once per object
+// and generation when its last missing chunk was cached, no matter if it
+// was read, preloaded, warmed or prefetched
+func OnObjectFullyCached(fn FullyCachedFunc) {
+	fullyCached.lock.Lock()
+	defer fullyCached.lock.Unlock()
+
+	fullyCached.fn = fn
+}
+
+// SetFullyCachedCommand runs a command with the id and the name of an
+// object as arguments once it is cached completely, e.g. to mark it as
+// available offline in a UI ("" = disabled)
+func SetFullyCachedCommand(command string) {
+	if "" == command {
+		OnObjectFullyCached(nil)
+		return
+	}
+	OnObjectFullyCached(func(object *APIObject) {
+		output, err := exec.Command(command, object.ObjectID, object.Name).CombinedOutput()
+		if nil != err {
+			Log.Debugf("%s", output)
+			Log.Warningf("Fully cached command %v failed for object %v: %v", command, object.ObjectID, err)
+		}
+	})
+}
+
+// notifyIfFullyCached calls the registered function if the chunk that was
+// just stored completed the cached object
+func (b *Buffer) notifyIfFullyCached(generation int64) {
+	fullyCached.lock.Lock()
+	fn := fullyCached.fn
+	notified, exists := fullyCached.notified[b.object.ObjectID]
+	fullyCached.lock.Unlock()
+
+	if nil == fn || (exists && notified == generation) ||
+		!chunks.complete(b.object.ObjectID, generation, int64(b.object.Size)) {
+		return
+	}
+
+	fullyCached.lock.Lock()
+	notified, exists = fullyCached.notified[b.object.ObjectID]
+	fullyCached.notified[b.object.ObjectID] = generation
+	fullyCached.lock.Unlock()
+	if exists && notified == generation {
+		return
+	}
+
+	go fn(b.object)
+}
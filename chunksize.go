@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+
+var chunkSizes struct {
+	lock sync.Mutex
+	fn   ChunkSizeFunc
+}
+
+// ChunkSizeFunc returns the chunk size of an object, e.g. by its size or
+// file type. A size of 0 uses the global chunk size.
+type ChunkSizeFunc func(object *APIObject) int64
+
+// SetChunkSizeFunc sets the function that chooses the chunk size of each
+// object when it is opened. The chunks of each chunk size are cached under
+// their own names, so changing the chunk size of an object only discards
+// its cached chunks.
+func SetChunkSizeFunc(fn ChunkSizeFunc) {
+	chunkSizes.lock.Lock()
+	defer chunkSizes.lock.Unlock()
+
+	chunkSizes.fn = fn
+}
+
+// ChunkSizeBySize uses the given chunk size for objects of at least the
+// given size
+func ChunkSizeBySize(minSize uint64, size int64) ChunkSizeFunc {
+	return func(object *APIObject) int64 {
+		if object.Size >= minSize {
+			return size
+		}
+		return 0
+	}
+}
+
+// objectChunkSize returns the chunk size of an object, a probed chunk size
+// is used if no chunk size function chose one
+func objectChunkSize(object *APIObject) int64 {
+	chunkSizes.lock.Lock()
+	fn := chunkSizes.fn
+	chunkSizes.lock.Unlock()
+
+	if nil != fn {
+		if size := fn(object); size > 0 {
+			return size
+		}
+	}
+
+	chunkProbe.lock.Lock()
+	defer chunkProbe.lock.Unlock()
+	if size, probed := chunkProbe.sizes[object.ObjectID]; probed {
+		return size
+	}
+	return currentChunkSize()
+}
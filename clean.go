@@ -10,56 +10,114 @@ import (
 )
 
 // CleanChunkDir check frequently the temporary directory and
-// cleans old stuff
-func CleanChunkDir(chunkDir string, clearInterval, chunkAge time.Duration, chunkSize, maxTempSize int64) {
-	if maxTempSize > 0 {
+// cleans old stuff. The chunk directory and the method follow a reloaded
+// chunk configuration.
+func CleanChunkDir(clearInterval, chunkAge time.Duration) {
+	bySize := currentChunkDirMaxSize() > 0
+	logCleanMethod(bySize)
+	for _ = range time.Tick(clearInterval) {
+		if currentChunkDirMaxSize() > 0 != bySize {
+			bySize = !bySize
+			logCleanMethod(bySize)
+		}
+		if bySize {
+			clearBySize(chunkPath)
+		} else {
+			clearByInterval(chunkPath, chunkAge)
+		}
+	}
+}
+
+// logCleanMethod logs the method used for chunk cleaning
+func logCleanMethod(bySize bool) {
+	if bySize {
 		Log.Info("Using clear-by-size method for chunk cleaning")
-		clearBySize(chunkDir, clearInterval)
 	} else {
 		Log.Info("Using clear-by-interval method for chunk cleaning")
-		clearByInterval(chunkDir, clearInterval, chunkAge)
 	}
 }
 
 // clearBySize clears the chunk dir temporarily and deletes only the oldest files
-func clearBySize(chunkDir string, clearInterval time.Duration) {
-	for _ = range time.Tick(clearInterval) {
-		deleteEmptyDirs(chunkDir)
-	}
+func clearBySize(chunkDir string) {
+	unlock := lockChunkDir(true)
+	deleteStaleChunks(chunkDir)
+	deleteEmptyDirs(chunkDir)
+	unlock()
+	compressChunks(chunkDir)
+	remeasureChunkDir(chunkDir)
+	saveChunkIndex()
 }
 
 // clearByInterval clears the chunk dir temporarily regardless of the size
-func clearByInterval(chunkDir string, clearInterval, chunkAge time.Duration) {
-	for _ = range time.Tick(clearInterval) {
-		Log.Debugf("Cleaning chunk directory %v", chunkDir)
+func clearByInterval(chunkDir string, chunkAge time.Duration) {
+	Log.Debugf("Cleaning chunk directory %v", chunkDir)
 
-		filepath.Walk(chunkDir, func(path string, f os.FileInfo, err error) error {
-			if path == chunkDir {
-				return nil
-			}
+	unlock := lockChunkDir(true)
+	filepath.Walk(chunkDir, func(path string, f os.FileInfo, err error) error {
+		if path == chunkDir || vanished(f, err) {
+			return nil
+		}
 
-			now := time.Now()
-			if !f.IsDir() {
-				if now.Sub(f.ModTime()) > chunkAge {
-					if err := os.Remove(path); nil != err {
-						Log.Warningf("Could not delete temp file %v", path)
-					}
+		now := time.Now()
+		if !f.IsDir() {
+			if (now.Sub(f.ModTime()) > chunkAge && !isPinnedChunk(path)) || chunks.isStale(path) {
+				if err := removeChunk(path); nil != err {
+					Log.Warningf("Could not delete temp file %v", path)
 				}
-			} else {
-				if empty, err := isEmptyDir(path); nil == err && empty {
-					if err := os.RemoveAll(path); nil != err {
-						Log.Warningf("Could not delete temp dir %v", path)
-					}
+			}
+		} else {
+			if empty, err := isEmptyDir(path); nil == err && empty {
+				if err := os.RemoveAll(path); nil != err {
+					Log.Warningf("Could not delete temp dir %v", path)
 				}
 			}
-			return err
-		})
+		}
+		return err
+	})
+	unlock()
+	compressChunks(chunkDir)
+	saveChunkIndex()
+}
+
+// compressChunks compresses the chunks that were not read for a while
+func compressChunks(chunkDir string) {
+	if err := compressColdChunks(chunkDir); nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not compress chunks in %v", chunkDir)
 	}
 }
 
+// saveChunkIndex persists the chunk index after a cleaning run
+func saveChunkIndex() {
+	if err := SaveChunkIndex(); nil != err {
+		Log.Warningf("%v", err)
+	}
+}
+
+// deleteStaleChunks deletes chunks of outdated generations or chunk sizes
+func deleteStaleChunks(dir string) error {
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if vanished(f, err) {
+			return nil
+		}
+		if !f.IsDir() && chunks.isStale(path) {
+			Log.Debugf("Cleaning stale chunk %v", path)
+			if err := removeChunk(path); nil != err {
+				Log.Warningf("Could not delete temp file %v", path)
+			}
+		}
+		return err
+	})
+
+	return err
+}
+
 // deleteEmptyDirs deletes empty directories
 func deleteEmptyDirs(dir string) error {
 	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if vanished(f, err) {
+			return nil
+		}
 		if f.IsDir() && path != dir {
 			if empty, err := isEmptyDir(path); nil == err && empty {
 				Log.Debugf("Cleaning empty directory %v", path)
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+var objectClients = struct {
+	lock    sync.Mutex
+	clients map[string]*http.Client
+}{
+	clients: make(map[string]*http.Client),
+}
+
+// SetObjectClient sets the http client an object is downloaded with, e.g.
+// with the credentials of the account that shared it (nil = the client of
+// the mount). It applies to buffers created afterwards.
+func SetObjectClient(objectID string, client *http.Client) {
+	objectClients.lock.Lock()
+	defer objectClients.lock.Unlock()
+
+	if nil == client {
+		delete(objectClients.clients, objectID)
+		return
+	}
+	objectClients.clients[objectID] = client
+}
+
+// objectClient returns the http client of an object or the given default
+func objectClient(objectID string, fallback *http.Client) *http.Client {
+	objectClients.lock.Lock()
+	defer objectClients.lock.Unlock()
+
+	if client, exists := objectClients.clients[objectID]; exists {
+		return client
+	}
+	return fallback
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authTransport sends requests with the token of an account
+type authTransport struct {
+	token string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authorized := new(http.Request)
+	*authorized = *req
+	authorized.Header = make(http.Header)
+	for key, values := range req.Header {
+		authorized.Header[key] = values
+	}
+	authorized.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultTransport.RoundTrip(authorized)
+}
+
+func TestObjectClientIsUsedPerObject(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(2 * testChunkSize)
+	var lock sync.Mutex
+	tokens := make(map[string]map[string]bool)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		objectID := strings.TrimPrefix(r.URL.Path, "/")
+		lock.Lock()
+		if nil == tokens[objectID] {
+			tokens[objectID] = make(map[string]bool)
+		}
+		tokens[objectID][r.Header.Get("Authorization")] = true
+		lock.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	defer server.Close()
+
+	mount := &http.Client{Transport: &authTransport{token: "mount"}}
+	SetObjectClient("shared", &http.Client{Transport: &authTransport{token: "shared"}})
+	defer SetObjectClient("shared", nil)
+
+	for _, objectID := range []string{"owned", "shared"} {
+		object := server.object(objectID)
+		object.Size = uint64(len(content))
+		buffer, err := GetBufferInstance(mount, object)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+			t.Fatalf("read %v bytes of %v that don't match the content", len(got), objectID)
+		}
+		buffer.Close()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if 1 != len(tokens["owned"]) || !tokens["owned"]["Bearer mount"] {
+		t.Fatalf("owned object was downloaded with %v instead of the client of the mount", tokens["owned"])
+	}
+	if 1 != len(tokens["shared"]) || !tokens["shared"]["Bearer shared"] {
+		t.Fatalf("shared object was downloaded with %v instead of its own client", tokens["shared"])
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// compressedSuffix is appended to the file name of a compressed chunk
+const compressedSuffix = ".gz"
+
+var chunkCompressAge time.Duration
+
+// compressionLock serializes compressing and decompressing chunks, so that
+// a chunk is never compressed while it is decompressed for a read
+var compressionLock sync.Mutex
+
+// SetChunkCompressAge compresses chunks that were not read for the given
+// time when the chunk directory is cleaned (0 = disabled). Compressed chunks
+// are decompressed on their next read, so that recently read chunks are
+// served without decompressing them. Only plain chunk files are compressed.
+func SetChunkCompressAge(age time.Duration) {
+	chunkCompressAge = age
+}
+
+// compressColdChunks compresses the chunks of the directory that were not
+// read within the compression age
+func compressColdChunks(dir string) error {
+	if chunkCompressAge <= 0 || "file" != chunkStoreName {
+		return nil
+	}
+
+	return filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if nil != err || f.IsDir() || strings.HasSuffix(path, compressedSuffix) {
+			return err
+		}
+		info, cached := chunks.info(path)
+		if !cached || info.Compressed || info.Incompressible || time.Since(info.Accessed) < chunkCompressAge {
+			return nil
+		}
+		if err := compressChunk(path); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not compress chunk %v", path)
+		}
+		return nil
+	})
+}
+
+// compressChunk replaces a chunk file with its compressed version. Chunks
+// that don't get smaller stay uncompressed and are marked as incompressible.
+func compressChunk(path string) error {
+	compressionLock.Lock()
+	defer compressionLock.Unlock()
+
+	stat, err := os.Stat(path)
+	if nil != err {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+compressedSuffix+"-")
+	if nil != err {
+		return err
+	}
+	writer, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	if nil == err {
+		_, err = writer.Write(data)
+	}
+	if nil == err {
+		err = writer.Close()
+	}
+	var size int64
+	if nil == err {
+		var compressed os.FileInfo
+		if compressed, err = f.Stat(); nil == err {
+			size = compressed.Size()
+		}
+	}
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil != err || size >= int64(len(data)) {
+		os.Remove(f.Name())
+		if nil == err {
+			chunks.setIncompressible(path)
+		}
+		return err
+	}
+	if err := os.Rename(f.Name(), path+compressedSuffix); nil != err {
+		os.Remove(f.Name())
+		return err
+	}
+	// the age of the chunk is kept for --clear-chunk-age
+	if err := os.Chtimes(path+compressedSuffix, stat.ModTime(), stat.ModTime()); nil != err {
+		Log.Debugf("%v", err)
+	}
+
+	Log.Debugf("Compressed chunk %v from %v to %v bytes", path, len(data), size)
+	chunks.setCompressed(path, true, size)
+	chunkWritten(size - int64(len(data)))
+	if objectID, _, _, _, ok := parseChunkPath(path); ok {
+		if instance, exists := instances.Get(objectID); exists {
+			instance.(*Buffer).store.Release(path)
+		}
+	}
+	return os.Remove(path)
+}
+
+// decompress restores a compressed chunk before it is read
+func (b *Buffer) decompress(filename string, generation, offset int64) {
+	if !chunks.compressed(b.object.ObjectID, generation, offset) {
+		return
+	}
+
+	compressionLock.Lock()
+	defer compressionLock.Unlock()
+
+	if !chunks.compressed(b.object.ObjectID, generation, offset) {
+		return
+	}
+	if err := b.decompressChunk(filename); nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not decompress chunk %v", filename)
+	}
+}
+
+// decompressChunk writes the uncompressed chunk and deletes the compressed
+// one, the compression lock must be held
+func (b *Buffer) decompressChunk(filename string) error {
+	f, err := os.Open(filename + compressedSuffix)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if nil != err {
+		return err
+	}
+	reader, err := gzip.NewReader(f)
+	if nil != err {
+		return err
+	}
+	data, err := ioutil.ReadAll(reader)
+	if nil != err {
+		return err
+	}
+	if err := b.store.Write(filename, data); nil != err {
+		return err
+	}
+
+	Log.Debugf("Decompressed chunk %v", filename)
+	chunks.setCompressed(filename, false, int64(len(data)))
+	chunkWritten(int64(len(data)) - stat.Size())
+	return os.Remove(filename + compressedSuffix)
+}
@@ -8,10 +8,15 @@ import (
 	. "github.com/claudetech/loggo/default"
 )
 
-// Config describes the basic configuration architecture
+// Config describes the basic configuration architecture. The crypt fields
+// hold the password, password2 and filename_encryption of an rclone crypt
+// remote, its files are decrypted if the password is set.
 type Config struct {
-	ClientID     string
-	ClientSecret string
+	ClientID                string
+	ClientSecret            string
+	CryptPassword           string `json:",omitempty"`
+	CryptPassword2          string `json:",omitempty"`
+	CryptFilenameEncryption string `json:",omitempty"`
 }
 
 // ReadConfig reads the configuration based on a filesystem path
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/net/context"
+)
+
+// preloadXattr is the extended attribute that preloads a range of a file
+// when it is set, e.g. setfattr -n user.plexdrive.preload -v 0:104857600
+const preloadXattr = "user.plexdrive.preload"
+
+// readModeXattr is the extended attribute that sets the read mode of a file,
+// e.g. setfattr -n user.plexdrive.mode -v sequential
+const readModeXattr = "user.plexdrive.mode"
+
+// cachedXattr is the read-only extended attribute holding the number of
+// cached bytes of a file, e.g. getfattr -n user.plexdrive.cached
+const cachedXattr = "user.plexdrive.cached"
+
+// warmXattr is the extended attribute that queues a file to be cached
+// completely with the given priority, e.g. setfattr -n user.plexdrive.warm -v 10
+const warmXattr = "user.plexdrive.warm"
+
+// unpinXattr is the extended attribute that releases the pinned tail of a
+// file when it is set, e.g. setfattr -n user.plexdrive.unpin
+const unpinXattr = "user.plexdrive.unpin"
+
+// exportXattr is the extended attribute that copies a file through the
+// chunk cache to the given absolute path, e.g.
+// setfattr -n user.plexdrive.export -v /media/offline/movie.mkv
+const exportXattr = "user.plexdrive.export"
+
+// offlineXattr is the read-only extended attribute that is 1 if a file is
+// cached completely and can be played offline, otherwise 0
+const offlineXattr = "user.plexdrive.offline"
+
+// Getxattr returns the cache state of a file
+func (o *Object) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if (cachedXattr != req.Name && offlineXattr != req.Name) || o.object.IsDir {
+		return fuse.ErrNoXattr
+	}
+	cached, complete := o.client.CachedBytes(o.object)
+
+	if cachedXattr == req.Name {
+		resp.Xattr = []byte(strconv.FormatInt(cached, 10))
+	} else if complete {
+		resp.Xattr = []byte("1")
+	} else {
+		resp.Xattr = []byte("0")
+	}
+	return nil
+}
+
+// Listxattr lists the cache state attributes of a file
+func (o *Object) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if !o.object.IsDir {
+		resp.Append(cachedXattr, offlineXattr)
+	}
+	return nil
+}
+
+// Setxattr handles the control attributes of a file
+func (o *Object) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if preloadXattr != req.Name && readModeXattr != req.Name && unpinXattr != req.Name && warmXattr != req.Name && exportXattr != req.Name {
+		return fuse.ENOTSUP
+	}
+	if o.object.IsDir {
+		return fuse.Errno(syscall.EISDIR)
+	}
+
+	if unpinXattr == req.Name {
+		UnpinTail(o.object.ObjectID)
+		return nil
+	}
+	if warmXattr == req.Name {
+		priority := 0
+		if value := strings.TrimSpace(string(req.Xattr)); "" != value {
+			var err error
+			if priority, err = strconv.Atoi(value); nil != err {
+				Log.Warningf("Invalid warm priority %v", value)
+				return fuse.Errno(syscall.EINVAL)
+			}
+		}
+		o.client.WarmWithPriority(o.object.ObjectID, priority)
+		return nil
+	}
+
+	if exportXattr == req.Name {
+		destination := strings.TrimSpace(string(req.Xattr))
+		if !filepath.IsAbs(destination) {
+			Log.Warningf("Invalid export destination %v (expected an absolute path)", destination)
+			return fuse.Errno(syscall.EINVAL)
+		}
+		buffer, err := o.client.Open(o.object)
+		if nil != err {
+			Log.Warningf("%v", err)
+			return fuse.EIO
+		}
+		go exportObject(buffer, destination)
+		return nil
+	}
+
+	if readModeXattr == req.Name {
+		if err := SetObjectReadMode(o.object.ObjectID, strings.TrimSpace(string(req.Xattr))); nil != err {
+			Log.Warningf("%v", err)
+			return fuse.Errno(syscall.EINVAL)
+		}
+		return nil
+	}
+
+	start, length, err := parsePreloadRange(string(req.Xattr), o.object.Size)
+	if nil != err {
+		Log.Warningf("%v", err)
+		return fuse.Errno(syscall.EINVAL)
+	}
+	Log.Infof("Preloading %v bytes %v - %v", safeName(o.object.Name), start, start+length)
+
+	// small objects are cached as a whole on their first read
+	if isSmallObject(o.object) {
+		go func() {
+			if _, err := o.client.ReadSmallObject(o.object, 0, int64(o.object.Size)); nil != err {
+				Log.Warningf("%v", err)
+			}
+		}()
+		return nil
+	}
+
+	buffer, err := o.client.Open(o.object)
+	if nil != err {
+		Log.Warningf("%v", err)
+		switch err.(type) {
+		case *TooManyBuffersError, *BufferRateError:
+			return fuse.Errno(syscall.EAGAIN)
+		}
+		return fuse.EIO
+	}
+	buffer.Warm(start, length)
+	if err := buffer.Close(); nil != err {
+		Log.Debugf("%v", err)
+	}
+	return nil
+}
+
+// exportObject copies the object of a buffer to the destination, the copy
+// is written next to it and renamed once it is complete
+func exportObject(buffer *Buffer, destination string) {
+	defer buffer.Close()
+
+	partial := destination + ".part"
+	file, err := os.Create(partial)
+	if nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not create export %v", partial)
+		return
+	}
+	err = buffer.Export(context.Background(), file, nil)
+	if closeErr := file.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(partial, destination)
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not export %v to %v", safeName(buffer.object.Name), destination)
+		os.Remove(partial)
+		return
+	}
+	Log.Infof("Exported %v to %v", safeName(buffer.object.Name), destination)
+}
+
+// parsePreloadRange parses the value of the preload attribute, the offset
+// and the length of the range separated by a colon. An empty value or a
+// length of 0 preloads till the end of the object.
+func parsePreloadRange(value string, size uint64) (int64, int64, error) {
+	value = strings.TrimSpace(value)
+	if "" == value {
+		return 0, int64(size), nil
+	}
+
+	parts := strings.Split(value, ":")
+	if 2 != len(parts) {
+		return 0, 0, fmt.Errorf("Invalid preload range %v (expected offset:length)", value)
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if nil != err || start < 0 || uint64(start) >= size {
+		return 0, 0, fmt.Errorf("Invalid preload offset %v", parts[0])
+	}
+	length, err := strconv.ParseInt(parts[1], 10, 64)
+	if nil != err || length < 0 {
+		return 0, 0, fmt.Errorf("Invalid preload length %v", parts[1])
+	}
+	if 0 == length || uint64(start+length) > size {
+		length = int64(size) - start
+	}
+	return start, length, nil
+}
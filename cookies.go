@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// downloadCookies keeps the cookies of all download requests, so that a
+// download session established by one chunk request is used by the next
+var downloadCookies = newCookieJar()
+
+// newCookieJar creates an empty cookie jar
+func newCookieJar() http.CookieJar {
+	// the jar only fails for invalid options
+	jar, _ := cookiejar.New(nil)
+	return jar
+}
+
+// AddDownloadCookies adds cookies that are sent with the download requests
+// to the host of the url, e.g. of a download session established elsewhere
+func AddDownloadCookies(rawurl string, cookies []*http.Cookie) error {
+	u, err := url.Parse(rawurl)
+	if nil != err || "" == u.Host {
+		return fmt.Errorf("Invalid cookie url %v", rawurl)
+	}
+	downloadCookies.SetCookies(u, cookies)
+	return nil
+}
+
+// LoadDownloadCookies adds the cookies of a cookie file in the Netscape
+// format, as exported by browsers and curl, to the download requests
+func LoadDownloadCookies(path string) error {
+	f, err := os.Open(path)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not open cookie file %v", path)
+	}
+	defer f.Close()
+
+	loaded := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "#HttpOnly_")
+		if "" == line || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// domain, subdomains, path, secure, expiry, name and value
+		fields := strings.Split(line, "\t")
+		if 7 != len(fields) {
+			return fmt.Errorf("Invalid cookie line %v in %v", line, path)
+		}
+		cookie := &http.Cookie{Name: fields[5], Value: fields[6], Path: fields[2], Secure: "TRUE" == fields[3]}
+		if expiry, err := strconv.ParseInt(fields[4], 10, 64); nil == err && expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		domain := strings.TrimPrefix(fields[0], ".")
+		if "TRUE" == fields[1] {
+			cookie.Domain = domain
+		}
+		if err := AddDownloadCookies(scheme+"://"+domain+fields[2], []*http.Cookie{cookie}); nil != err {
+			return err
+		}
+		loaded++
+	}
+	if err := scanner.Err(); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read cookie file %v", path)
+	}
+	Log.Infof("Loaded %v download cookies from %v", loaded, path)
+	return nil
+}
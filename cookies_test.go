@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sessionServer serves ranges only to requests with the session cookie, a
+// request without it gets a new session along with its range
+func sessionServer(content []byte, sessions *int32, rejected *int32, requireInitial bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("download_session"); nil != err || "valid" != cookie.Value {
+			if requireInitial {
+				atomic.AddInt32(rejected, 1)
+				http.Error(w, "no session", http.StatusForbidden)
+				return
+			}
+			atomic.AddInt32(sessions, 1)
+			http.SetCookie(w, &http.Cookie{Name: "download_session", Value: "valid", Path: "/"})
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}
+}
+
+func TestDownloadsReuseTheSession(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	defer func(jar http.CookieJar) { downloadCookies = jar }(downloadCookies)
+	downloadCookies = newCookieJar()
+	content := testContent(4 * testChunkSize)
+	var sessions int32
+	server := newTestServer(0, sessionServer(content, &sessions, nil, false))
+	defer server.Close()
+	object := server.object("session")
+	object.Size = uint64(len(content))
+
+	buffer, err := GetBufferInstance(&http.Client{Jar: downloadCookies}, object)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+	// the chunks are read one after the other, so the first request
+	// establishes the session
+	p := make([]byte, 10)
+	if _, err := buffer.ReadInto(p, 0); nil != err {
+		t.Fatal(err)
+	}
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content", len(got))
+	}
+	if server.requestCount() < 2 {
+		t.Fatalf("downloaded %v chunks in %v requests", len(content)/testChunkSize, server.requestCount())
+	}
+	if 1 != atomic.LoadInt32(&sessions) {
+		t.Fatalf("established %v sessions for %v requests", sessions, server.requestCount())
+	}
+}
+
+func TestDownloadsSendAddedCookies(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	defer func(jar http.CookieJar) { downloadCookies = jar }(downloadCookies)
+	downloadCookies = newCookieJar()
+	content := testContent(3 * testChunkSize)
+	var rejected int32
+	server := newTestServer(0, sessionServer(content, nil, &rejected, true))
+	defer server.Close()
+	object := server.object("addedcookie")
+	object.Size = uint64(len(content))
+
+	if err := AddDownloadCookies(server.URL, []*http.Cookie{{Name: "download_session", Value: "valid", Path: "/"}}); nil != err {
+		t.Fatal(err)
+	}
+	buffer, err := GetBufferInstance(&http.Client{Jar: downloadCookies}, object)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content", len(got))
+	}
+	if 0 != atomic.LoadInt32(&rejected) {
+		t.Fatalf("sent %v requests without the added session cookie", rejected)
+	}
+}
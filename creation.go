@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// bufferCreationMaxDelay is the longest time the creation of a buffer is
+// delayed before opening the file fails
+const bufferCreationMaxDelay = 10 * time.Second
+
+// bufferCreationWindow is the time the created buffers are counted in
+const bufferCreationWindow = 1 * time.Minute
+
+// creation spaces the creation of new buffers, so that a library scan
+// opening thousands of files doesn't flood the chunk directory and the
+// preloads. Files with an open or lingering buffer are never delayed.
+var creation = struct {
+	lock        sync.Mutex
+	rate        int
+	next        time.Time
+	windowStart time.Time
+	created     int
+	lastWindow  int
+	delayed     int64
+	rejected    int64
+}{}
+
+// BufferCreationStats holds the limit and the rate of buffer creations
+type BufferCreationStats struct {
+	Limit      int   `json:"limit"`
+	LastMinute int   `json:"lastMinute"`
+	Delayed    int64 `json:"delayed"`
+	Rejected   int64 `json:"rejected"`
+}
+
+// BufferRateError is returned if a file can not be opened, because new
+// buffers are created faster than the limit for too long
+type BufferRateError struct {
+	Rate int
+}
+
+func (e *BufferRateError) Error() string {
+	return fmt.Sprintf("Reached the maximum of %v new buffers per second", e.Rate)
+}
+
+// SetBufferCreationRate sets the maximum number of buffers created per
+// second (0 = unlimited). Bursts of up to one second of buffers are created
+// right away, further buffers are delayed for up to 10 seconds.
+func SetBufferCreationRate(rate int) {
+	creation.lock.Lock()
+	defer creation.lock.Unlock()
+
+	creation.rate = rate
+}
+
+// waitForBufferCreation waits for the next free slot to create a buffer
+func waitForBufferCreation() error {
+	creation.lock.Lock()
+	now := time.Now()
+	updateCreationWindow(now)
+	if creation.rate <= 0 {
+		creation.created++
+		creation.lock.Unlock()
+		return nil
+	}
+
+	interval := time.Second / time.Duration(creation.rate)
+	slot := creation.next
+	if earliest := now.Add(-time.Second + interval); slot.Before(earliest) {
+		slot = earliest
+	}
+	if slot.Sub(now) > bufferCreationMaxDelay {
+		creation.rejected++
+		rate := creation.rate
+		creation.lock.Unlock()
+		return &BufferRateError{Rate: rate}
+	}
+	creation.next = slot.Add(interval)
+	creation.created++
+	if slot.After(now) {
+		creation.delayed++
+	}
+	creation.lock.Unlock()
+
+	if wait := slot.Sub(now); wait > 0 {
+		Log.Debugf("Delaying the creation of a buffer for %v", wait)
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// updateCreationWindow starts a new window once the current one passed, the
+// lock must be held
+func updateCreationWindow(now time.Time) {
+	if now.Sub(creation.windowStart) < bufferCreationWindow {
+		return
+	}
+	creation.lastWindow = creation.created
+	if now.Sub(creation.windowStart) >= 2*bufferCreationWindow {
+		creation.lastWindow = 0
+	}
+	creation.windowStart = now
+	creation.created = 0
+}
+
+// GetBufferCreationStats returns the limit and the number of buffers
+// created within the last complete minute
+func GetBufferCreationStats() BufferCreationStats {
+	creation.lock.Lock()
+	defer creation.lock.Unlock()
+
+	updateCreationWindow(time.Now())
+	return BufferCreationStats{
+		Limit:      creation.rate,
+		LastMinute: creation.lastWindow,
+		Delayed:    creation.delayed,
+		Rejected:   creation.rejected,
+	}
+}
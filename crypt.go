@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/rfjakob/eme"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// CryptNamesStandard decrypts the names of files and directories
+	// encrypted by rclone crypt
+	CryptNamesStandard = "standard"
+	// CryptNamesOff only strips the .bin suffix rclone crypt appends to
+	// the names of encrypted files
+	CryptNamesOff = "off"
+)
+
+// the layout of a file encrypted by rclone crypt: a header of a magic and
+// the nonce of the first block, followed by blocks of 64 KiB sealed with
+// secretbox one after another
+const (
+	cryptMagic         = "RCLONE\x00\x00"
+	cryptHeaderSize    = int64(len(cryptMagic) + 24)
+	cryptBlockDataSize = int64(64 * 1024)
+	cryptBlockSize     = cryptBlockDataSize + secretbox.Overhead
+	cryptOffSuffix     = ".bin"
+)
+
+// cryptDefaultSalt is the salt rclone uses if the crypt remote has no
+// password2
+var cryptDefaultSalt = []byte{0xA8, 0x0D, 0xF4, 0x3A, 0x8F, 0xBD, 0x03, 0x08, 0xA7, 0xCA, 0xB8, 0x3E, 0x58, 0x1F, 0x86, 0xB1}
+
+// cryptKeys holds the keys derived from the password of the crypt remote,
+// nil if crypt is disabled
+var cryptKeys *cryptCipher
+
+type cryptCipher struct {
+	dataKey   [32]byte
+	nameKey   [32]byte
+	nameTweak [16]byte
+	block     cipher.Block
+	names     string
+	state     string
+}
+
+// CryptError is returned if a block of an encrypted file can't be decrypted
+type CryptError struct {
+	ObjectID string
+	Offset   int64
+}
+
+func (e *CryptError) Error() string {
+	return fmt.Sprintf("Could not decrypt object %v at offset %v, the crypt password is wrong or the file is corrupted", e.ObjectID, e.Offset)
+}
+
+// SetCrypt decrypts files encrypted by rclone crypt with the password and
+// salt (password2) of the crypt remote, in plain text as shown by rclone
+// reveal ("" = crypt disabled, "" salt = the default salt of rclone). The
+// name encryption is standard or off, like filename_encryption of rclone.
+func SetCrypt(password, salt, names string) error {
+	if "" == password {
+		return nil
+	}
+	if "" == names {
+		names = CryptNamesStandard
+	}
+	if CryptNamesStandard != names && CryptNamesOff != names {
+		return fmt.Errorf("Invalid crypt filename encryption %v", names)
+	}
+
+	saltBytes := cryptDefaultSalt
+	if "" != salt {
+		saltBytes = []byte(salt)
+	}
+	state := sha256.Sum256([]byte(password + "\x00" + salt + "\x00" + names))
+	c := &cryptCipher{names: names, state: hex.EncodeToString(state[:])}
+	key, err := scrypt.Key([]byte(password), saltBytes, 16384, 8, 1, len(c.dataKey)+len(c.nameKey)+len(c.nameTweak))
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not derive the crypt keys")
+	}
+	copy(c.dataKey[:], key)
+	copy(c.nameKey[:], key[len(c.dataKey):])
+	copy(c.nameTweak[:], key[len(c.dataKey)+len(c.nameKey):])
+	c.block, err = aes.NewCipher(c.nameKey[:])
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not create the crypt name cipher")
+	}
+	cryptKeys = c
+	return nil
+}
+
+// CryptChanged checks if the crypt configuration changed since the last
+// start, the state is kept in the given file. The cached objects hold the
+// decrypted names, they have to be fetched again after a change.
+func CryptChanged(path string) (bool, error) {
+	state := ""
+	if nil != cryptKeys {
+		state = cryptKeys.state
+	}
+
+	previous, err := ioutil.ReadFile(path)
+	if nil != err && !os.IsNotExist(err) {
+		Log.Debugf("%v", err)
+		return false, fmt.Errorf("Could not read crypt state %v", path)
+	}
+	if state == string(previous) {
+		return false, nil
+	}
+	if err := ioutil.WriteFile(path, []byte(state), 0600); nil != err {
+		Log.Debugf("%v", err)
+		return false, fmt.Errorf("Could not write crypt state %v", path)
+	}
+	return true, nil
+}
+
+// decryptObject decrypts the name of an object listed by the API. Objects
+// with names that don't decrypt are kept as they are, e.g. the folders
+// above the folder of the crypt remote.
+func decryptObject(object *APIObject) {
+	if nil == cryptKeys || "" != object.ExportURL {
+		return
+	}
+
+	if CryptNamesOff == cryptKeys.names {
+		if !object.IsDir && strings.HasSuffix(object.Name, cryptOffSuffix) {
+			object.Name = strings.TrimSuffix(object.Name, cryptOffSuffix)
+			object.Encrypted = true
+		}
+		return
+	}
+
+	name, err := cryptKeys.decryptName(object.Name)
+	if nil != err {
+		Log.Tracef("Keeping name of object %v: %v", object.ObjectID, err)
+		return
+	}
+	object.Name = name
+	object.Encrypted = true
+}
+
+// decryptName decrypts a name encrypted in the standard mode of rclone: the
+// padded name is encrypted with EME and encoded as lower case base32hex
+// without padding
+func (c *cryptCipher) decryptName(name string) (string, error) {
+	if "" == name || strings.HasSuffix(name, "=") {
+		return "", fmt.Errorf("Name %v is not base32hex encoded", name)
+	}
+	padded := (len(name) + 7) &^ 7
+	raw, err := base32.HexEncoding.DecodeString(strings.ToUpper(name) + "========"[:padded-len(name)])
+	if nil != err {
+		return "", err
+	}
+	if 0 == len(raw) || 0 != len(raw)%aes.BlockSize || len(raw) > 2048 {
+		return "", fmt.Errorf("Name %v has an invalid length", name)
+	}
+
+	plain := eme.Transform(c.block, c.nameTweak[:], raw, eme.DirectionDecrypt)
+	padding := int(plain[len(plain)-1])
+	if 0 == padding || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return "", fmt.Errorf("Name %v has an invalid padding", name)
+	}
+	return string(plain[:len(plain)-padding]), nil
+}
+
+// ContentSize returns the size of the content of the object, the decrypted
+// size for objects encrypted by rclone crypt
+func (o *APIObject) ContentSize() uint64 {
+	if !o.Encrypted {
+		return o.Size
+	}
+
+	size := int64(o.Size) - cryptHeaderSize
+	if size < 0 {
+		return 0
+	}
+	decrypted := size / cryptBlockSize * cryptBlockDataSize
+	if residue := size % cryptBlockSize; residue > secretbox.Overhead {
+		decrypted += residue - secretbox.Overhead
+	}
+	return uint64(decrypted)
+}
+
+// readDecrypted reads the decrypted bytes of an object encrypted by rclone
+// crypt into p. The blocks covering the range are read from the encrypted
+// object through the chunk cache and decrypted one by one.
+func (b *Buffer) readDecrypted(p []byte, start int64) (int, error) {
+	// an object cached as encrypted can't be read without the keys
+	if nil == cryptKeys {
+		return 0, &CryptError{ObjectID: b.object.ObjectID, Offset: start}
+	}
+	size := int64(b.object.ContentSize())
+	if start >= size || 0 == len(p) {
+		return 0, nil
+	}
+	end := start + int64(len(p))
+	if end > size {
+		end = size
+	}
+
+	nonce, err := b.cryptNonce()
+	if nil != err {
+		return 0, err
+	}
+
+	first := start / cryptBlockDataSize
+	last := (end - 1) / cryptBlockDataSize
+	rawStart := cryptHeaderSize + first*cryptBlockSize
+	rawEnd := cryptHeaderSize + (last+1)*cryptBlockSize
+	if rawEnd > int64(b.object.Size) {
+		rawEnd = int64(b.object.Size)
+	}
+	raw, err := b.readFull(rawStart, rawEnd-rawStart)
+	if nil != err {
+		return 0, err
+	}
+
+	n := 0
+	plain := make([]byte, 0, cryptBlockDataSize)
+	for block := first; block <= last; block++ {
+		boxStart := (block - first) * cryptBlockSize
+		boxEnd := boxStart + cryptBlockSize
+		if boxEnd > int64(len(raw)) {
+			boxEnd = int64(len(raw))
+		}
+		blockNonce := cryptBlockNonce(nonce, uint64(block))
+		var ok bool
+		plain, ok = secretbox.Open(plain[:0], raw[boxStart:boxEnd], &blockNonce, &cryptKeys.dataKey)
+		if !ok {
+			return 0, &CryptError{ObjectID: b.object.ObjectID, Offset: block * cryptBlockDataSize}
+		}
+
+		from := int64(0)
+		if block == first {
+			from = start - first*cryptBlockDataSize
+		}
+		if from < int64(len(plain)) {
+			n += copy(p[n:end-start], plain[from:])
+		}
+	}
+	return n, nil
+}
+
+// cryptNonce returns the nonce of the first block from the header of the
+// encrypted object, it is read once per buffer
+func (b *Buffer) cryptNonce() ([24]byte, error) {
+	b.lock.Lock()
+	nonce, read := b.nonce, b.nonceRead
+	b.lock.Unlock()
+	if read {
+		return nonce, nil
+	}
+
+	header, err := b.readFull(0, cryptHeaderSize)
+	if nil != err {
+		return nonce, err
+	}
+	if int64(len(header)) < cryptHeaderSize || cryptMagic != string(header[:len(cryptMagic)]) {
+		return nonce, &CryptError{ObjectID: b.object.ObjectID, Offset: 0}
+	}
+	copy(nonce[:], header[len(cryptMagic):])
+
+	b.lock.Lock()
+	b.nonce, b.nonceRead = nonce, true
+	b.lock.Unlock()
+	return nonce, nil
+}
+
+// readFull reads a range of the encrypted object, which may span several
+// chunks, and returns fewer bytes only at the end of the object
+func (b *Buffer) readFull(start, size int64) ([]byte, error) {
+	result := make([]byte, 0, size)
+	for int64(len(result)) < size {
+		data, err := b.ReadBytes(start+int64(len(result)), size-int64(len(result)), ReadForeground)
+		if nil != err {
+			return nil, err
+		}
+		if 0 == len(data) {
+			break
+		}
+		result = append(result, data...)
+	}
+	return result, nil
+}
+
+// cryptBlockNonce returns the nonce of a block, the nonce of the first
+// block plus the block number as little endian number
+func cryptBlockNonce(nonce [24]byte, block uint64) [24]byte {
+	carry := uint16(0)
+	for i := 0; i < 8; i++ {
+		carry += uint16(nonce[i]) + uint16(byte(block))
+		nonce[i] = byte(carry)
+		carry >>= 8
+		block >>= 8
+	}
+	for i := 8; i < len(nonce) && 0 != carry; i++ {
+		nonce[i]++
+		if 0 != nonce[i] {
+			carry = 0
+		}
+	}
+	return nonce
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"time"
+)
+
+// davWindowSize is the size of the windows the ranges of WebDAV responses
+// are read in
+const davWindowSize = 256 * 1024
+
+// davWindowTime is the time a read window serves the requests of ranges
+// overlapping it
+const davWindowTime = 5 * time.Second
+
+// davMaxWindows is the number of read windows kept in memory
+const davMaxWindows = 64
+
+// davWindows coalesces the reads of WebDAV responses. Browsers and HTML5
+// players send many small, overlapping Range requests in quick succession,
+// often at the same time. Their reads are aligned to windows, a window is
+// read from the buffer once and serves all requests overlapping it.
+// Requests of a window that is still being read wait for that read.
+var davWindows = struct {
+	lock    sync.Mutex
+	order   *list.List
+	windows map[davWindowKey]*list.Element
+}{
+	order:   list.New(),
+	windows: make(map[davWindowKey]*list.Element),
+}
+
+// davWindowKey identifies a window of a buffer, a new generation of an
+// object gets a new buffer and with it new windows
+type davWindowKey struct {
+	buffer *Buffer
+	offset int64
+}
+
+// davWindow is a window read from a buffer, its bytes and error are set
+// once ready is closed
+type davWindow struct {
+	key     davWindowKey
+	created time.Time
+	ready   chan struct{}
+	bytes   []byte
+	err     error
+}
+
+// readWindowed reads from the buffer at the given offset through the read
+// window covering it. It returns fewer bytes than requested at the end of
+// the window.
+func readWindowed(b *Buffer, p []byte, offset int64) (int, error) {
+	start := offset - offset%davWindowSize
+	window := davWindowAt(b, start)
+	<-window.ready
+	if nil != window.err {
+		return 0, window.err
+	}
+	if offset-start >= int64(len(window.bytes)) {
+		return 0, io.EOF
+	}
+	return copy(p, window.bytes[offset-start:]), nil
+}
+
+// davWindowAt returns the window of a buffer starting at the given offset,
+// it is read unless a recent or running read of it exists
+func davWindowAt(b *Buffer, start int64) *davWindow {
+	key := davWindowKey{buffer: b, offset: start}
+
+	davWindows.lock.Lock()
+	if element, exists := davWindows.windows[key]; exists {
+		window := element.Value.(*davWindow)
+		if time.Since(window.created) < davWindowTime {
+			davWindows.order.MoveToFront(element)
+			davWindows.lock.Unlock()
+			return window
+		}
+		removeDavWindow(element)
+	}
+	window := &davWindow{key: key, created: time.Now(), ready: make(chan struct{})}
+	davWindows.windows[key] = davWindows.order.PushFront(window)
+	for davWindows.order.Len() > davMaxWindows {
+		removeDavWindow(davWindows.order.Back())
+	}
+	davWindows.lock.Unlock()
+
+	window.bytes, window.err = readWindow(b, start)
+	close(window.ready)
+
+	// a failed read is tried again by the next request
+	if nil != window.err {
+		davWindows.lock.Lock()
+		if element, exists := davWindows.windows[key]; exists && element.Value.(*davWindow) == window {
+			removeDavWindow(element)
+		}
+		davWindows.lock.Unlock()
+	}
+	return window
+}
+
+// removeDavWindow drops a window, the lock must be held
+func removeDavWindow(element *list.Element) {
+	davWindows.order.Remove(element)
+	delete(davWindows.windows, element.Value.(*davWindow).key)
+}
+
+// readWindow reads a whole window from the buffer, it is shorter at the end
+// of the object
+func readWindow(b *Buffer, start int64) ([]byte, error) {
+	bytes := make([]byte, davWindowSize)
+	n := 0
+	for n < len(bytes) && uint64(start+int64(n)) < b.object.ContentSize() {
+		read, err := b.ReadInto(bytes[n:], start+int64(n))
+		n += read
+		if io.EOF == err || (nil == err && 0 == read) {
+			break
+		}
+		if nil != err {
+			return nil, err
+		}
+	}
+	return bytes[:n], nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOverlappingWindowedReads(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(2 * davWindowSize)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		// slow responses keep the reads of the window running while the
+		// other requests arrive
+		time.Sleep(20 * time.Millisecond)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	defer server.Close()
+	object := server.object("windows")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	// a browser sends overlapping Range requests of the first window at
+	// the same time
+	var failures int32
+	var readers sync.WaitGroup
+	for n := 0; n < 32; n++ {
+		readers.Add(1)
+		go func(offset int64) {
+			defer readers.Done()
+			p := make([]byte, 4096)
+			read, err := readWindowed(buffer, p, offset)
+			if nil != err || !bytes.Equal(content[offset:offset+int64(read)], p[:read]) || 0 == read {
+				atomic.AddInt32(&failures, 1)
+			}
+		}(int64(n) * 1000)
+	}
+	readers.Wait()
+
+	if 0 != failures {
+		t.Fatalf("%v overlapping reads failed or returned wrong bytes", failures)
+	}
+	if reads := atomic.LoadInt64(&buffer.reads); reads > davWindowSize/testChunkSize {
+		t.Fatalf("read the buffer %v times for overlapping ranges of one window", reads)
+	}
+	seen := make(map[string]bool)
+	for _, requested := range server.requestedRanges() {
+		if seen[requested] {
+			t.Fatalf("requested the range %v twice for overlapping reads", requested)
+		}
+		seen[requested] = true
+	}
+
+	// the end of the window is returned short, the next window goes on
+	p := make([]byte, 4096)
+	offset := int64(davWindowSize - 100)
+	if n, err := readWindowed(buffer, p, offset); nil != err || 100 != n || !bytes.Equal(content[offset:offset+100], p[:n]) {
+		t.Fatalf("read %v bytes (%v) at the end of the window instead of 100", n, err)
+	}
+	if n, err := readWindowed(buffer, p, davWindowSize); nil != err || !bytes.Equal(content[davWindowSize:davWindowSize+n], p[:n]) || 0 == n {
+		t.Fatalf("read %v bytes (%v) of the next window", n, err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var retryDeadline time.Duration
+
+// RetryDeadlineError is returned if the retries of a read did not succeed
+// within the retry deadline. The read may be retried.
+type RetryDeadlineError struct {
+	ObjectID string
+	Offset   int64
+	Deadline time.Duration
+}
+
+func (e *RetryDeadlineError) Error() string {
+	return fmt.Sprintf("Gave up retrying object %v offset %v after %v", e.ObjectID, e.Offset, e.Deadline)
+}
+
+// SetRetryDeadline bounds the time a read spends on the retries of its
+// download (0 = unlimited): the next endpoint, the rest of a short response,
+// the halves of a split range, the mirror and the request pacing. Once it is
+// over the read fails with EAGAIN instead of trying again. The first
+// request of a read is bounded by the read timeout.
+func SetRetryDeadline(deadline time.Duration) {
+	retryDeadline = deadline
+}
+
+// retryContext returns the context of the buffer, which ends at the retry
+// deadline of the read downloading the offset
+func (b *Buffer) retryContext(offset int64) (context.Context, context.CancelFunc) {
+	if fetch, exists := b.fetchOf(offset); exists && retryDeadline > 0 {
+		return context.WithDeadline(b.ctx, fetch.started.Add(retryDeadline))
+	}
+	return context.WithCancel(b.ctx)
+}
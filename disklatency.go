@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// diskLatencySamples is the number of chunk reads or writes measured before
+// the chunk directory can be found too slow
+const diskLatencySamples = 5
+
+// diskLatencyWeight is the weight of a new sample in the average latency
+const diskLatencyWeight = 0.2
+
+var diskLatency = struct {
+	lock       sync.Mutex
+	threshold  time.Duration
+	memoryOnly bool
+	read       time.Duration
+	reads      int
+	write      time.Duration
+	writes     int
+}{}
+
+// DiskLatencyStats holds the average latency of chunk reads and writes and
+// whether the chunk directory is bypassed
+type DiskLatencyStats struct {
+	Read       time.Duration `json:"read"`
+	Write      time.Duration `json:"write"`
+	Threshold  time.Duration `json:"threshold"`
+	MemoryOnly bool          `json:"memoryOnly"`
+}
+
+// SetDiskLatencyThreshold sets the average latency of chunk reads or writes
+// after which the chunk directory is bypassed for the rest of the session
+// (0 = disabled). On some network shares reading a cached chunk is slower
+// than downloading it again. Memory only bypasses the chunk directory right
+// away.
+func SetDiskLatencyThreshold(threshold time.Duration, memoryOnly bool) {
+	diskLatency.lock.Lock()
+	defer diskLatency.lock.Unlock()
+
+	diskLatency.threshold = threshold
+	diskLatency.memoryOnly = memoryOnly
+}
+
+// memoryOnly checks if the chunk directory is bypassed. Downloaded chunks
+// are then streamed without caching them, keeping the last chunk of every
+// buffer in memory.
+func memoryOnly() bool {
+	diskLatency.lock.Lock()
+	defer diskLatency.lock.Unlock()
+
+	return diskLatency.memoryOnly
+}
+
+// recordDiskRead adds the latency of a chunk read to the average
+func recordDiskRead(elapsed time.Duration) {
+	diskLatency.lock.Lock()
+	defer diskLatency.lock.Unlock()
+
+	diskLatency.read = averageLatency(diskLatency.read, diskLatency.reads, elapsed)
+	diskLatency.reads++
+	checkDiskLatency("reads", diskLatency.read, diskLatency.reads)
+}
+
+// recordDiskWrite adds the latency of a chunk write to the average
+func recordDiskWrite(elapsed time.Duration) {
+	diskLatency.lock.Lock()
+	defer diskLatency.lock.Unlock()
+
+	diskLatency.write = averageLatency(diskLatency.write, diskLatency.writes, elapsed)
+	diskLatency.writes++
+	checkDiskLatency("writes", diskLatency.write, diskLatency.writes)
+}
+
+// averageLatency returns the moving average of the latencies including a
+// new sample
+func averageLatency(average time.Duration, samples int, elapsed time.Duration) time.Duration {
+	if 0 == samples {
+		return elapsed
+	}
+	return time.Duration(float64(average)*(1-diskLatencyWeight) + float64(elapsed)*diskLatencyWeight)
+}
+
+// checkDiskLatency bypasses the chunk directory once the average latency
+// exceeds the threshold, the lock must be held
+func checkDiskLatency(kind string, average time.Duration, samples int) {
+	if diskLatency.memoryOnly || diskLatency.threshold <= 0 || samples < diskLatencySamples ||
+		average <= diskLatency.threshold {
+		return
+	}
+	diskLatency.memoryOnly = true
+	Log.Warningf("Chunk %v in %v take %v on average, streaming without the chunk directory for this session", kind, chunkPath, average)
+}
+
+// GetDiskLatencyStats returns the average latency of chunk reads and
+// writes
+func GetDiskLatencyStats() DiskLatencyStats {
+	diskLatency.lock.Lock()
+	defer diskLatency.lock.Unlock()
+
+	return DiskLatencyStats{
+		Read:       diskLatency.read,
+		Write:      diskLatency.write,
+		Threshold:  diskLatency.threshold,
+		MemoryOnly: diskLatency.memoryOnly,
+	}
+}
@@ -0,0 +1,915 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+const (
+	// PreloadBusyDrop drops preloads if all download slots are in use
+	PreloadBusyDrop = "drop"
+	// PreloadBusyWait lets preloads wait for a free download slot
+	PreloadBusyWait = "wait"
+)
+
+var readTimeout time.Duration
+var rangeHosts = newRangeSupport()
+var downloadSlots chan struct{}
+var maxObjectDownloads = 3
+var preloadWhenBusy = PreloadBusyDrop
+var downloadWaitTimeout time.Duration
+var urlRewriter URLRewriter
+var goneObjects = newObjectSet()
+var rangeAlignment int64
+var preloadWhenIdle bool
+var foregroundDownloads int64
+var shortBodyRetries = 2
+
+// SetRangeAlignment sets the boundary requested ranges are aligned to, e.g.
+// to improve the hit rate of a CDN in front of the API (0 = chunk size)
+func SetRangeAlignment(alignment int64) {
+	rangeAlignment = alignment
+}
+
+// alignRange widens a range to the range alignment, never beyond the end
+// of the object
+func (b *Buffer) alignRange(offset, offsetEnd int64) (int64, int64) {
+	if rangeAlignment <= 0 || rangeAlignment == b.chunkSize {
+		return offset, offsetEnd
+	}
+
+	start := offset - offset%rangeAlignment
+	end := (offsetEnd + rangeAlignment - 1) / rangeAlignment * rangeAlignment
+	return start, int64(math.Min(float64(end), float64(b.object.Size)))
+}
+
+// URLRewriter maps the download url of an object to the url that is
+// requested, e.g. to route chunk requests through a CDN
+type URLRewriter func(object *APIObject, url string) string
+
+// SetURLRewriter sets the hook that rewrites download urls (nil = none)
+func SetURLRewriter(rewriter URLRewriter) {
+	urlRewriter = rewriter
+}
+
+// RewriteToProxy rewrites download urls to the scheme and host of the proxy,
+// keeping path and query of the original url
+func RewriteToProxy(proxy string) (URLRewriter, error) {
+	proxyURL, err := url.Parse(proxy)
+	if nil != err || "" == proxyURL.Scheme || "" == proxyURL.Host {
+		return nil, fmt.Errorf("Invalid download proxy %v", proxy)
+	}
+	prefix := strings.TrimSuffix(proxyURL.Path, "/")
+
+	return func(object *APIObject, rawurl string) string {
+		u, err := url.Parse(rawurl)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return rawurl
+		}
+		u.Scheme = proxyURL.Scheme
+		u.Host = proxyURL.Host
+		u.Path = prefix + u.Path
+		return u.String()
+	}, nil
+}
+
+// SetMaxDownloads limits the number of chunks downloaded at once by all
+// buffers (0 = unlimited)
+func SetMaxDownloads(max int) {
+	if max <= 0 {
+		downloadSlots = nil
+		return
+	}
+	downloadSlots = make(chan struct{}, max)
+}
+
+// SetMaxObjectDownloads limits the number of chunks downloaded at once for
+// a single object (0 = unlimited)
+func SetMaxObjectDownloads(max int) {
+	maxObjectDownloads = max
+}
+
+// SetPreloadWhenBusy sets the behavior of preloads if all download slots
+// are in use
+func SetPreloadWhenBusy(behavior string) error {
+	if PreloadBusyDrop != behavior && PreloadBusyWait != behavior {
+		return fmt.Errorf("Invalid preload when busy behavior %v", behavior)
+	}
+	preloadWhenBusy = behavior
+	return nil
+}
+
+// SetPreloadWhenIdle only starts preload downloads while no foreground
+// read is downloading, so that preloads don't compete for bandwidth
+func SetPreloadWhenIdle(enabled bool) {
+	preloadWhenIdle = enabled
+}
+
+// connectionIdle checks if a preload may start a download
+func connectionIdle() bool {
+	return !preloadWhenIdle || 0 == atomic.LoadInt64(&foregroundDownloads)
+}
+
+// SetDownloadWaitTimeout sets the maximum time a read waits for a free
+// download slot (0 = no timeout)
+func SetDownloadWaitTimeout(timeout time.Duration) {
+	downloadWaitTimeout = timeout
+}
+
+// SetReadTimeout sets the maximum time a read may wait for the API
+func SetReadTimeout(timeout time.Duration) {
+	readTimeout = timeout
+}
+
+// SetShortBodyRetries sets how often the rest of a range is requested if a
+// response ended before the requested range was received
+func SetShortBodyRetries(retries int) {
+	shortBodyRetries = retries
+}
+
+// ReadTimeoutError is returned if a read took longer than the read timeout.
+// The read can be retried later on.
+type ReadTimeoutError struct {
+	ObjectID string
+	Offset   int64
+}
+
+func (e *ReadTimeoutError) Error() string {
+	return fmt.Sprintf("Timeout while reading object %v at offset %v", e.ObjectID, e.Offset)
+}
+
+// Timeout reports that the error is a timeout
+func (e *ReadTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary reports that the read can be retried
+func (e *ReadTimeoutError) Temporary() bool {
+	return true
+}
+
+// StatusError is returned if the API answered with an unexpected status code
+type StatusError struct {
+	ObjectID   string
+	StatusCode int
+	Reason     string
+	RequestID  string
+}
+
+func (e *StatusError) Error() string {
+	message := fmt.Sprintf("Wrong status code %v", e.StatusCode)
+	if "" != e.Reason {
+		message += fmt.Sprintf(" (%v)", e.Reason)
+	}
+	message += fmt.Sprintf(" for object %v", e.ObjectID)
+	if "" != e.RequestID {
+		message += fmt.Sprintf(" (request %v)", e.RequestID)
+	}
+	return message
+}
+
+// errorReason extracts the reason of a Google API error response body,
+// e.g. userRateLimitExceeded
+func errorReason(body io.Reader) string {
+	var response struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(body, 64*1024)).Decode(&response); nil != err {
+		return ""
+	}
+	if 0 == len(response.Error.Errors) {
+		return ""
+	}
+	return response.Error.Errors[0].Reason
+}
+
+// errPreloadDropped is returned if a preload was dropped, because all
+// download slots were in use
+var errPreloadDropped = fmt.Errorf("Dropped preload, all download slots are in use")
+
+// acquireDownload takes a download slot of the object and a global one.
+// Preloads are dropped or wait depending on the configured behavior, other
+// reads wait up to the download wait timeout. Free slots go to the waiting
+// reads of the highest priority first. A wait ends when the context is done.
+func (b *Buffer) acquireDownload(ctx context.Context, offset int64, priority ReadPriority) error {
+	var timeout <-chan time.Time
+	if ReadPrefetch != priority && downloadWaitTimeout > 0 {
+		timer := time.NewTimer(downloadWaitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	if err := b.acquireSlot(ctx, b.downloadSlots, offset, priority, timeout); nil != err {
+		return err
+	}
+	if err := b.acquireSlot(ctx, downloadSlots, offset, priority, timeout); nil != err {
+		releaseSlot(b.downloadSlots)
+		return err
+	}
+	return nil
+}
+
+// releaseDownload frees the download slots taken by acquireDownload
+func (b *Buffer) releaseDownload() {
+	releaseSlot(downloadSlots)
+	releaseSlot(b.downloadSlots)
+}
+
+// acquireSlot takes a slot of a download limit (nil = unlimited)
+func (b *Buffer) acquireSlot(ctx context.Context, slots chan struct{}, offset int64, priority ReadPriority, timeout <-chan time.Time) error {
+	if nil == slots {
+		return nil
+	}
+
+	if !outranked(slots, priority) {
+		select {
+		case slots <- struct{}{}:
+			return nil
+		default:
+		}
+	}
+
+	if ReadPrefetch == priority && PreloadBusyDrop == preloadWhenBusy {
+		return errPreloadDropped
+	}
+
+	Log.Debugf("Waiting for a download slot for object %v bytes %v (priority: %v)", b.object.ObjectID, offset, priority)
+	unqueue := queueRead(slots, priority)
+	defer unqueue()
+	for {
+		// a nil channel never takes a slot while higher priorities wait
+		var free chan struct{}
+		if !outranked(slots, priority) {
+			free = slots
+		}
+		select {
+		case free <- struct{}{}:
+			// a read of a higher priority may have queued meanwhile
+			if !outranked(slots, priority) {
+				return nil
+			}
+			<-slots
+		case <-time.After(slotYieldInterval):
+		case <-timeout:
+			return &ReadTimeoutError{ObjectID: b.object.ObjectID, Offset: offset}
+		case <-ctx.Done():
+			if nil != b.ctx.Err() {
+				return &BufferClosedError{ObjectID: b.object.ObjectID}
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// releaseSlot frees a slot taken by acquireSlot
+func releaseSlot(slots chan struct{}) {
+	if nil != slots {
+		<-slots
+	}
+}
+
+// rangeSupport remembers which download hosts ignore the Range header
+type rangeSupport struct {
+	lock    sync.Mutex
+	ignored map[string]bool
+}
+
+// newRangeSupport creates an empty range support state
+func newRangeSupport() *rangeSupport {
+	return &rangeSupport{
+		ignored: make(map[string]bool),
+	}
+}
+
+// supported checks if range requests may be sent to the host of the url.
+// Hosts are expected to support ranges until the first response proved
+// otherwise.
+func (r *rangeSupport) supported(rawurl string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return !r.ignored[hostOf(rawurl)]
+}
+
+// ignore marks the host of the url as ignoring the Range header
+func (r *rangeSupport) ignore(rawurl string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	host := hostOf(rawurl)
+	if !r.ignored[host] {
+		Log.Warningf("Download endpoint %v ignores range requests, falling back to full downloads", host)
+	}
+	r.ignored[host] = true
+}
+
+// hostOf returns the host of the url
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if nil != err {
+		return rawurl
+	}
+	return u.Host
+}
+
+// RequestState is a running chunk request
+type RequestState struct {
+	ID      string    `json:"id"`
+	Offset  int64     `json:"offset"`
+	Started time.Time `json:"started"`
+}
+
+// newRequestID generates a random id for a chunk request, it is logged and
+// sent as X-Request-Id header to correlate stutters with their downloads
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); nil != err {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// ObjectGoneError is returned for uncached ranges of an object that was
+// deleted on Google Drive
+type ObjectGoneError struct {
+	ObjectID string
+}
+
+func (e *ObjectGoneError) Error() string {
+	return fmt.Sprintf("Object %v was deleted on Google Drive", e.ObjectID)
+}
+
+// BufferClosedError is returned by reads of a buffer that was closed, e.g.
+// because the cache was reset
+type BufferClosedError struct {
+	ObjectID string
+}
+
+func (e *BufferClosedError) Error() string {
+	return fmt.Sprintf("Buffer of object %v was closed", e.ObjectID)
+}
+
+// ObjectChangedError is returned for uncached ranges of an object that
+// changed on Google Drive after the reader opened it
+type ObjectChangedError struct {
+	ObjectID string
+	Offset   int64
+}
+
+func (e *ObjectChangedError) Error() string {
+	return fmt.Sprintf("Object %v changed while reading offset %v, reopen it to read the new version", e.ObjectID, e.Offset)
+}
+
+// objectSet is a concurrency safe set of object ids
+type objectSet struct {
+	lock    sync.Mutex
+	objects map[string]bool
+}
+
+// newObjectSet creates an empty object set
+func newObjectSet() *objectSet {
+	return &objectSet{
+		objects: make(map[string]bool),
+	}
+}
+
+// add adds the object to the set
+func (s *objectSet) add(objectID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.objects[objectID] = true
+}
+
+// remove removes the object from the set
+func (s *objectSet) remove(objectID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.objects, objectID)
+}
+
+// has checks if the object is in the set
+func (s *objectSet) has(objectID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.objects[objectID]
+}
+
+// ContentRangeError is returned if a partial response doesn't contain the
+// requested range
+type ContentRangeError struct {
+	ObjectID     string
+	Offset       int64
+	ContentRange string
+}
+
+func (e *ContentRangeError) Error() string {
+	return fmt.Sprintf("Got content range '%v' for object %v at offset %v", e.ContentRange, e.ObjectID, e.Offset)
+}
+
+// ShortBodyError is returned if a partial response ended before the whole
+// content range was received
+type ShortBodyError struct {
+	ObjectID string
+	Offset   int64
+	Received int64
+	Expected int64
+}
+
+func (e *ShortBodyError) Error() string {
+	return fmt.Sprintf("Got %v of %v bytes for object %v at offset %v", e.Received, e.Expected, e.ObjectID, e.Offset)
+}
+
+var verifyContentLength = true
+
+// SetContentLengthCheck enables the check of the Content-Length of
+// responses against the requested range. A response advertising another
+// length is not cached but requested again. A body shorter than its
+// Content-Length was cut off, e.g. by a connection closed early, and only its
+// rest is requested again.
+func SetContentLengthCheck(enabled bool) {
+	verifyContentLength = enabled
+}
+
+// isLengthMismatch checks if a response advertises a Content-Length other
+// than the expected number of bytes
+func isLengthMismatch(res *http.Response, expected int64) bool {
+	return verifyContentLength && res.ContentLength >= 0 && res.ContentLength != expected
+}
+
+// isChunkedEncoding checks if a response has no Content-Length, because it
+// is sent with chunked transfer encoding
+func isChunkedEncoding(res *http.Response) bool {
+	for _, encoding := range res.TransferEncoding {
+		if "chunked" == encoding {
+			return res.ContentLength < 0
+		}
+	}
+	return false
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-end/total", an unknown total is returned as -1
+func parseContentRange(header string) (int64, int64, int64, error) {
+	invalid := fmt.Errorf("Invalid content range %v", header)
+
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, 0, invalid
+	}
+	parts := strings.Split(strings.TrimPrefix(header, "bytes "), "/")
+	if 2 != len(parts) {
+		return 0, 0, 0, invalid
+	}
+	bounds := strings.Split(parts[0], "-")
+	if 2 != len(bounds) {
+		return 0, 0, 0, invalid
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if nil != err {
+		return 0, 0, 0, invalid
+	}
+	end, err := strconv.ParseInt(bounds[1], 10, 64)
+	if nil != err || end < start {
+		return 0, 0, 0, invalid
+	}
+	total := int64(-1)
+	if "*" != parts[1] {
+		total, err = strconv.ParseInt(parts[1], 10, 64)
+		if nil != err {
+			return 0, 0, 0, invalid
+		}
+	}
+	return start, end, total, nil
+}
+
+// download requests the given byte range of the object from the API. The
+// download endpoints of the object are tried in order, falling back to the
+// next one if an endpoint refuses the request. The url rewriter is applied
+// to every endpoint. If all endpoints refuse the request with a 403 or 410
+// the download urls are refreshed and the range is requested once more.
+// Once the account hits a download limit the range is requested with the
+// next account.
+func (b *Buffer) download(generation, offset, offsetEnd int64) ([]byte, error) {
+	bytes, err := b.downloadSource(generation, offset, offsetEnd)
+	if b.refreshExpiredURLs(err) {
+		bytes, err = b.downloadSource(generation, offset, offsetEnd)
+	}
+	for b.rotateAccount(err) {
+		bytes, err = b.downloadSource(generation, offset, offsetEnd)
+	}
+	if nil == err {
+		accountSucceeded(b.httpClient())
+	}
+	if b.failOver(err) {
+		return b.downloadSource(generation, offset, offsetEnd)
+	}
+	return bytes, err
+}
+
+// downloadSource requests the given byte range from the object or its
+// mirror, if the buffer switched to it
+func (b *Buffer) downloadSource(generation, offset, offsetEnd int64) ([]byte, error) {
+	source := b.source()
+	requestID := newRequestID()
+	b.lock.Lock()
+	b.requests[requestID] = RequestState{
+		ID:      requestID,
+		Offset:  offset,
+		Started: time.Now(),
+	}
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		delete(b.requests, requestID)
+		b.lock.Unlock()
+	}()
+
+	urls, err := identifiedURLs(source, source.DownloadURLs())
+	if nil != err {
+		return nil, err
+	}
+	if nil != urlRewriter {
+		for i, url := range urls {
+			urls[i] = urlRewriter(source, url)
+		}
+	}
+	urls = healthyFirst(urls)
+	for i, url := range urls {
+		started := time.Now()
+		bytes, err := b.downloadFrom(url, requestID, generation, offset, offsetEnd)
+		if _, ok := err.(*ContentRangeError); ok {
+			Log.Debugf("%v", err)
+			Log.Debugf("Retrying request %v for object %v bytes %v - %v", requestID, b.object.ObjectID, offset, offsetEnd)
+			bytes, err = b.downloadFrom(url, requestID, generation, offset, offsetEnd)
+		}
+		if warning, ok := err.(*VirusScanWarningError); ok && "" != warning.Confirm {
+			Log.Debugf("%v", err)
+			Log.Debugf("Confirming virus scan warning for request %v of object %v", requestID, b.object.ObjectID)
+			bytes, err = b.downloadFrom(confirmURL(url, warning.Confirm), requestID, generation, offset, offsetEnd)
+		}
+		if isAbuseFlagged(err) && retryAbuseFlagged(b.object) {
+			Log.Debugf("%v", err)
+			Log.Debugf("Acknowledging abuse flag for request %v of object %v", requestID, b.object.ObjectID)
+			bytes, err = b.downloadFrom(acknowledgeURL(url), requestID, generation, offset, offsetEnd)
+		}
+		if _, ok := err.(*ShortBodyError); ok {
+			bytes, err = b.resumeDownload(url, requestID, generation, offset, offsetEnd, bytes, err)
+		}
+		recordHostResult(url, time.Since(started), err)
+		updateOffline(err)
+		if statusErr, ok := err.(*StatusError); ok && isRateLimited(statusErr) {
+			paceRateLimited()
+			rangeRateLimited(b.chunkSize)
+		} else if nil == err {
+			paceSucceeded()
+			rangeSucceeded(b.chunkSize)
+		}
+		if statusErr, ok := err.(*StatusError); ok && i < len(urls)-1 &&
+			(http.StatusForbidden == statusErr.StatusCode || http.StatusNotFound == statusErr.StatusCode) {
+			Log.Debugf("%v", err)
+			Log.Debugf("Falling back to next download endpoint for request %v of object %v", requestID, b.object.ObjectID)
+			continue
+		}
+		// the endpoint already ignored the request for the uncompressed
+		// range, the same request would be compressed again
+		if _, ok := err.(*ContentEncodingError); ok && i < len(urls)-1 {
+			Log.Debugf("%v", err)
+			Log.Debugf("Retrying request %v of object %v uncompressed on the next download endpoint", requestID, b.object.ObjectID)
+			continue
+		}
+		// another host may serve the range while one is degraded
+		if isTransientError(err) && i < len(urls)-1 && hostOf(urls[i+1]) != hostOf(url) {
+			Log.Debugf("%v", err)
+			Log.Debugf("Retrying request %v of object %v on the next download endpoint", requestID, b.object.ObjectID)
+			continue
+		}
+		if statusErr, ok := err.(*StatusError); ok && http.StatusNotFound == statusErr.StatusCode {
+			// the object was deleted, don't request it again
+			Log.Debugf("%v", err)
+			Log.Warningf("Object %v was deleted on Google Drive, serving cached chunks only", safeName(source.Name))
+			goneObjects.add(source.ObjectID)
+			return nil, &ObjectGoneError{ObjectID: b.object.ObjectID}
+		}
+		return bytes, err
+	}
+	return nil, fmt.Errorf("No download endpoint for object %v", b.object.ObjectID)
+}
+
+// downloadFrom requests the given byte range of the object from one endpoint.
+// If the endpoint ignores the Range header and answers with the full object,
+// the whole object is streamed into the cache instead.
+func (b *Buffer) downloadFrom(url, requestID string, generation, offset, offsetEnd int64) ([]byte, error) {
+	deadline, cancelDeadline := b.retryContext(offset)
+	defer cancelDeadline()
+	if err := pace(deadline); nil != err || nil != deadline.Err() {
+		if nil != b.ctx.Err() {
+			return nil, &BufferClosedError{ObjectID: b.object.ObjectID}
+		}
+		return nil, &RetryDeadlineError{ObjectID: b.object.ObjectID, Offset: offset, Deadline: retryDeadline}
+	}
+
+	Log.Debugf("Requesting object %v bytes %v - %v from API (request %v)", b.object.ObjectID, offset, offsetEnd, requestID)
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Add("X-Request-Id", requestID)
+	addScanConfirmation(b.object.ObjectID, req)
+	addDownloadHeaders(req)
+
+	// the timeout only applies to the requested range, a full download
+	// keeps on filling the cache after the range was served
+	ctx, cancelRequest := context.WithCancel(b.ctx)
+	untrack := trackDownload(cancelRequest)
+	cancel := func() {
+		untrack()
+		cancelRequest()
+	}
+	req = req.WithContext(ctx)
+	var timer *time.Timer
+	if readTimeout > 0 {
+		timer = time.AfterFunc(readTimeout, cancel)
+	}
+	timedOut := func() bool {
+		return nil != timer && !timer.Stop()
+	}
+
+	ranged := rangeHosts.supported(url)
+	if ranged {
+		req.Header.Add("Range", fmt.Sprintf("bytes=%v-%v", offset, offsetEnd-1))
+		requestIdentity(req)
+	}
+
+	Log.Tracef("Sending HTTP Request %v", req)
+
+	res, err := b.httpClient().Do(req)
+	if nil != err {
+		cancel()
+		if timedOut() {
+			return nil, &ReadTimeoutError{ObjectID: b.object.ObjectID, Offset: offset}
+		}
+		return nil, err
+	}
+	res.Body = b.bandwidthBody(b.softStartBody(res.Body), offset)
+
+	// large files may be answered with a virus scan warning page, which
+	// must never be cached as content
+	if (http.StatusOK == res.StatusCode || http.StatusPartialContent == res.StatusCode) && isInterstitial(res) {
+		defer cancel()
+		defer res.Body.Close()
+		return nil, readInterstitial(b.object.ObjectID, res)
+	}
+
+	// a server ignoring the range sends the whole object, which is cached
+	// chunk by chunk. A 200 that is not the whole object is never cached.
+	if http.StatusOK == res.StatusCode && !isFullBody(b.object, res) {
+		defer cancel()
+		defer res.Body.Close()
+		Log.Debugf("Got status 200 with content range '%v' and length %v for object %v (request %v)",
+			res.Header.Get("Content-Range"), res.ContentLength, b.object.ObjectID, requestID)
+		return nil, &ContentRangeError{ObjectID: b.object.ObjectID, Offset: offset, ContentRange: res.Header.Get("Content-Range")}
+	}
+	if http.StatusOK == res.StatusCode {
+		if ranged {
+			rangeHosts.ignore(url)
+		}
+		return b.downloadFull(res, requestID, cancel, timedOut, generation, offset, offsetEnd)
+	}
+	defer cancel()
+	defer res.Body.Close()
+
+	if http.StatusPartialContent != res.StatusCode {
+		Log.Tracef("Got HTTP Response %v", res)
+		return nil, &StatusError{ObjectID: b.object.ObjectID, StatusCode: res.StatusCode, Reason: errorReason(res.Body), RequestID: requestID}
+	}
+
+	// never cache a range that was not requested. Proxies re-encoding the
+	// response with chunked transfer encoding may drop the Content-Range,
+	// the length of such a response is only known from its body.
+	contentRange := res.Header.Get("Content-Range")
+	start, end, total, err := parseContentRange(contentRange)
+	unverified := "" == contentRange && isChunkedEncoding(res)
+	if unverified {
+		Log.Debugf("Got chunked response without content range for object %v (request %v)", b.object.ObjectID, requestID)
+		start, end, total, err = offset, offsetEnd-1, -1, nil
+	}
+	if nil != err || start != offset || end != offsetEnd-1 {
+		return nil, &ContentRangeError{ObjectID: b.object.ObjectID, Offset: offset, ContentRange: contentRange}
+	}
+	if err := checkTotalSize(b.source(), total); nil != err {
+		return nil, err
+	}
+
+	expected := end - start + 1
+	// the length and the offsets of a compressed body are those of the
+	// compressed bytes
+	if encoding := contentEncoding(res); "" != encoding {
+		bytes, decoded := decodeRange(res, expected)
+		if timedOut() {
+			return nil, &ReadTimeoutError{ObjectID: b.object.ObjectID, Offset: offset}
+		}
+		if !decoded {
+			return nil, &ContentEncodingError{ObjectID: b.object.ObjectID, Offset: offset, ContentEncoding: encoding}
+		}
+		Log.Debugf("Decoded %v encoded bytes %v - %v of object %v (request %v)", encoding, offset, offsetEnd, b.object.ObjectID, requestID)
+		return bytes, nil
+	}
+	if isLengthMismatch(res, expected) {
+		Log.Debugf("Got content length %v for %v requested bytes of object %v (request %v)", res.ContentLength, expected, b.object.ObjectID, requestID)
+		return nil, &ContentRangeError{ObjectID: b.object.ObjectID, Offset: offset, ContentRange: contentRange}
+	}
+
+	// a misbehaving server may send more than the content range, reading
+	// one byte more is enough to notice it. Other reads get the bytes of a
+	// verified range while they arrive.
+	var bytes []byte
+	if unverified {
+		bytes, err = ioutil.ReadAll(io.LimitReader(res.Body, expected+1))
+	} else {
+		bytes, err = b.receiveRange(res.Body, generation, offset, expected)
+	}
+	if timedOut() {
+		return nil, &ReadTimeoutError{ObjectID: b.object.ObjectID, Offset: offset}
+	}
+	if nil != err && int64(len(bytes)) >= expected {
+		Log.Debugf("%v", err)
+	} else if nil != err && 0 == len(bytes) {
+		return nil, err
+	}
+	if int64(len(bytes)) > expected && unverified {
+		return nil, &ContentRangeError{ObjectID: b.object.ObjectID, Offset: offset, ContentRange: contentRange}
+	}
+	if int64(len(bytes)) > expected {
+		Log.Warningf("Got more than the requested bytes %v - %v of object %v (request %v), dropping the rest", offset, offsetEnd, b.object.ObjectID, requestID)
+		bytes = bytes[:expected]
+	}
+	if int64(len(bytes)) != expected {
+		// the received bytes are returned, so that only the rest of the
+		// range has to be requested again
+		if nil != err {
+			Log.Debugf("%v", err)
+		}
+		return bytes, &ShortBodyError{ObjectID: b.object.ObjectID, Offset: offset, Received: int64(len(bytes)), Expected: expected}
+	}
+
+	return bytes, nil
+}
+
+// isFullBody checks if a response with status 200 holds the whole object:
+// it has no content range and, unless it is sent with chunked transfer
+// encoding, the length of the object
+func isFullBody(object *APIObject, res *http.Response) bool {
+	if "" != res.Header.Get("Content-Range") {
+		return false
+	}
+	return res.ContentLength < 0 || uint64(res.ContentLength) == object.Size
+}
+
+// resumeDownload requests the rest of a range after a response ended early,
+// a truncated range is never returned as a chunk
+func (b *Buffer) resumeDownload(url, requestID string, generation, offset, offsetEnd int64, received []byte, err error) ([]byte, error) {
+	for retry := 0; retry < shortBodyRetries; retry++ {
+		if _, ok := err.(*ShortBodyError); !ok {
+			break
+		}
+		resumeOffset := offset + int64(len(received))
+		Log.Debugf("%v", err)
+		Log.Debugf("Resuming request %v for object %v at offset %v", requestID, b.object.ObjectID, resumeOffset)
+
+		var rest []byte
+		rest, err = b.downloadFrom(url, requestID, generation, resumeOffset, offsetEnd)
+		received = append(received, rest...)
+	}
+	if nil != err {
+		if _, ok := err.(*ShortBodyError); ok {
+			err = &ShortBodyError{ObjectID: b.object.ObjectID, Offset: offset, Received: int64(len(received)), Expected: offsetEnd - offset}
+		}
+		return nil, err
+	}
+	return received, nil
+}
+
+// downloadFull reads a response containing the full object. The requested
+// range is returned as soon as it arrived, all chunks that are not within
+// the requested range are written to the cache while the response is read
+// in the background.
+// Reads of the buffer wait for the running full download instead of
+// starting another one. The rest of the response is read with a download
+// slot of its own, the slot of the read is freed once the range arrived.
+func (b *Buffer) downloadFull(res *http.Response, requestID string, cancel func(), timedOut func() bool, generation, offset, offsetEnd int64) ([]byte, error) {
+	Log.Debugf("Downloading full object %v (request %v)", b.object.ObjectID, requestID)
+
+	b.lock.Lock()
+	b.fullDownload = true
+	b.lock.Unlock()
+
+	result := make(chan []byte, 1)
+	go func() {
+		acquired := false
+		defer func() {
+			res.Body.Close()
+			cancel()
+			if acquired {
+				b.releaseDownload()
+			}
+
+			b.lock.Lock()
+			b.fullDownload = false
+			b.downloadDone.Broadcast()
+			b.lock.Unlock()
+
+			close(result)
+		}()
+
+		window := make([]byte, offsetEnd-offset)
+		for chunkOffset := int64(0); uint64(chunkOffset) < b.object.Size; chunkOffset += b.chunkSize {
+			size := int64(math.Min(float64(b.chunkSize), float64(int64(b.object.Size)-chunkOffset)))
+			chunkEnd := chunkOffset + size
+			bytes := make([]byte, size)
+			n, err := io.ReadFull(res.Body, bytes)
+			if nil != err {
+				if io.EOF != err && io.ErrUnexpectedEOF != err {
+					Log.Debugf("%v", err)
+				}
+				Log.Debugf("Full download of object %v stopped at offset %v", b.object.ObjectID, chunkOffset+int64(n))
+				return
+			}
+
+			// collect the requested range, chunks within it are stored by
+			// the reader
+			if chunkEnd > offset && chunkOffset < offsetEnd {
+				from := int64(math.Max(float64(chunkOffset), float64(offset)))
+				to := int64(math.Min(float64(chunkEnd), float64(offsetEnd)))
+				copy(window[from-offset:], bytes[from-chunkOffset:to-chunkOffset])
+			}
+			if chunkEnd >= offsetEnd && chunkOffset < offsetEnd {
+				result <- window
+				if uint64(chunkEnd) < b.object.Size {
+					if err := b.acquireDownload(b.ctx, chunkEnd, ReadBackground); nil != err {
+						Log.Debugf("%v", err)
+						Log.Debugf("Full download of object %v stopped at offset %v", b.object.ObjectID, chunkEnd)
+						return
+					}
+					acquired = true
+				}
+			}
+
+			if chunkOffset < offset || chunkEnd > offsetEnd {
+				accountDownload(size)
+				filename := filepath.Join(b.tempDir, chunkName(generation, b.chunkSize, chunkOffset))
+				if err := b.storeChunk(filename, generation, chunkOffset, bytes); nil != err {
+					Log.Debugf("%v", err)
+					return
+				}
+			}
+
+			b.lock.Lock()
+			b.downloadDone.Broadcast()
+			b.lock.Unlock()
+		}
+	}()
+
+	bytes, ok := <-result
+	if timedOut() {
+		return nil, &ReadTimeoutError{ObjectID: b.object.ObjectID, Offset: offset}
+	}
+	if !ok {
+		return nil, fmt.Errorf("Full download of object %v ended before offset %v", b.object.ObjectID, offset)
+	}
+	return bytes, nil
+}
+
+// waitFullDownload waits until a running full download of the object
+// passed the chunk at the given offset
+func (b *Buffer) waitFullDownload(generation, offset int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for b.fullDownload && !b.closed && !chunks.has(b.object.ObjectID, generation, offset) {
+		b.downloadDone.Wait()
+	}
+}
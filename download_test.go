@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// requestedRange parses the explicit byte range of a request
+func requestedRange(r *http.Request) (int, int, bool) {
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); nil != err {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// writeRange answers with the given bytes as the range start - end
+func writeRange(w http.ResponseWriter, content []byte, start, end int, body []byte) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, len(content)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(body)
+}
+
+func TestWrongContentRangeIsNotCached(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3 * testChunkSize)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := requestedRange(r)
+		if !ok {
+			http.Error(w, "ranges only", http.StatusBadRequest)
+			return
+		}
+		// the chunk after the requested one
+		start, end = (start+testChunkSize)%len(content), (end+testChunkSize)%len(content)
+		writeRange(w, content, start, end, content[start:end+1])
+	})
+	defer server.Close()
+	object := server.object("wrongrange")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	p := make([]byte, 1000)
+	if n, err := buffer.ReadInto(p, testChunkSize); nil == err && !bytes.Equal(content[testChunkSize:testChunkSize+n], p[:n]) {
+		t.Fatalf("read the bytes of a wrong content range")
+	}
+	if cached := chunks.cachedBytes("wrongrange", int64(len(content))); 0 != cached {
+		t.Fatalf("cached %v bytes of wrong content ranges", cached)
+	}
+}
+
+func TestWrongContentRangeIsRequestedAgain(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3 * testChunkSize)
+	wrong := int32(1)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := requestedRange(r)
+		if !ok {
+			http.Error(w, "ranges only", http.StatusBadRequest)
+			return
+		}
+		if atomic.CompareAndSwapInt32(&wrong, 1, 0) {
+			writeRange(w, content, start+1, end, content[start+1:end+1])
+			return
+		}
+		writeRange(w, content, start, end, content[start:end+1])
+	})
+	defer server.Close()
+	object := server.object("retriedrange")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content after a wrong content range", len(got))
+	}
+}
+
+func TestExtraBytesAreNotCached(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3*testChunkSize + 100)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := requestedRange(r)
+		if !ok {
+			http.Error(w, "ranges only", http.StatusBadRequest)
+			return
+		}
+		// the body goes on with the bytes after the range, it is sent with
+		// chunked encoding so that its length isn't declared
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.(http.Flusher).Flush()
+		w.Write(content[start : end+1])
+		w.Write(testContent(1000))
+	})
+	defer server.Close()
+	object := server.object("extra")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content", len(got))
+	}
+	if !eventually(func() bool { return int64(len(content)) == chunks.cachedBytes("extra", int64(len(content))) }) {
+		t.Fatalf("cached %v of %v bytes", chunks.cachedBytes("extra", int64(len(content))), len(content))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "extra"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		_, _, offset, _ := parseChunkName(file.Name())
+		if expected := int64(math.Min(testChunkSize, float64(int64(len(content))-offset))); expected != file.Size() {
+			t.Fatalf("cached %v bytes in chunk %v instead of %v", file.Size(), file.Name(), expected)
+		}
+	}
+}
+
+func TestVirusScanWarningIsConfirmed(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3 * testChunkSize)
+	warnings := int32(0)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		if "abc123" != r.URL.Query().Get("confirm") {
+			atomic.AddInt32(&warnings, 1)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, `<html><body>Google Drive can't scan this file for viruses.
+<a href="/uc?export=download&amp;confirm=abc123&amp;id=%v">Download anyway</a></body></html>`, r.URL.Path[1:])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	defer server.Close()
+	object := server.object("scanned")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content after the warning", len(got))
+	}
+	if 0 == atomic.LoadInt32(&warnings) {
+		t.Fatalf("the read was never warned")
+	}
+	if !eventually(func() bool { return int64(len(content)) == chunks.cachedBytes("scanned", int64(len(content))) }) {
+		t.Fatalf("cached %v of %v bytes", chunks.cachedBytes("scanned", int64(len(content))), len(content))
+	}
+}
+
+func TestEarlyCloseIsResumed(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3 * testChunkSize)
+	var lock sync.Mutex
+	truncated := make(map[int]bool)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := requestedRange(r)
+		if !ok {
+			http.Error(w, "ranges only", http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		truncate := 0 == start%testChunkSize && !truncated[start]
+		truncated[start] = true
+		lock.Unlock()
+
+		// the first response of a range closes after half of its bytes
+		body := content[start : end+1]
+		if truncate {
+			body = body[:len(body)/2]
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", end-start+1))
+		writeRange(w, content, start, end, body)
+	})
+	defer server.Close()
+	object := server.object("closed")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content after early closes", len(got))
+	}
+	resumed := 0
+	for _, requested := range server.requestedRanges() {
+		var start, end int
+		if _, err := fmt.Sscanf(requested, "bytes=%d-%d", &start, &end); nil == err && 0 != start%testChunkSize {
+			resumed++
+		}
+	}
+	if 0 == resumed {
+		t.Fatalf("early closed ranges were not resumed")
+	}
+	if !eventually(func() bool { return int64(len(content)) == chunks.cachedBytes("closed", int64(len(content))) }) {
+		t.Fatalf("cached %v of %v bytes", chunks.cachedBytes("closed", int64(len(content))), len(content))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "closed"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if testChunkSize != file.Size() {
+			t.Fatalf("cached the short chunk %v of %v bytes", file.Name(), file.Size())
+		}
+	}
+}
+
+func TestShortBodiesAreNotCached(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(2 * testChunkSize)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := requestedRange(r)
+		if !ok {
+			http.Error(w, "ranges only", http.StatusBadRequest)
+			return
+		}
+		// every response advertises the whole range but closes early
+		body := content[start : end+1]
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", end-start+1))
+		writeRange(w, content, start, end, body[:(len(body)+1)/2])
+	})
+	defer server.Close()
+	object := server.object("short")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	p := make([]byte, 10000)
+	if n, err := buffer.ReadInto(p, 0); nil == err && 0 != n {
+		t.Fatalf("read %v bytes of responses that are always cut off", n)
+	}
+	if 1 >= server.requestCount() {
+		t.Fatalf("cut off response was not requested again")
+	}
+	if cached := chunks.cachedBytes("short", int64(len(content))); 0 != cached {
+		t.Fatalf("cached %v bytes of cut off responses", cached)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "short"))
+	for _, file := range files {
+		t.Fatalf("cached the chunk %v of %v bytes from cut off responses", file.Name(), file.Size())
+	}
+}
+
+func TestChunkedResponses(t *testing.T) {
+	for _, withRange := range []bool{true, false} {
+		testChunkedResponses(t, withRange)
+	}
+}
+
+// testChunkedResponses reads an object whose ranges are sent with chunked
+// transfer encoding, with or without their content range
+func testChunkedResponses(t *testing.T, withRange bool) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3*testChunkSize + 300)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := requestedRange(r)
+		if !ok {
+			http.Error(w, "ranges only", http.StatusBadRequest)
+			return
+		}
+		if withRange {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, len(content)))
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		// flushing before the body leaves its length undeclared
+		w.(http.Flusher).Flush()
+		for offset := start; offset <= end; offset += 1000 {
+			w.Write(content[offset:int(math.Min(float64(offset+1000), float64(end+1)))])
+			w.(http.Flusher).Flush()
+		}
+	})
+	defer server.Close()
+	objectID := fmt.Sprintf("chunked%v", withRange)
+	object := server.object(objectID)
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the chunked content (content range %v)", len(got), withRange)
+	}
+	if !eventually(func() bool { return int64(len(content)) == chunks.cachedBytes(objectID, int64(len(content))) }) {
+		t.Fatalf("cached %v of %v chunked bytes (content range %v)", chunks.cachedBytes(objectID, int64(len(content))), len(content), withRange)
+	}
+}
+
+func TestFullBodyResponseIsCached(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(4*testChunkSize + 77)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		// the range is ignored
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+	})
+	defer server.Close()
+	object := server.object("fullbody")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	// a read in the middle gets its range out of the whole body
+	p := make([]byte, 5000)
+	start := 2*testChunkSize + 100
+	n, err := buffer.ReadInto(p, int64(start))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[start:start+n], p[:n]) || 0 == n {
+		t.Fatalf("read %v bytes that don't match the range of the full body", n)
+	}
+	if !eventually(func() bool { return int64(len(content)) == chunks.cachedBytes("fullbody", int64(len(content))) }) {
+		t.Fatalf("cached %v of %v bytes of the full body", chunks.cachedBytes("fullbody", int64(len(content))), len(content))
+	}
+	requests := server.requestCount()
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content", len(got))
+	}
+	if server.requestCount() != requests {
+		t.Fatalf("requested the cached full body %v more times", server.requestCount()-requests)
+	}
+}
+
+func TestPartialBodyWithStatusOKIsNotCached(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3 * testChunkSize)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		// a 200 of another length is not the whole object
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", testChunkSize))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content[:testChunkSize])
+	})
+	defer server.Close()
+	object := server.object("partialok")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if _, err := buffer.ReadInto(make([]byte, 1000), 0); nil == err {
+		t.Fatalf("served a 200 that is not the whole object")
+	}
+	if cached := chunks.cachedBytes("partialok", int64(len(content))); 0 != cached {
+		t.Fatalf("cached %v bytes of a 200 that is not the whole object", cached)
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 
 	gdrive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
 
 	"time"
 
@@ -15,6 +17,15 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// fileFields is the minimal set of file fields requested from the API, just
+// what mapFileToObject reads: the id, name, type, modification time, size,
+// download urls, md5 checksum, parents, trash state and export links. Any
+// field an object refresh needs has to be added here.
+const fileFields = "id,title,mimeType,modifiedDate,fileSize,downloadUrl,webContentLink,md5Checksum,parents(id),explicitlyTrashed,exportLinks"
+
+// changeFields is the minimal set of fields requested for a page of changes
+const changeFields = "items(deleted,fileId,file(" + fileFields + ")),largestChangeId,nextPageToken"
+
 // BlackListObjects is a list of blacklisted items that will not be
 // fetched from cache or the API
 var BlackListObjects map[string]bool
@@ -91,7 +102,7 @@ func (d *Drive) startWatchChanges(refreshInterval time.Duration) {
 		pageToken := ""
 		largestChangeID := changeID
 		for {
-			query := client.Changes.List().MaxResults(1000).IncludeDeleted(true)
+			query := client.Changes.List().MaxResults(1000).IncludeDeleted(true).Fields(changeFields)
 
 			if "" != pageToken {
 				query = query.PageToken(pageToken)
@@ -204,9 +215,16 @@ func (d *Drive) getClient() (*gdrive.Service, error) {
 	return gdrive.New(d.config.Client(d.context, d.token))
 }
 
-// getNativeClient gets a native http client
+// getNativeClient gets a native http client, all native clients share the
+// cookies and the transport of the download requests
 func (d *Drive) getNativeClient() *http.Client {
-	return oauth2.NewClient(d.context, d.config.TokenSource(d.context, d.token))
+	ctx := d.context
+	if nil != downloadTransport {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: downloadTransport})
+	}
+	client := oauth2.NewClient(ctx, d.config.TokenSource(ctx, d.token))
+	client.Jar = downloadCookies
+	return client
 }
 
 // GetRoot gets the root node directly from the API
@@ -220,7 +238,7 @@ func (d *Drive) GetRoot() (*APIObject, error) {
 		return nil, fmt.Errorf("Could not get Google Drive client")
 	}
 
-	file, err := client.Files.Get(id).Do()
+	file, err := client.Files.Get(id).Fields(fileFields).Do()
 	if nil != err {
 		Log.Debugf("%v", err)
 		return nil, fmt.Errorf("Could not get object %v from API", id)
@@ -252,15 +270,28 @@ func (d *Drive) GetObjectsByParent(parent string) ([]*APIObject, error) {
 // GetObjectByParentAndName finds a child element by name and its parent id
 func (d *Drive) GetObjectByParentAndName(parent, name string) (*APIObject, error) {
 	if _, exists := BlackListObjects[name]; exists {
-		return nil, fmt.Errorf("Object %v is blacklisted and will not be returned", name)
+		return nil, fmt.Errorf("Object %v is blacklisted and will not be returned", safeName(name))
 	}
 
 	return d.cache.GetObjectByParentAndName(parent, name)
 }
 
+// CachedBytes returns how many bytes of an object are in the chunk cache,
+// e.g. to show if it can be played offline. Only the chunk index is read.
+func (d *Drive) CachedBytes(object *APIObject) (int64, bool) {
+	if object.IsDir {
+		return 0, false
+	}
+	chunks.load(object.ObjectID)
+	size := int64(object.Size)
+	complete := chunks.complete(object.ObjectID, chunks.generation(object.ObjectID), size)
+	return chunks.cachedBytes(object.ObjectID, size), complete
+}
+
 // Open a file
 func (d *Drive) Open(object *APIObject) (*Buffer, error) {
-	nativeClient := d.getNativeClient()
+	d.tagObject(object)
+	nativeClient := downloadClient(d.getNativeClient())
 	return GetBufferInstance(nativeClient, object)
 }
 
@@ -274,17 +305,58 @@ func (d *Drive) Remove(object *APIObject) error {
 
 	if err := client.Files.Delete(object.ObjectID).Do(); nil != err {
 		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not delete object %v from API", object.Name)
+		return fmt.Errorf("Could not delete object %v from API", safeName(object.Name))
 	}
 
 	if err := d.cache.DeleteObject(object.ObjectID); nil != err {
 		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not delete object %v from cache", object.Name)
+		return fmt.Errorf("Could not delete object %v from cache", safeName(object.Name))
 	}
 
 	return nil
 }
 
+// Upload uploads the content of an object to Google Drive. Objects without
+// an id are created in their parents.
+func (d *Drive) Upload(object *APIObject, content io.Reader) (*APIObject, error) {
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	file := &gdrive.File{
+		Title: object.Name,
+	}
+
+	var uploaded *gdrive.File
+	if "" == object.ObjectID {
+		for _, parent := range strings.Split(strings.Trim(object.Parents, "|"), "|") {
+			file.Parents = append(file.Parents, &gdrive.ParentReference{Id: parent})
+		}
+		uploaded, err = client.Files.Insert(file).Media(content, googleapi.ChunkSize(int(currentChunkSize()))).Do()
+	} else {
+		uploaded, err = client.Files.Update(object.ObjectID, file).Media(content, googleapi.ChunkSize(int(currentChunkSize()))).Do()
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not upload object %v", safeName(object.Name))
+	}
+
+	result, err := d.mapFileToObject(uploaded)
+	if nil != err {
+		return nil, err
+	}
+
+	if err := d.cache.UpdateObject(result); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not update object %v in cache", safeName(object.Name))
+	}
+	InvalidateObject(result.ObjectID)
+
+	return result, nil
+}
+
 // mapFileToObject maps a Google Drive file to APIObject
 func (d *Drive) mapFileToObject(file *gdrive.File) (*APIObject, error) {
 	lastModified, err := time.Parse(time.RFC3339, file.ModifiedDate)
@@ -298,13 +370,24 @@ func (d *Drive) mapFileToObject(file *gdrive.File) (*APIObject, error) {
 		parents = append(parents, parent.Id)
 	}
 
-	return &APIObject{
+	object := &APIObject{
 		ObjectID:     file.Id,
 		Name:         file.Title,
 		IsDir:        file.MimeType == "application/vnd.google-apps.folder",
 		LastModified: lastModified,
 		Size:         uint64(file.FileSize),
 		DownloadURL:  file.DownloadUrl,
+		ContentLink:  file.WebContentLink,
+		MD5Checksum:  file.Md5Checksum,
 		Parents:      fmt.Sprintf("|%v|", strings.Join(parents, "|")),
-	}, nil
+	}
+	// native objects are served as an export, their size is known once
+	// they were exported
+	if link, format, exported := exportLink(file); exported {
+		object.Name = fmt.Sprintf("%v.%v", file.Title, format)
+		object.ExportURL = link
+		object.Size, _ = exportedSize(object)
+	}
+	decryptObject(object)
+	return object, nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// BufferState is a snapshot of an active buffer
+type BufferState struct {
+	ObjectID       string         `json:"objectId"`
+	Name           string         `json:"name"`
+	Instances      int            `json:"instances"`
+	Offset         int64          `json:"offset"`
+	Preload        bool           `json:"preload"`
+	Serial         bool           `json:"serial"`
+	FullDownload   bool           `json:"fullDownload"`
+	CachedFraction float64        `json:"cachedFraction"`
+	Memory         int64          `json:"memory"`
+	Requested      int64          `json:"requested"`
+	Cached         int64          `json:"cached"`
+	Amplification  float64        `json:"amplification"`
+	ReadRate       float64        `json:"readRate"`
+	Downloads      []int64        `json:"downloads"`
+	Requests       []RequestState `json:"requests"`
+	LastError      *ObjectError   `json:"lastError,omitempty"`
+}
+
+// BufferStates returns a snapshot of all active buffers
+func BufferStates() []BufferState {
+	states := []BufferState{}
+	for item := range instances.IterBuffered() {
+		b, ok := item.Val.(*Buffer)
+		if !ok {
+			continue
+		}
+		states = append(states, b.state())
+	}
+	return states
+}
+
+// BufferSnapshot is a read-only snapshot of an active buffer for admin
+// tooling
+type BufferSnapshot struct {
+	ObjectID       string
+	Name           string
+	Instances      int
+	Offset         int64
+	CachedFraction float64
+}
+
+// ForEachBuffer calls fn with a snapshot of every active buffer. The
+// snapshots are taken before fn is called and no lock is held while fn
+// runs, so fn may read, close or reopen buffers. Buffers opened or closed
+// meanwhile may be missing or still be included.
+func ForEachBuffer(fn func(snapshot BufferSnapshot)) {
+	snapshots := []BufferSnapshot{}
+	for item := range instances.IterBuffered() {
+		b, ok := item.Val.(*Buffer)
+		if !ok {
+			continue
+		}
+		snapshots = append(snapshots, b.snapshot())
+	}
+	for _, snapshot := range snapshots {
+		fn(snapshot)
+	}
+}
+
+// snapshot returns the read-only snapshot of the buffer
+func (b *Buffer) snapshot() BufferSnapshot {
+	b.lock.Lock()
+	snapshot := BufferSnapshot{
+		ObjectID:  b.object.ObjectID,
+		Name:      b.object.Name,
+		Instances: b.numberOfInstances,
+		Offset:    b.lastOffset,
+	}
+	b.lock.Unlock()
+
+	// the lookup in the chunk index doesn't hold the lock of the buffer,
+	// so that a snapshot never waits for both locks
+	snapshot.CachedFraction = b.CachedFraction()
+	return snapshot
+}
+
+// DumpBufferStates writes a snapshot of all active buffers as JSON to
+// stderr, regardless of the log level
+func DumpBufferStates() {
+	data, err := json.MarshalIndent(struct {
+		Buffers      []BufferState             `json:"buffers"`
+		BufferMemory BufferMemoryStats         `json:"bufferMemory"`
+		Cache        CacheStats                `json:"cache"`
+		ChunkFiles   ChunkFileStats            `json:"chunkFiles"`
+		Quota        QuotaStats                `json:"quota"`
+		Totals       TotalStats                `json:"totals"`
+		HitRatio     HitRatioStats             `json:"hitRatio"`
+		Hosts        []HostHealth              `json:"hosts"`
+		Preloads     PreloadStats              `json:"preloads"`
+		Partitions   map[string]PartitionStats `json:"partitions"`
+		Stalls       []StallStats              `json:"stalls"`
+		DiskLatency  DiskLatencyStats          `json:"diskLatency"`
+		Staging      StagingStats              `json:"staging"`
+		HotChunks    HotChunkStats             `json:"hotChunks"`
+		Accounts     []AccountStats            `json:"accounts"`
+		Creation     BufferCreationStats       `json:"bufferCreation"`
+		Paused       bool                      `json:"paused"`
+	}{
+		Buffers:      BufferStates(),
+		BufferMemory: GetBufferMemoryStats(),
+		Cache:        GetCacheStats(),
+		ChunkFiles:   GetChunkFileStats(),
+		Quota:        GetQuotaStats(),
+		Totals:       GetTotalStats(),
+		HitRatio:     GetHitRatioStats(),
+		Hosts:        GetHostHealth(),
+		Preloads:     GetPreloadStats(),
+		Partitions:   GetPartitionStats(),
+		Stalls:       GetStallReport(),
+		DiskLatency:  GetDiskLatencyStats(),
+		Staging:      GetStagingStats(),
+		HotChunks:    GetHotChunkStats(),
+		Accounts:     GetAccountStats(),
+		Creation:     GetBufferCreationStats(),
+		Paused:       DownloadsPaused(),
+	}, "", "  ")
+	if nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not encode buffer states")
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(data))
+}
+
+// state returns a snapshot of the buffer
+func (b *Buffer) state() BufferState {
+	b.lock.Lock()
+	state := BufferState{
+		ObjectID:     b.object.ObjectID,
+		Name:         b.object.Name,
+		Instances:    b.numberOfInstances,
+		Offset:       b.lastOffset,
+		Preload:      b.preload,
+		FullDownload: b.fullDownload,
+		Memory:       int64(len(b.slab)),
+		ReadRate:     b.readRate,
+		Downloads:    []int64{},
+		Requests:     []RequestState{},
+	}
+	for offset := range b.downloads {
+		state.Downloads = append(state.Downloads, offset)
+	}
+	for _, request := range b.requests {
+		state.Requests = append(state.Requests, request)
+	}
+	b.lock.Unlock()
+
+	sort.Sort(int64Slice(state.Downloads))
+	state.Serial = isSerial(b.object)
+	state.CachedFraction = b.CachedFraction()
+	state.LastError = LastError(b.object.ObjectID)
+	state.Requested = atomic.LoadInt64(&b.requestedBytes)
+	state.Cached = atomic.LoadInt64(&b.cachedBytes)
+	if state.Requested > 0 {
+		state.Amplification = float64(state.Cached) / float64(state.Requested)
+	}
+	return state
+}
+
+// int64Slice sorts offsets in increasing order
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
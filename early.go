@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var earlyFirstRead bool
+
+// SetEarlyFirstRead lets the first read of a buffer return as soon as the
+// requested bytes of its chunk arrived, instead of waiting for the whole
+// chunk. The rest of the chunk is downloaded and cached in the background,
+// so that opening a file for playback starts sooner.
+func SetEarlyFirstRead(enabled bool) {
+	earlyFirstRead = enabled
+}
+
+// downloadEarly streams the chunk at the given offset and returns its first
+// bytes up to need. It returns false if the read has to download the chunk
+// as usual, e.g. because it is not the first read or the endpoint did not
+// answer with the requested range. On success the background download owns
+// the download slots and the running download of the chunk and releases
+// them once the chunk is cached.
+func (b *Buffer) downloadEarly(generation, offset, offsetEnd, need int64) ([]byte, bool) {
+	b.lock.Lock()
+	first := !b.earlyRead
+	b.earlyRead = true
+	b.lock.Unlock()
+
+	if !first || !earlyFirstRead || chunkReadOnly || rangeAlignment > 0 || need >= offsetEnd-offset {
+		return nil, false
+	}
+	source := b.source()
+	urls, err := identifiedURLs(source, source.DownloadURLs())
+	if nil != err {
+		return nil, false
+	}
+	url := urls[0]
+	if nil != urlRewriter {
+		url = urlRewriter(source, url)
+	}
+	if !rangeHosts.supported(url) {
+		return nil, false
+	}
+	if err := pace(b.ctx); nil != err {
+		return nil, false
+	}
+
+	requestID := newRequestID()
+	Log.Debugf("Streaming object %v bytes %v - %v from API (request %v)", b.object.ObjectID, offset, offsetEnd, requestID)
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		return nil, false
+	}
+	req.Header.Add("X-Request-Id", requestID)
+	req.Header.Add("Range", fmt.Sprintf("bytes=%v-%v", offset, offsetEnd-1))
+	addScanConfirmation(b.object.ObjectID, req)
+	addDownloadHeaders(req)
+	requestIdentity(req)
+
+	ctx, cancelRequest := context.WithCancel(b.ctx)
+	untrack := trackDownload(cancelRequest)
+	cancel := func() {
+		untrack()
+		cancelRequest()
+	}
+	var timer *time.Timer
+	if readTimeout > 0 {
+		timer = time.AfterFunc(readTimeout, cancel)
+	}
+
+	started := time.Now()
+	res, err := b.httpClient().Do(req.WithContext(ctx))
+	if nil != err {
+		Log.Debugf("%v", err)
+		cancel()
+		return nil, false
+	}
+	res.Body = b.bandwidthBody(b.softStartBody(res.Body), offset)
+	contentRange := res.Header.Get("Content-Range")
+	start, end, total, err := parseContentRange(contentRange)
+	if http.StatusPartialContent != res.StatusCode || isInterstitial(res) || "" != contentEncoding(res) ||
+		nil != err || start != offset || end != offsetEnd-1 || isLengthMismatch(res, offsetEnd-offset) ||
+		nil != checkTotalSize(b.source(), total) {
+		res.Body.Close()
+		cancel()
+		return nil, false
+	}
+
+	bytes := make([]byte, offsetEnd-offset)
+	if _, err := io.ReadFull(res.Body, bytes[:need]); nil != err {
+		Log.Debugf("%v", err)
+		res.Body.Close()
+		cancel()
+		return nil, false
+	}
+	// the rest of the chunk must keep arriving, a stalled body would hold
+	// the download slots and the readers waiting for the chunk forever
+	if nil != timer {
+		timer.Reset(readTimeout)
+		res.Body = &idleBody{ReadCloser: res.Body, timer: timer, timeout: readTimeout}
+	}
+	recordHostResult(url, time.Since(started), nil)
+	paceSucceeded()
+
+	go func() {
+		defer func() {
+			if nil != timer {
+				timer.Stop()
+			}
+			res.Body.Close()
+			cancel()
+			b.releaseDownload()
+
+			b.lock.Lock()
+			if b.downloads[offset]--; 0 == b.downloads[offset] {
+				delete(b.downloads, offset)
+			}
+			b.downloadDone.Broadcast()
+			b.lock.Unlock()
+		}()
+
+		n, err := b.receiveInto(res.Body, generation, offset, bytes, need)
+		accountDownload(need + n)
+		if nil != err {
+			Log.Debugf("%v", err)
+			Log.Debugf("Streaming object %v bytes %v - %v ended early (request %v)", b.object.ObjectID, offset, offsetEnd, requestID)
+			return
+		}
+
+		filename := filepath.Join(b.tempDir, chunkName(generation, b.chunkSize, offset))
+		if err := b.storeChunk(filename, generation, offset, bytes); nil != err {
+			Log.Warningf("%v", err)
+		}
+	}()
+	return bytes[:need], true
+}
+
+// idleBody is a response body that is cancelled by its timer once no bytes
+// arrived for the timeout
+type idleBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// Read reads from the body and rearms the timer on progress
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// RangeEncodingReject requests a compressed partial response again
+	RangeEncodingReject = "reject"
+	// RangeEncodingDecode decodes a gzip compressed partial response and
+	// keeps it if it holds exactly the requested range
+	RangeEncodingDecode = "decode"
+)
+
+var rangeEncoding = RangeEncodingReject
+
+// ContentEncodingError is returned if a partial response is compressed, so
+// that its body doesn't hold the bytes of its content range
+type ContentEncodingError struct {
+	ObjectID        string
+	Offset          int64
+	ContentEncoding string
+}
+
+func (e *ContentEncodingError) Error() string {
+	return fmt.Sprintf("Got content encoding '%v' for object %v at offset %v", e.ContentEncoding, e.ObjectID, e.Offset)
+}
+
+// SetRangeEncoding sets the behavior if a partial response is compressed
+// although the identity encoding was requested, e.g. by a proxy
+func SetRangeEncoding(behavior string) error {
+	if RangeEncodingReject != behavior && RangeEncodingDecode != behavior {
+		return fmt.Errorf("Invalid range encoding behavior %v", behavior)
+	}
+	rangeEncoding = behavior
+	return nil
+}
+
+// requestIdentity asks for the uncompressed bytes of a range, the offsets
+// of a compressed body don't match the content range. no-transform keeps
+// proxies from compressing the response on their own.
+func requestIdentity(req *http.Request) {
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Cache-Control", "no-transform")
+}
+
+// contentEncoding returns the content encoding of a response ("" = none)
+func contentEncoding(res *http.Response) string {
+	encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if "identity" == encoding {
+		return ""
+	}
+	return encoding
+}
+
+// decodeRange decodes a gzip compressed partial response, if configured.
+// The bytes are only returned if they are exactly the expected length.
+func decodeRange(res *http.Response, expected int64) ([]byte, bool) {
+	if RangeEncodingDecode != rangeEncoding || "gzip" != contentEncoding(res) {
+		return nil, false
+	}
+
+	reader, err := gzip.NewReader(res.Body)
+	if nil != err {
+		return nil, false
+	}
+	defer reader.Close()
+	bytes, err := ioutil.ReadAll(io.LimitReader(reader, expected+1))
+	if nil != err || int64(len(bytes)) != expected {
+		return nil, false
+	}
+	return bytes, true
+}
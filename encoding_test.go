@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// serveGzipRange answers range requests with the gzip compressed bytes of
+// the range like a proxy compressing partial responses, whatever encoding
+// was requested. It counts the requests that didn't ask for the identity
+// encoding.
+func serveGzipRange(content []byte, compressible *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := requestedRange(r)
+		if !ok {
+			http.Error(w, "ranges only", http.StatusBadRequest)
+			return
+		}
+		if "identity" != r.Header.Get("Accept-Encoding") {
+			atomic.AddInt32(compressible, 1)
+		}
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(content[start : end+1])
+		writer.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		writeRange(w, content, start, end, compressed.Bytes())
+	}
+}
+
+// checkCachedChunks checks that the chunk files of an object hold the
+// bytes of the content at their offsets
+func checkCachedChunks(t *testing.T, dir, objectID string, content []byte) {
+	if !eventually(func() bool { return int64(len(content)) == chunks.cachedBytes(objectID, int64(len(content))) }) {
+		t.Fatalf("cached %v of %v bytes", chunks.cachedBytes(objectID, int64(len(content))), len(content))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, objectID))
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		_, _, offset, _ := parseChunkName(file.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, objectID, file.Name()))
+		if nil != err {
+			t.Fatal(err)
+		}
+		end := int64(math.Min(float64(offset+testChunkSize), float64(len(content))))
+		if !bytes.Equal(content[offset:end], data) {
+			t.Fatalf("cached %v wrong bytes in chunk %v", len(data), file.Name())
+		}
+	}
+}
+
+func TestCompressedRangeIsDecoded(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	if err := SetRangeEncoding(RangeEncodingDecode); nil != err {
+		t.Fatal(err)
+	}
+	defer SetRangeEncoding(RangeEncodingReject)
+	content := testContent(3*testChunkSize + 100)
+	var compressible int32
+	server := newTestServer(0, serveGzipRange(content, &compressible))
+	defer server.Close()
+	object := server.object("gzipped")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content of compressed ranges", len(got))
+	}
+	if 0 != compressible {
+		t.Fatalf("%v range requests allowed a compressed response", compressible)
+	}
+	checkCachedChunks(t, dir, "gzipped", content)
+}
+
+func TestCompressedRangeIsRequestedUncompressed(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3*testChunkSize + 100)
+	var compressible int32
+	proxy := newTestServer(0, serveGzipRange(content, &compressible))
+	defer proxy.Close()
+	origin := newTestServer(0, nil)
+	defer origin.Close()
+	origin.content = content
+	object := proxy.object("compressed")
+	object.Size = uint64(len(content))
+	object.ContentLink = origin.URL + "/compressed"
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	// the compressed ranges of the proxy are rejected, the endpoint after
+	// it serves them uncompressed
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content behind a compressing proxy", len(got))
+	}
+	if 0 == proxy.requestCount() || 0 == origin.requestCount() {
+		t.Fatalf("requested %v ranges of the proxy and %v of the next endpoint", proxy.requestCount(), origin.requestCount())
+	}
+	if 0 != compressible {
+		t.Fatalf("%v range requests allowed a compressed response", compressible)
+	}
+	checkCachedChunks(t, dir, "compressed", content)
+}
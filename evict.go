@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// evictionBacklog is the number of chunks the chunk directory may exceed
+// its maximum size by, before reads wait for the eviction
+const evictionBacklog = 2
+
+// sharedMeasureInterval is the time after which the size of a chunk
+// directory shared with other instances is measured again, the chunks the
+// other instances write are not tracked
+const sharedMeasureInterval = 10 * time.Second
+
+// evictor deletes the oldest chunks in the background, so that reads don't
+// wait for deletions on slow filesystems. The size is the first field to be
+// 64 bit aligned for atomic access on 32 bit platforms.
+var evictor = struct {
+	size        int64
+	indexed     int32
+	once        sync.Once
+	lock        sync.Mutex
+	signal      chan int64
+	measureLock sync.Mutex
+	measured    time.Time
+}{
+	signal: make(chan int64, 1),
+}
+
+// reserveChunkSpace makes sure the next chunk of the given size fits into
+// the chunk directory.
+// It only signals the background evictor, unless the evictor fell behind
+// and the chunk directory exceeds its maximum size by the eviction backlog.
+func reserveChunkSpace(chunk int64) error {
+	evictor.once.Do(func() {
+		// the first eviction measures the size of the chunk directory
+		if err := evictChunks(chunk); nil != err {
+			Log.Warningf("%v", err)
+		}
+		go evictLoop()
+	})
+	measureSharedChunkDir()
+
+	size := atomic.LoadInt64(&evictor.size)
+	maxSize := currentChunkDirMaxSize()
+	if size+chunk <= maxSize {
+		return nil
+	}
+
+	if size+chunk > maxSize+evictionBacklog*chunk {
+		Log.Debugf("Chunk eviction fell behind, evicting before download")
+		return evictChunks(chunk)
+	}
+
+	select {
+	case evictor.signal <- chunk:
+	default:
+	}
+	return nil
+}
+
+// InitChunkIndex measures the chunk directory once, after the chunk index
+// was loaded. From then on the evictions pick their chunks from the chunk
+// index and track the size of the directory in memory, instead of walking
+// the chunk directory for every evicted chunk, and cache hits don't touch
+// the modification time of the chunk files. The cleaning of the chunk
+// directory measures it again. Without it, with sparse chunk files or a
+// chunk directory shared with other instances, evictions walk the chunk
+// directory.
+func InitChunkIndex(path string) error {
+	evictor.lock.Lock()
+	defer evictor.lock.Unlock()
+
+	size, err := dirSize(path)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not measure chunk directory %v, evicting by walking it", path)
+	}
+	atomic.StoreInt64(&evictor.size, size)
+	atomic.StoreInt32(&evictor.indexed, 1)
+	Log.Debugf("Evicting from the chunk index, the chunk directory holds %v bytes", size)
+	return nil
+}
+
+// measureSharedChunkDir measures a chunk directory shared with other
+// instances again once the size is older than the measure interval, so
+// that the chunks of all instances count toward the maximum size
+func measureSharedChunkDir() {
+	if !sharedCache {
+		return
+	}
+
+	evictor.measureLock.Lock()
+	defer evictor.measureLock.Unlock()
+
+	if time.Since(evictor.measured) < sharedMeasureInterval {
+		return
+	}
+	evictor.measured = time.Now()
+	size, err := dirSize(chunkPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return
+	}
+	atomic.StoreInt64(&evictor.size, size)
+}
+
+// evictionIndexed checks if evictions pick their chunks from the chunk index.
+// The index doesn't know the chunks other instances sharing the chunk
+// directory write, they are found by walking it.
+func evictionIndexed() bool {
+	return 1 == atomic.LoadInt32(&evictor.indexed) && "sparse" != chunkStoreName && !sharedCache
+}
+
+// remeasureChunkDir corrects the tracked size of the chunk directory, e.g.
+// after chunks were compressed or stale chunks deleted
+func remeasureChunkDir(path string) {
+	if !evictionIndexed() {
+		return
+	}
+
+	evictor.lock.Lock()
+	defer evictor.lock.Unlock()
+
+	size, err := dirSize(path)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return
+	}
+	atomic.StoreInt64(&evictor.size, size)
+}
+
+// chunkWritten adds a written chunk to the known size of the chunk directory
+func chunkWritten(size int64) {
+	atomic.AddInt64(&evictor.size, size)
+}
+
+// evictLoop evicts chunks whenever reserveChunkSpace signals it
+func evictLoop() {
+	for chunk := range evictor.signal {
+		if err := evictChunks(chunk); nil != err {
+			Log.Warningf("%v", err)
+		}
+	}
+}
+
+// diskFullEviction is the number of bytes evicted when the disk of the
+// chunk directory is full
+var diskFullEviction int64 = 4 * 5 * 1024 * 1024
+
+// SetDiskFullEviction sets the bytes of chunks evicted before a chunk write
+// that failed on a full disk is tried again (0 = don't evict). A disk
+// shared with other data can fill up before the chunk directory reaches
+// its maximum size.
+func SetDiskFullEviction(size int64) {
+	diskFullEviction = size
+}
+
+// evictForFullDisk deletes the oldest chunks till the disk full eviction
+// size is freed and reports if anything was freed. The cached heads, pinned
+// tails, exempt and resume chunks are kept, the write is dropped instead.
+func evictForFullDisk() bool {
+	if diskFullEviction <= 0 {
+		return false
+	}
+
+	evictor.lock.Lock()
+	defer evictor.lock.Unlock()
+	defer lockChunkDir(true)()
+
+	var freed int64
+	for freed < diskFullEviction {
+		removed, _, err := deleteOldestFile(chunkPath, true)
+		if nil != err {
+			Log.Debugf("%v", err)
+			break
+		}
+		if 0 == removed {
+			break
+		}
+		freed += removed
+		atomic.AddInt64(&evictor.size, -removed)
+	}
+	Log.Infof("Evicted %v bytes of chunks, the disk of %v is full", freed, chunkPath)
+	return freed > 0
+}
+
+// evictChunks deletes the oldest chunks till the next chunk of the given
+// size fits (0 = till the chunk directory fits)
+func evictChunks(chunk int64) error {
+	evictor.lock.Lock()
+	defer evictor.lock.Unlock()
+	defer lockChunkDir(true)()
+
+	if evictionIndexed() {
+		size, exhausted, err := evictOldest(chunkPath, atomic.LoadInt64(&evictor.size), chunk, true)
+		if !exhausted {
+			atomic.StoreInt64(&evictor.size, size)
+			return err
+		}
+		// the measured size holds files the index doesn't know, e.g. of
+		// other generations or chunk sizes, walking the directory finds
+		// and measures them
+		Log.Debugf("Chunk index has no chunk left to evict, walking the chunk directory")
+	}
+	size, err := cleanChunkDir(chunkPath, chunk)
+	atomic.StoreInt64(&evictor.size, size)
+	return err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// evictionPolicies holds the selectable eviction policies
+var evictionPolicies = map[string]EvictionPolicy{
+	"lru":  LRUPolicy{},
+	"lfu":  LFUPolicy{},
+	"size": SizePolicy{},
+}
+
+var eviction = struct {
+	lock   sync.Mutex
+	policy EvictionPolicy
+}{
+	policy: LRUPolicy{},
+}
+
+// EvictionCandidate is a cached chunk file that could be evicted
+type EvictionCandidate struct {
+	Path     string
+	ObjectID string
+	Size     int64
+	Accessed time.Time
+	Hits     int64
+	// Sequence orders the accesses since startup (0 = not accessed since)
+	Sequence int64
+}
+
+// usedBefore checks if chunk a was used less recently than chunk b. The
+// access sequence is used if both chunks were accessed since startup, so
+// that clock changes and coarse file times don't reorder them. Chunks that
+// were not accessed since startup are older than all others and ordered by
+// their access time.
+func (a *EvictionCandidate) usedBefore(b *EvictionCandidate) bool {
+	if a.Sequence > 0 && b.Sequence > 0 {
+		return a.Sequence < b.Sequence
+	}
+	if a.Sequence != b.Sequence {
+		return 0 == a.Sequence
+	}
+	return a.Accessed.Before(b.Accessed)
+}
+
+// EvictionPolicy decides which cached chunk is evicted first. Chunks of
+// objects with a lower priority are always evicted before the policy is
+// asked.
+type EvictionPolicy interface {
+	// Before checks if chunk a should be evicted before chunk b
+	Before(a, b *EvictionCandidate) bool
+}
+
+// LRUPolicy evicts the least recently used chunk first
+type LRUPolicy struct{}
+
+// Before checks if chunk a was used less recently than chunk b
+func (LRUPolicy) Before(a, b *EvictionCandidate) bool {
+	return a.usedBefore(b)
+}
+
+// LFUPolicy evicts the least frequently used chunk first, chunks with the
+// same number of hits are evicted least recently used first
+type LFUPolicy struct{}
+
+// Before checks if chunk a was used less frequently than chunk b
+func (LFUPolicy) Before(a, b *EvictionCandidate) bool {
+	if a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+	return a.usedBefore(b)
+}
+
+// SizePolicy evicts the largest chunk first, so that as few chunks as
+// possible are evicted. Chunks of the same size are evicted least recently
+// used first.
+type SizePolicy struct{}
+
+// Before checks if chunk a is larger than chunk b
+func (SizePolicy) Before(a, b *EvictionCandidate) bool {
+	if a.Size != b.Size {
+		return a.Size > b.Size
+	}
+	return a.usedBefore(b)
+}
+
+// SetEvictionPolicy selects the eviction policy by name (lru, lfu or size)
+func SetEvictionPolicy(name string) error {
+	policy, exists := evictionPolicies[name]
+	if !exists {
+		return fmt.Errorf("Invalid eviction policy %v (expected lru, lfu or size)", name)
+	}
+	SetCustomEvictionPolicy(policy)
+	return nil
+}
+
+// SetCustomEvictionPolicy sets an eviction policy that is not built in
+func SetCustomEvictionPolicy(policy EvictionPolicy) {
+	eviction.lock.Lock()
+	defer eviction.lock.Unlock()
+
+	eviction.policy = policy
+}
+
+// evictionPolicy returns the selected eviction policy
+func evictionPolicy() EvictionPolicy {
+	eviction.lock.Lock()
+	defer eviction.lock.Unlock()
+
+	return eviction.policy
+}
+
+// evictionCandidate describes a chunk file for the eviction policy. Chunks
+// unknown to the chunk index, like sparse files, use the modification time
+// as access time.
+func evictionCandidate(path string, info os.FileInfo) *EvictionCandidate {
+	candidate := &EvictionCandidate{
+		Path:     path,
+		Size:     info.Size(),
+		Accessed: info.ModTime(),
+	}
+	if objectID, _, _, _, ok := parseChunkPath(path); ok {
+		candidate.ObjectID = objectID
+	}
+	if cached, exists := chunks.info(path); exists {
+		candidate.Accessed = cached.Accessed
+		candidate.Hits = cached.Hits
+		candidate.Sequence = cached.Sequence
+	}
+	return candidate
+}
@@ -0,0 +1,63 @@
+package main
+
+import "fmt"
+
+const (
+	// ExemptNone evicts the first and last chunks like all others
+	ExemptNone = "none"
+	// ExemptFirst keeps the first chunk of every open object
+	ExemptFirst = "first"
+	// ExemptLast keeps the last chunk of every open object
+	ExemptLast = "last"
+	// ExemptBoth keeps the first and the last chunk of every open object
+	ExemptBoth = "both"
+)
+
+var evictionExemption = ExemptNone
+
+// SetEvictionExemption sets which chunks of open objects are only evicted
+// if no other chunk is left. Players read the header at the beginning and
+// often an index at the end of a file on every start of the playback.
+func SetEvictionExemption(exemption string) error {
+	if ExemptNone != exemption && ExemptFirst != exemption &&
+		ExemptLast != exemption && ExemptBoth != exemption {
+		return fmt.Errorf("Invalid eviction exemption %v", exemption)
+	}
+	evictionExemption = exemption
+	return nil
+}
+
+// isExemptChunk checks if the chunk stored under the given path is the
+// first or last chunk of an open object that is exempt from eviction. The
+// exemption ends once the object is released.
+func isExemptChunk(path string) bool {
+	if ExemptNone == evictionExemption {
+		return false
+	}
+	objectID, _, size, offset, ok := parseChunkPath(path)
+	if !ok || sparseOffset == offset {
+		return false
+	}
+	instance, open := instances.Get(objectID)
+	if !open {
+		return false
+	}
+
+	first := 0 == offset
+	last := uint64(offset+size) >= instance.(*Buffer).object.Size
+	switch evictionExemption {
+	case ExemptFirst:
+		return first
+	case ExemptLast:
+		return last
+	default:
+		return first || last
+	}
+}
+
+// isPinnedChunk checks if a chunk is kept till no other chunk is left: the
+// cached head and the pinned tail of an object, the exempt chunks of open
+// objects and the chunks around resume positions
+func isPinnedChunk(path string) bool {
+	return isHeadChunk(path) || isTailChunk(path) || isExemptChunk(path) || isResumeChunk(path)
+}
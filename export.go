@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// ExportProgressFunc is called after every chunk an export wrote, with the
+// bytes written so far and the size of the object
+type ExportProgressFunc func(written, size int64)
+
+// Export copies the whole object chunk by chunk through the chunk cache to
+// w, e.g. to download a file for offline use. The chunks are cached like
+// on a read, so the export warms the cache and uses the same download
+// slots. It stops between two chunks once ctx is cancelled.
+func (b *Buffer) Export(ctx context.Context, w io.Writer, progress ExportProgressFunc) error {
+	size := int64(b.object.Size)
+	var written int64
+	for written < size {
+		if err := ctx.Err(); nil != err {
+			return err
+		}
+
+		bytes, err := b.readBytes(written, b.chunkSize-written%b.chunkSize, ReadBackground)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return fmt.Errorf("Could not read object %v at offset %v", b.object.ObjectID, written)
+		}
+		if 0 == len(bytes) {
+			Log.Debugf("Object %v ended at offset %v instead of %v", b.object.ObjectID, written, size)
+			return io.ErrUnexpectedEOF
+		}
+
+		n, err := w.Write(bytes)
+		written += int64(n)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return fmt.Errorf("Could not write object %v at offset %v", b.object.ObjectID, written)
+		}
+		if nil != progress {
+			progress(written, size)
+		}
+	}
+
+	Log.Debugf("Exported object %v (%v bytes)", b.object.ObjectID, written)
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// defaultMaxOpenChunks is the default limit of open chunk files
+const defaultMaxOpenChunks = 256
+
+var chunkFiles = newFilePool(defaultMaxOpenChunks)
+
+// SetMaxOpenChunks sets the maximum number of chunk files open at once
+func SetMaxOpenChunks(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+
+	chunkFiles.lock.Lock()
+	defer chunkFiles.lock.Unlock()
+
+	chunkFiles.limit = limit
+	chunkFiles.closeIdle()
+	chunkFiles.cond.Broadcast()
+}
+
+// ChunkFileStats holds the usage of the chunk file pool
+type ChunkFileStats struct {
+	Limit int `json:"limit"`
+	Open  int `json:"open"`
+	InUse int `json:"inUse"`
+}
+
+// GetChunkFileStats returns the current usage of the chunk file pool
+func GetChunkFileStats() ChunkFileStats {
+	chunkFiles.lock.Lock()
+	defer chunkFiles.lock.Unlock()
+
+	return ChunkFileStats{
+		Limit: chunkFiles.limit,
+		Open:  chunkFiles.open,
+		InUse: chunkFiles.open - chunkFiles.idle.Len(),
+	}
+}
+
+// filePool keeps chunk files open for reuse without exceeding a limit of
+// open files. Idle files are closed least recently used first, if all
+// files are in use borrowing waits until one is returned.
+type filePool struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	limit int
+	open  int
+	files map[string]*pooledFile
+	idle  *list.List
+	// opened counts the files opened, each open of a chunk costs the open,
+	// the close and, unless the eviction is indexed, a chtimes syscall
+	opened int64
+}
+
+// pooledFile is an open chunk file of the pool
+type pooledFile struct {
+	file     *os.File
+	filename string
+	refs     int
+	element  *list.Element
+	removed  bool
+}
+
+// newFilePool creates an empty file pool
+func newFilePool(limit int) *filePool {
+	pool := filePool{
+		limit: limit,
+		files: make(map[string]*pooledFile),
+		idle:  list.New(),
+	}
+	pool.cond = sync.NewCond(&pool.lock)
+	return &pool
+}
+
+// borrow returns an open handle of the file, it has to be given back with
+// giveBack after use
+func (p *filePool) borrow(filename string) (*pooledFile, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for {
+		if file, exists := p.files[filename]; exists {
+			if nil != file.element {
+				p.idle.Remove(file.element)
+				file.element = nil
+			}
+			file.refs++
+			return file, nil
+		}
+
+		if p.open < p.limit {
+			break
+		}
+		if !p.closeOldest() {
+			p.cond.Wait()
+		}
+	}
+
+	var f *os.File
+	err := retryFS(func() (err error) {
+		f, err = os.Open(filename)
+		return err
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	// update the last modified time for files that are often in use, the
+	// chunk index tracks the accesses itself
+	if !evictionIndexed() {
+		if err := os.Chtimes(filename, time.Now(), time.Now()); nil != err {
+			Log.Warningf("Could not update last modified time for %v", filename)
+		}
+	}
+
+	file := &pooledFile{
+		file:     f,
+		filename: filename,
+		refs:     1,
+	}
+	p.files[filename] = file
+	p.open++
+	p.opened++
+	return file, nil
+}
+
+// giveBack returns a borrowed handle to the pool
+func (p *filePool) giveBack(file *pooledFile) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	file.refs--
+	if file.refs > 0 {
+		return
+	}
+
+	if file.removed || p.open > p.limit {
+		p.closeFile(file)
+	} else {
+		file.element = p.idle.PushBack(file)
+	}
+	p.cond.Broadcast()
+}
+
+// release closes the handle of an evicted file as soon as it is not in use anymore
+func (p *filePool) release(filename string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if file, exists := p.files[filename]; exists {
+		p.remove(file)
+	}
+}
+
+// releaseDir closes the handles of all files in the directory as soon as
+// they are not in use anymore
+func (p *filePool) releaseDir(dir string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	prefix := dir + string(filepath.Separator)
+	for filename, file := range p.files {
+		if strings.HasPrefix(filename, prefix) {
+			p.remove(file)
+		}
+	}
+}
+
+// remove drops the file from the pool and closes it if it is idle, the
+// lock must be held
+func (p *filePool) remove(file *pooledFile) {
+	file.removed = true
+	delete(p.files, file.filename)
+	if 0 == file.refs {
+		p.closeFile(file)
+		p.cond.Broadcast()
+	}
+}
+
+// closeOldest closes the least recently used idle file, the lock must be held
+func (p *filePool) closeOldest() bool {
+	element := p.idle.Front()
+	if nil == element {
+		return false
+	}
+	p.closeFile(element.Value.(*pooledFile))
+	return true
+}
+
+// closeIdle closes idle files until the limit is met, the lock must be held
+func (p *filePool) closeIdle() {
+	for p.open > p.limit && p.closeOldest() {
+	}
+}
+
+// closeFile closes the file and drops it from the pool, the lock must be held
+func (p *filePool) closeFile(file *pooledFile) {
+	if nil != file.element {
+		p.idle.Remove(file.element)
+		file.element = nil
+	}
+	if !file.removed {
+		delete(p.files, file.filename)
+	}
+	p.open--
+	if err := file.file.Close(); nil != err {
+		Log.Debugf("%v", err)
+	}
+}
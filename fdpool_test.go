@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkCachedSequentialRead measures the sequential playback of a fully
+// cached object in reads of the FUSE size, with the chunk file handles kept
+// by the pool and with every chunk file opened for each read. It logs the
+// chunk file opens per read, every read costs a pread and each open adds
+// the open, the close and possibly a chtimes.
+func BenchmarkCachedSequentialRead(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		benchmarkCachedSequentialRead(b, false)
+	})
+	b.Run("reopened", func(b *testing.B) {
+		benchmarkCachedSequentialRead(b, true)
+	})
+}
+
+func benchmarkCachedSequentialRead(b *testing.B, reopen bool) {
+	dir, cleanup := setupChunkDir(b)
+	defer cleanup()
+	server := newTestServer(16*testChunkSize, nil)
+	defer server.Close()
+	buffer := openTestBuffer(b, server.object("sequential"))
+	defer buffer.Close()
+	size := int64(len(server.content))
+	readAll(b, buffer, 128*1024)
+	if !eventually(func() bool { return size == chunks.cachedBytes("sequential", size) }) {
+		b.Fatalf("cached %v of %v bytes", chunks.cachedBytes("sequential", size), size)
+	}
+	objectDir := filepath.Join(dir, "sequential")
+	requests := server.requestCount()
+
+	chunkFiles.lock.Lock()
+	opened := chunkFiles.opened
+	chunkFiles.lock.Unlock()
+	reads := atomic.LoadInt64(&buffer.reads)
+
+	p := make([]byte, 128*1024)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for offset := int64(0); offset < size; {
+			read, err := buffer.ReadInto(p, offset)
+			if nil != err {
+				b.Fatal(err)
+			}
+			offset += int64(read)
+			if reopen {
+				chunkFiles.releaseDir(objectDir)
+			}
+		}
+	}
+	b.StopTimer()
+
+	if server.requestCount() != requests {
+		b.Fatalf("downloaded %v ranges of a cached object", server.requestCount()-requests)
+	}
+	chunkFiles.lock.Lock()
+	opened = chunkFiles.opened - opened
+	chunkFiles.lock.Unlock()
+	reads = atomic.LoadInt64(&buffer.reads) - reads
+	b.Logf("%v chunk file opens for %v reads (%.3f per read)", opened, reads, float64(opened)/float64(reads))
+}
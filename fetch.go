@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+)
+
+// fetchRange is a range downloaded by a read, the requests of the range
+// look up the read they belong to
+type fetchRange struct {
+	offset    int64
+	offsetEnd int64
+	priority  ReadPriority
+	started   time.Time
+}
+
+// startFetch registers the range a read downloads. The returned function
+// ends it.
+func (b *Buffer) startFetch(offset, offsetEnd int64, priority ReadPriority) func() {
+	r := &fetchRange{offset: offset, offsetEnd: offsetEnd, priority: priority, started: time.Now()}
+	b.lock.Lock()
+	if nil == b.fetches {
+		b.fetches = make(map[*fetchRange]bool)
+	}
+	b.fetches[r] = true
+	b.lock.Unlock()
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		delete(b.fetches, r)
+	}
+}
+
+// fetchOf returns the read downloading the offset. If several reads
+// download it, it has the highest priority and the latest start of them.
+func (b *Buffer) fetchOf(offset int64) (fetchRange, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var fetch fetchRange
+	exists := false
+	for r := range b.fetches {
+		if offset < r.offset || offset >= r.offsetEnd {
+			continue
+		}
+		if !exists || r.priority > fetch.priority {
+			fetch.priority = r.priority
+		}
+		if !exists || r.started.After(fetch.started) {
+			fetch.started = r.started
+		}
+		fetch.offset, fetch.offsetEnd = r.offset, r.offsetEnd
+		exists = true
+	}
+	return fetch, exists
+}
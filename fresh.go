@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var freshWindow time.Duration
+
+var staleIfError time.Duration
+
+// SetFreshWindow limits the cache age of objects modified within the
+// window (0 = disabled). Cached chunks of such objects are downloaded again
+// once they are older than the time since the object was modified, so that
+// files still being written elsewhere are not served stale, while static
+// media is cached as usual.
+func SetFreshWindow(window time.Duration) {
+	freshWindow = window
+}
+
+// SetStaleIfError sets the time cached chunks that need to be revalidated
+// are still served after Google Drive became unreachable (0 = disabled).
+// Once it is reachable again, the chunks are revalidated on their next read.
+func SetStaleIfError(window time.Duration) {
+	staleIfError = window
+}
+
+// servesStale checks if chunks that are not fresh may be served, because
+// Google Drive is unreachable for less than the stale-if-error window
+func servesStale() bool {
+	if staleIfError <= 0 {
+		return false
+	}
+	outage, unreachable := outageDuration()
+	return unreachable && outage <= staleIfError
+}
+
+// isFresh checks if a cached chunk may be served
+func (b *Buffer) isFresh(generation, offset int64) bool {
+	if freshWindow <= 0 {
+		return true
+	}
+
+	sinceModified := time.Since(b.object.LastModified)
+	if sinceModified >= freshWindow {
+		return true
+	}
+	written, cached := chunks.written(b.object.ObjectID, generation, offset)
+	if !cached {
+		return true
+	}
+	if time.Since(written) <= sinceModified {
+		return true
+	}
+	if servesStale() {
+		Log.Debugf("Serving stale object %v bytes %v, Google Drive is unreachable", b.object.ObjectID, offset)
+		return true
+	}
+
+	Log.Debugf("Revalidating object %v bytes %v, it was modified %v ago", b.object.ObjectID, offset, sinceModified)
+	return false
+}
+
+// readCache reads from a cached chunk, if it is fresh. Chunks that are
+// still written in the background or kept in memory are read from memory,
+// a chunk read from disk is kept in memory as a whole.
+func (b *Buffer) readCache(filename string, generation, offset, fOffset, size int64) ([]byte, error) {
+	if bytes, staged := b.readStaged(generation, offset, fOffset, size); staged {
+		return bytes, nil
+	}
+	if bytes, streamed := b.readStreamed(generation, offset, fOffset, size); streamed {
+		return bytes, nil
+	}
+	if !b.isFresh(generation, offset) {
+		return nil, fmt.Errorf("Chunk %v is outdated", filename)
+	}
+	if bytes, hot := b.readHot(generation, offset, fOffset, size); hot {
+		return bytes, nil
+	}
+	if memoryOnly() {
+		return nil, fmt.Errorf("Chunk %v is not read from the bypassed chunk directory", filename)
+	}
+	b.decompress(filename, generation, offset)
+	started := time.Now()
+	if hotChunksEnabled() {
+		if bytes, err := b.store.Read(filename, 0, b.chunkSize); nil == err {
+			recordDiskRead(time.Since(started))
+			b.keepHot(generation, offset, bytes)
+			return hotRange(bytes, fOffset, size), nil
+		}
+	}
+	bytes, err := b.store.Read(filename, fOffset, size)
+	if nil == err {
+		recordDiskRead(time.Since(started))
+	}
+	if nil != err {
+		if bytes, migrated := b.readMigrated(filename, fOffset, size); migrated {
+			return bytes, nil
+		}
+	}
+	return bytes, err
+}
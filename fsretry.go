@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// fsRetries is the number of times chunk I/O is retried while a network
+// filesystem is busy
+const fsRetries = 3
+
+// fsRetryDelay is the delay before the first retry, it grows with every retry
+const fsRetryDelay = 10 * time.Millisecond
+
+// fsErrno returns the system call error of a filesystem error
+func fsErrno(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	}
+	return err
+}
+
+// isTransientFSError checks if a filesystem error may go away on its own.
+// Interrupted system calls are already retried by the os package, errors
+// like ENOSPC or EACCES are permanent and never retried.
+func isTransientFSError(err error) bool {
+	return syscall.EAGAIN == fsErrno(err)
+}
+
+// isNoSpaceError checks if a write failed because the disk is full
+func isNoSpaceError(err error) bool {
+	return syscall.ENOSPC == fsErrno(err)
+}
+
+// retryFS runs a chunk I/O operation till it succeeded, failed with a
+// permanent error or ran out of retries
+func retryFS(operation func() error) error {
+	for retry := 0; ; retry++ {
+		err := operation()
+		if nil == err || !isTransientFSError(err) || retry >= fsRetries {
+			return err
+		}
+		Log.Debugf("%v", err)
+		time.Sleep(time.Duration(retry+1) * fsRetryDelay)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// failingFS fails the first operations with the given error
+type failingFS struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *failingFS) open() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return &os.PathError{Op: "open", Path: "/chunks/object/0_1024_0", Err: f.err}
+	}
+	return nil
+}
+
+func TestTransientFSErrorsAreRetried(t *testing.T) {
+	fs := &failingFS{failures: fsRetries, err: syscall.EAGAIN}
+	if err := retryFS(fs.open); nil != err {
+		t.Fatalf("failed after %v transient errors: %v", fs.failures, err)
+	}
+	if fsRetries+1 != fs.calls {
+		t.Fatalf("called the operation %v times instead of %v", fs.calls, fsRetries+1)
+	}
+}
+
+func TestTransientFSErrorsRunOutOfRetries(t *testing.T) {
+	fs := &failingFS{failures: fsRetries + 1, err: syscall.EAGAIN}
+	if err := retryFS(fs.open); !isTransientFSError(err) {
+		t.Fatalf("returned %v instead of the transient error", err)
+	}
+	if fsRetries+1 != fs.calls {
+		t.Fatalf("called the operation %v times instead of %v", fs.calls, fsRetries+1)
+	}
+}
+
+func TestPermanentFSErrorsAreNotRetried(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EACCES, syscall.ENOENT} {
+		fs := &failingFS{failures: 1, err: errno}
+		if err := retryFS(fs.open); errno != fsErrno(err) {
+			t.Fatalf("returned %v instead of %v", err, errno)
+		}
+		if 1 != fs.calls {
+			t.Fatalf("retried the permanent error %v %v times", errno, fs.calls-1)
+		}
+	}
+	if !isNoSpaceError(&os.PathError{Op: "write", Path: "chunk", Err: syscall.ENOSPC}) {
+		t.Fatalf("ENOSPC of a write is not recognized")
+	}
+}
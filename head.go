@@ -0,0 +1,21 @@
+package main
+
+var headCacheSize int64
+
+// SetHeadCacheSize sets the number of bytes at the beginning of every
+// opened object that are downloaded right away and kept when chunks are
+// evicted (0 = disabled). Players read the header of a file first, so a
+// cached head lets playback start instantly.
+func SetHeadCacheSize(size int64) {
+	headCacheSize = size
+}
+
+// isHeadChunk checks if the chunk stored under the given path holds bytes
+// of the head of its object
+func isHeadChunk(path string) bool {
+	if headCacheSize <= 0 {
+		return false
+	}
+	_, _, _, offset, ok := parseChunkPath(path)
+	return ok && offset >= 0 && offset < headCacheSize
+}
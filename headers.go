@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+var downloadHeaders = struct {
+	lock   sync.Mutex
+	global http.Header
+}{
+	global: make(http.Header),
+}
+
+// SetDownloadHeader adds a header to all download requests, e.g. the
+// Referer or Origin a proxy in front of the API checks ("" = remove it)
+func SetDownloadHeader(name, value string) {
+	downloadHeaders.lock.Lock()
+	defer downloadHeaders.lock.Unlock()
+
+	if "" == value {
+		downloadHeaders.global.Del(name)
+		return
+	}
+	downloadHeaders.global.Set(name, value)
+}
+
+// addDownloadHeaders adds the configured headers to a download request
+func addDownloadHeaders(req *http.Request) {
+	downloadHeaders.lock.Lock()
+	defer downloadHeaders.lock.Unlock()
+
+	for name, values := range downloadHeaders.global {
+		req.Header[name] = values
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadHeadersAreSent(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	SetDownloadHeader("Referer", "https://drive.example.com/")
+	SetDownloadHeader("Origin", "https://drive.example.com")
+	defer SetDownloadHeader("Referer", "")
+	defer SetDownloadHeader("Origin", "")
+	content := testContent(3 * testChunkSize)
+	var rejected int32
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		if "https://drive.example.com/" != r.Header.Get("Referer") || "https://drive.example.com" != r.Header.Get("Origin") {
+			atomic.AddInt32(&rejected, 1)
+			http.Error(w, "wrong referer", http.StatusForbidden)
+			return
+		}
+		if "" == r.Header.Get("Range") {
+			http.Error(w, "ranges only", http.StatusBadRequest)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	defer server.Close()
+	object := server.object("headers")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(content, got) {
+		t.Fatalf("read %v bytes that don't match the content", len(got))
+	}
+	if 0 != atomic.LoadInt32(&rejected) {
+		t.Fatalf("sent %v requests without the configured headers", rejected)
+	}
+}
+
+func TestRemovedDownloadHeadersAreNotSent(t *testing.T) {
+	SetDownloadHeader("Referer", "https://drive.example.com/")
+	SetDownloadHeader("Referer", "")
+
+	req, err := http.NewRequest("GET", "http://localhost/", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	addDownloadHeaders(req)
+	if _, exists := req.Header["Referer"]; exists {
+		t.Fatalf("sent the removed header %v", req.Header.Get("Referer"))
+	}
+}
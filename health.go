@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// healthCheckInterval is the time a health check result is reused, so that
+// frequent probes don't send requests to Google Drive
+const healthCheckInterval = 30 * time.Second
+
+// HealthStatus is the result of a health check
+type HealthStatus struct {
+	Healthy bool      `json:"healthy"`
+	Detail  string    `json:"detail"`
+	Object  string    `json:"object,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// healthChecker checks if Google Drive can be reached with the credentials
+// of the mount
+type healthChecker struct {
+	lock     sync.Mutex
+	drive    *Drive
+	objectID string
+	last     HealthStatus
+}
+
+// ServeHealthCheck serves the health of the mount on the given address,
+// e.g. for liveness probes. With a sentinel object id the first byte of
+// the object is downloaded, otherwise the root folder is requested from
+// the API.
+func ServeHealthCheck(address string, drive *Drive, objectID string) error {
+	listener, err := net.Listen("tcp", address)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not listen for health checks on %v", address)
+	}
+	Log.Infof("Serving health checks on %v", listener.Addr())
+
+	checker := &healthChecker{drive: drive, objectID: objectID}
+	go func() {
+		if err := http.Serve(listener, checker); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Stopped serving health checks")
+		}
+	}()
+	return nil
+}
+
+func (c *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := c.status()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); nil != err {
+		Log.Debugf("%v", err)
+	}
+}
+
+// status returns the last health check result or checks again once it
+// is outdated
+func (c *healthChecker) status() HealthStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.last.Checked) < healthCheckInterval {
+		return c.last
+	}
+
+	c.last = HealthStatus{Healthy: true, Object: c.objectID, Checked: time.Now()}
+	if err := c.check(); nil != err {
+		Log.Debugf("%v", err)
+		c.last.Healthy = false
+		c.last.Detail = err.Error()
+	} else if "" != c.objectID {
+		c.last.Detail = fmt.Sprintf("Downloaded object %v", c.objectID)
+	} else {
+		c.last.Detail = "Reached the Google Drive API"
+	}
+	return c.last
+}
+
+// check requests the sentinel object or the root folder
+func (c *healthChecker) check() error {
+	if "" == c.objectID {
+		_, err := c.drive.GetRoot()
+		return err
+	}
+
+	object, err := c.drive.GetObject(c.objectID)
+	if nil != err {
+		return err
+	}
+	url := object.DownloadURL
+	if nil != urlRewriter {
+		url = urlRewriter(object, url)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		return err
+	}
+	req.Header.Add("Range", "bytes=0-0")
+	addDownloadHeaders(req)
+
+	// the client is shared with the downloads, only a copy gets the timeout
+	client := *objectClient(object.ObjectID, c.drive.getNativeClient())
+	client.Timeout = healthCheckInterval
+	res, err := client.Do(req)
+	if nil != err {
+		return fmt.Errorf("Could not download object %v: %v", c.objectID, err)
+	}
+	defer res.Body.Close()
+
+	if http.StatusOK != res.StatusCode && http.StatusPartialContent != res.StatusCode {
+		return fmt.Errorf("Download of object %v answered with status %v", c.objectID, res.StatusCode)
+	}
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1))
+	accountDownload(n)
+	return err
+}
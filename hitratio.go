@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// hitRatioBucket is the time covered by one bucket of the hit ratio ring
+const hitRatioBucket = time.Minute
+
+// hitRatioBuckets is the number of buckets in the ring, the longest window
+// the hit ratio is computed for
+const hitRatioBuckets = 60
+
+var hitRatio struct {
+	lock    sync.Mutex
+	buckets [hitRatioBuckets]hitBucket
+}
+
+// hitBucket counts the cache hits and misses of one minute
+type hitBucket struct {
+	start  int64
+	hits   int64
+	misses int64
+}
+
+// HitRatio holds the cache hits and misses of reads within a time window
+type HitRatio struct {
+	Hits   int64   `json:"hits"`
+	Misses int64   `json:"misses"`
+	Ratio  float64 `json:"ratio"`
+}
+
+// HitRatioStats holds the cache hit ratio of the recent reads
+type HitRatioStats struct {
+	FiveMinutes HitRatio `json:"fiveMinutes"`
+	Hour        HitRatio `json:"hour"`
+}
+
+// GetHitRatioStats returns the cache hit ratio of the reads of the last
+// five minutes and the last hour
+func GetHitRatioStats() HitRatioStats {
+	now := time.Now()
+	return HitRatioStats{
+		FiveMinutes: recentHitRatio(now, 5),
+		Hour:        recentHitRatio(now, hitRatioBuckets),
+	}
+}
+
+// recordRead counts a read that was served from the cache or had to wait
+// for a download
+func recordRead(hit bool) {
+	countRead(hit)
+
+	hitRatio.lock.Lock()
+	defer hitRatio.lock.Unlock()
+
+	start := time.Now().UnixNano() / int64(hitRatioBucket)
+	bucket := &hitRatio.buckets[start%hitRatioBuckets]
+	if bucket.start != start {
+		*bucket = hitBucket{start: start}
+	}
+	if hit {
+		bucket.hits++
+	} else {
+		bucket.misses++
+	}
+}
+
+// recentHitRatio sums the buckets of the given number of minutes
+func recentHitRatio(now time.Time, buckets int64) HitRatio {
+	hitRatio.lock.Lock()
+	defer hitRatio.lock.Unlock()
+
+	current := now.UnixNano() / int64(hitRatioBucket)
+	var ratio HitRatio
+	for _, bucket := range hitRatio.buckets {
+		if bucket.start > current-buckets && bucket.start <= current {
+			ratio.Hits += bucket.hits
+			ratio.Misses += bucket.misses
+		}
+	}
+	if total := ratio.Hits + ratio.Misses; total > 0 {
+		ratio.Ratio = float64(ratio.Hits) / float64(total)
+	}
+	return ratio
+}
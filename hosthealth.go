@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hostHealthWeight is the weight of the latest request in the failure rate
+// and the latency of a host
+const hostHealthWeight = 0.2
+
+// unhealthyFailureRate is the failure rate above which a host is only
+// requested after the healthy ones
+const unhealthyFailureRate = 0.5
+
+var hosts = struct {
+	lock   sync.Mutex
+	health map[string]*HostHealth
+}{
+	health: make(map[string]*HostHealth),
+}
+
+// HostHealth holds the recent success of the requests to one download host
+type HostHealth struct {
+	Host        string        `json:"host"`
+	Requests    int64         `json:"requests"`
+	Failures    int64         `json:"failures"`
+	FailureRate float64       `json:"failureRate"`
+	Latency     time.Duration `json:"latency"`
+}
+
+// hostHealthSlice sorts hosts by name
+type hostHealthSlice []HostHealth
+
+func (s hostHealthSlice) Len() int           { return len(s) }
+func (s hostHealthSlice) Less(i, j int) bool { return s[i].Host < s[j].Host }
+func (s hostHealthSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// GetHostHealth returns the health of all download hosts requested so far
+func GetHostHealth() []HostHealth {
+	hosts.lock.Lock()
+	defer hosts.lock.Unlock()
+
+	health := hostHealthSlice{}
+	for _, host := range hosts.health {
+		health = append(health, *host)
+	}
+	sort.Sort(health)
+	return health
+}
+
+// isTransientError checks if a request failed in a way another attempt,
+// e.g. to another host, could succeed
+func isTransientError(err error) bool {
+	switch e := err.(type) {
+	case *ReadTimeoutError, *ShortBodyError:
+		return true
+	case *StatusError:
+		return e.StatusCode >= http.StatusInternalServerError
+	}
+	return isNetworkError(err)
+}
+
+// recordHostResult updates the health of the host of a requested url. The
+// failure rate decays, so that a host that recovered is preferred again.
+func recordHostResult(rawurl string, latency time.Duration, err error) {
+	hosts.lock.Lock()
+	defer hosts.lock.Unlock()
+
+	name := hostOf(rawurl)
+	host, exists := hosts.health[name]
+	if !exists {
+		host = &HostHealth{Host: name}
+		hosts.health[name] = host
+	}
+
+	host.Requests++
+	if isTransientError(err) {
+		host.Failures++
+		host.FailureRate += hostHealthWeight * (1 - host.FailureRate)
+		return
+	}
+	host.FailureRate -= hostHealthWeight * host.FailureRate
+	if nil == err {
+		if 0 == host.Latency {
+			host.Latency = latency
+		} else {
+			host.Latency += time.Duration(hostHealthWeight * float64(latency-host.Latency))
+		}
+	}
+}
+
+// isHealthy checks if the host of the url did not fail recently
+func isHealthy(rawurl string) bool {
+	hosts.lock.Lock()
+	defer hosts.lock.Unlock()
+
+	host, exists := hosts.health[hostOf(rawurl)]
+	return !exists || host.FailureRate <= unhealthyFailureRate
+}
+
+// healthyFirst moves the urls of unhealthy hosts behind the others and keeps
+// the order otherwise
+func healthyFirst(urls []string) []string {
+	ordered := make([]string, 0, len(urls))
+	unhealthy := []string{}
+	for _, url := range urls {
+		if isHealthy(url) {
+			ordered = append(ordered, url)
+		} else {
+			unhealthy = append(unhealthy, url)
+		}
+	}
+	return append(ordered, unhealthy...)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var verifyIdentity bool
+
+// ObjectMismatchError is returned if a download url or a response belongs
+// to another object than the one it is cached for
+type ObjectMismatchError struct {
+	ObjectID string
+	Reason   string
+}
+
+func (e *ObjectMismatchError) Error() string {
+	return fmt.Sprintf("Download of object %v belongs to another object, %v", e.ObjectID, e.Reason)
+}
+
+// SetVerifyIdentity checks that the download urls of an object name the
+// object and that the total size of every partial response is the size of
+// the object, so that a stale or wrong download url never caches the
+// content of another object
+func SetVerifyIdentity(enabled bool) {
+	verifyIdentity = enabled
+}
+
+// urlObjectID returns the object id a download url names ("" = unknown).
+// The API names it in the path (/drive/v2/files/<id>), the content links
+// in the id parameter and the download hosts in the last path segment.
+func urlObjectID(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if nil != err {
+		return ""
+	}
+	if id := u.Query().Get("id"); "" != id {
+		return id
+	}
+	if parts := strings.SplitN(u.Path, "/files/", 2); 2 == len(parts) {
+		return strings.Split(parts[1], "/")[0]
+	}
+	if strings.HasSuffix(u.Host, ".googleusercontent.com") && strings.HasPrefix(u.Path, "/docs/") {
+		return path.Base(u.Path)
+	}
+	return ""
+}
+
+// identifiedURLs drops the download urls that name another object
+func identifiedURLs(object *APIObject, urls []string) ([]string, error) {
+	if !verifyIdentity {
+		return urls, nil
+	}
+
+	matching := []string{}
+	for _, rawurl := range urls {
+		if id := urlObjectID(rawurl); "" != id && id != object.ObjectID {
+			Log.Warningf("Skipping download url of object %v, it names object %v", object.ObjectID, id)
+			continue
+		}
+		matching = append(matching, rawurl)
+	}
+	if 0 == len(matching) {
+		return nil, &ObjectMismatchError{ObjectID: object.ObjectID, Reason: "all download urls name other objects"}
+	}
+	return matching, nil
+}
+
+// checkTotalSize compares the total size of a content range with the size
+// of the object (-1 = unknown total)
+func checkTotalSize(object *APIObject, total int64) error {
+	if !verifyIdentity || total < 0 || uint64(total) == object.Size {
+		return nil
+	}
+	return &ObjectMismatchError{
+		ObjectID: object.ObjectID,
+		Reason:   fmt.Sprintf("got a total size of %v instead of %v bytes", total, object.Size),
+	}
+}
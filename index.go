@@ -0,0 +1,925 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var chunks *chunkIndex
+
+func init() {
+	chunks = newChunkIndex()
+}
+
+// chunkIndex keeps track of the chunks stored in the chunk directory,
+// so that the cache state can be queried without touching the disk
+type chunkIndex struct {
+	lock        sync.Mutex
+	path        string
+	objects     map[string]map[int64]*chunkInfo
+	generations map[string]int64
+	pinned      map[string]map[int64]int
+	sizes       map[string]int64
+	resized     map[string]bool
+	otherSizes  map[string][]otherSizeChunk
+	tenants     map[string]string
+	sequence    int64
+	// lru orders the chunks by their last access, least recently used
+	// first. Entries of chunks that were dropped with their object are
+	// skipped and removed once an eviction reaches them.
+	lru *list.List
+}
+
+// lruChunk is an entry of the access order of the chunk index
+type lruChunk struct {
+	objectID string
+	offset   int64
+}
+
+// chunkInfo is the metadata of a cached chunk. Sequence orders the
+// accesses of this run independent of the system clock, chunks that were
+// not accessed since startup have no sequence. Incompressible chunks did
+// not get smaller when they were compressed and are not tried again.
+type chunkInfo struct {
+	Size           int64     `json:"size"`
+	Accessed       time.Time `json:"accessed"`
+	Written        time.Time `json:"written"`
+	Hits           int64     `json:"hits"`
+	Compressed     bool      `json:"compressed,omitempty"`
+	Incompressible bool      `json:"incompressible,omitempty"`
+	Sequence       int64     `json:"-"`
+	element        *list.Element
+}
+
+// persistedIndex is the on disk format of the chunk index
+type persistedIndex struct {
+	ChunkSize int64                      `json:"chunkSize"`
+	ChunkPath string                     `json:"chunkPath,omitempty"`
+	Objects   map[string]persistedObject `json:"objects"`
+}
+
+// persistedObject is the on disk format of the chunks of one object
+type persistedObject struct {
+	Generation int64                `json:"generation"`
+	ChunkSize  int64                `json:"chunkSize,omitempty"`
+	Tenant     string               `json:"tenant,omitempty"`
+	Chunks     map[int64]*chunkInfo `json:"chunks"`
+}
+
+// newChunkIndex creates an empty chunk index
+func newChunkIndex() *chunkIndex {
+	return &chunkIndex{
+		objects:     make(map[string]map[int64]*chunkInfo),
+		generations: make(map[string]int64),
+		pinned:      make(map[string]map[int64]int),
+		sizes:       make(map[string]int64),
+		resized:     make(map[string]bool),
+		otherSizes:  make(map[string][]otherSizeChunk),
+		tenants:     make(map[string]string),
+		lru:         list.New(),
+	}
+}
+
+// LoadChunkIndex restores the chunk index from the index file written on
+// the last run, so that the metadata of all cached chunks is known right
+// after startup. Objects whose chunk directory changed after the index was
+// written are rescanned. A missing or corrupt index file falls back to a
+// scan of the whole chunk directory.
+func LoadChunkIndex(path string) error {
+	chunks.lock.Lock()
+	defer chunks.lock.Unlock()
+
+	chunks.path = path
+	if err := chunks.restore(); nil != err {
+		Log.Debugf("%v", err)
+		Log.Infof("Could not restore chunk index from %v, scanning %v", path, chunkPath)
+		return chunks.scan()
+	}
+	return nil
+}
+
+// SaveChunkIndex writes the chunk index to the index file, if one was loaded
+// and the chunk directory is writable
+func SaveChunkIndex() error {
+	chunks.lock.Lock()
+	persisted := persistedIndex{
+		ChunkSize: currentChunkSize(),
+		ChunkPath: chunkPath,
+		Objects:   make(map[string]persistedObject, len(chunks.objects)),
+	}
+	for objectID, offsets := range chunks.objects {
+		infos := make(map[int64]*chunkInfo, len(offsets))
+		for offset, info := range offsets {
+			copied := *info
+			infos[offset] = &copied
+		}
+		persisted.Objects[objectID] = persistedObject{
+			Generation: chunks.generations[objectID],
+			ChunkSize:  chunks.sizes[objectID],
+			Tenant:     chunks.tenants[objectID],
+			Chunks:     infos,
+		}
+	}
+	path := chunks.path
+	chunks.lock.Unlock()
+
+	if "" == path || chunkReadOnly {
+		return nil
+	}
+
+	data, err := json.Marshal(persisted)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not encode chunk index")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write chunk index %v", path)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), path)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write chunk index %v", path)
+	}
+
+	Log.Debugf("Saved chunk index to %v", path)
+	return nil
+}
+
+// restore reads the index file, the lock must be held
+func (i *chunkIndex) restore() error {
+	info, err := os.Stat(i.path)
+	if nil != err {
+		return err
+	}
+	data, err := ioutil.ReadFile(i.path)
+	if nil != err {
+		return err
+	}
+
+	var persisted persistedIndex
+	if err := json.Unmarshal(data, &persisted); nil != err {
+		return err
+	}
+	if persisted.ChunkSize != currentChunkSize() {
+		return fmt.Errorf("Chunk index was written for chunk size %v", persisted.ChunkSize)
+	}
+	if "" != persisted.ChunkPath && persisted.ChunkPath != chunkPath {
+		return fmt.Errorf("Chunk index was written for chunk directory %v", persisted.ChunkPath)
+	}
+
+	dirs, err := ioutil.ReadDir(chunkPath)
+	if nil != err {
+		return err
+	}
+	restored := []string{}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		objectID := dir.Name()
+		object, exists := persisted.Objects[objectID]
+		if exists && object.ChunkSize > 0 {
+			i.sizes[objectID] = object.ChunkSize
+		}
+		if exists && "" != object.Tenant {
+			i.tenants[objectID] = object.Tenant
+		}
+		if !exists || dir.ModTime().After(info.ModTime()) || nil == object.Chunks {
+			i.loadDir(objectID)
+			continue
+		}
+		for _, chunk := range object.Chunks {
+			if nil == chunk {
+				return fmt.Errorf("Chunk index contains empty entries for object %v", objectID)
+			}
+		}
+		i.objects[objectID] = object.Chunks
+		i.generations[objectID] = object.Generation
+		restored = append(restored, objectID)
+	}
+	i.enqueue(restored...)
+
+	Log.Debugf("Restored chunk index from %v", i.path)
+	return nil
+}
+
+// scan indexes all objects of the chunk directory, the lock must be held
+func (i *chunkIndex) scan() error {
+	dirs, err := ioutil.ReadDir(chunkPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not scan chunk directory %v", chunkPath)
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			i.loadDir(dir.Name())
+		}
+	}
+	return nil
+}
+
+// InvalidateObject bumps the cache generation of an object, so that all
+// of its cached chunks are ignored from now on. An object that was deleted
+// before can be downloaded again. Readers that already opened the object
+// keep reading the chunks of their generation until they are closed, new
+// readers get the new generation. The chunk files themselves are deleted
+// lazily by the chunk cleaner.
+func InvalidateObject(objectID string) {
+	chunks.load(objectID)
+
+	chunks.lock.Lock()
+	goneObjects.remove(objectID)
+	chunks.generations[objectID]++
+	chunks.objects[objectID] = make(map[int64]*chunkInfo)
+	Log.Debugf("Invalidated cache of object %v (generation %v)", objectID, chunks.generations[objectID])
+	chunks.lock.Unlock()
+
+	// the active buffer stays with its readers, the next reader creates a
+	// buffer of the new generation
+	instances.Remove(objectID)
+	smallObjects.remove(objectID)
+	dropHotObject(objectID)
+}
+
+// claimTenant makes the cached chunks of an object belong to a tenant. If
+// they were cached for another tenant, or for an unknown one and the tenant
+// is not the tenant of the mount (""), the object moves to a new generation
+// and the chunks of the other tenant become stale. It reports if it moved.
+func (i *chunkIndex) claimTenant(objectID, tenant string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	owner, known := i.tenants[objectID]
+	if owner == tenant && (known || "" == tenant) {
+		return false
+	}
+	if "" == tenant {
+		delete(i.tenants, objectID)
+	} else {
+		i.tenants[objectID] = tenant
+	}
+	if 0 == len(i.objects[objectID]) {
+		return false
+	}
+	i.generations[objectID]++
+	i.objects[objectID] = make(map[int64]*chunkInfo)
+	Log.Debugf("Moved object %v to generation %v of another tenant", objectID, i.generations[objectID])
+	return true
+}
+
+// load reads the chunks of an object from its directory, if the object
+// is not indexed yet
+func (i *chunkIndex) load(objectID string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if _, exists := i.objects[objectID]; exists {
+		return
+	}
+	i.loadDir(objectID)
+}
+
+// loadDir reads the chunks of an object from its directory, the lock must
+// be held. The highest generation found on disk becomes the current
+// generation.
+func (i *chunkIndex) loadDir(objectID string) {
+	files, err := ioutil.ReadDir(filepath.Join(chunkPath, objectID))
+	if nil != err {
+		Log.Debugf("%v", err)
+	}
+
+	var generation int64
+	offsets := make(map[int64]*chunkInfo)
+	legacy := make(map[int64]string)
+	for _, file := range files {
+		fileGeneration, size, offset, ok := parseChunkName(file.Name())
+		if !ok || file.IsDir() || size != i.chunkSize(objectID) {
+			continue
+		}
+		if sparseOffset == offset && !strings.HasSuffix(file.Name(), sparseMapName("")) {
+			continue
+		}
+		if fileGeneration > generation {
+			generation = fileGeneration
+			offsets = make(map[int64]*chunkInfo)
+			legacy = make(map[int64]string)
+		}
+		if fileGeneration != generation {
+			continue
+		}
+
+		if sparseOffset == offset {
+			sparseChunks, err := readSparseMap(filepath.Join(chunkPath, objectID, file.Name()))
+			if nil != err {
+				Log.Debugf("%v", err)
+			}
+			for chunkOffset, length := range sparseChunks {
+				offsets[chunkOffset] = &chunkInfo{
+					Size:     length,
+					Accessed: file.ModTime(),
+					Written:  file.ModTime(),
+				}
+			}
+			continue
+		}
+		// a chunk that was decompressed before a crash may still have
+		// its compressed file, which sorts after the chunk
+		compressed := strings.HasSuffix(file.Name(), compressedSuffix)
+		if _, exists := offsets[offset]; exists && compressed {
+			continue
+		}
+		// chunks of older versions are named by their bare offset, the
+		// chunk of the same offset with the current naming wins
+		if !strings.Contains(file.Name(), "_") {
+			if _, exists := offsets[offset]; exists {
+				continue
+			}
+			legacy[offset] = file.Name()
+		} else {
+			delete(legacy, offset)
+		}
+		offsets[offset] = &chunkInfo{
+			Size:       file.Size(),
+			Accessed:   file.ModTime(),
+			Written:    file.ModTime(),
+			Compressed: compressed,
+		}
+	}
+	for offset, legacyName := range legacy {
+		name := chunkName(0, i.chunkSize(objectID), offset)
+		if strings.HasSuffix(legacyName, compressedSuffix) {
+			name += compressedSuffix
+		}
+		if !adoptLegacyChunk(objectID, legacyName, name) {
+			delete(offsets, offset)
+		}
+	}
+	i.objects[objectID] = offsets
+	i.generations[objectID] = generation
+	i.enqueue(objectID)
+}
+
+// adoptLegacyChunk renames a chunk of older versions, named by its bare
+// offset, to the name of the chunk in generation 0 so it is read like any
+// other chunk
+func adoptLegacyChunk(objectID, legacyName, name string) bool {
+	dir := filepath.Join(chunkPath, objectID)
+	if err := os.Rename(filepath.Join(dir, legacyName), filepath.Join(dir, name)); nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not rename chunk %v of object %v", legacyName, objectID)
+		return false
+	}
+	return true
+}
+
+// enqueue adds the chunks of objects that were indexed from disk to the
+// access order. They were not accessed since startup, so they are older
+// than all chunks accessed since and ordered by their access time. The
+// lock must be held.
+func (i *chunkIndex) enqueue(objectIDs ...string) {
+	var queued []*lruChunk
+	for _, objectID := range objectIDs {
+		for offset, info := range i.objects[objectID] {
+			if nil == info.element {
+				queued = append(queued, &lruChunk{objectID: objectID, offset: offset})
+			}
+		}
+	}
+	sort.Sort(byAccess{i, queued})
+	for n := len(queued) - 1; n >= 0; n-- {
+		i.objects[queued[n].objectID][queued[n].offset].element = i.lru.PushFront(queued[n])
+	}
+}
+
+// byAccess sorts chunks of the index by their access time, oldest first
+type byAccess struct {
+	index  *chunkIndex
+	chunks []*lruChunk
+}
+
+func (a byAccess) Len() int      { return len(a.chunks) }
+func (a byAccess) Swap(i, j int) { a.chunks[i], a.chunks[j] = a.chunks[j], a.chunks[i] }
+func (a byAccess) Less(i, j int) bool {
+	x, y := a.chunks[i], a.chunks[j]
+	return a.index.objects[x.objectID][x.offset].Accessed.Before(a.index.objects[y.objectID][y.offset].Accessed)
+}
+
+// forget removes a chunk from the access order, the lock must be held
+func (i *chunkIndex) forget(info *chunkInfo) {
+	if nil != info.element {
+		i.lru.Remove(info.element)
+		info.element = nil
+	}
+}
+
+// oldest returns the least recently used chunk the exempt func doesn't
+// exempt, or the least recently used exempt chunk if all chunks are exempt
+// (reported with true). Entries of dropped chunks are removed on the way.
+func (i *chunkIndex) oldest(exempt func(path string) bool) (*EvictionCandidate, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var fallback *EvictionCandidate
+	for element := i.lru.Front(); nil != element; {
+		next := element.Next()
+		entry := element.Value.(*lruChunk)
+		info, exists := i.objects[entry.objectID][entry.offset]
+		if !exists || info.element != element {
+			i.lru.Remove(element)
+			element = next
+			continue
+		}
+
+		path := filepath.Join(chunkPath, entry.objectID, chunkName(i.generations[entry.objectID], i.chunkSize(entry.objectID), entry.offset))
+		if info.Compressed {
+			path += compressedSuffix
+		}
+		candidate := &EvictionCandidate{
+			Path:     path,
+			ObjectID: entry.objectID,
+			Size:     info.Size,
+			Accessed: info.Accessed,
+			Hits:     info.Hits,
+			Sequence: info.Sequence,
+		}
+		if !exempt(path) {
+			return candidate, false
+		}
+		if nil == fallback {
+			fallback = candidate
+		}
+		element = next
+	}
+	return fallback, nil != fallback
+}
+
+// setChunkSize sets the chunk size of an object, chunks of other sizes are
+// stale. Objects without a chunk size use the global chunk size.
+func (i *chunkIndex) setChunkSize(objectID string, size int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if size == i.chunkSize(objectID) {
+		return
+	}
+	// the object is indexed again with the chunks of the new size
+	delete(i.objects, objectID)
+	delete(i.resized, objectID)
+	delete(i.otherSizes, objectID)
+	if size == currentChunkSize() {
+		delete(i.sizes, objectID)
+	} else {
+		i.sizes[objectID] = size
+	}
+}
+
+// indexedChunkSize returns the chunk size an object was cached with, if it
+// is not the global chunk size
+func (i *chunkIndex) indexedChunkSize(objectID string) (int64, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	size, exists := i.sizes[objectID]
+	return size, exists
+}
+
+// chunkSize returns the chunk size of an object, the lock must be held
+func (i *chunkIndex) chunkSize(objectID string) int64 {
+	if size, exists := i.sizes[objectID]; exists {
+		return size
+	}
+	return currentChunkSize()
+}
+
+// pin returns the current generation of an object and keeps its chunks
+// from being cleaned as stale until it is unpinned
+func (i *chunkIndex) pin(objectID string) int64 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	generation := i.generations[objectID]
+	if _, exists := i.pinned[objectID]; !exists {
+		i.pinned[objectID] = make(map[int64]int)
+	}
+	i.pinned[objectID][generation]++
+	return generation
+}
+
+// unpin releases a generation pinned by pin
+func (i *chunkIndex) unpin(objectID string, generation int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	// the pins of buffers closed after a cache reset are gone already
+	pinned, exists := i.pinned[objectID]
+	if !exists {
+		return
+	}
+	if pinned[generation]--; pinned[generation] <= 0 {
+		delete(pinned, generation)
+	}
+	if 0 == len(pinned) {
+		delete(i.pinned, objectID)
+	}
+}
+
+// generation returns the current cache generation of an object
+func (i *chunkIndex) generation(objectID string) int64 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.generations[objectID]
+}
+
+// add marks a chunk of the given generation as cached
+func (i *chunkIndex) add(objectID string, generation, offset, size int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if generation != i.generations[objectID] {
+		return
+	}
+
+	offsets, exists := i.objects[objectID]
+	if !exists {
+		offsets = make(map[int64]*chunkInfo)
+		i.objects[objectID] = offsets
+	}
+	if old, exists := offsets[offset]; exists {
+		i.forget(old)
+	}
+	i.sequence++
+	offsets[offset] = &chunkInfo{
+		Size:     size,
+		Accessed: time.Now(),
+		Written:  time.Now(),
+		Sequence: i.sequence,
+		element:  i.lru.PushBack(&lruChunk{objectID: objectID, offset: offset}),
+	}
+}
+
+// touch updates the access time and the hits of a cached chunk
+func (i *chunkIndex) touch(objectID string, generation, offset int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if generation != i.generations[objectID] {
+		return
+	}
+	if info, exists := i.objects[objectID][offset]; exists {
+		i.sequence++
+		info.Accessed = time.Now()
+		info.Hits++
+		info.Sequence = i.sequence
+		if nil != info.element {
+			i.lru.MoveToBack(info.element)
+		}
+	}
+}
+
+// info returns the metadata of the chunk stored under the given path
+func (i *chunkIndex) info(path string) (chunkInfo, bool) {
+	objectID, generation, size, offset, ok := parseChunkPath(path)
+	if !ok {
+		return chunkInfo{}, false
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if generation != i.generations[objectID] || size != i.chunkSize(objectID) {
+		return chunkInfo{}, false
+	}
+	info, exists := i.objects[objectID][offset]
+	if !exists {
+		return chunkInfo{}, false
+	}
+	return *info, true
+}
+
+// written returns the time a cached chunk of the given generation was written
+func (i *chunkIndex) written(objectID string, generation, offset int64) (time.Time, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	info, exists := i.objects[objectID][offset]
+	if !exists || generation != i.generations[objectID] {
+		return time.Time{}, false
+	}
+	return info.Written, true
+}
+
+// compressed checks if a cached chunk of the given generation is compressed
+func (i *chunkIndex) compressed(objectID string, generation, offset int64) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	info, exists := i.objects[objectID][offset]
+	return exists && generation == i.generations[objectID] && info.Compressed
+}
+
+// setCompressed marks the chunk stored under the given path as compressed
+// or not, with the size of the file it is stored in now
+func (i *chunkIndex) setCompressed(path string, compressed bool, size int64) {
+	objectID, generation, size, offset, ok := parseChunkPath(path)
+	if !ok {
+		return
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if generation != i.generations[objectID] || size != i.chunkSize(objectID) {
+		return
+	}
+	if info, exists := i.objects[objectID][offset]; exists {
+		info.Compressed = compressed
+		info.Size = size
+	}
+}
+
+// setIncompressible marks the chunk stored under the given path as not
+// getting smaller when compressed
+func (i *chunkIndex) setIncompressible(path string) {
+	objectID, generation, size, offset, ok := parseChunkPath(path)
+	if !ok {
+		return
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if generation != i.generations[objectID] || size != i.chunkSize(objectID) {
+		return
+	}
+	if info, exists := i.objects[objectID][offset]; exists {
+		info.Incompressible = true
+	}
+}
+
+// has checks if a chunk of the given generation is cached
+func (i *chunkIndex) has(objectID string, generation, offset int64) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	_, exists := i.objects[objectID][offset]
+	return exists && generation == i.generations[objectID]
+}
+
+// removePath marks the chunk stored under the given path as not cached anymore
+func (i *chunkIndex) removePath(path string) {
+	objectID, generation, size, offset, ok := parseChunkPath(path)
+	if !ok {
+		return
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if size != i.chunkSize(objectID) {
+		i.removeOtherSize(objectID, strings.TrimSuffix(filepath.Base(path), compressedSuffix))
+		return
+	}
+	if generation != i.generations[objectID] {
+		return
+	}
+	if sparseOffset == offset {
+		for _, info := range i.objects[objectID] {
+			i.forget(info)
+		}
+		i.objects[objectID] = make(map[int64]*chunkInfo)
+		return
+	}
+	if info, exists := i.objects[objectID][offset]; exists {
+		i.forget(info)
+		delete(i.objects[objectID], offset)
+	}
+}
+
+// isStale checks if the chunk stored under the given path belongs to an
+// outdated generation that is not pinned by a reader or to another chunk size
+func (i *chunkIndex) isStale(path string) bool {
+	objectID, generation, size, _, ok := parseChunkPath(path)
+	if !ok {
+		return false
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return size != i.chunkSize(objectID) || (generation < i.generations[objectID] && 0 == i.pinned[objectID][generation])
+}
+
+// offsetsBefore returns the offsets of the cached chunks of the given
+// generation below the given offset
+func (i *chunkIndex) offsetsBefore(objectID string, generation, before int64) []int64 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	offsets := []int64{}
+	if generation != i.generations[objectID] {
+		return offsets
+	}
+	for offset := range i.objects[objectID] {
+		if offset < before {
+			offsets = append(offsets, offset)
+		}
+	}
+	return offsets
+}
+
+// count returns the number of cached chunks of an object below the given size
+func (i *chunkIndex) count(objectID string, size int64) int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	count := 0
+	for offset := range i.objects[objectID] {
+		if offset < size {
+			count++
+		}
+	}
+	return count
+}
+
+// cachedBytes returns the number of cached bytes of the current generation
+// of an object of the given size
+func (i *chunkIndex) cachedBytes(objectID string, size int64) int64 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var cached int64
+	for offset, info := range i.objects[objectID] {
+		if offset < size {
+			cached += info.Size
+		}
+	}
+	return cached
+}
+
+// complete checks if all chunks of the given generation of an object of the
+// given size are cached. The number of cached chunks is checked first, so
+// that incomplete objects don't need a lookup per chunk.
+func (i *chunkIndex) complete(objectID string, generation, size int64) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	offsets := i.objects[objectID]
+	step := i.chunkSize(objectID)
+	if generation != i.generations[objectID] || int64(len(offsets)) < (size+step-1)/step {
+		return false
+	}
+	for offset := int64(0); offset < size; offset += step {
+		if _, exists := offsets[offset]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// missing returns the offsets of the chunks of the current generation that
+// are not cached for an object of the given size and the number of chunks
+// the object consists of
+func (i *chunkIndex) missing(objectID string, size int64) ([]int64, int) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	offsets := i.objects[objectID]
+	step := i.chunkSize(objectID)
+	missing := []int64{}
+	expected := 0
+	for offset := int64(0); offset < size; offset += step {
+		if _, exists := offsets[offset]; !exists {
+			missing = append(missing, offset)
+		}
+		expected++
+	}
+	return missing, expected
+}
+
+// objectIDs returns the ids of all objects with cached chunks
+func (i *chunkIndex) objectIDs() []string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	ids := make([]string, 0, len(i.objects))
+	for objectID, offsets := range i.objects {
+		if len(offsets) > 0 {
+			ids = append(ids, objectID)
+		}
+	}
+	return ids
+}
+
+// cachedChunks returns the generation, the chunk size and the metadata of
+// the cached chunks of an object
+func (i *chunkIndex) cachedChunks(objectID string) (int64, int64, map[int64]chunkInfo) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	infos := make(map[int64]chunkInfo, len(i.objects[objectID]))
+	for offset, info := range i.objects[objectID] {
+		infos[offset] = *info
+	}
+	return i.generations[objectID], i.chunkSize(objectID), infos
+}
+
+// evictionCandidates returns the cached chunks of the current generations
+// of all objects as eviction candidates
+func (i *chunkIndex) evictionCandidates() []*EvictionCandidate {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	candidates := []*EvictionCandidate{}
+	for objectID, offsets := range i.objects {
+		generation := i.generations[objectID]
+		size := i.chunkSize(objectID)
+		for offset, info := range offsets {
+			path := filepath.Join(chunkPath, objectID, chunkName(generation, size, offset))
+			if info.Compressed {
+				path += compressedSuffix
+			}
+			candidates = append(candidates, &EvictionCandidate{
+				Path:     path,
+				ObjectID: objectID,
+				Size:     info.Size,
+				Accessed: info.Accessed,
+				Hits:     info.Hits,
+				Sequence: info.Sequence,
+			})
+		}
+	}
+	return candidates
+}
+
+// chunkName builds the file name of a chunk
+func chunkName(generation, size, offset int64) string {
+	return fmt.Sprintf("%v_%v_%v", generation, size, offset)
+}
+
+// parseChunkName extracts generation, chunk size and offset from a chunk
+// file name. Bare offsets of older versions are treated as generation 0
+// with the current chunk size, sparse files and their maps are returned
+// with the sparse offset. Compressed chunks have the name of the chunk.
+func parseChunkName(name string) (int64, int64, int64, bool) {
+	parts := strings.Split(strings.TrimSuffix(name, compressedSuffix), "_")
+	if 1 == len(parts) {
+		offset, err := strconv.ParseInt(parts[0], 10, 64)
+		return 0, currentChunkSize(), offset, nil == err
+	}
+	if 3 != len(parts) {
+		return 0, 0, 0, false
+	}
+	if "sparse" == parts[2] || sparseMapName("sparse") == parts[2] {
+		parts[2] = strconv.Itoa(sparseOffset)
+	}
+
+	var values [3]int64
+	for n, part := range parts {
+		value, err := strconv.ParseInt(part, 10, 64)
+		if nil != err {
+			return 0, 0, 0, false
+		}
+		values[n] = value
+	}
+
+	return values[0], values[1], values[2], true
+}
+
+// parseChunkPath extracts the object id, generation, chunk size and offset
+// from a chunk file path
+func parseChunkPath(path string) (string, int64, int64, int64, bool) {
+	rel, err := filepath.Rel(chunkPath, path)
+	if nil != err {
+		return "", 0, 0, 0, false
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if 2 != len(parts) {
+		return "", 0, 0, 0, false
+	}
+
+	generation, size, offset, ok := parseChunkName(parts[1])
+	return parts[0], generation, size, offset, ok
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeLegacyChunks writes the chunks of an object the way older versions
+// did, named by their bare offset
+func writeLegacyChunks(t testing.TB, dir, objectID string, content []byte) {
+	objectDir := filepath.Join(dir, objectID)
+	if err := os.MkdirAll(objectDir, 0777); nil != err {
+		t.Fatal(err)
+	}
+	for offset := 0; offset < len(content); offset += testChunkSize {
+		end := offset + testChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		if err := ioutil.WriteFile(filepath.Join(objectDir, strconv.Itoa(offset)), content[offset:end], 0644); nil != err {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fileExists checks if a file exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return nil == err
+}
+
+func TestLegacyChunksAreServed(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	server := newTestServer(3*testChunkSize, nil)
+	defer server.Close()
+	writeLegacyChunks(t, dir, "legacy", server.content)
+
+	buffer := openTestBuffer(t, server.object("legacy"))
+	defer buffer.Close()
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes that don't match the legacy chunks", len(got))
+	}
+	if 0 != server.requestCount() {
+		t.Fatalf("requested %v ranges although the legacy chunks cover the object", server.requestCount())
+	}
+	if fileExists(filepath.Join(dir, "legacy", "0")) || !fileExists(filepath.Join(dir, "legacy", chunkName(0, testChunkSize, 0))) {
+		t.Fatalf("legacy chunk was not renamed to the chunk of generation 0")
+	}
+}
+
+func TestLegacyChunksAreDeletedOnceOutdated(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(2 * testChunkSize)
+	writeLegacyChunks(t, dir, "outdated", content)
+
+	chunks.load("outdated")
+	adopted := filepath.Join(dir, "outdated", chunkName(0, testChunkSize, testChunkSize))
+	if chunks.isStale(adopted) {
+		t.Fatalf("legacy chunk of the current generation is stale")
+	}
+	if err := deleteStaleChunks(dir); nil != err {
+		t.Fatal(err)
+	}
+	if !fileExists(adopted) {
+		t.Fatalf("legacy chunk of the current generation was deleted")
+	}
+
+	// a new generation makes the legacy chunks stale
+	InvalidateObject("outdated")
+	if err := deleteStaleChunks(dir); nil != err {
+		t.Fatal(err)
+	}
+	if fileExists(adopted) {
+		t.Fatalf("legacy chunk of an outdated generation was kept")
+	}
+}
+
+func TestLegacyChunksOfOutdatedGenerationsAreIgnored(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(2 * testChunkSize)
+	writeLegacyChunks(t, dir, "newer", content)
+	if err := ioutil.WriteFile(filepath.Join(dir, "newer", chunkName(1, testChunkSize, 0)), content[:testChunkSize], 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	chunks.load("newer")
+	if 1 != chunks.generation("newer") {
+		t.Fatalf("loaded generation %v instead of 1", chunks.generation("newer"))
+	}
+	if chunks.has("newer", 1, testChunkSize) {
+		t.Fatalf("legacy chunk was indexed in generation 1")
+	}
+	legacy := filepath.Join(dir, "newer", strconv.Itoa(testChunkSize))
+	if !fileExists(legacy) || !chunks.isStale(legacy) {
+		t.Fatalf("legacy chunk next to a newer generation is not stale")
+	}
+}
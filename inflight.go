@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// inflightIdleTimeout is the time a read waits for a running download that
+// receives no bytes, before it downloads the bytes itself
+const inflightIdleTimeout = 10 * time.Second
+
+// inflightRange is a range that is being received from the API. Reads of
+// bytes within it are served as soon as their bytes arrived, instead of
+// waiting for the whole chunk.
+type inflightRange struct {
+	generation int64
+	offset     int64
+	bytes      []byte
+	received   int64
+	done       bool
+	waiters    int
+}
+
+// receiveInto reads a response body into bytes, of which the first
+// received bytes arrived already, and lets other reads use the received
+// bytes in the meantime. It returns the number of bytes read.
+func (b *Buffer) receiveInto(body io.Reader, generation, offset int64, bytes []byte, received int64) (int64, error) {
+	r := &inflightRange{generation: generation, offset: offset, bytes: bytes, received: received}
+	b.lock.Lock()
+	if nil == b.inflight {
+		b.inflight = make(map[*inflightRange]bool)
+	}
+	b.inflight[r] = true
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		delete(b.inflight, r)
+		r.done = true
+		if r.waiters > 0 {
+			b.downloadDone.Broadcast()
+		}
+	}()
+
+	n := received
+	for n < int64(len(bytes)) {
+		read, err := body.Read(bytes[n:])
+		if read > 0 {
+			n += int64(read)
+			b.lock.Lock()
+			r.received = n
+			if r.waiters > 0 {
+				b.downloadDone.Broadcast()
+			}
+			b.lock.Unlock()
+		}
+		if nil != err {
+			return n - received, err
+		}
+	}
+	return n - received, nil
+}
+
+// receiveRange reads the body of a response for the range at the given
+// offset like ioutil.ReadAll, but at most one byte more than expected, so
+// that a misbehaving server sending more than the range is noticed. Only
+// the expected bytes are shared with other reads.
+func (b *Buffer) receiveRange(body io.Reader, generation, offset, expected int64) ([]byte, error) {
+	bytes := make([]byte, expected+1)
+	n, err := b.receiveInto(body, generation, offset, bytes[:expected], 0)
+	if nil == err {
+		more, _ := io.ReadFull(body, bytes[expected:])
+		n += int64(more)
+	}
+	if io.EOF == err {
+		err = nil
+	}
+	return bytes[:n], err
+}
+
+// readInflight serves a read of bytes that another read is receiving right
+// now, as soon as they arrived. It returns false if no running download
+// receives the bytes or it ended before they arrived, and reports a stalled
+// download that received nothing for the inflight idle timeout.
+func (b *Buffer) readInflight(generation, start, size int64) ([]byte, bool, bool) {
+	if size <= 0 {
+		return nil, false, false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var r *inflightRange
+	for candidate := range b.inflight {
+		if generation == candidate.generation && start >= candidate.offset && start+size <= candidate.offset+int64(len(candidate.bytes)) {
+			r = candidate
+			break
+		}
+	}
+	if nil == r {
+		return nil, false, false
+	}
+
+	r.waiters++
+	defer func() {
+		r.waiters--
+	}()
+	need := start + size - r.offset
+	received := r.received
+	deadline := time.Now().Add(inflightIdleTimeout)
+	for r.received < need && !r.done && !b.closed {
+		if !b.waitUntil(deadline) {
+			Log.Debugf("Download of object %v bytes %v stalled at %v bytes", b.object.ObjectID, r.offset, r.received)
+			return nil, false, true
+		}
+		if r.received != received {
+			received = r.received
+			deadline = time.Now().Add(inflightIdleTimeout)
+		}
+	}
+	if r.received < need {
+		return nil, false, false
+	}
+
+	result := make([]byte, size)
+	copy(result, r.bytes[start-r.offset:need])
+	return result, true, false
+}
+
+// waitUntil waits for the download condition of the buffer like Wait, but
+// returns false once the deadline passed. The lock must be held.
+func (b *Buffer) waitUntil(deadline time.Time) bool {
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return false
+	}
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		b.lock.Lock()
+		expired = true
+		b.downloadDone.Broadcast()
+		b.lock.Unlock()
+	})
+	b.downloadDone.Wait()
+	timer.Stop()
+	return !expired
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOverlappingReadsOfInflightChunk(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(2 * testChunkSize)
+	release := make(chan struct{})
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := requestedRange(r)
+		if !ok || 0 != start {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		// the first chunk arrives in two halves, the second one once the
+		// test releases it
+		body := content[start : end+1]
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", len(body)))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(body[len(body)/2:])
+	})
+	defer server.Close()
+	object := server.object("inflight")
+	object.Size = uint64(len(content))
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	var failures int32
+	read := func(readers *sync.WaitGroup, offset, size int64) {
+		defer readers.Done()
+		p := make([]byte, size)
+		n, err := buffer.ReadInto(p, offset)
+		if nil != err || !bytes.Equal(content[offset:offset+int64(n)], p[:n]) || 0 == n {
+			atomic.AddInt32(&failures, 1)
+		}
+	}
+	var first sync.WaitGroup
+	first.Add(1)
+	go read(&first, 0, 1000)
+	arrived := func() bool {
+		buffer.lock.Lock()
+		defer buffer.lock.Unlock()
+		for r := range buffer.inflight {
+			if r.received >= testChunkSize/2 {
+				return true
+			}
+		}
+		return false
+	}
+	if !eventually(arrived) {
+		close(release)
+		t.Fatalf("first half of the chunk was not received")
+	}
+
+	// overlapping reads of the received half are served while the chunk
+	// is still being downloaded
+	var received sync.WaitGroup
+	for n := int64(0); n < 16; n++ {
+		received.Add(1)
+		go read(&received, n*1000, 3000)
+	}
+	done := make(chan struct{})
+	go func() {
+		received.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatalf("reads of received bytes waited for the whole chunk")
+	}
+
+	// reads of the missing half wait for their bytes
+	var missing sync.WaitGroup
+	for n := int64(0); n < 4; n++ {
+		missing.Add(1)
+		go read(&missing, testChunkSize/2+n*5000, 10000)
+	}
+	close(release)
+	missing.Wait()
+	first.Wait()
+
+	if 0 != failures {
+		t.Fatalf("%v overlapping reads failed or returned wrong bytes", failures)
+	}
+	requests := 0
+	for _, requested := range server.requestedRanges() {
+		if start, _, ok := requestedRange(&http.Request{Header: http.Header{"Range": {requested}}}); ok && 0 == start {
+			requests++
+		}
+	}
+	if 1 != requests {
+		t.Fatalf("requested the first chunk %v times for overlapping reads", requests)
+	}
+}
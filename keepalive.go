@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var keepaliveIdle time.Duration
+
+// SetKeepaliveIdle sets the idle time of an open buffer after which a tiny
+// range request keeps its connection warm (0 = disabled)
+func SetKeepaliveIdle(idle time.Duration) {
+	keepaliveIdle = idle
+}
+
+// keepalive sends a tiny range request whenever the buffer was idle for the
+// keepalive idle time, so that resuming a paused stream doesn't pay for a
+// new connection. It stops as soon as the buffer is closed.
+func (b *Buffer) keepalive(stop <-chan struct{}) {
+	interval := keepaliveIdle / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPing := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		b.lock.Lock()
+		lastRead := b.lastRead
+		b.lock.Unlock()
+
+		if time.Since(lastRead) < keepaliveIdle || time.Since(lastPing) < keepaliveIdle {
+			continue
+		}
+		lastPing = time.Now()
+		b.ping()
+	}
+}
+
+// ping requests the first byte of the object and discards it
+func (b *Buffer) ping() {
+	source := b.source()
+	urls := source.DownloadURLs()
+	if 0 == len(urls) {
+		return
+	}
+	url := urls[0]
+	if nil != urlRewriter {
+		url = urlRewriter(source, url)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return
+	}
+	req.Header.Add("Range", "bytes=0-0")
+
+	Log.Tracef("Sending keepalive request for object %v", b.object.ObjectID)
+	res, err := b.httpClient().Do(req)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return
+	}
+	// the connection is only reused if the body was read till the end
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+}
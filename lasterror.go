@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxObjectErrors is the maximum number of objects whose last error is kept
+const maxObjectErrors = 1000
+
+var objectErrors = struct {
+	lock   sync.Mutex
+	errors map[string]*ObjectError
+}{
+	errors: make(map[string]*ObjectError),
+}
+
+// ObjectError is the last error that occurred while reading an object
+type ObjectError struct {
+	ObjectID   string    `json:"objectId"`
+	Message    string    `json:"message"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+func (e *ObjectError) Error() string {
+	return fmt.Sprintf("%v (%v ago)", e.Message, time.Since(e.Time))
+}
+
+// LastError returns the last read error of an object, nil if reading the
+// object didn't fail recently
+func LastError(objectID string) *ObjectError {
+	objectErrors.lock.Lock()
+	defer objectErrors.lock.Unlock()
+
+	if err, exists := objectErrors.errors[objectID]; exists {
+		copied := *err
+		return &copied
+	}
+	return nil
+}
+
+// recordError remembers the error as last error of the object. If errors
+// of too many objects are kept, the oldest one is dropped.
+func recordError(objectID string, err error) {
+	objectError := &ObjectError{
+		ObjectID: objectID,
+		Message:  err.Error(),
+		Time:     time.Now(),
+	}
+	if statusErr, ok := err.(*StatusError); ok {
+		objectError.StatusCode = statusErr.StatusCode
+		objectError.RequestID = statusErr.RequestID
+	}
+
+	objectErrors.lock.Lock()
+	defer objectErrors.lock.Unlock()
+
+	if _, exists := objectErrors.errors[objectID]; !exists && len(objectErrors.errors) >= maxObjectErrors {
+		var oldest *ObjectError
+		for _, e := range objectErrors.errors {
+			if nil == oldest || e.Time.Before(oldest.Time) {
+				oldest = e
+			}
+		}
+		delete(objectErrors.errors, oldest.ObjectID)
+	}
+	objectErrors.errors[objectID] = objectError
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// readRateInterval is the minimum time a sample of the read rate of a
+// buffer covers
+const readRateInterval = 1 * time.Second
+
+// readRateWeight is the weight of a new sample in the read rate
+const readRateWeight = 0.3
+
+var preloadLeadTime time.Duration
+
+// SetPreloadLeadTime sets the playback time preloads stay ahead of the
+// reader (0 = disabled). The read rate of every file is measured from the
+// reads of its player, so that a player filling its own buffer and pausing
+// gets as many chunks preloaded as it plays in the lead time.
+func SetPreloadLeadTime(lead time.Duration) {
+	preloadLeadTime = lead
+}
+
+// measureReadRate updates the read rate with a read before the last read
+// offset is updated, the lock must be held. Seeks start a new sample
+// without updating the rate.
+func (b *Buffer) measureReadRate(start int64, now time.Time) {
+	if preloadLeadTime <= 0 {
+		return
+	}
+	sequential := start >= b.lastOffset && start-b.lastOffset <= 2*b.chunkSize
+	if b.rateSampled.IsZero() || !sequential {
+		b.rateSampled = now
+		b.rateOffset = start
+		return
+	}
+
+	elapsed := now.Sub(b.rateSampled)
+	if elapsed < readRateInterval {
+		return
+	}
+	sample := float64(start-b.rateOffset) / elapsed.Seconds()
+	if 0 == b.readRate {
+		b.readRate = sample
+	} else {
+		b.readRate = b.readRate*(1-readRateWeight) + sample*readRateWeight
+	}
+	b.rateSampled = now
+	b.rateOffset = start
+}
+
+// leadDepth returns the number of chunks the reader reads in the preload
+// lead time, if the read rate is known
+func (b *Buffer) leadDepth() (int, bool) {
+	if preloadLeadTime <= 0 {
+		return 0, false
+	}
+
+	b.lock.Lock()
+	rate := b.readRate
+	b.lock.Unlock()
+
+	if rate <= 0 {
+		return 0, false
+	}
+	depth := int(math.Ceil(rate * preloadLeadTime.Seconds() / float64(b.chunkSize)))
+	if depth < 1 {
+		depth = 1
+	}
+	return depth, true
+}
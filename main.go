@@ -31,13 +31,132 @@ func main() {
 	argLogLevel := flag.IntP("verbosity", "v", 0, "Set the log level (0 = error, 1 = warn, 2 = info, 3 = debug, 4 = trace)")
 	argConfigPath := flag.StringP("config", "c", filepath.Join(user.HomeDir, ".plexdrive"), "The path to the configuration directory")
 	argTempPath := flag.StringP("temp", "t", os.TempDir(), "Path to a temporary directory to store temporary data")
+	argChunkSparse := flag.Bool("chunk-sparse", false, "Store all chunks of a file in one sparse file instead of one file per chunk")
 	argChunkSize := flag.Int64("chunk-size", 5*1024*1024, "The size of each chunk that is downloaded (in byte)")
+	argChunkProbe := flag.Bool("chunk-probe", false, "Choose the chunk size of every file by the throughput of a small download on its first open")
+	argChunkProbeMin := flag.Int64("chunk-probe-min", 1024*1024, "The smallest chunk size the chunk size probe chooses (in byte)")
+	argChunkProbeMax := flag.Int64("chunk-probe-max", 64*1024*1024, "The largest chunk size the chunk size probe chooses (in byte)")
+	argMaxObjectDownloads := flag.Int("max-object-downloads", 3, "The maximum number of chunks of one file downloaded at once (0 = unlimited)")
+	argBufferLinger := flag.Duration("buffer-linger", 5*time.Second, "The time the buffer of a closed file is kept for reopening it (0 = close right away)")
+	argLingerPreload := flag.Bool("linger-preload", false, "Keep preloading chunks while the buffer of a closed file lingers")
+	argMirrors := flag.String("mirrors", "", "Copies of files to read from once a file is gone or keeps failing (e.g. id=mirror-id,id2=mirror-id2)")
+	argMaxBufferAge := flag.Duration("max-buffer-age", 6*time.Hour, "The time after which an open file refreshes its metadata and download urls on the next read (0 = never)")
+	argBufferCreationRate := flag.Int("buffer-creation-rate", 0, "The maximum number of files opened per second that have no buffer yet, further opens are delayed for up to 10s and then fail with EAGAIN (0 = unlimited)")
+	argResumeWindow := flag.Int64("resume-window", 0, "Keep this many bytes of chunks around the last read offset of a closed file, so that resuming its playback starts right away (in byte, 0 = disabled)")
+	argResumeRetention := flag.Duration("resume-retention", 24*time.Hour, "The time the chunks around the last read offset of a closed file are kept")
+	argReadRepair := flag.Bool("read-repair", false, "Download the chunks missing between the cached chunks of a file in the background once it is closed, e.g. gaps left by seeks or failed chunks")
+	argReadRepairPriority := flag.String("read-repair-priority", "background", "The priority of the read repair downloads (background = after all other reads, prefetch = like preloads, dropped when all download slots are in use)")
+	argScanThreshold := flag.Int("scan-threshold", 0, "Suppress preloads during a library scan, detected by this many brief accesses within a minute (0 = disabled)")
+	argScanReadSize := flag.Int64("scan-read-size", 1024*1024, "An access of a file reading less than this is brief (in byte)")
+	argScanOpenTime := flag.Duration("scan-open-time", 10*time.Second, "An access of a file closed within this time is brief")
+	argPreloadRecover := flag.Bool("preload-recover", true, "Only abort a preload that panicked instead of the whole process")
+	argMaxOpenBuffers := flag.Int("max-open-buffers", 0, "The maximum number of files open for reading at once, further opens fail with EAGAIN (0 = unlimited)")
+	argMaxOpenChunks := flag.Int("max-open-chunks", 256, "The maximum number of chunk files open at once")
+	argObjectAccountDir := flag.String("object-account-dir", "", "A directory of service account keys and OAuth tokens (JSON files) named by the id of the object they download, for files shared by other accounts (\"\" = download all files with the account of the mount)")
+	argAccountFile := flag.String("account-file", "", "A directory of service account keys and OAuth tokens (JSON files) to download with once the account of the mount hits a download limit, the accounts are used in turn (\"\" = only the account of the mount)")
+	argDailyDownloadCap := flag.Int64("daily-download-cap", 0, "The maximum number of bytes downloaded per day, afterwards only cached chunks are served till midnight pacific time (in byte, 0 = unlimited)")
+	argExportManifest := flag.String("export-manifest", "", "Write a manifest of the cached chunks with their hashes to this file on startup, e.g. to warm the cache of another instance")
+	argImportManifest := flag.String("import-manifest", "", "Warm the cache with the chunks listed in this manifest of another instance on startup")
+	argImportManifestChunks := flag.String("import-manifest-chunks", "", "The chunk directory of the instance that exported the manifest, its chunks are copied instead of downloaded (e.g. on a shared path)")
+	argImportRclone := flag.String("import-rclone-cache", "", "Copy the chunks cached by rclone mount from its VFS cache directory of the remote on startup (e.g. ~/.cache/rclone/vfs/gdrive)")
+	argWebDAVListen := flag.String("webdav-listen", "", "Serve the files read-only over WebDAV on this address, a bare port listens on 127.0.0.1 (e.g. :8080, default = disabled)")
+	argWebDAVAuth := flag.String("webdav-auth", "", "Require HTTP basic authentication with this user and password for WebDAV (e.g. user:password, default = no authentication)")
+	argHealthListen := flag.String("health-listen", "", "Serve a health check for liveness probes on this address (e.g. :7789, default = disabled)")
+	argHealthObject := flag.String("health-object", "", "The id of a file whose first byte the health check downloads (default = request the root folder)")
+	argPeers := flag.String("peers", "", "Ask these plexdrive instances for missing chunks before Google Drive (e.g. http://10.0.0.2:7788,http://10.0.0.3:7788)")
+	argPeerListen := flag.String("peer-listen", "", "Serve the cached chunks to other plexdrive instances on this address (e.g. :7788, default = disabled)")
+	argPeerSecret := flag.String("peer-secret", "", "The secret shared by the peers, chunks are only served to and requested with it (default = none)")
+	argAcknowledgeAbuse := flag.Bool("acknowledge-abuse", false, "Download files Google Drive flagged as malware or spam (only for files you trust)")
+	argDownloadProxy := flag.String("download-proxy", "", "Send chunk requests to this proxy / CDN instead of Google Drive (e.g. https://cdn.example.com)")
+	argKeepaliveIdle := flag.Duration("keepalive-idle", 0, "Keep the connection of open files that were idle for this time warm, so that paused streams resume faster (0 = disabled)")
+	argMaxDownloads := flag.Int("max-downloads", 0, "The maximum number of chunks downloaded at once (0 = unlimited)")
+	argPausePolicy := flag.String("pause-policy", "wait", "The behavior of reads of missing chunks while downloads are paused with SIGUSR2 (wait = wait for the download wait timeout, fail = fail the read)")
+	argPauseCancel := flag.Bool("pause-cancel", false, "Cancel running downloads when downloads are paused with SIGUSR2")
+	argPreloadWhenIdle := flag.Bool("preload-when-idle", false, "Only preload while no read of a player is downloading, so that preloads don't compete for bandwidth")
+	argPreloadWhenBusy := flag.String("preload-when-busy", "drop", "The behavior of preloads if all download slots are in use (drop = skip the preload, wait = wait for a slot)")
+	argDownloadWaitTimeout := flag.Duration("download-wait-timeout", 1*time.Minute, "The maximum time a read waits for a free download slot (0 = no timeout)")
+	argMaxBufferMemory := flag.Int64("max-buffer-memory", 0, "The maximum memory held by all open files, the least recently read files drop their in-memory state first (in byte, 0 = unlimited)")
+	argMinReadSize := flag.Int64("min-read-size", 0, "The minimum size of a read, smaller reads are served from one larger read (in byte)")
+	argChunkReadOnly := flag.Bool("chunk-read-only", false, "Use the chunk directory as read-only cache populated by another instance (e.g. on a network share)")
+	argRangeEncoding := flag.String("range-encoding", "reject", "The behavior if a chunk response is compressed although it was requested uncompressed, e.g. by a proxy (reject = request the chunk from the next download endpoint, decode = decode gzip and keep it if it holds exactly the chunk)")
+	argPartialReadFailure := flag.String("partial-read-failure", "partial", "The behavior if a read spanning multiple chunks fails after the first chunk (partial = return the bytes read so far, fail = fail the read)")
+	argDiskFullEviction := flag.Int64("disk-full-eviction", 4*5*1024*1024, "The bytes of chunks evicted once a chunk write finds the disk full, before the write is tried again (in byte, 0 = don't evict)")
+	argChunkWriteFailure := flag.String("chunk-write-failure", "stream", "The behavior if chunks can not be written (stream = serve without caching, fail = fail the read)")
+	argVerifyMD5 := flag.Bool("verify-md5", false, "Verify the md5 checksum of objects once they are fully cached")
+	argChunkWriteQueue := flag.Int("chunk-write-queue", 16, "The maximum number of staged chunks waiting to be written, further chunks are written before they are served")
+	argChunkMemory := flag.Int64("chunk-memory-size", 0, "Keep the most recently read chunks in memory and serve reads of them from memory, using up to this memory (in byte, 0 = read cached chunks from disk)")
+	argChunkStaging := flag.Int64("chunk-staging-size", 0, "Serve downloaded chunks from memory while they are written to disk in the background, using up to this memory for unwritten chunks (in byte, 0 = write chunks before serving them)")
+	argChunkMigrate := flag.Bool("chunk-migrate", false, "Move chunks cached as one file per chunk to sparse files or back in the background, while reads still find them in both layouts")
+	argCacheSalt := flag.String("cache-salt", "", "Cache the chunks in a separate chunk directory per salt, e.g. the account name of every instance sharing the --temp directory (\"\" = no salt)")
+	argChunkConfig := flag.String("chunk-config", "", "A JSON file with the chunkSize and chunkDirMaxSize reloaded on SIGHUP (\"\" = disabled)")
+	argExportNative := flag.String("export-native", "", "Export Google Docs, Sheets and Slides in the first of these formats they support, e.g. docx,xlsx,pptx,pdf (\"\" = disabled)")
+	argSharedCache := flag.Bool("shared-cache", false, "Lock the chunk directory, so that several instances can cache chunks in the same --temp directory")
+	argChunkStorage := flag.String("chunk-storage", "auto", "The medium of the chunk directory (auto = detect a tmpfs, tmpfs = never sync chunks and fill at most half of the tmpfs without --clear-chunk-max-size, disk)")
+	argChunkFsync := flag.Bool("chunk-fsync", false, "Sync every written chunk to disk, so that cached chunks survive a power loss (slower)")
+	argChunkMmap := flag.Bool("chunk-mmap", false, "Use memory mapped reads for cached chunks (linux / mac, requires the mmap build tag)")
+	argTailCacheSize := flag.Int64("tail-cache-size", 0, "Download this many bytes at the end of every opened file right away and keep them cached for 10 minutes, for players reading an index at the end of a file (in byte, 0 = disabled)")
+	argHeadCacheSize := flag.Int64("head-cache-size", 0, "Download this many bytes at the beginning of every opened file right away and keep them cached, so that playback starts instantly (in byte, 0 = disabled)")
+	argPreloadThreshold := flag.Float64("preload-threshold", 0, "The fraction of a chunk that has to be read before the next chunk is preloaded (0 = preload immediately)")
+	argPreloadTriggerOffset := flag.Int64("preload-trigger-offset", 0, "The distance to the end of a chunk the reader has to come within before the next chunk is preloaded, replaces --preload-threshold (in byte, 0 = disabled)")
+	argPreloadMinReads := flag.Int64("preload-min-reads", 0, "The number of reads of a file before it is preloaded, so that probing a file doesn't preload it (0 = preload on the first read)")
+	argPreloadMinOpen := flag.Duration("preload-min-open", 0, "The time a file has to be open before it is preloaded, either this or --preload-min-reads activates the preloads (0 = disabled)")
+	argPreloadRampInitial := flag.Int("preload-ramp-initial", 1, "The number of chunks preloaded when starting to read a file with the preload ramp")
+	argMaxPreloads := flag.Int64("max-preloads", 256, "The maximum number of preloads running at the same time, further preloads are skipped (0 = unlimited)")
+	argPreloadLeadTime := flag.Duration("preload-lead-time", 0, "Preload the chunks of the playback time ahead of the reader, measured from the read rate of every file (0 = disabled)")
+	argPreloadMaxAhead := flag.Int64("preload-max-ahead", 4*5*1024*1024, "The maximum number of bytes preloaded past the read position (in byte, 0 = unlimited)")
+	argPreloadRampMax := flag.Int("preload-ramp-max", 0, "Double the preloaded chunks with every sequentially read chunk up to this number (0 = disabled)")
+	argPreloadSchedule := flag.String("preload-schedule", "", "Daily windows with a different number of preloaded chunks (e.g. 01:00-06:00=8,18:00-23:00=0, default = 1 chunk)")
+	argSerialMinSize := flag.Uint64("serial-min-size", 0, "Stream objects of at least this size one chunk at a time without preload (in byte, 0 = disabled)")
+	argSerialPattern := flag.String("serial-pattern", "", "Stream objects whose name matches one of the patterns one chunk at a time without preload (e.g. *.iso,*.mkv)")
+	argSmallObjectSize := flag.Int64("small-object-size", 0, "Download files up to this size (e.g. posters) in one request and serve them from memory (in byte, 0 = disabled)")
+	argSmallObjectCacheSize := flag.Int64("small-object-cache-size", 64*1024*1024, "The size of the memory cache for small files (in byte)")
+	argRangeAlignment := flag.Int64("range-alignment", 0, "Align requested ranges to this boundary, e.g. for a CDN in front of Google Drive (in byte, 0 = chunk size)")
+	argBandwidthLimit := flag.Int64("bandwidth-limit", 0, "The maximum download rate of all files together, shared equally between the files that are played (in bytes per second, 0 = unlimited)")
+	argBandwidthFairness := flag.String("bandwidth-fairness", "stream", "How the bandwidth limit is shared (stream = equally per played file, user = equally per user playing files)")
+	argSoftStart := flag.Duration("soft-start", 0, "Limit the downloads of a newly opened file to --soft-start-rate for this time, so that many streams starting at once don't burst Google Drive (0 = disabled)")
+	argSoftStartRate := flag.Int64("soft-start-rate", 4*1024*1024, "The download rate of a newly opened file during the soft start (in byte per second)")
+	argRequestPacing := flag.Duration("request-pacing", 0, "The minimum time between two chunk requests, doubled while Google Drive rate limits requests (0 = disabled)")
+	argRateLimitMinRange := flag.Int64("rate-limit-min-range", 0, "Halve the ranges requested from Google Drive down to this size while it keeps rate limiting requests, the chunks are still cached in their full size (in byte, 0 = disabled)")
+	argParallelStreams := flag.Int("parallel-streams", 1, "The number of requests every chunk is downloaded with, each requesting an equal part of at least 1 MB")
+	argDownloadSplitFloor := flag.Int64("download-split-floor", 0, "Retry chunks that timed out or failed on the network in halves down to this size (in byte, 0 = disabled)")
+	argShortBodyRetries := flag.Int("short-body-retries", 2, "How often the rest of a range is requested if a download ended early")
+	argEarlyFirstRead := flag.Bool("early-first-read", false, "Return the first read of a file as soon as its bytes arrived and cache the rest of the chunk in the background")
+	argDiskLatency := flag.Duration("disk-latency-threshold", 0, "Stream without the chunk directory for the rest of the session once reading or writing chunks takes longer than this on average (0 = disabled)")
+	argMemoryOnly := flag.Bool("memory-only", false, "Stream without the chunk directory, keeping only the last downloaded chunk of every file in memory")
+	argSlowRead := flag.Duration("slow-read", 2*time.Second, "Log reads that take longer than this (0 = disabled)")
+	argCacheProxy := flag.String("cache-proxy", "", "Send the download requests through this caching forward proxy, e.g. a local squid (e.g. http://localhost:3128)")
+	argCacheProxyPlain := flag.Bool("cache-proxy-plain", false, "Send the download requests as HTTP to the cache proxy, which has to forward them as HTTPS, so that it can cache them")
+	argCacheProxyCA := flag.String("cache-proxy-ca", "", "The CA certificate file (PEM) of a cache proxy that re-signs TLS")
+	argReadBuffer := flag.Int("download-read-buffer", 0, "The socket receive buffer of download connections, e.g. for links with a high latency (in byte, 0 = OS default)")
+	argFullyCachedCommand := flag.String("fully-cached-command", "", "Run this command with the id and the name of a file as arguments once the file is cached completely, e.g. to mark it as available offline (default = disabled)")
+	argDownloadCookies := flag.String("download-cookies", "", "A cookie file in the Netscape format whose cookies are sent with the download requests, e.g. of a download session of a proxy")
+	argReferer := flag.String("referer", "", "The Referer header of all download requests, e.g. for a proxy in front of the API")
+	argOrigin := flag.String("origin", "", "The Origin header of all download requests, e.g. for a proxy in front of the API")
+	argWarmWorkers := flag.Int("warm-workers", 2, "The number of files queued with the user.plexdrive.warm attribute that are cached at the same time")
+	argVerifyIdentity := flag.Bool("verify-object-identity", false, "Check that the download urls of a file name it and that every response has the size of the file, so that a wrong download url never caches another file")
+	argVerifyLength := flag.Bool("verify-content-length", true, "Check the Content-Length of responses against the requested range, so that truncated responses are requested again instead of cached")
+	argRetryDeadline := flag.Duration("retry-deadline", 0, "The maximum time a read spends on retrying its download before it fails with EAGAIN (0 = unlimited)")
+	argReadTimeout := flag.Duration("read-timeout", 2*time.Minute, "The maximum time a read waits for Google Drive (0 = no timeout)")
+	argOffline := flag.Bool("offline", false, "Only serve cached chunks and never download chunks from Google Drive")
+	argFreshWindow := flag.Duration("fresh-window", 0, "Files modified within this time cache chunks at most as long as the time since their modification (0 = disabled)")
+	argStaleIfError := flag.Duration("stale-if-error", 0, "The time cached chunks that need to be revalidated are still served after Google Drive became unreachable (0 = disabled)")
 	argRefreshInterval := flag.Duration("refresh-interval", 5*time.Minute, "The time to wait till checking for changes")
 	argClearInterval := flag.Duration("clear-chunk-interval", 1*time.Minute, "The time to wait till clearing the chunk directory")
 	argClearChunkAge := flag.Duration("clear-chunk-age", 30*time.Minute, "The maximum age of a cached chunk file")
+	argChunkCompressAge := flag.Duration("chunk-compress-age", 0, "Compress cached chunks that were not read for this time, they are decompressed on their next read (0 = disabled)")
 	argClearChunkMaxSize := flag.Int64("clear-chunk-max-size", 0, "The maximum size of the temporary chunk directory (in byte)")
+	argCacheMaxSize := flag.Int64("cache-max-size", 0, "The maximum size of the memory and the disk cache together, replaces --clear-chunk-max-size and --small-object-cache-size (in byte, 0 = disabled)")
+	argCacheMemoryFraction := flag.Float64("cache-memory-fraction", 0.1, "The fraction of --cache-max-size used for the memory cache")
+	argEvictOnRelease := flag.Int("evict-on-release", 0, "Delete the cached chunks of a closed file while the chunk directory is filled above this percentage of --clear-chunk-max-size (0 = keep them)")
+	argThrashThreshold := flag.Int("thrash-threshold", 0, "The number of evicted chunks per minute the cache is considered too small at (0 = disabled)")
+	argThrashBypass := flag.Bool("thrash-bypass", false, "Stream downloads without caching them while the cache is too small")
+	argCachePartitions := flag.String("cache-partitions", "", "Reserve cache space for the files in folders, their chunks are evicted last while within the quota (e.g. folder-id=107374182400,folder-id2=53687091200)")
+	argEvictionExemption := flag.String("eviction-exemption", "none", "Which chunks of open files are only evicted if no other chunk is left (none, first, last or both)")
+	argEvictionPressureCommand := flag.String("eviction-pressure-command", "", "Run this command with the missing bytes as argument when only pinned chunks are left to evict, the oldest pins are released if it doesn't release any within 30 seconds (default = release the oldest pins right away)")
+	argEvictionPolicy := flag.String("eviction-policy", "lru", "Which cached chunk is evicted first if the chunk directory is full (lru, lfu or size)")
 	argMountOptions := flag.StringP("fuse-options", "o", "", "Fuse mount options (e.g. -fuse-options allow_other,...)")
 	argVersion := flag.Bool("version", false, "Displays program's version information")
+	argSelfTest := flag.Bool("self-test", false, "Tests the chunk cache in the temp directory and exits")
 	argUID := flag.Int64("uid", -1, "Set the mounts UID (-1 = default permissions)")
 	argGID := flag.Int64("gid", -1, "Set the mounts GID (-1 = default permissions)")
 	argUmask := flag.Uint32("umask", 0, "Override the default file permissions")
@@ -51,7 +170,7 @@ func main() {
 
 	// check if mountpoint is specified
 	argMountPoint := flag.Arg(0)
-	if "" == argMountPoint {
+	if "" == argMountPoint && !*argSelfTest {
 		flag.Usage()
 		panic(fmt.Errorf("Mountpoint not specified"))
 	}
@@ -97,11 +216,129 @@ func main() {
 	Log.Debugf("verbosity            : %v", logLevel)
 	Log.Debugf("config               : %v", *argConfigPath)
 	Log.Debugf("temp                 : %v", *argTempPath)
+	Log.Debugf("chunk-sparse         : %v", *argChunkSparse)
 	Log.Debugf("chunk-size           : %v", *argChunkSize)
+	Log.Debugf("chunk-probe          : %v", *argChunkProbe)
+	Log.Debugf("chunk-probe-min      : %v", *argChunkProbeMin)
+	Log.Debugf("chunk-probe-max      : %v", *argChunkProbeMax)
+	Log.Debugf("chunk-memory-size    : %v", *argChunkMemory)
+	Log.Debugf("chunk-staging-size   : %v", *argChunkStaging)
+	Log.Debugf("chunk-write-queue    : %v", *argChunkWriteQueue)
+	Log.Debugf("chunk-migrate        : %v", *argChunkMigrate)
+	Log.Debugf("shared-cache         : %v", *argSharedCache)
+	Log.Debugf("export-native        : %v", *argExportNative)
+	Log.Debugf("chunk-config         : %v", *argChunkConfig)
+	Log.Debugf("cache-salt           : %v", "" != *argCacheSalt)
+	Log.Debugf("chunk-fsync          : %v", *argChunkFsync)
+	Log.Debugf("chunk-storage        : %v", *argChunkStorage)
+	Log.Debugf("chunk-mmap           : %v", *argChunkMmap)
+	Log.Debugf("max-object-downloads : %v", *argMaxObjectDownloads)
+	Log.Debugf("buffer-linger        : %v", *argBufferLinger)
+	Log.Debugf("linger-preload       : %v", *argLingerPreload)
+	Log.Debugf("max-buffer-age       : %v", *argMaxBufferAge)
+	Log.Debugf("mirrors              : %v", *argMirrors)
+	Log.Debugf("max-open-buffers     : %v", *argMaxOpenBuffers)
+	Log.Debugf("preload-recover      : %v", *argPreloadRecover)
+	Log.Debugf("scan-threshold       : %v", *argScanThreshold)
+	Log.Debugf("scan-read-size       : %v", *argScanReadSize)
+	Log.Debugf("scan-open-time       : %v", *argScanOpenTime)
+	Log.Debugf("resume-window        : %v", *argResumeWindow)
+	Log.Debugf("resume-retention     : %v", *argResumeRetention)
+	Log.Debugf("read-repair          : %v", *argReadRepair)
+	Log.Debugf("read-repair-priority : %v", *argReadRepairPriority)
+	Log.Debugf("buffer-creation-rate : %v", *argBufferCreationRate)
+	Log.Debugf("max-open-chunks      : %v", *argMaxOpenChunks)
+	Log.Debugf("account-file         : %v", *argAccountFile)
+	Log.Debugf("object-account-dir   : %v", *argObjectAccountDir)
+	Log.Debugf("daily-download-cap   : %v", *argDailyDownloadCap)
+	Log.Debugf("webdav-listen        : %v", *argWebDAVListen)
+	Log.Debugf("webdav-auth          : %v", "" != *argWebDAVAuth)
+	Log.Debugf("import-rclone-cache  : %v", *argImportRclone)
+	Log.Debugf("export-manifest      : %v", *argExportManifest)
+	Log.Debugf("import-manifest      : %v", *argImportManifest)
+	Log.Debugf("import-manifest-chunks: %v", *argImportManifestChunks)
+	Log.Debugf("health-listen        : %v", *argHealthListen)
+	Log.Debugf("health-object        : %v", *argHealthObject)
+	Log.Debugf("peers                : %v", *argPeers)
+	Log.Debugf("peer-listen          : %v", *argPeerListen)
+	Log.Debugf("peer-secret          : %v", "" != *argPeerSecret)
+	Log.Debugf("acknowledge-abuse    : %v", *argAcknowledgeAbuse)
+	Log.Debugf("download-proxy       : %v", *argDownloadProxy)
+	Log.Debugf("keepalive-idle       : %v", *argKeepaliveIdle)
+	Log.Debugf("max-downloads        : %v", *argMaxDownloads)
+	Log.Debugf("preload-when-busy    : %v", *argPreloadWhenBusy)
+	Log.Debugf("preload-when-idle    : %v", *argPreloadWhenIdle)
+	Log.Debugf("pause-policy         : %v", *argPausePolicy)
+	Log.Debugf("pause-cancel         : %v", *argPauseCancel)
+	Log.Debugf("download-wait-timeout: %v", *argDownloadWaitTimeout)
+	Log.Debugf("max-buffer-memory    : %v", *argMaxBufferMemory)
+	Log.Debugf("min-read-size        : %v", *argMinReadSize)
+	Log.Debugf("chunk-read-only      : %v", *argChunkReadOnly)
+	Log.Debugf("chunk-write-failure  : %v", *argChunkWriteFailure)
+	Log.Debugf("disk-full-eviction   : %v", *argDiskFullEviction)
+	Log.Debugf("partial-read-failure : %v", *argPartialReadFailure)
+	Log.Debugf("range-encoding       : %v", *argRangeEncoding)
+	Log.Debugf("offline              : %v", *argOffline)
+	Log.Debugf("fresh-window         : %v", *argFreshWindow)
+	Log.Debugf("stale-if-error       : %v", *argStaleIfError)
 	Log.Debugf("refresh-interval     : %v", *argRefreshInterval)
+	Log.Debugf("small-object-size    : %v", *argSmallObjectSize)
+	Log.Debugf("small-object-cache-size: %v", *argSmallObjectCacheSize)
+	Log.Debugf("range-alignment      : %v", *argRangeAlignment)
+	Log.Debugf("download-split-floor : %v", *argDownloadSplitFloor)
+	Log.Debugf("parallel-streams     : %v", *argParallelStreams)
+	Log.Debugf("read-timeout         : %v", *argReadTimeout)
+	Log.Debugf("retry-deadline       : %v", *argRetryDeadline)
+	Log.Debugf("verify-content-length: %v", *argVerifyLength)
+	Log.Debugf("verify-object-identity: %v", *argVerifyIdentity)
+	Log.Debugf("download-read-buffer : %v", *argReadBuffer)
+	Log.Debugf("cache-proxy          : %v", *argCacheProxy)
+	Log.Debugf("cache-proxy-plain    : %v", *argCacheProxyPlain)
+	Log.Debugf("cache-proxy-ca       : %v", *argCacheProxyCA)
+	Log.Debugf("download-cookies     : %v", *argDownloadCookies)
+	Log.Debugf("warm-workers         : %v", *argWarmWorkers)
+	Log.Debugf("fully-cached-command : %v", *argFullyCachedCommand)
+	Log.Debugf("referer              : %v", *argReferer)
+	Log.Debugf("origin               : %v", *argOrigin)
+	Log.Debugf("slow-read            : %v", *argSlowRead)
+	Log.Debugf("disk-latency-threshold: %v", *argDiskLatency)
+	Log.Debugf("memory-only          : %v", *argMemoryOnly)
+	Log.Debugf("early-first-read     : %v", *argEarlyFirstRead)
+	Log.Debugf("short-body-retries   : %v", *argShortBodyRetries)
+	Log.Debugf("request-pacing       : %v", *argRequestPacing)
+	Log.Debugf("bandwidth-limit      : %v", *argBandwidthLimit)
+	Log.Debugf("bandwidth-fairness   : %v", *argBandwidthFairness)
+	Log.Debugf("soft-start           : %v", *argSoftStart)
+	Log.Debugf("soft-start-rate      : %v", *argSoftStartRate)
+	Log.Debugf("rate-limit-min-range : %v", *argRateLimitMinRange)
+	Log.Debugf("head-cache-size      : %v", *argHeadCacheSize)
+	Log.Debugf("tail-cache-size      : %v", *argTailCacheSize)
+	Log.Debugf("preload-threshold    : %v", *argPreloadThreshold)
+	Log.Debugf("preload-trigger-offset: %v", *argPreloadTriggerOffset)
+	Log.Debugf("preload-min-reads    : %v", *argPreloadMinReads)
+	Log.Debugf("preload-min-open     : %v", *argPreloadMinOpen)
+	Log.Debugf("preload-ramp-initial : %v", *argPreloadRampInitial)
+	Log.Debugf("preload-ramp-max     : %v", *argPreloadRampMax)
+	Log.Debugf("preload-max-ahead    : %v", *argPreloadMaxAhead)
+	Log.Debugf("preload-lead-time    : %v", *argPreloadLeadTime)
+	Log.Debugf("max-preloads         : %v", *argMaxPreloads)
+	Log.Debugf("preload-schedule     : %v", *argPreloadSchedule)
+	Log.Debugf("serial-min-size      : %v", *argSerialMinSize)
+	Log.Debugf("serial-pattern       : %v", *argSerialPattern)
+	Log.Debugf("verify-md5           : %v", *argVerifyMD5)
 	Log.Debugf("clear-chunk-interval : %v", *argClearInterval)
 	Log.Debugf("clear-chunk-age      : %v", *argClearChunkAge)
+	Log.Debugf("chunk-compress-age   : %v", *argChunkCompressAge)
 	Log.Debugf("clear-chunk-max-size : %v", *argClearChunkMaxSize)
+	Log.Debugf("cache-max-size       : %v", *argCacheMaxSize)
+	Log.Debugf("cache-memory-fraction: %v", *argCacheMemoryFraction)
+	Log.Debugf("eviction-policy      : %v", *argEvictionPolicy)
+	Log.Debugf("eviction-exemption   : %v", *argEvictionExemption)
+	Log.Debugf("eviction-pressure-command: %v", *argEvictionPressureCommand)
+	Log.Debugf("cache-partitions     : %v", *argCachePartitions)
+	Log.Debugf("evict-on-release     : %v", *argEvictOnRelease)
+	Log.Debugf("thrash-threshold     : %v", *argThrashThreshold)
+	Log.Debugf("thrash-bypass        : %v", *argThrashBypass)
 	Log.Debugf("fuse-options         : %v", *argMountOptions)
 	Log.Debugf("UID                  : %v", uid)
 	Log.Debugf("GID                  : %v", gid)
@@ -114,17 +351,219 @@ func main() {
 		Log.Debugf("%v", err)
 		os.Exit(1)
 	}
-	chunkPath := filepath.Join(*argTempPath, "chunks")
+	saltSuffix := CacheSaltSuffix(*argCacheSalt)
+	chunkPath := filepath.Join(*argTempPath, "chunks"+saltSuffix)
 	if err := os.MkdirAll(chunkPath, 0777); nil != err {
 		Log.Errorf("Could not create temp chunk directory")
 		Log.Debugf("%v", err)
 		os.Exit(2)
 	}
+	exportPath := filepath.Join(*argTempPath, "exports")
+	if err := os.MkdirAll(exportPath, 0777); nil != err {
+		Log.Errorf("Could not create temp export directory")
+		Log.Debugf("%v", err)
+		os.Exit(2)
+	}
+	uploadPath := filepath.Join(*argTempPath, "uploads")
+	if err := os.MkdirAll(uploadPath, 0777); nil != err {
+		Log.Errorf("Could not create temp upload directory")
+		Log.Debugf("%v", err)
+		os.Exit(2)
+	}
 
 	// set the global buffer configuration
 	SetChunkPath(chunkPath)
+	SetUploadPath(uploadPath)
+	if err := SetNativeExport(*argExportNative, exportPath); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(25)
+	}
 	SetChunkSize(*argChunkSize)
+	if err := SetChunkProbe(*argChunkProbe, *argChunkProbeMin, *argChunkProbeMax); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(21)
+	}
 	SetChunkDirMaxSize(*argClearChunkMaxSize)
+	SetChunkMmap(*argChunkMmap)
+	SetChunkSparse(*argChunkSparse)
+	SetChunkMigration(*argChunkMigrate)
+	SetChunkConfigFile(*argChunkConfig)
+	if err := SetSharedCache(*argSharedCache); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(22)
+	}
+	SetChunkFsync(*argChunkFsync)
+	SetDiskFullEviction(*argDiskFullEviction)
+	SetChunkMemorySize(*argChunkMemory)
+	SetChunkStaging(*argChunkStaging)
+	SetChunkWriteQueue(*argChunkWriteQueue)
+	SetChunkCompressAge(*argChunkCompressAge)
+	SetChunkReadOnly(*argChunkReadOnly)
+	SetMaxOpenBuffers(*argMaxOpenBuffers)
+	SetPreloadRecovery(*argPreloadRecover)
+	SetScanDetection(*argScanThreshold, *argScanReadSize, *argScanOpenTime)
+	SetResumeWindow(*argResumeWindow, *argResumeRetention)
+	if err := SetReadRepair(*argReadRepair, *argReadRepairPriority); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(28)
+	}
+	SetBufferCreationRate(*argBufferCreationRate)
+	SetBufferLinger(*argBufferLinger, *argLingerPreload)
+	SetMaxOpenChunks(*argMaxOpenChunks)
+	SetKeepaliveIdle(*argKeepaliveIdle)
+	SetMaxDownloads(*argMaxDownloads)
+	SetMaxObjectDownloads(*argMaxObjectDownloads)
+	SetDownloadWaitTimeout(*argDownloadWaitTimeout)
+	SetMinReadSize(*argMinReadSize)
+	SetBufferMemoryBudget(*argMaxBufferMemory)
+	SetReadTimeout(*argReadTimeout)
+	SetRetryDeadline(*argRetryDeadline)
+	SetContentLengthCheck(*argVerifyLength)
+	SetVerifyIdentity(*argVerifyIdentity)
+	SetWarmWorkers(*argWarmWorkers)
+	SetReadBufferSize(*argReadBuffer)
+	if err := SetCacheProxy(*argCacheProxy, *argCacheProxyPlain, *argCacheProxyCA); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(27)
+	}
+	if "" != *argDownloadCookies {
+		if err := LoadDownloadCookies(*argDownloadCookies); nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(34)
+		}
+	}
+	SetFullyCachedCommand(*argFullyCachedCommand)
+	SetDownloadHeader("Referer", *argReferer)
+	SetDownloadHeader("Origin", *argOrigin)
+	SetSlowReadThreshold(*argSlowRead)
+	SetDiskLatencyThreshold(*argDiskLatency, *argMemoryOnly)
+	SetEarlyFirstRead(*argEarlyFirstRead)
+	SetShortBodyRetries(*argShortBodyRetries)
+	SetDownloadSplitFloor(*argDownloadSplitFloor)
+	SetParallelStreams(*argParallelStreams)
+	SetRequestPacing(*argRequestPacing)
+	if err := SetBandwidthLimit(*argBandwidthLimit, *argBandwidthFairness); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(30)
+	}
+	SetSoftStart(*argSoftStart, *argSoftStartRate)
+	SetRateLimitMinRange(*argRateLimitMinRange)
+	SetOffline(*argOffline)
+	SetAcknowledgeAbuse(*argAcknowledgeAbuse)
+	SetFreshWindow(*argFreshWindow)
+	SetStaleIfError(*argStaleIfError)
+	SetDailyDownloadCap(*argDailyDownloadCap)
+	SetSmallObjects(*argSmallObjectSize, *argSmallObjectCacheSize)
+	if err := SetCacheBudget(*argCacheMaxSize, *argCacheMemoryFraction); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(15)
+	}
+	if err := SetChunkStorage(*argChunkStorage); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(29)
+	}
+	SetRangeAlignment(*argRangeAlignment)
+	SetHeadCacheSize(*argHeadCacheSize)
+	SetTailCacheSize(*argTailCacheSize)
+	SetPreloadThreshold(*argPreloadThreshold)
+	SetPreloadTriggerOffset(*argPreloadTriggerOffset)
+	SetPreloadActivation(*argPreloadMinReads, *argPreloadMinOpen)
+	SetPreloadRamp(*argPreloadRampInitial, *argPreloadRampMax)
+	SetPreloadMaxAhead(*argPreloadMaxAhead)
+	SetPreloadLeadTime(*argPreloadLeadTime)
+	SetMaxActivePreloads(*argMaxPreloads)
+	SetVerifyMD5(*argVerifyMD5)
+	if err := SetChunkWriteFailure(*argChunkWriteFailure); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(7)
+	}
+	if err := SetPartialReadFailure(*argPartialReadFailure); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(14)
+	}
+	if err := SetRangeEncoding(*argRangeEncoding); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(26)
+	}
+	if "" != *argDownloadProxy {
+		rewriter, err := RewriteToProxy(*argDownloadProxy)
+		if nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(12)
+		}
+		SetURLRewriter(rewriter)
+	}
+	if err := SetPeers(*argPeers, *argPeerSecret); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(17)
+	}
+	SetPreloadWhenIdle(*argPreloadWhenIdle)
+	if err := SetPausePolicy(*argPausePolicy); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(16)
+	}
+	if err := SetPreloadWhenBusy(*argPreloadWhenBusy); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(11)
+	}
+	if err := SetPreloadSchedule(*argPreloadSchedule); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(9)
+	}
+	SetEvictOnRelease(*argEvictOnRelease)
+	SetThrashThreshold(*argThrashThreshold, *argThrashBypass)
+	if err := SetEvictionPolicy(*argEvictionPolicy); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(13)
+	}
+	if err := SetEvictionExemption(*argEvictionExemption); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(23)
+	}
+	SetEvictionPressureCommand(*argEvictionPressureCommand)
+	if err := SetCachePartitions(*argCachePartitions); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(24)
+	}
+	if *argSerialMinSize > 0 {
+		RegisterSerialPolicy(SerialBySize(*argSerialMinSize))
+	}
+	for _, pattern := range strings.Split(*argSerialPattern, ",") {
+		if "" == pattern {
+			continue
+		}
+		policy, err := SerialByPattern(pattern)
+		if nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(10)
+		}
+		RegisterSerialPolicy(policy)
+	}
+
+	// run the self test without connecting to Google Drive
+	if *argSelfTest {
+		passed := true
+		for _, result := range BufferSelfTest() {
+			if result.Passed {
+				fmt.Printf("PASS %v\n", result.Name)
+			} else {
+				fmt.Printf("FAIL %v: %v\n", result.Name, result.Error)
+				passed = false
+			}
+		}
+		if !passed {
+			os.Exit(8)
+		}
+		return
+	}
+
+	// restore the metadata of the cached chunks
+	if err := LoadChunkIndex(filepath.Join(*argTempPath, "chunks"+saltSuffix+".index")); nil != err {
+		Log.Warningf("%v", err)
+	}
+	if err := InitChunkIndex(chunkPath); nil != err {
+		Log.Warningf("%v", err)
+	}
 
 	// read the configuration
 	configPath := filepath.Join(*argConfigPath, "config.json")
@@ -137,6 +576,23 @@ func main() {
 			os.Exit(3)
 		}
 	}
+	if err := SetCrypt(config.CryptPassword, config.CryptPassword2, config.CryptFilenameEncryption); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(31)
+	}
+
+	// restore the bytes downloaded today
+	if err := LoadDownloadQuota(filepath.Join(*argConfigPath, "quota.json")); nil != err {
+		Log.Warningf("%v", err)
+	}
+	// restore the last read offsets of the recently closed files
+	if err := LoadResumePositions(filepath.Join(*argConfigPath, "resume.json")); nil != err {
+		Log.Warningf("%v", err)
+	}
+	// restore the downloaded bytes and cache hits of earlier runs
+	if err := LoadStats(filepath.Join(*argConfigPath, "stats.json")); nil != err {
+		Log.Warningf("%v", err)
+	}
 
 	cache, err := NewCache(*argConfigPath, *argLogLevel > 3)
 	if nil != err {
@@ -145,6 +601,14 @@ func main() {
 		os.Exit(4)
 	}
 	defer cache.Close()
+	changed, err := CryptChanged(filepath.Join(*argConfigPath, "crypt.state"))
+	if nil != err {
+		Log.Warningf("%v", err)
+	}
+	if changed {
+		Log.Infof("The crypt configuration changed, fetching all objects again")
+		cache.DeleteObjects()
+	}
 
 	drive, err := NewDriveClient(config, cache, *argRefreshInterval)
 	if nil != err {
@@ -152,19 +616,103 @@ func main() {
 		Log.Debugf("%v", err)
 		os.Exit(5)
 	}
+	if "" != *argAccountFile {
+		if err := drive.LoadAccounts(*argAccountFile); nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(32)
+		}
+	}
+	if "" != *argObjectAccountDir {
+		if err := drive.LoadObjectAccounts(*argObjectAccountDir); nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(33)
+		}
+	}
+
+	if "" != *argPeerListen {
+		if err := ServePeerCache(*argPeerListen, drive); nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(17)
+		}
+	}
+
+	if "" != *argImportRclone && !*argChunkReadOnly {
+		go func() {
+			if err := ImportRcloneCache(drive, *argImportRclone); nil != err {
+				Log.Warningf("%v", err)
+			}
+		}()
+	}
+	if "" != *argExportManifest {
+		go func() {
+			manifest, err := drive.ExportManifest()
+			if nil == err {
+				err = SaveManifest(*argExportManifest, manifest)
+			}
+			if nil != err {
+				Log.Warningf("%v", err)
+				return
+			}
+			Log.Infof("Wrote the manifest of %v cached objects to %v", len(manifest.Objects), *argExportManifest)
+		}()
+	}
+	if "" != *argImportManifest && !*argChunkReadOnly {
+		go func() {
+			manifest, err := ReadManifest(*argImportManifest)
+			if nil == err {
+				err = drive.ImportManifest(manifest, ManifestImportOptions{ChunkDir: *argImportManifestChunks})
+			}
+			if nil != err {
+				Log.Warningf("%v", err)
+			}
+		}()
+	}
+	if "" != *argWebDAVListen {
+		if err := ServeWebDAV(*argWebDAVListen, *argWebDAVAuth, drive); nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(19)
+		}
+	}
+	if "" != *argHealthListen {
+		if err := ServeHealthCheck(*argHealthListen, drive, *argHealthObject); nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(18)
+		}
+	}
+	SetMaxBufferAge(*argMaxBufferAge, drive.GetObject)
+	if err := SetMirrors(*argMirrors, drive.GetObject); nil != err {
+		Log.Errorf("%v", err)
+		os.Exit(20)
+	}
 
 	// check os signals like SIGINT/TERM
-	checkOsSignals(argMountPoint)
-	go CleanChunkDir(chunkPath, *argClearInterval, *argClearChunkAge, *argChunkSize, *argClearChunkMaxSize)
-	if err := Mount(drive, argMountPoint, mountOptions, uid, gid, umask); nil != err {
+	checkOsSignals(argMountPoint, *argPauseCancel)
+	if !*argChunkReadOnly {
+		go CleanChunkDir(*argClearInterval, *argClearChunkAge)
+		go MigrateChunks(chunkPath)
+	}
+	err = Mount(drive, argMountPoint, mountOptions, uid, gid, umask)
+	if err := SaveChunkIndex(); nil != err {
+		Log.Warningf("%v", err)
+	}
+	if err := SaveDownloadQuota(); nil != err {
+		Log.Warningf("%v", err)
+	}
+	if err := SaveStats(); nil != err {
+		Log.Warningf("%v", err)
+	}
+	if err := SaveResumePositions(); nil != err {
+		Log.Warningf("%v", err)
+	}
+	if nil != err {
 		Log.Debugf("%v", err)
 		os.Exit(6)
 	}
 }
 
-func checkOsSignals(mountpoint string) {
+func checkOsSignals(mountpoint string, pauseCancel bool) {
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 
 	go func() {
 		for sig := range signals {
@@ -173,6 +721,21 @@ func checkOsSignals(mountpoint string) {
 					Log.Warningf("%v", err)
 				}
 			}
+			if sig == syscall.SIGHUP {
+				if err := ReloadChunkConfigFile(); nil != err {
+					Log.Warningf("%v", err)
+				}
+			}
+			if sig == syscall.SIGUSR1 {
+				go DumpBufferStates()
+			}
+			if sig == syscall.SIGUSR2 {
+				if DownloadsPaused() {
+					ResumeDownloads()
+				} else {
+					PauseDownloads(pauseCancel)
+				}
+			}
 		}
 	}()
 }
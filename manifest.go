@@ -0,0 +1,298 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// ChunkManifest lists the cached chunks of an instance, so that the cache of
+// another instance can be warmed with the same chunks
+type ChunkManifest struct {
+	Created time.Time        `json:"created"`
+	Objects []ManifestObject `json:"objects"`
+}
+
+// ManifestObject lists the cached chunks of one object. Modified is the
+// modification time of the cached version in nanoseconds, chunks of another
+// version are not imported.
+type ManifestObject struct {
+	ObjectID   string          `json:"objectId"`
+	Modified   int64           `json:"modified"`
+	Generation int64           `json:"generation"`
+	ChunkSize  int64           `json:"chunkSize"`
+	Chunks     []ManifestChunk `json:"chunks"`
+}
+
+// ManifestChunk is a cached chunk and the sha256 hash of its bytes
+type ManifestChunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestImportOptions configures the import of a chunk manifest
+type ManifestImportOptions struct {
+	// ChunkDir is the chunk directory of the exporting instance, e.g. on a
+	// shared path. Chunks of the same chunk size are copied from it instead
+	// of downloaded if their hash matches ("" = download all chunks).
+	ChunkDir string
+}
+
+// ExportManifest lists the cached chunks of all objects of the drive with
+// the hashes of their bytes. Chunks that can't be read are left out.
+func (d *Drive) ExportManifest() (*ChunkManifest, error) {
+	manifest := &ChunkManifest{Created: time.Now(), Objects: []ManifestObject{}}
+	for _, objectID := range chunks.objectIDs() {
+		object, err := d.GetObject(objectID)
+		if nil != err || object.IsDir {
+			continue
+		}
+
+		generation, size, infos := chunks.cachedChunks(objectID)
+		entry := ManifestObject{
+			ObjectID:   objectID,
+			Modified:   object.LastModified.UnixNano(),
+			Generation: generation,
+			ChunkSize:  size,
+			Chunks:     []ManifestChunk{},
+		}
+		dir := filepath.Join(chunkPath, objectID)
+		store := newChunkStore(dir)
+		for offset, info := range infos {
+			if uint64(offset) >= object.Size {
+				continue
+			}
+			length := int64(math.Min(float64(size), float64(int64(object.Size)-offset)))
+			data, err := readChunkFile(store, filepath.Join(dir, chunkName(generation, size, offset)), length, info.Compressed)
+			if nil != err {
+				Log.Debugf("%v", err)
+				continue
+			}
+			entry.Chunks = append(entry.Chunks, ManifestChunk{Offset: offset, Size: length, SHA256: chunkHash(data)})
+		}
+		store.Close()
+
+		if len(entry.Chunks) > 0 {
+			manifest.Objects = append(manifest.Objects, entry)
+		}
+	}
+	return manifest, nil
+}
+
+// ImportManifest warms the cache with the chunks listed in a manifest.
+// Chunks that are cached already are skipped, objects that are gone or were
+// modified since the export are skipped. Chunks are copied from the chunk
+// directory of the options if possible, otherwise they are downloaded one
+// after another in the background and wait for the download slots like all
+// other reads. Copying stops before the chunk directory exceeds its maximum
+// size.
+func (d *Drive) ImportManifest(manifest *ChunkManifest, opts ManifestImportOptions) error {
+	if chunkReadOnly {
+		return fmt.Errorf("Could not import the manifest, the chunk directory is read-only")
+	}
+	used, err := dirSize(chunkPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not measure chunk directory %v", chunkPath)
+	}
+
+	var copied, downloaded int
+	for _, entry := range manifest.Objects {
+		object, err := d.GetObject(entry.ObjectID)
+		if nil != err || object.IsDir || object.LastModified.UnixNano() != entry.Modified {
+			Log.Debugf("Skipping object %v of the manifest, it was modified or removed", entry.ObjectID)
+			continue
+		}
+
+		missing := entry.Chunks
+		if "" != opts.ChunkDir {
+			var count int
+			count, missing = importManifestChunks(opts.ChunkDir, object, entry, &used)
+			copied += count
+		}
+		if len(missing) > 0 {
+			downloaded += d.downloadManifestChunks(object, missing)
+		}
+	}
+	Log.Infof("Imported the manifest, copied %v and downloaded %v chunks", copied, downloaded)
+	return nil
+}
+
+// importManifestChunks copies the chunks of an object from the chunk
+// directory of the exporting instance and returns their number and the
+// chunks that still have to be downloaded
+func importManifestChunks(from string, object *APIObject, entry ManifestObject, used *int64) (int, []ManifestChunk) {
+	objectID := object.ObjectID
+	size := objectChunkSize(object)
+	if indexed, exists := chunks.indexedChunkSize(objectID); exists {
+		size = indexed
+	}
+	if size != entry.ChunkSize {
+		return 0, entry.Chunks
+	}
+	chunks.load(objectID)
+	generation := chunks.generation(objectID)
+	dir := filepath.Join(chunkPath, objectID)
+	store := newChunkStore(dir)
+	defer store.Close()
+	sourceDir := filepath.Join(from, objectID)
+	source := newChunkStore(sourceDir)
+	defer source.Close()
+
+	count := 0
+	missing := []ManifestChunk{}
+	for _, chunk := range entry.Chunks {
+		if chunks.has(objectID, generation, chunk.Offset) {
+			continue
+		}
+		if currentChunkDirMaxSize() > 0 && *used+chunk.Size > currentChunkDirMaxSize() {
+			missing = append(missing, chunk)
+			continue
+		}
+
+		sourceName := filepath.Join(sourceDir, chunkName(entry.Generation, size, chunk.Offset))
+		data, err := readChunkFile(source, sourceName, chunk.Size, false)
+		if nil != err {
+			data, err = readChunkFile(source, sourceName, chunk.Size, true)
+		}
+		if nil != err || chunkHash(data) != chunk.SHA256 {
+			Log.Debugf("Could not copy chunk %v, downloading it", sourceName)
+			missing = append(missing, chunk)
+			continue
+		}
+		filename := filepath.Join(dir, chunkName(generation, size, chunk.Offset))
+		if err := store.Write(filename, data); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not write chunk %v", filename)
+			missing = append(missing, chunk)
+			continue
+		}
+		chunkWritten(chunk.Size)
+		chunks.add(objectID, generation, chunk.Offset, chunk.Size)
+		*used += chunk.Size
+		count++
+	}
+	return count, missing
+}
+
+// downloadManifestChunks downloads the chunks covering the ranges of the
+// manifest chunks of an object that are not cached and returns their number
+func (d *Drive) downloadManifestChunks(object *APIObject, missing []ManifestChunk) int {
+	buffer, err := d.Open(object)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return 0
+	}
+	defer buffer.Close()
+
+	// the chunk size of this instance may differ from the exporting one
+	count := 0
+	for _, chunk := range missing {
+		end := int64(math.Min(float64(chunk.Offset+chunk.Size), float64(object.Size)))
+		for offset := chunk.Offset - chunk.Offset%buffer.chunkSize; offset < end; offset += buffer.chunkSize {
+			if chunks.has(object.ObjectID, chunks.generation(object.ObjectID), offset) {
+				continue
+			}
+			if _, err := buffer.readBytes(offset, buffer.chunkSize, ReadBackground); nil != err {
+				Log.Debugf("%v", err)
+				return count
+			}
+			count++
+		}
+	}
+	return count
+}
+
+// ReadManifest reads a chunk manifest written by SaveManifest
+func ReadManifest(path string) (*ChunkManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read manifest %v", path)
+	}
+
+	var manifest ChunkManifest
+	if err := json.Unmarshal(data, &manifest); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not decode manifest %v", path)
+	}
+	return &manifest, nil
+}
+
+// SaveManifest writes a chunk manifest
+func SaveManifest(path string, manifest *ChunkManifest) error {
+	data, err := json.Marshal(manifest)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not encode manifest")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write manifest %v", path)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), path)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write manifest %v", path)
+	}
+	return nil
+}
+
+// readChunkFile reads a whole chunk of the given length, a compressed chunk
+// from its compressed file
+func readChunkFile(store ChunkStore, filename string, length int64, compressed bool) ([]byte, error) {
+	if !compressed {
+		data, err := store.Read(filename, 0, length)
+		if nil != err {
+			return nil, err
+		}
+		if int64(len(data)) != length {
+			return nil, fmt.Errorf("Chunk %v is incomplete", filename)
+		}
+		return data, nil
+	}
+
+	f, err := os.Open(filename + compressedSuffix)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	reader, err := gzip.NewReader(f)
+	if nil != err {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, length+1))
+	if nil != err {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("Chunk %v is incomplete", filename)
+	}
+	return data, nil
+}
+
+// chunkHash returns the hex encoded sha256 hash of the bytes of a chunk
+func chunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"sync"
+)
+
+var hotChunks = newHotChunkCache()
+
+// hotChunkCache keeps recently read chunks in memory, so that seeks within
+// them and reads of several players of the same file don't touch the chunk
+// directory. The least recently read chunks are evicted first, the chunk
+// files stay on disk. Chunks are dropped together with their chunk files
+// and when the cache of their object is invalidated, so that only chunks
+// the chunk index knows are served.
+type hotChunkCache struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	hits    int64
+	misses  int64
+	order   *list.List
+	chunks  map[hotChunkKey]*list.Element
+}
+
+// hotChunkKey identifies a chunk of a generation and chunk size of an object
+type hotChunkKey struct {
+	objectID   string
+	generation int64
+	chunkSize  int64
+	offset     int64
+}
+
+// hotChunk is a chunk held in memory
+type hotChunk struct {
+	key   hotChunkKey
+	bytes []byte
+}
+
+// HotChunkStats holds the usage of the memory chunk cache
+type HotChunkStats struct {
+	Budget int64 `json:"budget"`
+	Used   int64 `json:"used"`
+	Chunks int   `json:"chunks"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// newHotChunkCache creates an empty memory chunk cache
+func newHotChunkCache() *hotChunkCache {
+	return &hotChunkCache{
+		order:  list.New(),
+		chunks: make(map[hotChunkKey]*list.Element),
+	}
+}
+
+// SetChunkMemorySize keeps the most recently read chunks in memory, using
+// up to the given number of bytes (0 = disabled). Downloaded chunks and
+// chunks read from disk are kept, reads are served from memory first, then
+// from the chunk directory and then from Google Drive.
+func SetChunkMemorySize(size int64) {
+	hotChunks.lock.Lock()
+	defer hotChunks.lock.Unlock()
+
+	hotChunks.maxSize = size
+	hotChunks.evict()
+}
+
+// GetHotChunkStats returns the usage of the memory chunk cache
+func GetHotChunkStats() HotChunkStats {
+	hotChunks.lock.Lock()
+	defer hotChunks.lock.Unlock()
+
+	return HotChunkStats{
+		Budget: hotChunks.maxSize,
+		Used:   hotChunks.size,
+		Chunks: len(hotChunks.chunks),
+		Hits:   hotChunks.hits,
+		Misses: hotChunks.misses,
+	}
+}
+
+// hotChunksEnabled checks if chunks are kept in memory
+func hotChunksEnabled() bool {
+	hotChunks.lock.Lock()
+	defer hotChunks.lock.Unlock()
+
+	return hotChunks.maxSize > 0
+}
+
+// hotKey returns the key of a chunk of the buffer
+func (b *Buffer) hotKey(generation, offset int64) hotChunkKey {
+	return hotChunkKey{objectID: b.object.ObjectID, generation: generation, chunkSize: b.chunkSize, offset: offset}
+}
+
+// readHot reads from a chunk kept in memory
+func (b *Buffer) readHot(generation, offset, fOffset, size int64) ([]byte, bool) {
+	hotChunks.lock.Lock()
+	defer hotChunks.lock.Unlock()
+
+	if hotChunks.maxSize <= 0 {
+		return nil, false
+	}
+	element, exists := hotChunks.chunks[b.hotKey(generation, offset)]
+	if !exists {
+		hotChunks.misses++
+		return nil, false
+	}
+	hotChunks.hits++
+	hotChunks.order.MoveToFront(element)
+	return hotRange(element.Value.(*hotChunk).bytes, fOffset, size), true
+}
+
+// hotRange returns the bytes of a chunk at the given offset within the chunk
+func hotRange(bytes []byte, fOffset, size int64) []byte {
+	if fOffset >= int64(len(bytes)) {
+		return []byte{}
+	}
+	return bytes[fOffset:int64(math.Min(float64(fOffset+size), float64(len(bytes))))]
+}
+
+// keepHot keeps a copy of a whole chunk in memory, so that neither the
+// buffer the chunk was read into nor a larger backing array stays referenced
+func (b *Buffer) keepHot(generation, offset int64, bytes []byte) {
+	hotChunks.lock.Lock()
+	defer hotChunks.lock.Unlock()
+
+	if int64(len(bytes)) > hotChunks.maxSize {
+		return
+	}
+	key := b.hotKey(generation, offset)
+	if element, exists := hotChunks.chunks[key]; exists {
+		hotChunks.removeElement(element)
+	}
+	kept := make([]byte, len(bytes))
+	copy(kept, bytes)
+	hotChunks.chunks[key] = hotChunks.order.PushFront(&hotChunk{key: key, bytes: kept})
+	hotChunks.size += int64(len(kept))
+	hotChunks.evict()
+}
+
+// dropHot removes a chunk from memory, e.g. after its chunk file was deleted
+func dropHot(objectID string, generation, chunkSize, offset int64) {
+	hotChunks.lock.Lock()
+	defer hotChunks.lock.Unlock()
+
+	key := hotChunkKey{objectID: objectID, generation: generation, chunkSize: chunkSize, offset: offset}
+	if element, exists := hotChunks.chunks[key]; exists {
+		hotChunks.removeElement(element)
+	}
+}
+
+// dropHotObject removes all chunks of an object from memory
+func dropHotObject(objectID string) {
+	hotChunks.lock.Lock()
+	defer hotChunks.lock.Unlock()
+
+	for key, element := range hotChunks.chunks {
+		if objectID == key.objectID {
+			hotChunks.removeElement(element)
+		}
+	}
+}
+
+// evict removes the least recently read chunks till the cache fits, the
+// lock must be held
+func (c *hotChunkCache) evict() {
+	for c.size > c.maxSize && c.order.Len() > 0 {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// removeElement removes a chunk from memory, the lock must be held
+func (c *hotChunkCache) removeElement(element *list.Element) {
+	chunk := element.Value.(*hotChunk)
+	c.order.Remove(element)
+	delete(c.chunks, chunk.key)
+	c.size -= int64(len(chunk.bytes))
+}
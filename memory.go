@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// bufferMemory accounts the memory held by all buffers, like the slabs of
+// small reads and the staged chunks. The used bytes are the first field to be 64 bit aligned for
+// atomic access on 32 bit platforms.
+var bufferMemory = struct {
+	used   int64
+	budget int64
+	lock   sync.Mutex
+}{}
+
+// BufferMemoryStats holds the memory usage of all buffers
+type BufferMemoryStats struct {
+	Budget int64 `json:"budget"`
+	Used   int64 `json:"used"`
+}
+
+// SetBufferMemoryBudget limits the memory held by all buffers (in byte,
+// 0 = unlimited). If the budget is exceeded the least recently read buffers
+// drop their in-memory state, their chunks stay cached on disk.
+func SetBufferMemoryBudget(budget int64) {
+	atomic.StoreInt64(&bufferMemory.budget, budget)
+}
+
+// GetBufferMemoryStats returns the current memory usage of all buffers
+func GetBufferMemoryStats() BufferMemoryStats {
+	return BufferMemoryStats{
+		Budget: atomic.LoadInt64(&bufferMemory.budget),
+		Used:   atomic.LoadInt64(&bufferMemory.used),
+	}
+}
+
+// setSlab replaces the slab of small reads and enforces the memory budget
+func (b *Buffer) setSlab(slab []byte, offset int64) {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	delta := int64(len(slab) - len(b.slab))
+	b.slab = slab
+	b.slabOffset = offset
+	b.lock.Unlock()
+
+	used := atomic.AddInt64(&bufferMemory.used, delta)
+	if budget := atomic.LoadInt64(&bufferMemory.budget); budget > 0 && used > budget {
+		shedBufferMemory(b)
+	}
+}
+
+// reserveBufferMemory accounts memory that can't be shed, like a staged
+// chunk. The in-memory state of the least recently read buffers is dropped
+// to make room, it returns false if the budget is still exceeded.
+func reserveBufferMemory(size int64) bool {
+	budget := atomic.LoadInt64(&bufferMemory.budget)
+	if budget > 0 && atomic.LoadInt64(&bufferMemory.used)+size > budget {
+		shedBufferMemory(nil)
+	}
+	if used := atomic.AddInt64(&bufferMemory.used, size); budget > 0 && used > budget {
+		atomic.AddInt64(&bufferMemory.used, -size)
+		return false
+	}
+	return true
+}
+
+// shedMemory drops the in-memory state of the buffer
+func (b *Buffer) shedMemory() {
+	b.lock.Lock()
+	size := int64(len(b.slab))
+	b.slab = nil
+	b.lock.Unlock()
+
+	atomic.AddInt64(&bufferMemory.used, -size)
+}
+
+// shedBufferMemory drops the in-memory state of the least recently read
+// buffers other than the current one till the memory budget is met
+func shedBufferMemory(current *Buffer) {
+	bufferMemory.lock.Lock()
+	defer bufferMemory.lock.Unlock()
+
+	buffers := buffersByLastRead{}
+	for item := range instances.IterBuffered() {
+		if b, ok := item.Val.(*Buffer); ok && b != current {
+			buffers = append(buffers, b)
+		}
+	}
+	sort.Sort(buffers)
+
+	for _, b := range buffers {
+		if atomic.LoadInt64(&bufferMemory.used) <= atomic.LoadInt64(&bufferMemory.budget) {
+			return
+		}
+		Log.Debugf("Dropping the in-memory state of object %v to meet the buffer memory budget", b.object.ObjectID)
+		b.shedMemory()
+	}
+}
+
+// buffersByLastRead sorts buffers least recently read first
+type buffersByLastRead []*Buffer
+
+func (s buffersByLastRead) Len() int      { return len(s) }
+func (s buffersByLastRead) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s buffersByLastRead) Less(i, j int) bool {
+	return s[i].lastReadTime().Before(s[j].lastReadTime())
+}
+
+// lastReadTime returns the time of the last read of the buffer
+func (b *Buffer) lastReadTime() time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.lastRead
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// migrationInterval is the time between two passes of the chunk migration
+// over the chunk directory
+const migrationInterval = 1 * time.Minute
+
+var migration = struct {
+	lock    sync.Mutex
+	from    string
+	running bool
+}{}
+
+// SetChunkMigration moves the chunks cached in the other chunk layout, one
+// file per chunk or sparse files, to the layout of the selected chunk
+// store. Till all chunks are moved, reads of chunks missing in the selected
+// layout also look into the other one, so the cache stays warm.
+func SetChunkMigration(enabled bool) {
+	migration.lock.Lock()
+	defer migration.lock.Unlock()
+
+	migration.running = enabled
+	migration.from = "sparse"
+	if "sparse" == chunkStoreName {
+		migration.from = "file"
+	}
+}
+
+// migrationSource returns the chunk store chunks are migrated from
+func migrationSource() (string, bool) {
+	migration.lock.Lock()
+	defer migration.lock.Unlock()
+
+	return migration.from, migration.running
+}
+
+// readMigrated reads a chunk from the old layout and moves it to the chunk
+// store of the buffer
+func (b *Buffer) readMigrated(filename string, fOffset, size int64) ([]byte, bool) {
+	from, running := migrationSource()
+	if !running {
+		return nil, false
+	}
+
+	old := b.oldLayoutStore(from)
+	data, err := old.Read(filename, 0, b.chunkSize)
+	if nil != err || fOffset >= int64(len(data)) {
+		return nil, false
+	}
+	// the store may return slices of its own memory
+	data = append([]byte(nil), data...)
+
+	if err := b.store.Write(filename, data); nil != err {
+		Log.Debugf("%v", err)
+	} else if err := dropMigrated(old, from, filename); nil != err {
+		Log.Debugf("%v", err)
+	}
+	Log.Debugf("Read chunk %v from the %v chunk layout", filename, from)
+
+	end := fOffset + size
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[fOffset:end], true
+}
+
+// oldLayoutStore returns the chunk store of the old layout of the buffer,
+// it is created on the first read of a missing chunk
+func (b *Buffer) oldLayoutStore(from string) ChunkStore {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if nil == b.migrationStore {
+		b.migrationStore = chunkStores[from](b.tempDir)
+	}
+	return b.migrationStore
+}
+
+// dropMigrated removes a moved chunk from the old layout. The chunk index
+// keeps the chunk, because it is cached under the same name in the new
+// layout. Sparse files are deleted once their last chunk was moved.
+func dropMigrated(old ChunkStore, from, filename string) error {
+	old.Release(filename)
+	if "sparse" != from {
+		return os.Remove(filename)
+	}
+
+	generation, size, _, ok := parseChunkName(filepath.Base(filename))
+	if !ok {
+		return nil
+	}
+	name := filepath.Join(filepath.Dir(filename), sparseName(generation, size))
+	left, err := readSparseMap(sparseMapName(name))
+	if nil != err || len(left) > 0 {
+		return err
+	}
+	old.Close()
+	if err := os.Remove(name); nil != err && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(sparseMapName(name))
+}
+
+// MigrateChunks moves the chunks of all objects that are not open from the
+// old layout in the background. Open objects move their chunks as they are
+// read or on a later pass. Once no chunk is left the old layout is no
+// longer looked into.
+func MigrateChunks(chunkDir string) {
+	from, running := migrationSource()
+	if !running {
+		return
+	}
+	Log.Infof("Migrating chunks from the %v to the %v chunk layout", from, chunkStoreName)
+
+	for {
+		if left := migratePass(chunkDir, from); 0 == left {
+			break
+		}
+		time.Sleep(migrationInterval)
+	}
+
+	migration.lock.Lock()
+	migration.running = false
+	migration.lock.Unlock()
+	Log.Infof("Migrated all chunks to the %v chunk layout", chunkStoreName)
+}
+
+// migratePass moves the chunks of all objects that are not open and
+// returns the number of chunks left in the old layout
+func migratePass(chunkDir, from string) int {
+	dirs, err := ioutil.ReadDir(chunkDir)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return 1
+	}
+
+	left := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		names := oldLayoutChunks(filepath.Join(chunkDir, dir.Name()), from)
+		if _, open := instances.Get(dir.Name()); open {
+			left += len(names)
+			continue
+		}
+		left += migrateObject(filepath.Join(chunkDir, dir.Name()), from, names)
+	}
+	return left
+}
+
+// oldLayoutChunks lists the names of the chunks of an object directory that
+// are stored in the old layout. Compressed chunks are left alone, they move
+// to the new layout when they are decompressed.
+func oldLayoutChunks(dir, from string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if nil != err {
+		return nil
+	}
+
+	var names []string
+	for _, file := range files {
+		generation, size, offset, ok := parseChunkName(file.Name())
+		if !ok || file.IsDir() || strings.HasSuffix(file.Name(), compressedSuffix) {
+			continue
+		}
+		if "sparse" != from && sparseOffset != offset {
+			names = append(names, file.Name())
+		}
+		if "sparse" == from && strings.HasSuffix(file.Name(), sparseMapName("")) {
+			offsets, err := readSparseMap(filepath.Join(dir, file.Name()))
+			if nil != err {
+				Log.Debugf("%v", err)
+			}
+			for chunkOffset := range offsets {
+				names = append(names, chunkName(generation, size, chunkOffset))
+			}
+		}
+	}
+	return names
+}
+
+// migrateObject moves the given chunks of an object directory and returns
+// the number of chunks that could not be moved. Chunks that can not be read
+// are dropped from the old layout and the chunk index.
+func migrateObject(dir, from string, names []string) int {
+	if 0 == len(names) {
+		return 0
+	}
+	old := chunkStores[from](dir)
+	defer old.Close()
+	store := newChunkStore(dir)
+	defer store.Close()
+
+	left := 0
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		_, size, _, _ := parseChunkName(name)
+		data, err := old.Read(filename, 0, size)
+		if nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not read chunk %v, dropping it", filename)
+			chunks.removePath(filename)
+		} else if err := store.Write(filename, data); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not migrate chunk %v", filename)
+			left++
+			continue
+		}
+		if err := dropMigrated(old, from, filename); nil != err {
+			Log.Debugf("%v", err)
+		}
+	}
+	return left
+}
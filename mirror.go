@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// mirrorFailures is the number of downloads of an object that have to fail
+// in a row before its reads switch to the mirror
+const mirrorFailures = 3
+
+var mirrors = struct {
+	lock   sync.Mutex
+	ids    map[string]string
+	lookup ObjectRefresher
+}{
+	ids: make(map[string]string),
+}
+
+// SetMirrors sets the mirrors of objects from a comma separated list of
+// id=mirror-id entries. A mirror is a copy of the same content under another
+// id, reads of an object switch to its mirror once the object is gone or
+// its downloads keep failing. The lookup retrieves the mirror objects.
+func SetMirrors(list string, lookup ObjectRefresher) error {
+	mirrors.lock.Lock()
+	defer mirrors.lock.Unlock()
+
+	mirrors.lookup = lookup
+	for _, entry := range strings.Split(list, ",") {
+		if "" == entry {
+			continue
+		}
+		parts := strings.Split(entry, "=")
+		if 2 != len(parts) || "" == parts[0] || "" == parts[1] || parts[0] == parts[1] {
+			return fmt.Errorf("Invalid mirror %v", entry)
+		}
+		mirrors.ids[parts[0]] = parts[1]
+	}
+	return nil
+}
+
+// source returns the object the chunks of the buffer are downloaded from,
+// the mirror or the object with its latest download urls
+func (b *Buffer) source() *APIObject {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if nil != b.mirror {
+		return b.mirror
+	}
+	if nil != b.urlObject {
+		return b.urlObject
+	}
+	return b.object
+}
+
+// failOver counts the failed downloads of the buffer and switches to the
+// mirror of its object once the object is gone or too many downloads failed
+// in a row. It returns true if the download should be retried.
+func (b *Buffer) failOver(err error) bool {
+	b.lock.Lock()
+	if nil == err {
+		b.sourceFailures = 0
+		b.lock.Unlock()
+		return false
+	}
+	if _, closed := err.(*BufferClosedError); closed || nil != b.mirror {
+		b.lock.Unlock()
+		return false
+	}
+	b.sourceFailures++
+	_, gone := err.(*ObjectGoneError)
+	tripped := gone || b.sourceFailures >= mirrorFailures
+	b.lock.Unlock()
+
+	mirrors.lock.Lock()
+	mirrorID, exists := mirrors.ids[b.object.ObjectID]
+	lookup := mirrors.lookup
+	mirrors.lock.Unlock()
+	if !tripped || !exists || nil == lookup {
+		return false
+	}
+
+	mirror, lookupErr := lookup(mirrorID)
+	if nil != lookupErr {
+		Log.Debugf("%v", lookupErr)
+		Log.Warningf("Could not get mirror %v of object %v", mirrorID, b.object.ObjectID)
+		return false
+	}
+	// the offsets only map to the mirror if it has the same content
+	if mirror.Size != b.object.Size || ("" != mirror.MD5Checksum && "" != b.object.MD5Checksum && mirror.MD5Checksum != b.object.MD5Checksum) {
+		Log.Warningf("Mirror %v of object %v has a different content, not switching to it", mirrorID, b.object.ObjectID)
+		return false
+	}
+
+	Log.Debugf("%v", err)
+	Log.Warningf("Downloads of %v keep failing, switching to mirror %v", safeName(b.object.Name), mirrorID)
+	b.lock.Lock()
+	b.mirror = mirror
+	b.lock.Unlock()
+	return true
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"os"
 
 	"fmt"
@@ -9,6 +10,12 @@ import (
 
 	"strconv"
 
+	"sync"
+
+	"syscall"
+
+	"time"
+
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	. "github.com/claudetech/loggo/default"
@@ -141,9 +148,14 @@ type Object struct {
 	client *Drive
 	object *APIObject
 	buffer *Buffer
+	small  bool
 	uid    uint32
 	gid    uint32
 	umask  os.FileMode
+	// lock guards the object against the flushes of write handles and
+	// the write handle the size is reported of
+	lock    sync.Mutex
+	writing *WriteHandle
 }
 
 // Attr returns the attributes for a directory
@@ -161,19 +173,44 @@ func (o *Object) Attr(ctx context.Context, attr *fuse.Attr) error {
 		} else {
 			attr.Mode = 0644
 		}
-		attr.Size = o.object.Size
+		attr.Size = o.currentObject().ContentSize()
+		if size, writing := o.writtenSize(); writing {
+			attr.Size = size
+		}
 	}
 
 	attr.Uid = uint32(o.uid)
 	attr.Gid = uint32(o.gid)
 
-	attr.Mtime = o.object.LastModified
-	attr.Crtime = o.object.LastModified
-	attr.Ctime = o.object.LastModified
+	object := o.currentObject()
+	attr.Mtime = object.LastModified
+	attr.Crtime = object.LastModified
+	attr.Ctime = object.LastModified
 
 	return nil
 }
 
+// currentObject returns the object, which is replaced when a write handle
+// uploaded it
+func (o *Object) currentObject() *APIObject {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.object
+}
+
+// writtenSize returns the size of the object as written by the latest
+// open write handle
+func (o *Object) writtenSize() (uint64, bool) {
+	o.lock.Lock()
+	handle := o.writing
+	o.lock.Unlock()
+
+	if nil == handle {
+		return 0, false
+	}
+	return handle.size()
+}
+
 // ReadDirAll shows all files in the current directory
 func (o *Object) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	objects, err := o.client.GetObjectsByParent(o.object.ObjectID)
@@ -209,22 +246,104 @@ func (o *Object) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	}, nil
 }
 
-// Open opens a file for reading
+// Open opens a file for reading or truncates it for writing
 func (o *Object) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	if req.Dir {
 		return o, nil
 	}
+	object := o.currentObject()
 
-	buffer, err := o.client.Open(o.object)
+	if !req.Flags.IsReadOnly() {
+		// objects are always uploaded as a whole, so they can't be modified
+		// in place, encrypted objects would be uploaded unencrypted
+		if 0 == req.Flags&fuse.OpenTruncate || "" != object.ExportURL || object.Encrypted {
+			return nil, fuse.EPERM
+		}
+
+		writer, err := NewWriteBuffer(o.client, object)
+		if nil != err {
+			Log.Warningf("%v", err)
+			return nil, fuse.EIO
+		}
+		return o.openWriteHandle(writer), nil
+	}
+
+	// native objects are served from their export
+	if "" != object.ExportURL {
+		exported, err := o.client.OpenExport(object)
+		if nil != err {
+			Log.Warningf("%v", err)
+			if _, ok := err.(*OfflineError); ok {
+				return o, fuse.Errno(syscall.ENETDOWN)
+			}
+			return o, fuse.EIO
+		}
+		// the kernel may still know the size from before the export
+		resp.Flags |= fuse.OpenDirectIO
+		return &ExportHandle{object: object, file: exported}, nil
+	}
+
+	// small objects bypass the chunk cache
+	if isSmallObject(object) {
+		o.small = true
+		return o, nil
+	}
+
+	buffer, err := o.client.Open(object)
 	if nil != err {
 		Log.Warningf("%v", err)
+		switch err.(type) {
+		case *TooManyBuffersError, *BufferRateError:
+			return o, fuse.Errno(syscall.EAGAIN)
+		}
 		return o, fuse.ENOENT
 	}
+	buffer.setReaderUID(req.Uid)
 	o.buffer = buffer
 
 	return o, nil
 }
 
+// Create creates a new file for writing
+func (o *Object) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	// files are uploaded unencrypted, rclone couldn't read them from an
+	// encrypted directory
+	if o.object.Encrypted {
+		return nil, nil, fuse.EPERM
+	}
+
+	object := &APIObject{
+		Name:         req.Name,
+		LastModified: time.Now(),
+		Parents:      fmt.Sprintf("|%v|", o.object.ObjectID),
+	}
+
+	writer, err := NewWriteBuffer(o.client, object)
+	if nil != err {
+		Log.Warningf("%v", err)
+		return nil, nil, fuse.EIO
+	}
+
+	child := &Object{
+		client: o.client,
+		object: object,
+		uid:    o.uid,
+		gid:    o.gid,
+		umask:  o.umask,
+	}
+	return child, child.openWriteHandle(writer), nil
+}
+
+// openWriteHandle returns a new write handle of the object, its size is
+// reported till it is released
+func (o *Object) openWriteHandle(writer *WriteBuffer) *WriteHandle {
+	handle := &WriteHandle{node: o, writer: writer}
+	o.lock.Lock()
+	o.writing = handle
+	o.lock.Unlock()
+	return handle
+}
+
 // Release a stream
 func (o *Object) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	if nil != o.buffer {
@@ -238,16 +357,174 @@ func (o *Object) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 
 // Read reads some bytes or the whole file
 func (o *Object) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	buf, err := o.buffer.ReadBytes(req.Offset, int64(req.Size), false)
+	if o.small {
+		data, err := o.client.ReadSmallObject(o.object, req.Offset, int64(req.Size))
+		if nil != err {
+			Log.Warningf("%v", err)
+			if _, ok := err.(*OfflineError); ok {
+				return fuse.Errno(syscall.ENETDOWN)
+			}
+			if _, ok := err.(*QuotaExceededError); ok {
+				return fuse.Errno(syscall.EDQUOT)
+			}
+			return fuse.EIO
+		}
+		resp.Data = data
+		return nil
+	}
+
+	// the response data is allocated with the requested size as capacity
+	buf := resp.Data[:0]
+	if cap(buf) < req.Size {
+		buf = make([]byte, req.Size)
+	}
+	n, err := o.buffer.ReadInto(buf[:req.Size], req.Offset)
 	if nil != err {
+		Log.Warningf("%v", err)
+		if _, ok := err.(*ReadTimeoutError); ok {
+			return fuse.Errno(syscall.EAGAIN)
+		}
+		if _, ok := err.(*RetryDeadlineError); ok {
+			return fuse.Errno(syscall.EAGAIN)
+		}
+		if _, ok := err.(*ObjectGoneError); ok {
+			return fuse.ENOENT
+		}
+		if _, ok := err.(*ObjectChangedError); ok {
+			return fuse.Errno(syscall.ESTALE)
+		}
+		if _, ok := err.(*OfflineError); ok {
+			return fuse.Errno(syscall.ENETDOWN)
+		}
+		if _, ok := err.(*QuotaExceededError); ok {
+			return fuse.Errno(syscall.EDQUOT)
+		}
+		if _, ok := err.(*DownloadsPausedError); ok {
+			return fuse.Errno(syscall.EAGAIN)
+		}
+		return fuse.EIO
+	}
+
+	resp.Data = buf[:n]
+	return nil
+}
+
+// ExportHandle is an open export of a native object, every open of the
+// object reads its own file
+type ExportHandle struct {
+	object *APIObject
+	file   *os.File
+}
+
+// Read reads some bytes of the export
+func (h *ExportHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.file.ReadAt(buf, req.Offset)
+	if nil != err && io.EOF != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not read export of object %v", h.object.ObjectID)
+		return fuse.EIO
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Release closes the export
+func (h *ExportHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if err := h.file.Close(); nil != err {
+		Log.Debugf("%v", err)
+	}
+	return nil
+}
+
+// WriteHandle is an open write of an object, every open of the object for
+// writing has its own write buffer
+type WriteHandle struct {
+	node   *Object
+	lock   sync.Mutex
+	writer *WriteBuffer
+}
+
+// size returns the size of the written object, unless the handle was
+// released
+func (h *WriteHandle) size() (uint64, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if nil == h.writer {
+		return 0, false
+	}
+	return h.writer.Size(), true
+}
+
+// Write writes bytes to the write buffer
+func (h *WriteHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if nil == h.writer {
+		return fuse.EPERM
+	}
+	n, err := h.writer.Write(req.Offset, req.Data)
+	resp.Size = n
+	if nil != err {
+		Log.Warningf("%v", err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Flush uploads written bytes
+func (h *WriteHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if nil == h.writer {
+		return nil
+	}
+	if err := h.writer.Flush(); nil != err {
 		Log.Warningf("%v", err)
 		return fuse.EIO
 	}
+	h.uploaded()
+	return nil
+}
 
-	resp.Data = buf[:]
+// Release uploads the written bytes and closes the write buffer
+func (h *WriteHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if nil == h.writer {
+		return nil
+	}
+	if err := h.writer.Flush(); nil != err {
+		Log.Warningf("%v", err)
+	} else {
+		h.uploaded()
+	}
+	if err := h.writer.Close(); nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not close write buffer")
+	}
+	h.writer = nil
+
+	h.node.lock.Lock()
+	if h.node.writing == h {
+		h.node.writing = nil
+	}
+	h.node.lock.Unlock()
 	return nil
 }
 
+// uploaded makes the uploaded object the object of the node, the lock
+// must be held
+func (h *WriteHandle) uploaded() {
+	h.node.lock.Lock()
+	h.node.object = h.writer.Object()
+	h.node.lock.Unlock()
+}
+
 // Remove deletes an element
 func (o *Object) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	obj, err := o.client.GetObjectByParentAndName(o.object.ObjectID, req.Name)
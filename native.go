@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	gdrive "google.golang.org/api/drive/v2"
+)
+
+// nativeMimePrefix is the mime type prefix of Google Docs, Sheets, Slides
+// and the other Google native formats
+const nativeMimePrefix = "application/vnd.google-apps."
+
+// exportMimeTypes are the mime types of the formats native objects can be
+// exported in, by file extension
+var exportMimeTypes = map[string]string{
+	"pdf":  "application/pdf",
+	"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"odt":  "application/vnd.oasis.opendocument.text",
+	"ods":  "application/x-vnd.oasis.opendocument.spreadsheet",
+	"odp":  "application/vnd.oasis.opendocument.presentation",
+	"rtf":  "application/rtf",
+	"txt":  "text/plain",
+	"csv":  "text/csv",
+	"epub": "application/epub+zip",
+	"png":  "image/png",
+	"svg":  "image/svg+xml",
+}
+
+// exportDirMaxSize is the size the cached exports are kept under, the
+// least recently opened exports are deleted first
+const exportDirMaxSize = int64(1024 * 1024 * 1024)
+
+var nativeExport = struct {
+	lock    sync.Mutex
+	formats []string
+	path    string
+	running map[string]chan struct{}
+}{
+	running: make(map[string]chan struct{}),
+}
+
+// SetNativeExport sets the comma separated file extensions Google native
+// objects are exported in, the first format an object supports is used
+// ("" = disabled). Exports are cached in the given directory.
+func SetNativeExport(list, path string) error {
+	var formats []string
+	for _, format := range strings.Split(list, ",") {
+		format = strings.TrimPrefix(strings.TrimSpace(format), ".")
+		if "" == format {
+			continue
+		}
+		if _, exists := exportMimeTypes[format]; !exists {
+			return fmt.Errorf("Invalid export format %v", format)
+		}
+		formats = append(formats, format)
+	}
+
+	nativeExport.lock.Lock()
+	defer nativeExport.lock.Unlock()
+
+	nativeExport.formats = formats
+	nativeExport.path = path
+	return nil
+}
+
+// exportLink returns the export url and the file extension of a native
+// file in the first configured format it supports
+func exportLink(file *gdrive.File) (string, string, bool) {
+	if !strings.HasPrefix(file.MimeType, nativeMimePrefix) || "application/vnd.google-apps.folder" == file.MimeType {
+		return "", "", false
+	}
+
+	nativeExport.lock.Lock()
+	formats := nativeExport.formats
+	nativeExport.lock.Unlock()
+	for _, format := range formats {
+		if link, exists := file.ExportLinks[exportMimeTypes[format]]; exists {
+			return link, format, true
+		}
+	}
+	return "", "", false
+}
+
+// exportName returns the file the export of an object version is cached in
+func exportName(object *APIObject) string {
+	return filepath.Join(nativeExport.path, fmt.Sprintf("%v-%v", object.ObjectID, object.LastModified.UnixNano()))
+}
+
+// exportedSize returns the size of the cached export of an object version
+func exportedSize(object *APIObject) (uint64, bool) {
+	if "" == nativeExport.path {
+		return 0, false
+	}
+	info, err := os.Stat(exportName(object))
+	if nil != err {
+		return 0, false
+	}
+	return uint64(info.Size()), true
+}
+
+// OpenExport opens the cached export of a native object. The size of an
+// export is not known in advance and exports don't support ranges, so the
+// whole object is exported on the first read of a version and its size is
+// set once it is done. Concurrent opens wait for the running export.
+// Exports of older versions are deleted.
+func (d *Drive) OpenExport(object *APIObject) (*os.File, error) {
+	filename := exportName(object)
+	for {
+		nativeExport.lock.Lock()
+		if f, err := os.Open(filename); nil == err {
+			nativeExport.lock.Unlock()
+			touchExport(filename)
+			return f, nil
+		}
+		done, running := nativeExport.running[object.ObjectID]
+		if !running {
+			break
+		}
+		nativeExport.lock.Unlock()
+		<-done
+	}
+	done := make(chan struct{})
+	nativeExport.running[object.ObjectID] = done
+	nativeExport.lock.Unlock()
+	defer func() {
+		nativeExport.lock.Lock()
+		delete(nativeExport.running, object.ObjectID)
+		nativeExport.lock.Unlock()
+		close(done)
+	}()
+
+	if isOffline() {
+		return nil, &OfflineError{ObjectID: object.ObjectID}
+	}
+
+	Log.Infof("Exporting %v", safeName(object.Name))
+	res, err := d.getNativeClient().Get(object.ExportURL)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not export object %v", object.ObjectID)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		Log.Debugf("Export of object %v failed with status %v", object.ObjectID, res.StatusCode)
+		return nil, fmt.Errorf("Could not export object %v", object.ObjectID)
+	}
+
+	f, err := ioutil.TempFile(nativeExport.path, object.ObjectID+"-export-")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not create export of object %v", object.ObjectID)
+	}
+	size, err := io.Copy(f, res.Body)
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), filename)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not export object %v", object.ObjectID)
+	}
+
+	old, _ := filepath.Glob(filepath.Join(nativeExport.path, object.ObjectID+"-*"))
+	for _, name := range old {
+		if name != filename {
+			os.Remove(name)
+		}
+	}
+
+	Log.Debugf("Exported %v bytes of object %v", size, object.ObjectID)
+	cleanExports(filename)
+
+	// the object may be shared by other nodes, the next lookup gets the size
+	sized := *object
+	sized.Size = uint64(size)
+	if err := d.cache.UpdateObject(&sized); nil != err {
+		Log.Debugf("%v", err)
+	}
+	return os.Open(filename)
+}
+
+// touchExport marks an export as recently opened
+func touchExport(filename string) {
+	if err := os.Chtimes(filename, time.Now(), time.Now()); nil != err {
+		Log.Debugf("%v", err)
+	}
+}
+
+// cleanExports deletes the least recently opened exports but the given one
+// till the exports fit into the maximum size. Open exports stay readable.
+func cleanExports(keep string) {
+	files, err := ioutil.ReadDir(nativeExport.path)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return
+	}
+
+	size := int64(0)
+	for _, file := range files {
+		size += file.Size()
+	}
+	sort.Sort(byModTime(files))
+	for _, file := range files {
+		if size <= exportDirMaxSize {
+			return
+		}
+		filename := filepath.Join(nativeExport.path, file.Name())
+		if filename == keep || strings.Contains(file.Name(), "-export-") {
+			continue
+		}
+		if err := os.Remove(filename); nil != err {
+			Log.Debugf("%v", err)
+			continue
+		}
+		Log.Debugf("Deleted export %v", file.Name())
+		size -= file.Size()
+	}
+}
+
+// byModTime sorts files by their last modified time, oldest first
+type byModTime []os.FileInfo
+
+func (f byModTime) Len() int           { return len(f) }
+func (f byModTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byModTime) Less(i, j int) bool { return f[i].ModTime().Before(f[j].ModTime()) }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// offlineProbeInterval is the time reads are served from the cache only
+// after a request failed because the API was unreachable. The next missing
+// chunk afterwards probes the connection again.
+const offlineProbeInterval = 30 * time.Second
+
+var offline struct {
+	lock   sync.Mutex
+	forced bool
+	until  time.Time
+	since  time.Time
+}
+
+// OfflineError is returned for chunks that are not cached while the API is
+// unreachable
+type OfflineError struct {
+	ObjectID string
+	Offset   int64
+}
+
+func (e *OfflineError) Error() string {
+	return fmt.Sprintf("Offline, object %v offset %v is not cached", e.ObjectID, e.Offset)
+}
+
+// SetOffline serves cached chunks only and never contacts the API for chunks
+func SetOffline(forced bool) {
+	offline.lock.Lock()
+	defer offline.lock.Unlock()
+
+	offline.forced = forced
+}
+
+// isOffline checks if missing chunks fail right away
+func isOffline() bool {
+	offline.lock.Lock()
+	defer offline.lock.Unlock()
+
+	return offline.forced || time.Now().Before(offline.until)
+}
+
+// outageDuration returns the time since Google Drive became unreachable and
+// if it is unreachable now. A forced offline mode is no outage.
+func outageDuration() (time.Duration, bool) {
+	offline.lock.Lock()
+	defer offline.lock.Unlock()
+
+	if offline.since.IsZero() || !time.Now().Before(offline.until) {
+		return 0, false
+	}
+	return time.Since(offline.since), true
+}
+
+// isNetworkError checks if a request failed because the API was unreachable
+func isNetworkError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// updateOffline switches to serving cached chunks only after a network
+// error and back after a successful request
+func updateOffline(err error) {
+	offline.lock.Lock()
+	defer offline.lock.Unlock()
+
+	if nil == err {
+		if !offline.until.IsZero() {
+			Log.Infof("Google Drive is reachable again")
+			offline.until = time.Time{}
+			offline.since = time.Time{}
+		}
+		return
+	}
+	if !isNetworkError(err) {
+		return
+	}
+	if offline.until.IsZero() {
+		Log.Warningf("Google Drive is unreachable, serving cached chunks only")
+		offline.since = time.Now()
+	}
+	offline.until = time.Now().Add(offlineProbeInterval)
+}
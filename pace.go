@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// maxPacingFactor limits how far rate limit responses stretch the pacing
+// interval
+const maxPacingFactor = 16
+
+// pacer spaces chunk requests by a minimum interval, so that bursts of
+// requests don't trip the per second limits of Google Drive. Rate limit
+// responses double the interval, successful responses halve it again
+// down to the configured interval.
+var pacer = struct {
+	lock     sync.Mutex
+	interval time.Duration
+	current  time.Duration
+	next     time.Time
+}{}
+
+// SetRequestPacing sets the minimum interval between two chunk requests
+// (0 = disabled)
+func SetRequestPacing(interval time.Duration) {
+	pacer.lock.Lock()
+	defer pacer.lock.Unlock()
+
+	pacer.interval = interval
+	pacer.current = interval
+}
+
+// pace waits for the next free request slot or until the context is done
+func pace(ctx context.Context) error {
+	pacer.lock.Lock()
+	if 0 == pacer.current {
+		pacer.lock.Unlock()
+		return nil
+	}
+	now := time.Now()
+	slot := pacer.next
+	if slot.Before(now) {
+		slot = now
+	}
+	pacer.next = slot.Add(pacer.current)
+	pacer.lock.Unlock()
+
+	if !slot.After(now) {
+		return nil
+	}
+
+	timer := time.NewTimer(slot.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// paceRateLimited doubles the pacing interval after a rate limit response
+func paceRateLimited() {
+	pacer.lock.Lock()
+	defer pacer.lock.Unlock()
+
+	if 0 == pacer.interval || pacer.current >= maxPacingFactor*pacer.interval {
+		return
+	}
+	pacer.current *= 2
+	Log.Debugf("Rate limited, pacing chunk requests every %v", pacer.current)
+}
+
+// paceSucceeded halves the pacing interval after a successful response
+func paceSucceeded() {
+	pacer.lock.Lock()
+	defer pacer.lock.Unlock()
+
+	if pacer.current > pacer.interval {
+		pacer.current /= 2
+		if pacer.current < pacer.interval {
+			pacer.current = pacer.interval
+		}
+	}
+}
+
+// isRateLimited checks if a response rejected the request because of a
+// rate limit (e.g. userRateLimitExceeded)
+func isRateLimited(err *StatusError) bool {
+	return http.StatusTooManyRequests == err.StatusCode ||
+		(http.StatusForbidden == err.StatusCode && strings.HasSuffix(strings.ToLower(err.Reason), "ratelimitexceeded"))
+}
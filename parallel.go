@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// parallelStreamMinSize is the minimum size of the part of a chunk one
+// parallel stream downloads
+const parallelStreamMinSize = 1024 * 1024
+
+var parallelStreams = 1
+
+// SetParallelStreams sets the number of requests one chunk is downloaded
+// with (1 = one request per chunk). On links with a high bandwidth delay
+// product a single connection can't use the whole bandwidth for large
+// chunks.
+func SetParallelStreams(streams int) {
+	if streams < 1 {
+		streams = 1
+	}
+	parallelStreams = streams
+}
+
+// downloadParallel downloads a range in parts of equal size at the same
+// time and assembles them in memory, so that the chunk is still written
+// with one atomic write. The download slot of the range is shared by its
+// streams. Parts that succeeded are kept till the whole range is
+// downloaded, so that a retried read only requests the missing parts.
+func (b *Buffer) downloadParallel(generation, offset, offsetEnd int64) ([]byte, error) {
+	streams := int64(parallelStreams)
+	if parts := (offsetEnd - offset) / parallelStreamMinSize; parts < streams {
+		streams = parts
+	}
+	if streams <= 1 {
+		return b.downloadCapped(generation, offset, offsetEnd)
+	}
+
+	Log.Debugf("Downloading object %v bytes %v - %v in %v streams", b.object.ObjectID, offset, offsetEnd, streams)
+	bytes := make([]byte, offsetEnd-offset)
+	errs := make([]error, streams)
+	part := (offsetEnd - offset + streams - 1) / streams
+	var wg sync.WaitGroup
+	for n := int64(0); n < streams; n++ {
+		start := offset + n*part
+		end := start + part
+		if end > offsetEnd {
+			end = offsetEnd
+		}
+
+		wg.Add(1)
+		go func(n, start, end int64) {
+			defer wg.Done()
+			data, err := b.downloadCapped(generation, start, end)
+			if nil == err && int64(len(data)) != end-start {
+				err = &ShortBodyError{
+					ObjectID: b.object.ObjectID,
+					Offset:   start,
+					Received: int64(len(data)),
+					Expected: end - start,
+				}
+			}
+			if nil != err {
+				errs[n] = err
+				return
+			}
+			b.keepSubRange(generation, start, end, data)
+			copy(bytes[start-offset:], data)
+		}(n, start, end)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if nil != err {
+			return nil, err
+		}
+	}
+	for n := int64(0); n < streams; n++ {
+		b.dropSubRange(offset + n*part)
+	}
+	return bytes, nil
+}
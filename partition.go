@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// partitionMaxDepth is the maximum number of parent folders looked up for
+// the partition of an object
+const partitionMaxDepth = 64
+
+var partitions = struct {
+	lock    sync.Mutex
+	quotas  map[string]int64
+	objects map[string]string
+	used    map[string]int64
+}{
+	quotas:  make(map[string]int64),
+	objects: make(map[string]string),
+	used:    make(map[string]int64),
+}
+
+// PartitionStats holds the quota and the last measured usage of a cache
+// partition
+type PartitionStats struct {
+	Quota int64 `json:"quota"`
+	Used  int64 `json:"used"`
+}
+
+// SetCachePartitions sets the comma separated cache partitions as folder
+// id and quota in byte (e.g. movies-folder-id=107374182400). Files in a
+// partition folder or its sub folders are tagged with the folder id when
+// they are opened.
+func SetCachePartitions(list string) error {
+	quotas := make(map[string]int64)
+	for _, partition := range strings.Split(list, ",") {
+		if "" == partition {
+			continue
+		}
+		parts := strings.SplitN(partition, "=", 2)
+		if 2 != len(parts) || "" == parts[0] {
+			return fmt.Errorf("Invalid cache partition %v", partition)
+		}
+		quota, err := strconv.ParseInt(parts[1], 10, 64)
+		if nil != err || quota <= 0 {
+			return fmt.Errorf("Invalid quota of cache partition %v", partition)
+		}
+		quotas[parts[0]] = quota
+	}
+
+	for tag, quota := range quotas {
+		SetTagQuota(tag, quota)
+	}
+	return nil
+}
+
+// SetTagQuota reserves cache space for the chunks of the objects with the
+// given tag. While a tag uses less than its quota, its chunks are only
+// evicted after the chunks of untagged objects and of tags over their
+// quota. The quotas share the space of the chunk directory, they don't add
+// to it.
+func SetTagQuota(tag string, quota int64) {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+
+	if quota <= 0 {
+		delete(partitions.quotas, tag)
+		return
+	}
+	partitions.quotas[tag] = quota
+}
+
+// SetObjectTag sets the tag of an object, e.g. the library it belongs to
+// ("" = untagged)
+func SetObjectTag(objectID, tag string) {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+
+	if "" == tag {
+		delete(partitions.objects, objectID)
+		return
+	}
+	partitions.objects[objectID] = tag
+}
+
+// objectTag returns the tag of an object
+func objectTag(objectID string) string {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+
+	return partitions.objects[objectID]
+}
+
+// tagObject tags an object with the partition folder it is in
+func (d *Drive) tagObject(object *APIObject) {
+	partitions.lock.Lock()
+	_, tagged := partitions.objects[object.ObjectID]
+	configured := len(partitions.quotas) > 0
+	partitions.lock.Unlock()
+	if tagged || !configured {
+		return
+	}
+
+	parent := object
+	for depth := 0; depth < partitionMaxDepth; depth++ {
+		parentID := strings.Split(strings.Trim(parent.Parents, "|"), "|")[0]
+		if "" == parentID {
+			return
+		}
+
+		partitions.lock.Lock()
+		_, partitioned := partitions.quotas[parentID]
+		partitions.lock.Unlock()
+		if partitioned {
+			SetObjectTag(object.ObjectID, parentID)
+			return
+		}
+
+		next, err := d.GetObject(parentID)
+		if nil != err {
+			return
+		}
+		parent = next
+	}
+}
+
+// partitionsConfigured checks if cache partitions with quotas are set
+func partitionsConfigured() bool {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+
+	return len(partitions.quotas) > 0
+}
+
+// partitionRank orders chunks for eviction by their partition. Chunks of
+// untagged objects and of tags over their quota rank 0 and go first,
+// chunks of tags within their quota rank 1.
+func partitionRank(objectID string) int {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+
+	tag, tagged := partitions.objects[objectID]
+	quota, partitioned := partitions.quotas[tag]
+	if !tagged || !partitioned || partitions.used[tag] > quota {
+		return 0
+	}
+	return 1
+}
+
+// measurePartitions stores the usage of all tags measured by an eviction
+func measurePartitions(used map[string]int64) {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+
+	partitions.used = used
+}
+
+// partitionEvicted subtracts an evicted chunk from the usage of its tag
+func partitionEvicted(objectID string, size int64) {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+
+	if tag, tagged := partitions.objects[objectID]; tagged {
+		partitions.used[tag] -= size
+	}
+}
+
+// GetPartitionStats returns the quota and the usage measured by the last
+// eviction of every tag with a quota
+func GetPartitionStats() map[string]PartitionStats {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+
+	stats := make(map[string]PartitionStats)
+	for tag, quota := range partitions.quotas {
+		stats[tag] = PartitionStats{
+			Quota: quota,
+			Used:  partitions.used[tag],
+		}
+	}
+	return stats
+}
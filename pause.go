@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+const (
+	// PauseWait lets reads of missing chunks wait till downloads are resumed
+	PauseWait = "wait"
+	// PauseFail fails reads of missing chunks while downloads are paused
+	PauseFail = "fail"
+)
+
+var pausePolicy = PauseWait
+
+var pause = struct {
+	lock    sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	running map[*context.CancelFunc]struct{}
+}{
+	running: make(map[*context.CancelFunc]struct{}),
+}
+
+// DownloadsPausedError is returned for chunks that are not cached while
+// downloads are paused
+type DownloadsPausedError struct {
+	ObjectID string
+	Offset   int64
+}
+
+func (e *DownloadsPausedError) Error() string {
+	return fmt.Sprintf("Downloads are paused, object %v offset %v is not cached", e.ObjectID, e.Offset)
+}
+
+// SetPausePolicy sets the behavior of reads of missing chunks while
+// downloads are paused
+func SetPausePolicy(policy string) error {
+	if PauseWait != policy && PauseFail != policy {
+		return fmt.Errorf("Invalid pause policy %v", policy)
+	}
+	pausePolicy = policy
+	return nil
+}
+
+// PauseDownloads stops starting downloads, cached chunks are still served.
+// Running downloads finish unless they are cancelled.
+func PauseDownloads(cancelRunning bool) {
+	pause.lock.Lock()
+	defer pause.lock.Unlock()
+
+	if !pause.paused {
+		Log.Infof("Pausing downloads")
+		pause.paused = true
+		pause.resumed = make(chan struct{})
+	}
+	if cancelRunning {
+		for cancel := range pause.running {
+			(*cancel)()
+		}
+	}
+}
+
+// ResumeDownloads starts downloads again after PauseDownloads
+func ResumeDownloads() {
+	pause.lock.Lock()
+	defer pause.lock.Unlock()
+
+	if pause.paused {
+		Log.Infof("Resuming downloads")
+		pause.paused = false
+		close(pause.resumed)
+	}
+}
+
+// DownloadsPaused checks if downloads are paused
+func DownloadsPaused() bool {
+	pause.lock.Lock()
+	defer pause.lock.Unlock()
+
+	return pause.paused
+}
+
+// waitUnpaused waits till downloads are resumed. Preloads are dropped and
+// reads fail right away with the fail policy or after the download wait
+// timeout.
+func (b *Buffer) waitUnpaused(offset int64, priority ReadPriority) error {
+	pause.lock.Lock()
+	paused := pause.paused
+	resumed := pause.resumed
+	pause.lock.Unlock()
+
+	if !paused {
+		return nil
+	}
+	if ReadPrefetch == priority {
+		return errPreloadDropped
+	}
+	if PauseFail == pausePolicy {
+		return &DownloadsPausedError{ObjectID: b.object.ObjectID, Offset: offset}
+	}
+
+	var timeout <-chan time.Time
+	if downloadWaitTimeout > 0 {
+		timer := time.NewTimer(downloadWaitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-timeout:
+		return &DownloadsPausedError{ObjectID: b.object.ObjectID, Offset: offset}
+	case <-b.ctx.Done():
+		return &BufferClosedError{ObjectID: b.object.ObjectID}
+	}
+}
+
+// trackDownload registers the cancel function of a running request, so
+// that pausing can cancel it. The returned function unregisters it.
+func trackDownload(cancel context.CancelFunc) func() {
+	pause.lock.Lock()
+	defer pause.lock.Unlock()
+
+	key := &cancel
+	pause.running[key] = struct{}{}
+	return func() {
+		pause.lock.Lock()
+		defer pause.lock.Unlock()
+
+		delete(pause.running, key)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// peerTimeout is the maximum time all peers together get to serve a chunk
+// before the chunk is downloaded from Google Drive
+const peerTimeout = time.Second
+
+// peerPathPrefix is the path chunks are served under, followed by the
+// object id and the offset of the chunk
+const peerPathPrefix = "/chunks/"
+
+// peerSecretHeader is the header requests of peers send the shared secret in
+const peerSecretHeader = "X-Plexdrive-Secret"
+
+var peers []string
+var peerSecret string
+var peerClient = &http.Client{}
+
+// SetPeers sets the comma separated base urls of other plexdrive instances
+// that are asked for missing chunks before Google Drive, and the secret
+// shared by all instances ("" = none). Requests send the secret and are
+// only served if it is the own one.
+func SetPeers(list, secret string) error {
+	peers = nil
+	peerSecret = secret
+	for _, peer := range strings.Split(list, ",") {
+		if "" == peer {
+			continue
+		}
+		peerURL, err := url.Parse(peer)
+		if nil != err || "" == peerURL.Scheme || "" == peerURL.Host {
+			return fmt.Errorf("Invalid peer %v", peer)
+		}
+		peers = append(peers, strings.TrimSuffix(peer, "/"))
+	}
+	return nil
+}
+
+// ServePeerCache serves the cached chunks to other plexdrive instances on
+// the given address. Chunks are only served if the peer asks for the same
+// modification time of the object and the same chunk size.
+func ServePeerCache(address string, drive *Drive) error {
+	listener, err := net.Listen("tcp", address)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not listen for peers on %v", address)
+	}
+	Log.Infof("Serving cached chunks to peers on %v", listener.Addr())
+
+	go func() {
+		if err := http.Serve(listener, &peerHandler{drive: drive}); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Stopped serving cached chunks to peers")
+		}
+	}()
+	return nil
+}
+
+// peerHandler serves the cached chunks of this instance
+type peerHandler struct {
+	drive *Drive
+}
+
+func (h *peerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if "GET" != r.Method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if 1 != subtle.ConstantTimeCompare([]byte(peerSecret), []byte(r.Header.Get(peerSecretHeader))) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, peerPathPrefix), "/")
+	if !strings.HasPrefix(r.URL.Path, peerPathPrefix) || 2 != len(parts) {
+		http.NotFound(w, r)
+		return
+	}
+	objectID := parts[0]
+	offset, err := strconv.ParseInt(parts[1], 10, 64)
+	if nil != err {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if nil != err || size <= 0 {
+		http.Error(w, "invalid chunk size", http.StatusBadRequest)
+		return
+	}
+	modified, err := strconv.ParseInt(r.URL.Query().Get("modified"), 10, 64)
+	if nil != err {
+		http.Error(w, "invalid modification time", http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.readChunk(objectID, offset, size, modified)
+	if nil != err {
+		Log.Tracef("%v", err)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// readChunk reads a cached chunk of the current version of an object
+func (h *peerHandler) readChunk(objectID string, offset, size, modified int64) ([]byte, error) {
+	object, err := h.drive.GetObject(objectID)
+	if nil != err {
+		return nil, err
+	}
+	if object.LastModified.UnixNano() != modified {
+		return nil, fmt.Errorf("Object %v was modified", objectID)
+	}
+	if offset < 0 || uint64(offset) >= object.Size || 0 != offset%size {
+		return nil, fmt.Errorf("Invalid offset %v of object %v", offset, objectID)
+	}
+
+	chunks.load(objectID)
+	dir := filepath.Join(chunkPath, objectID)
+	filename := filepath.Join(dir, chunkName(chunks.generation(objectID), size, offset))
+	info, cached := chunks.info(filename)
+	if !cached {
+		return nil, fmt.Errorf("Chunk %v is not cached", filename)
+	}
+
+	var store ChunkStore
+	if instance, exists := instances.Get(objectID); exists {
+		store = instance.(*Buffer).store
+	} else {
+		store = newChunkStore(dir)
+		defer store.Close()
+	}
+	length := int64(math.Min(float64(size), float64(int64(object.Size)-offset)))
+	return readChunkFile(store, filename, length, info.Compressed)
+}
+
+// peerResult is the answer of a peer to a chunk request
+type peerResult struct {
+	peer string
+	data []byte
+	err  error
+}
+
+// readPeers asks all peers at once for a chunk that is not cached locally
+// and takes the first complete answer. The other requests are canceled.
+func (b *Buffer) readPeers(offset, offsetEnd int64) ([]byte, bool) {
+	if 0 == len(peers) {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(b.ctx, peerTimeout)
+	defer cancel()
+
+	results := make(chan peerResult, len(peers))
+	for _, peer := range peers {
+		chunkURL := fmt.Sprintf("%v%v%v/%v?size=%v&modified=%v", peer, peerPathPrefix,
+			url.PathEscape(b.object.ObjectID), offset, b.chunkSize, b.object.LastModified.UnixNano())
+		go func(peer, chunkURL string) {
+			data, err := readPeer(ctx, chunkURL, offsetEnd-offset)
+			results <- peerResult{peer: peer, data: data, err: err}
+		}(peer, chunkURL)
+	}
+	for range peers {
+		result := <-results
+		if nil != result.err {
+			Log.Tracef("%v", result.err)
+			continue
+		}
+		Log.Debugf("Got object %v bytes %v - %v from peer %v", b.object.ObjectID, offset, offsetEnd, result.peer)
+		return result.data, true
+	}
+	return nil, false
+}
+
+// readPeer requests a chunk of the given length from a peer
+func readPeer(ctx context.Context, chunkURL string, length int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", chunkURL, nil)
+	if nil != err {
+		return nil, err
+	}
+	if "" != peerSecret {
+		req.Header.Set(peerSecretHeader, peerSecret)
+	}
+	res, err := peerClient.Do(req.WithContext(ctx))
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf("Peer responded with status %v for %v", res.StatusCode, chunkURL)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, length+1))
+	if nil != err {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("Peer sent %v bytes instead of %v for %v", len(data), length, chunkURL)
+	}
+	return data, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import "sync"
+
+// recentReadCount is the number of read offsets kept for the prefetch predictor
+const recentReadCount = 16
+
+var prefetch = struct {
+	lock      sync.Mutex
+	predictor PrefetchPredictor
+}{
+	predictor: SequentialPredictor{},
+}
+
+// PrefetchPredictor decides which chunks of an object are preloaded
+type PrefetchPredictor interface {
+	// Predict returns the offsets of the chunks to preload, given the recent
+	// read offsets of the buffer (oldest first) and the number of chunks the
+	// preload schedule allows at the moment
+	Predict(object *APIObject, reads []int64, depth int) []int64
+}
+
+// SetPrefetchPredictor replaces the prefetch predictor (nil = sequential)
+func SetPrefetchPredictor(predictor PrefetchPredictor) {
+	prefetch.lock.Lock()
+	defer prefetch.lock.Unlock()
+
+	if nil == predictor {
+		predictor = SequentialPredictor{}
+	}
+	prefetch.predictor = predictor
+}
+
+// chunkOffsets aligns predicted offsets to the chunks of the buffer and
+// drops offsets outside of the object, the current chunk and duplicates.
+// The last chunk of an object is kept even if it is shorter than the chunk
+// size, it is downloaded and cached with its real length.
+func (b *Buffer) chunkOffsets(predicted []int64, current int64) []int64 {
+	var offsets []int64
+	seen := make(map[int64]bool)
+	for _, offset := range predicted {
+		if offset < 0 || uint64(offset) >= b.object.Size {
+			continue
+		}
+		offset -= offset % b.chunkSize
+		if offset == current || seen[offset] {
+			continue
+		}
+		seen[offset] = true
+		offsets = append(offsets, offset)
+	}
+	return offsets
+}
+
+// prefetchPredictor returns the current prefetch predictor
+func prefetchPredictor() PrefetchPredictor {
+	prefetch.lock.Lock()
+	defer prefetch.lock.Unlock()
+
+	return prefetch.predictor
+}
+
+// SequentialPredictor preloads the chunks following the last read
+type SequentialPredictor struct{}
+
+// Predict returns the chunks after the chunk of the last read
+func (SequentialPredictor) Predict(object *APIObject, reads []int64, depth int) []int64 {
+	if 0 == len(reads) {
+		return nil
+	}
+
+	size := objectChunkSize(object)
+	last := reads[len(reads)-1]
+	next := last - last%size + size
+
+	var offsets []int64
+	for n := 0; n < depth && uint64(next) < object.Size; n++ {
+		offsets = append(offsets, next)
+		next += size
+	}
+	return offsets
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fixedPredictor always predicts the same offsets
+type fixedPredictor []int64
+
+func (p fixedPredictor) Predict(object *APIObject, reads []int64, depth int) []int64 {
+	return p
+}
+
+func TestSequentialPredictor(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	object := &APIObject{ObjectID: "sequential", Size: 4*testChunkSize + 10}
+
+	tests := []struct {
+		reads    []int64
+		depth    int
+		expected []int64
+	}{
+		{nil, 2, nil},
+		{[]int64{0}, 0, nil},
+		{[]int64{0}, 2, []int64{testChunkSize, 2 * testChunkSize}},
+		// the last read counts, in the middle of its chunk
+		{[]int64{3 * testChunkSize, testChunkSize + 5}, 1, []int64{2 * testChunkSize}},
+		// the short last chunk is predicted, nothing beyond it
+		{[]int64{3 * testChunkSize}, 5, []int64{4 * testChunkSize}},
+		{[]int64{4 * testChunkSize}, 5, nil},
+	}
+	for _, test := range tests {
+		if got := (SequentialPredictor{}).Predict(object, test.reads, test.depth); !reflect.DeepEqual(test.expected, got) {
+			t.Errorf("predicted %v for reads %v and depth %v instead of %v", got, test.reads, test.depth, test.expected)
+		}
+	}
+}
+
+func TestChunkOffsets(t *testing.T) {
+	b := &Buffer{
+		object:    &APIObject{ObjectID: "offsets", Size: 4*testChunkSize + 10},
+		chunkSize: testChunkSize,
+	}
+	predicted := []int64{-1, testChunkSize, 2*testChunkSize + 7, 2 * testChunkSize, 4*testChunkSize + 9, 4*testChunkSize + 10, 0}
+
+	// offsets are aligned, the current chunk, duplicates and offsets outside
+	// of the object are dropped
+	expected := []int64{2 * testChunkSize, 4 * testChunkSize, 0}
+	if got := b.chunkOffsets(predicted, testChunkSize); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("got chunk offsets %v instead of %v", got, expected)
+	}
+}
+
+func TestPrefetchPredictorIsConsulted(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	SetPrefetchPredictor(fixedPredictor{4 * testChunkSize})
+	defer SetPrefetchPredictor(nil)
+	server := newTestServer(5*testChunkSize, nil)
+	defer server.Close()
+	buffer := openTestBuffer(t, server.object("predicted"))
+	defer buffer.Close()
+
+	p := make([]byte, testChunkSize)
+	if _, err := buffer.ReadInto(p, 0); nil != err {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { return chunks.has("predicted", 0, 4*testChunkSize) }) {
+		t.Fatalf("predicted chunk was not preloaded")
+	}
+	if chunks.has("predicted", 0, testChunkSize) {
+		t.Fatalf("preloaded the next chunk the predictor didn't predict")
+	}
+}
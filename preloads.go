@@ -0,0 +1,79 @@
+package main
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var activePreloads int64
+var refusedPreloads int64
+var maxActivePreloads int64 = 256
+var recoverPreloads = true
+
+// preloadCeilingHit is 1 while preloads are refused, so that the warning is
+// only logged once each time the ceiling is reached
+var preloadCeilingHit int32
+
+// PreloadStats holds the number of running preload goroutines
+type PreloadStats struct {
+	Active  int64 `json:"active"`
+	Max     int64 `json:"max"`
+	Refused int64 `json:"refused"`
+}
+
+// SetMaxActivePreloads sets the maximum number of preload goroutines that
+// run at the same time (0 = unlimited), further preloads are skipped
+func SetMaxActivePreloads(max int64) {
+	atomic.StoreInt64(&maxActivePreloads, max)
+}
+
+// SetPreloadRecovery sets if a panic of a preload only aborts that preload
+// instead of the whole process. Disabling it crashes with the stack
+// traces of all goroutines, e.g. to debug the panic.
+func SetPreloadRecovery(enabled bool) {
+	recoverPreloads = enabled
+}
+
+// GetPreloadStats returns the number of running and refused preloads
+func GetPreloadStats() PreloadStats {
+	return PreloadStats{
+		Active:  atomic.LoadInt64(&activePreloads),
+		Max:     atomic.LoadInt64(&maxActivePreloads),
+		Refused: atomic.LoadInt64(&refusedPreloads),
+	}
+}
+
+// startPreload runs a preload of an object in its own goroutine, unless the
+// maximum number of preloads is running already
+func startPreload(objectID string, preload func()) bool {
+	active := atomic.AddInt64(&activePreloads, 1)
+	if max := atomic.LoadInt64(&maxActivePreloads); max > 0 && active > max {
+		atomic.AddInt64(&activePreloads, -1)
+		atomic.AddInt64(&refusedPreloads, 1)
+		if atomic.CompareAndSwapInt32(&preloadCeilingHit, 0, 1) {
+			Log.Warningf("%v preloads are running, skipping further preloads", max)
+		}
+		return false
+	}
+	atomic.StoreInt32(&preloadCeilingHit, 0)
+
+	go func() {
+		defer atomic.AddInt64(&activePreloads, -1)
+		if recoverPreloads {
+			defer recoverPreload(objectID)
+		}
+		preload()
+	}()
+	return true
+}
+
+// recoverPreload logs the panic of a preload, e.g. of a buffer that was
+// closed concurrently, and lets the process go on
+func recoverPreload(objectID string) {
+	if r := recover(); nil != r {
+		Log.Errorf("Preload of object %v panicked: %v", objectID, r)
+		Log.Debugf("%s", debug.Stack())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+)
+
+// panicStore panics on chunk writes while panicking is set, like a
+// preload writing a chunk of a buffer that was closed concurrently
+type panicStore struct {
+	ChunkStore
+	panicking *int32
+	panics    *int32
+}
+
+func (s *panicStore) Write(filename string, data []byte) error {
+	if 0 != atomic.LoadInt32(s.panicking) {
+		atomic.AddInt32(s.panics, 1)
+		var closed *Buffer
+		return closed.store.Write(filename, data)
+	}
+	return s.ChunkStore.Write(filename, data)
+}
+
+func TestPanickingPreloadIsRecovered(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	panicking, panics := int32(1), int32(0)
+	chunkStores["panicking"] = func(dir string) ChunkStore {
+		return &panicStore{ChunkStore: newFileStore(dir), panicking: &panicking, panics: &panics}
+	}
+	defer delete(chunkStores, "panicking")
+	name := chunkStoreName
+	if err := SetChunkStore("panicking"); nil != err {
+		t.Fatal(err)
+	}
+	defer SetChunkStore(name)
+	server := newTestServer(2*testChunkSize, nil)
+	defer server.Close()
+	buffer := openTestBuffer(t, server.object("panicking"))
+	defer buffer.Close()
+
+	active := atomic.LoadInt64(&activePreloads)
+	buffer.Prefetch(testChunkSize, testChunkSize)
+	if !eventually(func() bool { return 1 == atomic.LoadInt32(&panics) && atomic.LoadInt64(&activePreloads) <= active }) {
+		t.Fatalf("preload panicked %v times, %v preloads are running", atomic.LoadInt32(&panics), atomic.LoadInt64(&activePreloads))
+	}
+
+	// the process and the buffer go on after the preload was aborted
+	atomic.StoreInt32(&panicking, 0)
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes that don't match the content after a preload panicked", len(got))
+	}
+	if !startPreload("panicking", func() {}) {
+		t.Fatalf("preloads are refused after a preload panicked")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// evictionPressureGrace is the time the pin manager has to release pins
+// before the oldest pins are released for it
+const evictionPressureGrace = 30 * time.Second
+
+// evictionPressureInterval is the minimum time between two notifications
+// of the pin manager
+const evictionPressureInterval = 5 * time.Second
+
+// EvictionPressureFunc is notified with the missing bytes when the chunk
+// directory is full and only pinned chunks are left to evict, e.g. to
+// release cold pins with UnpinTail
+type EvictionPressureFunc func(shortfall int64)
+
+// SetEvictionPressureCommand runs a command with the missing bytes as its
+// argument when only pinned chunks are left to evict ("" = the oldest pins
+// are released right away). The command can release the pins of cold files
+// with the unpin attribute, e.g. setfattr -n user.plexdrive.unpin.
+func SetEvictionPressureCommand(command string) {
+	if "" == command {
+		SetEvictionPressureFunc(nil)
+		return
+	}
+	SetEvictionPressureFunc(func(shortfall int64) {
+		output, err := exec.Command(command, strconv.FormatInt(shortfall, 10)).CombinedOutput()
+		if nil != err {
+			Log.Debugf("%s", output)
+			Log.Warningf("Eviction pressure command %v failed: %v", command, err)
+		}
+	})
+}
+
+var pressure = struct {
+	lock     sync.Mutex
+	fn       EvictionPressureFunc
+	since    time.Time
+	notified time.Time
+}{}
+
+// SetEvictionPressureFunc sets the function notified when the eviction
+// can't free enough space, because all chunks left are pinned (nil = the
+// oldest pins are released right away). The function runs in its own
+// goroutine. If the pins are not released within 30 seconds, the oldest
+// pins are released anyway, so that a fully pinned cache can't block the
+// eviction.
+func SetEvictionPressureFunc(fn EvictionPressureFunc) {
+	pressure.lock.Lock()
+	defer pressure.lock.Unlock()
+
+	pressure.fn = fn
+}
+
+// notifyEvictionPressure notifies the pin manager about the missing bytes
+// and reports if the eviction should wait for it to release pins
+func notifyEvictionPressure(shortfall int64) bool {
+	pressure.lock.Lock()
+	defer pressure.lock.Unlock()
+
+	now := time.Now()
+	if pressure.since.IsZero() {
+		pressure.since = now
+	}
+	if nil == pressure.fn || now.Sub(pressure.since) >= evictionPressureGrace {
+		Log.Debugf("Only pinned chunks are left to evict %v bytes, releasing the oldest pins", shortfall)
+		pressure.since = time.Time{}
+		return false
+	}
+
+	if now.Sub(pressure.notified) >= evictionPressureInterval {
+		pressure.notified = now
+		go pressure.fn(shortfall)
+	}
+	return true
+}
+
+// endEvictionPressure restarts the grace period once an unpinned chunk
+// could be evicted again
+func endEvictionPressure() {
+	pressure.lock.Lock()
+	defer pressure.lock.Unlock()
+
+	pressure.since = time.Time{}
+}
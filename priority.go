@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// DefaultPriority is the eviction priority of objects without a priority
+const DefaultPriority = 0
+
+var priorities = struct {
+	lock    sync.Mutex
+	objects map[string]int
+}{
+	objects: make(map[string]int),
+}
+
+// SetObjectPriority sets the eviction priority of an object. Chunks of
+// objects with a lower priority are evicted first, the oldest chunks of
+// objects with the same priority are evicted first.
+func SetObjectPriority(objectID string, priority int) {
+	priorities.lock.Lock()
+	defer priorities.lock.Unlock()
+
+	if DefaultPriority == priority {
+		delete(priorities.objects, objectID)
+		return
+	}
+	priorities.objects[objectID] = priority
+}
+
+// prioritiesSet checks if any object has an eviction priority
+func prioritiesSet() bool {
+	priorities.lock.Lock()
+	defer priorities.lock.Unlock()
+
+	return len(priorities.objects) > 0
+}
+
+// objectPriority returns the eviction priority of an object
+func objectPriority(objectID string) int {
+	priorities.lock.Lock()
+	defer priorities.lock.Unlock()
+
+	if priority, exists := priorities.objects[objectID]; exists {
+		return priority
+	}
+	return DefaultPriority
+}
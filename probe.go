@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// probeSize is the number of bytes the chunk size probe downloads
+const probeSize = 256 * 1024
+
+// probeTarget is the time the download of a chunk of the probed chunk size
+// takes at the measured throughput
+const probeTarget = 1 * time.Second
+
+// probeTimeout is the maximum time of the probe
+const probeTimeout = 30 * time.Second
+
+var chunkProbe = struct {
+	lock    sync.Mutex
+	enabled bool
+	min     int64
+	max     int64
+	sizes   map[string]int64
+}{
+	sizes: make(map[string]int64),
+}
+
+// SetChunkProbe enables the chunk size probe. The first open of an object
+// downloads its first 256 KB and chooses the chunk size within the bounds
+// that downloads in about a second at the measured throughput. Objects that
+// get their chunk size from a chunk size function are not probed.
+func SetChunkProbe(enabled bool, min, max int64) error {
+	if enabled && (min <= 0 || max < min) {
+		return fmt.Errorf("Invalid chunk size bounds %v - %v", min, max)
+	}
+
+	chunkProbe.lock.Lock()
+	defer chunkProbe.lock.Unlock()
+
+	chunkProbe.enabled = enabled
+	chunkProbe.min = min
+	chunkProbe.max = max
+	return nil
+}
+
+// probedChunkSize returns the chunk size of an object, probing it on the
+// first open if the probe is enabled. The chunk size chosen once is kept,
+// also across restarts through the chunk index.
+func probedChunkSize(client *http.Client, object *APIObject) int64 {
+	chunkSizes.lock.Lock()
+	fn := chunkSizes.fn
+	chunkSizes.lock.Unlock()
+
+	chunkProbe.lock.Lock()
+	enabled := chunkProbe.enabled
+	min, max := chunkProbe.min, chunkProbe.max
+	_, probed := chunkProbe.sizes[object.ObjectID]
+	chunkProbe.lock.Unlock()
+
+	if probed || !enabled || uint64(probeSize) >= object.Size || (nil != fn && fn(object) > 0) {
+		return objectChunkSize(object)
+	}
+
+	size, indexed := chunks.indexedChunkSize(object.ObjectID)
+	if !indexed || size < min || size > max {
+		size = objectChunkSize(object)
+		throughput, err := probeThroughput(client, object)
+		if nil != err {
+			Log.Debugf("%v", err)
+			Log.Debugf("Could not probe object %v, using chunk size %v", object.ObjectID, size)
+		} else {
+			// chunk sizes are multiples of one MB, so that the sizes of
+			// the objects don't scatter
+			size = int64(throughput*probeTarget.Seconds()) / (1024 * 1024) * (1024 * 1024)
+			if size < min {
+				size = min
+			}
+			if size > max {
+				size = max
+			}
+			Log.Debugf("Probed %.0f bytes/s for object %v, using chunk size %v", throughput, object.ObjectID, size)
+		}
+	}
+
+	chunkProbe.lock.Lock()
+	chunkProbe.sizes[object.ObjectID] = size
+	chunkProbe.lock.Unlock()
+	return size
+}
+
+// probeThroughput downloads the first bytes of an object and returns the
+// measured throughput in bytes per second
+func probeThroughput(client *http.Client, object *APIObject) (float64, error) {
+	url := object.DownloadURL
+	if nil != urlRewriter {
+		url = urlRewriter(object, url)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		return 0, err
+	}
+	req.Header.Add("Range", fmt.Sprintf("bytes=0-%v", probeSize-1))
+	addScanConfirmation(object.ObjectID, req)
+	addDownloadHeaders(req)
+
+	probeClient := *client
+	probeClient.Timeout = probeTimeout
+	started := time.Now()
+	res, err := probeClient.Do(req)
+	if nil != err {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if http.StatusPartialContent != res.StatusCode || isInterstitial(res) {
+		return 0, fmt.Errorf("Probe of object %v answered with status %v", object.ObjectID, res.StatusCode)
+	}
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(res.Body, probeSize))
+	accountDownload(n)
+	if nil != err {
+		return 0, err
+	}
+	elapsed := time.Since(started)
+	if n < probeSize || elapsed <= 0 {
+		return 0, fmt.Errorf("Probe of object %v got %v bytes", object.ObjectID, n)
+	}
+	return float64(n) / elapsed.Seconds(), nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// quotaSaveInterval is the time between two writes of the download quota
+const quotaSaveInterval = 1 * time.Minute
+
+// quotaLocation is the time zone the daily quotas of Google reset in
+var quotaLocation = loadQuotaLocation()
+
+var quota = struct {
+	lock       sync.Mutex
+	path       string
+	day        string
+	downloaded int64
+	cap        int64
+	changed    bool
+}{}
+
+// QuotaStats holds the bytes downloaded on the current quota day
+type QuotaStats struct {
+	Day        string `json:"day"`
+	Downloaded int64  `json:"downloaded"`
+	Cap        int64  `json:"cap"`
+}
+
+// QuotaExceededError is returned for chunks that are not cached once the
+// daily download cap is reached
+type QuotaExceededError struct {
+	ObjectID string
+	Offset   int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("Reached the daily download cap, object %v offset %v is not cached", e.ObjectID, e.Offset)
+}
+
+// loadQuotaLocation returns the pacific time zone, or its standard offset
+// if the time zone database is not available
+func loadQuotaLocation() *time.Location {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if nil != err {
+		return time.FixedZone("PST", -8*60*60)
+	}
+	return location
+}
+
+// quotaDay returns the quota day of the given time
+func quotaDay(now time.Time) string {
+	return now.In(quotaLocation).Format("2006-01-02")
+}
+
+// SetDailyDownloadCap sets the maximum number of bytes downloaded per day
+// (0 = unlimited). Once it is reached only cached chunks are served till
+// the quota resets at midnight pacific time.
+func SetDailyDownloadCap(cap int64) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	quota.cap = cap
+}
+
+// LoadDownloadQuota restores the bytes downloaded today from the quota file
+// and keeps the file up to date
+func LoadDownloadQuota(path string) error {
+	quota.lock.Lock()
+	quota.path = path
+	quota.day = quotaDay(time.Now())
+	quota.lock.Unlock()
+	go saveQuotaLoop()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read download quota %v", path)
+	}
+
+	var stats QuotaStats
+	if err := json.Unmarshal(data, &stats); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not decode download quota %v", path)
+	}
+
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	if stats.Day == quota.day {
+		quota.downloaded = stats.Downloaded
+	}
+	return nil
+}
+
+// SaveDownloadQuota writes the bytes downloaded today to the quota file
+func SaveDownloadQuota() error {
+	quota.lock.Lock()
+	stats := quotaStats()
+	path := quota.path
+	quota.changed = false
+	quota.lock.Unlock()
+
+	if "" == path {
+		return nil
+	}
+
+	data, err := json.Marshal(stats)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not encode download quota")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write download quota %v", path)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), path)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write download quota %v", path)
+	}
+	return nil
+}
+
+// GetQuotaStats returns the bytes downloaded on the current quota day
+func GetQuotaStats() QuotaStats {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	return quotaStats()
+}
+
+// quotaStats returns the current quota, the lock must be held
+func quotaStats() QuotaStats {
+	if day := quotaDay(time.Now()); day != quota.day {
+		quota.day = day
+		quota.downloaded = 0
+		quota.changed = true
+	}
+	return QuotaStats{
+		Day:        quota.day,
+		Downloaded: quota.downloaded,
+		Cap:        quota.cap,
+	}
+}
+
+// accountDownload adds downloaded bytes to the quota of the current day
+func accountDownload(size int64) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	countDownload(size)
+	stats := quotaStats()
+	quota.downloaded += size
+	quota.changed = true
+	if stats.Cap > 0 && stats.Downloaded < stats.Cap && quota.downloaded >= stats.Cap {
+		Log.Warningf("Reached the daily download cap of %v bytes, serving cached chunks only", stats.Cap)
+	}
+}
+
+// quotaExceeded checks if the daily download cap is reached
+func quotaExceeded() bool {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	stats := quotaStats()
+	return stats.Cap > 0 && stats.Downloaded >= stats.Cap
+}
+
+// saveQuotaLoop writes the quota file whenever the quota changed
+func saveQuotaLoop() {
+	for range time.Tick(quotaSaveInterval) {
+		quota.lock.Lock()
+		quotaStats()
+		changed := quota.changed
+		quota.lock.Unlock()
+
+		if changed {
+			if err := SaveDownloadQuota(); nil != err {
+				Log.Warningf("%v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// rangeCapWindow is the time rate limit responses are counted in, and the
+// minimum time between two changes of the range cap
+const rangeCapWindow = 1 * time.Minute
+
+// rangeCapShrinkAfter is the number of rate limit responses within the
+// window that halve the range cap
+const rangeCapShrinkAfter = 3
+
+// rangeCap halves the size of the ranges requested from the API under
+// sustained rate limiting and doubles it again once the rate limiting
+// stopped. The chunks are still cached in their full size.
+var rangeCap = struct {
+	lock        sync.Mutex
+	min         int64
+	current     int64
+	limited     int
+	windowStart time.Time
+	lastLimited time.Time
+	lastChange  time.Time
+}{}
+
+// SetRateLimitMinRange sets the size the requested ranges shrink to at
+// most under sustained rate limiting (in byte, 0 = disabled)
+func SetRateLimitMinRange(size int64) {
+	rangeCap.lock.Lock()
+	defer rangeCap.lock.Unlock()
+
+	rangeCap.min = size
+	rangeCap.current = 0
+}
+
+// currentRangeCap returns the maximum size of a requested range (0 = the
+// whole range)
+func currentRangeCap() int64 {
+	rangeCap.lock.Lock()
+	defer rangeCap.lock.Unlock()
+
+	return rangeCap.current
+}
+
+// rangeRateLimited counts a rate limit response of a request of a chunk of
+// the given size and halves the range cap if the API keeps rate limiting
+func rangeRateLimited(chunkSize int64) {
+	rangeCap.lock.Lock()
+	defer rangeCap.lock.Unlock()
+
+	if rangeCap.min <= 0 {
+		return
+	}
+	now := time.Now()
+	rangeCap.lastLimited = now
+	if now.Sub(rangeCap.windowStart) > rangeCapWindow {
+		rangeCap.windowStart = now
+		rangeCap.limited = 0
+	}
+	rangeCap.limited++
+	if rangeCap.limited < rangeCapShrinkAfter || now.Sub(rangeCap.lastChange) < rangeCapWindow {
+		return
+	}
+
+	current := rangeCap.current
+	if 0 == current {
+		current = chunkSize
+	}
+	next := int64(math.Max(float64(current/2), float64(rangeCap.min)))
+	if next >= current {
+		return
+	}
+	rangeCap.current = next
+	rangeCap.limited = 0
+	rangeCap.lastChange = now
+	Log.Infof("Rate limited, requesting ranges of at most %v bytes", next)
+}
+
+// rangeSucceeded doubles the range cap after a successful response of a
+// request of a chunk of the given size, once there was no rate limit
+// response for a while
+func rangeSucceeded(chunkSize int64) {
+	rangeCap.lock.Lock()
+	defer rangeCap.lock.Unlock()
+
+	now := time.Now()
+	if 0 == rangeCap.current || now.Sub(rangeCap.lastLimited) < rangeCapWindow || now.Sub(rangeCap.lastChange) < rangeCapWindow {
+		return
+	}
+
+	rangeCap.lastChange = now
+	if rangeCap.current *= 2; rangeCap.current >= chunkSize {
+		rangeCap.current = 0
+		Log.Infof("No longer rate limited, requesting whole chunks again")
+		return
+	}
+	Log.Infof("Less rate limited, requesting ranges of at most %v bytes", rangeCap.current)
+}
+
+// downloadCapped downloads a range in consecutive parts of at most the
+// range cap. Parts that succeeded are kept till the whole range is
+// downloaded, so that a retried read only requests the missing parts.
+func (b *Buffer) downloadCapped(generation, offset, offsetEnd int64) ([]byte, error) {
+	limit := currentRangeCap()
+	if limit <= 0 || offsetEnd-offset <= limit {
+		return b.downloadSplit(generation, offset, offsetEnd)
+	}
+
+	Log.Debugf("Downloading object %v bytes %v - %v in parts of %v bytes", b.object.ObjectID, offset, offsetEnd, limit)
+	result := make([]byte, 0, offsetEnd-offset)
+	for start := offset; start < offsetEnd; start += limit {
+		end := int64(math.Min(float64(start+limit), float64(offsetEnd)))
+		bytes, err := b.downloadSplit(generation, start, end)
+		if nil == err && int64(len(bytes)) != end-start {
+			err = &ShortBodyError{
+				ObjectID: b.object.ObjectID,
+				Offset:   start,
+				Received: int64(len(bytes)),
+				Expected: end - start,
+			}
+		}
+		if nil != err {
+			return nil, err
+		}
+		b.keepSubRange(generation, start, end, bytes)
+		result = append(result, bytes...)
+	}
+	for start := offset; start < offsetEnd; start += limit {
+		b.dropSubRange(start)
+	}
+	return result, nil
+}
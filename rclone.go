@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// rcloneItem is the metadata rclone keeps in vfsMeta for every file of its
+// VFS cache
+type rcloneItem struct {
+	Size  int64
+	Rs    []rcloneRange
+	Dirty bool
+}
+
+// rcloneRange is a cached range of a file in the VFS cache of rclone
+type rcloneRange struct {
+	Pos  int64
+	Size int64
+}
+
+// covers checks if the cached ranges hold the whole given range
+func (item *rcloneItem) covers(offset, offsetEnd int64) bool {
+	for position := offset; position < offsetEnd; {
+		next := position
+		for _, r := range item.Rs {
+			if r.Pos <= position && r.Pos+r.Size > next {
+				next = r.Pos + r.Size
+			}
+		}
+		if next == position {
+			return false
+		}
+		position = next
+	}
+	return true
+}
+
+// ImportRcloneCache copies the chunks cached by the VFS cache of rclone
+// mount into the chunk cache, e.g. after switching from rclone to
+// plexdrive. vfsDir is the cache directory of the remote, e.g.
+// ~/.cache/rclone/vfs/gdrive, its metadata is read from the matching
+// vfsMeta directory. Files are matched by their path, only chunks that
+// rclone cached completely are copied. Files that don't exist in the drive,
+// have another size or local changes are skipped, and the import stops
+// before the chunk directory exceeds its maximum size.
+func ImportRcloneCache(drive *Drive, vfsDir string) error {
+	vfsDir = filepath.Clean(vfsDir)
+	metaDir := filepath.Join(filepath.Dir(filepath.Dir(vfsDir)), "vfsMeta", filepath.Base(vfsDir))
+	if _, err := os.Stat(metaDir); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not find the rclone cache metadata %v", metaDir)
+	}
+	used, err := dirSize(chunkPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not measure chunk directory %v", chunkPath)
+	}
+
+	Log.Infof("Importing the rclone cache %v", vfsDir)
+	// the WebDAV file system resolves paths the same way
+	resolver := &davFS{drive: drive}
+	var files, imported int
+	full := false
+	err = filepath.Walk(vfsDir, func(path string, info os.FileInfo, err error) error {
+		if vanished(info, err) || full {
+			return nil
+		}
+		if nil != err || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(vfsDir, path)
+		if nil != err {
+			return nil
+		}
+		object, err := resolver.resolve(filepath.ToSlash(rel))
+		if nil != err || object.IsDir {
+			Log.Debugf("Skipping %v of the rclone cache, it is not in the drive", safeName(rel))
+			return nil
+		}
+		item, err := readRcloneItem(filepath.Join(metaDir, rel))
+		if nil != err || item.Dirty || uint64(item.Size) != object.Size {
+			Log.Debugf("Skipping %v of the rclone cache, it does not match the drive", safeName(rel))
+			return nil
+		}
+
+		var count int
+		count, full = importRcloneFile(path, object, item, &used)
+		if count > 0 {
+			files++
+			imported += count
+		}
+		return nil
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read the rclone cache %v", vfsDir)
+	}
+	if full {
+		Log.Infof("Stopped the import of the rclone cache, the chunk directory is full")
+	}
+	Log.Infof("Imported %v chunks of %v files from the rclone cache", imported, files)
+	return nil
+}
+
+// readRcloneItem reads the metadata of a file in the rclone cache
+func readRcloneItem(path string) (*rcloneItem, error) {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+	var item rcloneItem
+	if err := json.Unmarshal(data, &item); nil != err {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// importRcloneFile copies the completely cached chunks of a file that are
+// not cached yet and returns their number and if the chunk directory is
+// full
+func importRcloneFile(path string, object *APIObject, item *rcloneItem, used *int64) (int, bool) {
+	f, err := os.Open(path)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return 0, false
+	}
+	defer f.Close()
+
+	objectID := object.ObjectID
+	size := objectChunkSize(object)
+	if indexed, exists := chunks.indexedChunkSize(objectID); exists {
+		size = indexed
+	}
+	chunks.load(objectID)
+	generation := chunks.generation(objectID)
+	dir := filepath.Join(chunkPath, objectID)
+	store := newChunkStore(dir)
+	defer store.Close()
+
+	count := 0
+	for offset := int64(0); uint64(offset) < object.Size; offset += size {
+		length := int64(math.Min(float64(size), float64(int64(object.Size)-offset)))
+		if chunks.has(objectID, generation, offset) || !item.covers(offset, offset+length) {
+			continue
+		}
+		if currentChunkDirMaxSize() > 0 && *used+length > currentChunkDirMaxSize() {
+			return count, true
+		}
+
+		data := make([]byte, length)
+		if n, err := f.ReadAt(data, offset); int64(n) != length {
+			Log.Debugf("%v", err)
+			return count, false
+		}
+		filename := filepath.Join(dir, chunkName(generation, size, offset))
+		if err := store.Write(filename, data); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not write chunk %v", filename)
+			return count, false
+		}
+		chunkWritten(length)
+		chunks.add(objectID, generation, offset, length)
+		*used += length
+		count++
+	}
+	if count > 0 {
+		Log.Debugf("Imported %v chunks of %v from the rclone cache", count, safeName(object.Name))
+	}
+	return count, false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+const (
+	// ReadModeCache keeps all chunks of an object cached, e.g. for direct play
+	ReadModeCache = "cache"
+	// ReadModeSequential only keeps the chunks around the read position of
+	// an object that is read once from start to end, e.g. for transcoding
+	ReadModeSequential = "sequential"
+)
+
+// sequentialKeepBehind is the number of chunks behind the read position
+// that stay cached in the sequential read mode, so that short seeks back
+// don't download again
+const sequentialKeepBehind = 1
+
+var readModes = struct {
+	lock    sync.Mutex
+	objects map[string]string
+}{
+	objects: make(map[string]string),
+}
+
+// SetObjectReadMode sets the read mode of an object (cache or sequential)
+func SetObjectReadMode(objectID, mode string) error {
+	if ReadModeCache != mode && ReadModeSequential != mode {
+		return fmt.Errorf("Invalid read mode %v (expected cache or sequential)", mode)
+	}
+
+	readModes.lock.Lock()
+	defer readModes.lock.Unlock()
+
+	if ReadModeCache == mode {
+		delete(readModes.objects, objectID)
+		return nil
+	}
+	readModes.objects[objectID] = mode
+	return nil
+}
+
+// objectReadMode returns the read mode of an object
+func objectReadMode(objectID string) string {
+	readModes.lock.Lock()
+	defer readModes.lock.Unlock()
+
+	if mode, exists := readModes.objects[objectID]; exists {
+		return mode
+	}
+	return ReadModeCache
+}
+
+// dropBehind deletes the cached chunks behind the read position of an
+// object in the sequential read mode. Sparse files hold all chunks of an
+// object and are kept.
+func (b *Buffer) dropBehind(start int64) {
+	if ReadModeSequential != objectReadMode(b.object.ObjectID) || chunkReadOnly || "sparse" == chunkStoreName {
+		return
+	}
+	keep := start - start%b.chunkSize - sequentialKeepBehind*b.chunkSize
+	if keep <= 0 {
+		return
+	}
+
+	generation := b.cacheGeneration()
+	for _, offset := range chunks.offsetsBefore(b.object.ObjectID, generation, keep) {
+		path := filepath.Join(b.tempDir, chunkName(generation, b.chunkSize, offset))
+		if isPinnedChunk(path) {
+			continue
+		}
+		Log.Debugf("Dropping chunk %v behind the read position of object %v", offset, b.object.ObjectID)
+		if err := removeChunk(path); nil != err {
+			Log.Debugf("%v", err)
+		}
+	}
+}
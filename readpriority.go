@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReadPriority orders the reads waiting for a download slot
+type ReadPriority int
+
+const (
+	// ReadBackground is the priority of reads that have to complete but
+	// nobody waits for, e.g. exports and warming the cache
+	ReadBackground ReadPriority = iota
+	// ReadPrefetch is the priority of preloads, they are dropped instead of
+	// waiting if configured
+	ReadPrefetch
+	// ReadForeground is the priority of reads of a player
+	ReadForeground
+)
+
+// slotYieldInterval is the time a read outranked by queued reads of a higher
+// priority waits before it checks for a free download slot again
+const slotYieldInterval = 50 * time.Millisecond
+
+func (p ReadPriority) String() string {
+	switch p {
+	case ReadBackground:
+		return "background"
+	case ReadPrefetch:
+		return "prefetch"
+	case ReadForeground:
+		return "foreground"
+	}
+	return fmt.Sprintf("%d", int(p))
+}
+
+// ParseReadPriority parses the name of a read priority
+func ParseReadPriority(name string) (ReadPriority, error) {
+	for _, priority := range []ReadPriority{ReadBackground, ReadPrefetch, ReadForeground} {
+		if priority.String() == name {
+			return priority, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid read priority %v", name)
+}
+
+// slotQueueKey identifies the reads of a priority waiting for a slot of a
+// download limit
+type slotQueueKey struct {
+	slots    chan struct{}
+	priority ReadPriority
+}
+
+var slotQueue = struct {
+	lock   sync.Mutex
+	queued map[slotQueueKey]int
+}{
+	queued: make(map[slotQueueKey]int),
+}
+
+// queueRead registers a read waiting for a slot of a download limit. The
+// returned function unregisters it.
+func queueRead(slots chan struct{}, priority ReadPriority) func() {
+	key := slotQueueKey{slots: slots, priority: priority}
+
+	slotQueue.lock.Lock()
+	defer slotQueue.lock.Unlock()
+	slotQueue.queued[key]++
+
+	return func() {
+		slotQueue.lock.Lock()
+		defer slotQueue.lock.Unlock()
+
+		if slotQueue.queued[key]--; 0 == slotQueue.queued[key] {
+			delete(slotQueue.queued, key)
+		}
+	}
+}
+
+// outranked checks if reads of a higher priority wait for a slot of the
+// download limit, they get the next free slot
+func outranked(slots chan struct{}, priority ReadPriority) bool {
+	slotQueue.lock.Lock()
+	defer slotQueue.lock.Unlock()
+
+	for higher := priority + 1; higher <= ReadForeground; higher++ {
+		if slotQueue.queued[slotQueueKey{slots: slots, priority: higher}] > 0 {
+			return true
+		}
+	}
+	return false
+}
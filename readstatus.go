@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// ReadStatus tells how a read was served
+type ReadStatus struct {
+	// Hit is set if the chunk holding the first byte was cached
+	Hit bool
+	// Chunk is the offset of the chunk holding the first byte
+	Chunk int64
+	// Latency is the time the read took
+	Latency time.Duration
+}
+
+// ReadIntoStatus reads into p like ReadInto and reports if the read was
+// served from the cache, e.g. for the response headers of a HTTP server
+func (b *Buffer) ReadIntoStatus(p []byte, start int64) (int, ReadStatus, error) {
+	status := ReadStatus{
+		Hit:   b.chunkCached(start),
+		Chunk: start - start%b.chunkSize,
+	}
+	started := time.Now()
+	n, err := b.ReadInto(p, start)
+	status.Latency = time.Since(started)
+	return n, status, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var maxBufferAge time.Duration
+var objectRefresher ObjectRefresher
+
+// ObjectRefresher returns the current metadata of an object
+type ObjectRefresher func(objectID string) (*APIObject, error)
+
+// SetMaxBufferAge sets the time after which the next read of a buffer
+// refreshes the metadata and the download urls of its object, even while
+// the buffer is open (0 = never)
+func SetMaxBufferAge(age time.Duration, refresher ObjectRefresher) {
+	maxBufferAge = age
+	objectRefresher = refresher
+}
+
+// refreshIfOld refreshes the object of a buffer that reached the maximum
+// buffer age. If the object changed, its cache is invalidated, the buffer
+// keeps serving the cached chunks of the old version to its readers.
+func (b *Buffer) refreshIfOld() {
+	if maxBufferAge <= 0 || nil == objectRefresher {
+		return
+	}
+
+	b.lock.Lock()
+	due := time.Since(b.refreshed) >= maxBufferAge
+	if due {
+		b.refreshed = time.Now()
+	}
+	b.lock.Unlock()
+	if !due {
+		return
+	}
+	old := b.object
+
+	object, err := objectRefresher(old.ObjectID)
+	if nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not refresh object %v", old.ObjectID)
+		return
+	}
+	if objectChanged(old, object) {
+		Log.Infof("%v changed while it was open, invalidating cache", safeName(old.Name))
+		if generation := b.cacheGeneration(); generation == chunks.generation(old.ObjectID) {
+			InvalidateObject(old.ObjectID)
+		}
+		return
+	}
+
+	b.setDownloadURLs(object)
+}
+
+// refreshExpiredURLs refreshes the download urls of the object of a buffer
+// once a download was refused with a 403 or 410, an expired url may resolve
+// to another host afterwards. It returns true if the download should be
+// retried with the refreshed urls.
+func (b *Buffer) refreshExpiredURLs(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	if !ok || nil == objectRefresher || isAccountLimited(statusErr) ||
+		(http.StatusForbidden != statusErr.StatusCode && http.StatusGone != statusErr.StatusCode) {
+		return false
+	}
+
+	b.lock.Lock()
+	mirrored := nil != b.mirror
+	b.lock.Unlock()
+	if mirrored {
+		return false
+	}
+	old := b.source()
+
+	object, refreshErr := objectRefresher(old.ObjectID)
+	if nil != refreshErr {
+		Log.Debugf("%v", refreshErr)
+		Log.Warningf("Could not refresh the download urls of object %v", old.ObjectID)
+		return false
+	}
+	if objectChanged(old, object) ||
+		(object.DownloadURL == old.DownloadURL && object.ContentLink == old.ContentLink) {
+		return false
+	}
+	Log.Debugf("%v", err)
+	b.setDownloadURLs(object)
+	return true
+}
+
+// setDownloadURLs keeps the download urls of the refreshed object for the
+// downloads of the buffer. The object of the buffer itself is never
+// replaced, so that it can be read without the lock.
+func (b *Buffer) setDownloadURLs(object *APIObject) {
+	Log.Debugf("Refreshed download urls of object %v", b.object.ObjectID)
+	refreshed := *b.object
+	refreshed.DownloadURL = object.DownloadURL
+	refreshed.ContentLink = object.ContentLink
+	b.lock.Lock()
+	b.urlObject = &refreshed
+	b.refreshed = time.Now()
+	b.lock.Unlock()
+}
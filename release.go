@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"sync/atomic"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var evictOnReleasePercent int
+
+// SetEvictOnRelease deletes the cached chunks of an object once its last
+// reader closed it while the chunk directory is filled above the given
+// percentage of --clear-chunk-max-size (0 = keep the chunks), so that active
+// playback gets the space sooner. The cached head, the pinned tail and the
+// chunks around the resume position of the object are kept.
+func SetEvictOnRelease(percent int) {
+	evictOnReleasePercent = percent
+}
+
+// evictOnRelease deletes the cached chunks of a buffer that was shut down
+// if the chunk directory is under pressure
+func (b *Buffer) evictOnRelease() {
+	if evictOnReleasePercent <= 0 || currentChunkDirMaxSize() <= 0 || chunkReadOnly {
+		return
+	}
+	size := atomic.LoadInt64(&evictor.size)
+	if size*100 <= currentChunkDirMaxSize()*int64(evictOnReleasePercent) {
+		return
+	}
+	// the object was opened again in the meantime
+	if _, exists := instances.Get(b.object.ObjectID); exists {
+		return
+	}
+
+	// chunks are evicted one by one from the chunk index, so that the
+	// chunk map of a sparse file drops them like the evictor does
+	store := newChunkStore(b.tempDir)
+	defer store.Close()
+	generation, size, infos := chunks.cachedChunks(b.object.ObjectID)
+	var evicted int64
+	for offset, info := range infos {
+		path := filepath.Join(b.tempDir, chunkName(generation, size, offset))
+		if info.Compressed {
+			path += compressedSuffix
+		}
+		if isPinnedChunk(path) {
+			continue
+		}
+		store.Release(path)
+		if err := removeChunk(path); nil != err {
+			Log.Debugf("%v", err)
+			continue
+		}
+		partitionEvicted(b.object.ObjectID, info.Size)
+		evicted += info.Size
+	}
+	atomic.AddInt64(&evictor.size, -evicted)
+	Log.Debugf("Evicted %v bytes of object %v after it was closed", evicted, b.object.ObjectID)
+}
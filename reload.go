@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// ChunkConfig holds the chunk settings that can be changed without a
+// restart. Zero values keep the current setting.
+type ChunkConfig struct {
+	ChunkSize       int64  `json:"chunkSize"`
+	ChunkDirMaxSize int64  `json:"chunkDirMaxSize"`
+	ChunkPath       string `json:"chunkPath"`
+}
+
+var reload = struct {
+	lock sync.Mutex
+	path string
+}{}
+
+// SetChunkConfigFile sets the JSON file the chunk configuration is reloaded
+// from on SIGHUP ("" = disabled)
+func SetChunkConfigFile(path string) {
+	reload.lock.Lock()
+	defer reload.lock.Unlock()
+
+	reload.path = path
+}
+
+// ReloadChunkConfigFile reloads the chunk configuration from the file set
+// with SetChunkConfigFile
+func ReloadChunkConfigFile() error {
+	reload.lock.Lock()
+	path := reload.path
+	reload.lock.Unlock()
+	if "" == path {
+		return fmt.Errorf("No chunk configuration file to reload")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read chunk configuration %v", path)
+	}
+	var config ChunkConfig
+	if err := json.Unmarshal(data, &config); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not decode chunk configuration %v", path)
+	}
+	return ReloadChunkConfig(config)
+}
+
+// ReloadChunkConfig changes the chunk configuration at runtime. Open
+// buffers keep the chunk size they were created with till they are closed,
+// so that in-flight reads never mix chunks of two sizes.
+//
+// A new maximum size of the chunk directory is enforced right away. A new
+// chunk size applies to files opened afterwards, the chunks of the old size
+// become stale and only serve reads of ranges they cover till the cleaner
+// deletes them. The chunk directory can't be changed at runtime, open
+// buffers, the chunk index and the evictor all work on it.
+func ReloadChunkConfig(config ChunkConfig) error {
+	reload.lock.Lock()
+	defer reload.lock.Unlock()
+
+	if config.ChunkSize < 0 || config.ChunkDirMaxSize < 0 {
+		return fmt.Errorf("Invalid chunk configuration")
+	}
+	if "" != config.ChunkPath && filepath.Clean(config.ChunkPath) != filepath.Clean(chunkPath) {
+		return fmt.Errorf("Can not change the chunk directory to %v without a restart", config.ChunkPath)
+	}
+
+	if config.ChunkSize > 0 && config.ChunkSize != currentChunkSize() {
+		chunks.lock.Lock()
+		chunks.resize(currentChunkSize())
+		SetChunkSize(config.ChunkSize)
+		chunks.lock.Unlock()
+		Log.Infof("Using chunk size %v for files opened from now on", config.ChunkSize)
+	}
+
+	if config.ChunkDirMaxSize > 0 {
+		SetChunkDirMaxSize(config.ChunkDirMaxSize)
+		Log.Infof("Limiting the chunk directory to %v bytes", currentChunkDirMaxSize())
+	}
+	if currentChunkDirMaxSize() > 0 && !chunkReadOnly {
+		// measures the chunk directory again and evicts down to the limit
+		return evictChunks(0)
+	}
+	return nil
+}
+
+// resize keeps the old chunk size for the objects of open buffers created
+// with it and indexes all other objects of the old size again, so that
+// their chunks of the old size are stale. The lock must be held.
+func (i *chunkIndex) resize(old int64) {
+	for objectID := range i.objects {
+		if _, sized := i.sizes[objectID]; sized {
+			continue
+		}
+		if instance, open := instances.Get(objectID); open && old == instance.(*Buffer).chunkSize {
+			i.sizes[objectID] = old
+			i.resized[objectID] = true
+			continue
+		}
+		delete(i.objects, objectID)
+	}
+	// the chunks of the old size are of another size now
+	for objectID := range i.otherSizes {
+		if _, sized := i.sizes[objectID]; !sized {
+			delete(i.otherSizes, objectID)
+		}
+	}
+}
+
+// closed drops the old chunk size resize kept for an object once its
+// buffer is closed, the object is indexed again with the current size
+func (i *chunkIndex) closed(objectID string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if !i.resized[objectID] {
+		return
+	}
+	delete(i.resized, objectID)
+	delete(i.sizes, objectID)
+	delete(i.objects, objectID)
+	delete(i.otherSizes, objectID)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var readRepair = struct {
+	enabled  bool
+	priority ReadPriority
+}{
+	priority: ReadBackground,
+}
+
+// SetReadRepair downloads the chunks missing between the cached chunks of
+// an object in the background once its buffer is idle, e.g. the gaps left
+// by failed chunks or seeks, so that it can be replayed from the cache.
+// The downloads use the given priority (background or prefetch).
+func SetReadRepair(enabled bool, priority string) error {
+	parsed, err := ParseReadPriority(priority)
+	if nil != err || ReadForeground == parsed {
+		return fmt.Errorf("Invalid read repair priority %v", priority)
+	}
+	readRepair.enabled = enabled
+	readRepair.priority = parsed
+	return nil
+}
+
+// gaps returns the offsets of the chunks that are not cached before the
+// last cached chunk of the object
+func (b *Buffer) gaps() []int64 {
+	missing, expected := chunks.missing(b.object.ObjectID, int64(b.object.Size))
+	if len(missing) == expected {
+		return nil
+	}
+
+	// the chunks after the last cached one were never read
+	end := int64(expected-1) * b.chunkSize
+	for len(missing) > 0 && missing[len(missing)-1] == end {
+		missing = missing[:len(missing)-1]
+		end -= b.chunkSize
+	}
+	return missing
+}
+
+// startRepair starts the repair of the gaps in the cache of an idle buffer
+// and reports if it started. The buffer stays open till the repair is
+// done, it is repaired once.
+func (b *Buffer) startRepair() bool {
+	if !readRepair.enabled || chunkReadOnly || memoryOnly() {
+		return false
+	}
+
+	b.lock.Lock()
+	repaired := b.repaired
+	b.repaired = true
+	b.lock.Unlock()
+	if repaired {
+		return false
+	}
+	gaps := b.gaps()
+	if 0 == len(gaps) {
+		return false
+	}
+
+	b.attach()
+	go func() {
+		defer b.Close()
+		b.repair(gaps)
+	}()
+	return true
+}
+
+// repair downloads the missing chunks one after another. It stops at the
+// first failure, e.g. once the daily download cap is reached.
+func (b *Buffer) repair(gaps []int64) {
+	Log.Infof("Repairing %v gaps in the cache of %v", len(gaps), safeName(b.object.Name))
+	for _, offset := range gaps {
+		if _, err := b.readBytes(offset, b.chunkSize, readRepair.priority); nil != err {
+			Log.Debugf("%v", err)
+			Log.Debugf("Stopped the repair of object %v at offset %v", b.object.ObjectID, offset)
+			return
+		}
+	}
+	Log.Debugf("Repaired the cache of object %v", b.object.ObjectID)
+}
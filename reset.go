@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// ResetCache closes all active buffers and deletes all cached chunks and
+// their index. Running reads and preloads are cancelled, reads of files
+// that are still open fail until the files are opened again.
+//
+// This is a heavyweight operation: every chunk has to be downloaded again
+// afterwards. It is meant for tests and administrative resets, e.g. after
+// changing the chunk size.
+func ResetCache() error {
+	Log.Infof("Resetting chunk cache %v", chunkPath)
+
+	for item := range instances.IterBuffered() {
+		if b, ok := item.Val.(*Buffer); ok {
+			b.shutdown()
+		}
+		instances.Remove(item.Key)
+	}
+
+	chunkFiles.releaseDir(chunkPath)
+
+	chunks.lock.Lock()
+	chunks.objects = make(map[string]map[int64]*chunkInfo)
+	chunks.generations = make(map[string]int64)
+	chunks.pinned = make(map[string]map[int64]int)
+	chunks.tenants = make(map[string]string)
+	chunks.otherSizes = make(map[string][]otherSizeChunk)
+	chunks.lru.Init()
+	chunks.lock.Unlock()
+
+	goneObjects.lock.Lock()
+	goneObjects.objects = make(map[string]bool)
+	goneObjects.lock.Unlock()
+
+	files, err := ioutil.ReadDir(chunkPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read chunk directory %v", chunkPath)
+	}
+	for _, file := range files {
+		if err := os.RemoveAll(filepath.Join(chunkPath, file.Name())); nil != err {
+			Log.Debugf("%v", err)
+			return fmt.Errorf("Could not delete %v from chunk directory", file.Name())
+		}
+	}
+
+	if err := SaveChunkIndex(); nil != err {
+		Log.Warningf("%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResetCacheDeletesChunks(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	server := newTestServer(3*testChunkSize, nil)
+	defer server.Close()
+	buffer := openTestBuffer(t, server.object("reset"))
+	readAll(t, buffer, 10000)
+	if !eventually(func() bool { return 3*testChunkSize == chunks.cachedBytes("reset", 3*testChunkSize) }) {
+		t.Fatalf("object was not cached before the reset")
+	}
+
+	if err := ResetCache(); nil != err {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != len(files) {
+		t.Fatalf("kept %v files in the chunk directory", len(files))
+	}
+	if 0 != chunks.cachedBytes("reset", 3*testChunkSize) {
+		t.Fatalf("kept the index of the deleted chunks")
+	}
+	if 0 != instances.Count() {
+		t.Fatalf("kept %v buffers", instances.Count())
+	}
+
+	// reads of the closed buffer fail, a new buffer downloads again
+	if _, err := buffer.ReadInto(make([]byte, 1000), 0); nil == err {
+		t.Fatalf("read from a buffer closed by the reset")
+	}
+	buffer = openTestBuffer(t, server.object("reset"))
+	defer buffer.Close()
+	requests := server.requestCount()
+	readAll(t, buffer, 10000)
+	if server.requestCount() == requests {
+		t.Fatalf("read the reset object without downloading it")
+	}
+}
+
+func TestResetCacheCancelsRunningReads(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	release := make(chan struct{})
+	defer close(release)
+	server := newTestServer(3*testChunkSize, func(w http.ResponseWriter, r *http.Request) {
+		// the download hangs till the test ends or the request is canceled
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer server.Close()
+	buffer := openTestBuffer(t, server.object("resetread"))
+
+	done := make(chan error)
+	go func() {
+		_, err := buffer.ReadInto(make([]byte, 1000), 0)
+		done <- err
+	}()
+	eventually(func() bool { return server.requestCount() > 0 })
+
+	if err := ResetCache(); nil != err {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if nil == err {
+			t.Fatalf("running read succeeded without a response")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("running read was not canceled by the reset")
+	}
+}
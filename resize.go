@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// otherSizeChunk is a cached chunk of an object with another chunk size
+// than the current one
+type otherSizeChunk struct {
+	name       string
+	generation int64
+	size       int64
+	offset     int64
+	length     int64
+	written    time.Time
+}
+
+// otherSizeChunks returns the chunks of an object with another chunk size.
+// The chunk directory of the object is read once, till the chunk size of
+// the object changes again.
+func (i *chunkIndex) otherSizeChunks(objectID string) []otherSizeChunk {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if pieces, exists := i.otherSizes[objectID]; exists {
+		return pieces
+	}
+	files, err := ioutil.ReadDir(filepath.Join(chunkPath, objectID))
+	if nil != err && !os.IsNotExist(err) {
+		Log.Debugf("%v", err)
+	}
+	pieces := []otherSizeChunk{}
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), compressedSuffix) {
+			continue
+		}
+		generation, size, offset, ok := parseChunkName(file.Name())
+		if !ok || size == i.chunkSize(objectID) || sparseOffset == offset || size <= 0 {
+			continue
+		}
+		pieces = append(pieces, otherSizeChunk{
+			name:       file.Name(),
+			generation: generation,
+			size:       size,
+			offset:     offset,
+			length:     file.Size(),
+			written:    file.ModTime(),
+		})
+	}
+	i.otherSizes[objectID] = pieces
+	return pieces
+}
+
+// removeOtherSize drops a deleted chunk of another chunk size, the lock
+// must be held
+func (i *chunkIndex) removeOtherSize(objectID, name string) {
+	pieces := i.otherSizes[objectID]
+	for n, piece := range pieces {
+		if name == piece.name {
+			i.otherSizes[objectID] = append(pieces[:n:n], pieces[n+1:]...)
+			return
+		}
+	}
+}
+
+// readOtherSizes assembles a missing chunk from the cached chunks of the
+// same generation with another chunk size, e.g. after the chunk size of the
+// object was changed. Such chunks are stale and deleted by the cleaner, but
+// until then they spare the download of the ranges they cover.
+func (b *Buffer) readOtherSizes(generation, offset, offsetEnd int64) ([]byte, bool) {
+	if "file" != chunkStoreName {
+		return nil, false
+	}
+
+	// each position is served from the chunk reaching the furthest
+	var pieces []otherSizeChunk
+	for _, piece := range chunks.otherSizeChunks(b.object.ObjectID) {
+		if piece.generation != generation || piece.size == b.chunkSize {
+			continue
+		}
+		// only complete chunks can be used, a shorter file was cut off
+		complete := int64(math.Min(float64(piece.size), float64(int64(b.object.Size)-piece.offset)))
+		if piece.length != complete || piece.offset >= offsetEnd || piece.offset+complete <= offset || !b.freshPiece(piece.written) {
+			continue
+		}
+		pieces = append(pieces, piece)
+	}
+	if 0 == len(pieces) {
+		return nil, false
+	}
+
+	bytes := make([]byte, offsetEnd-offset)
+	for position := offset; position < offsetEnd; {
+		best := -1
+		for n, piece := range pieces {
+			if piece.offset <= position && piece.offset+piece.length > position &&
+				(-1 == best || piece.offset+piece.length > pieces[best].offset+pieces[best].length) {
+				best = n
+			}
+		}
+		if -1 == best {
+			return nil, false
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(b.tempDir, pieces[best].name))
+		if nil != err || int64(len(data)) != pieces[best].length {
+			Log.Debugf("%v", err)
+			return nil, false
+		}
+		end := int64(math.Min(float64(pieces[best].offset+int64(len(data))), float64(offsetEnd)))
+		copy(bytes[position-offset:], data[position-pieces[best].offset:end-pieces[best].offset])
+		position = end
+	}
+
+	Log.Debugf("Assembled object %v bytes %v - %v from chunks of another chunk size", b.object.ObjectID, offset, offsetEnd)
+	return bytes, true
+}
+
+// freshPiece checks if a chunk of another chunk size may be served, like
+// isFresh does for chunks of the current size
+func (b *Buffer) freshPiece(written time.Time) bool {
+	if freshWindow <= 0 {
+		return true
+	}
+	sinceModified := time.Since(b.object.LastModified)
+	return sinceModified >= freshWindow || time.Since(written) <= sinceModified
+}
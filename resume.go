@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// resumeSaveInterval is the time between two writes of the resume positions
+const resumeSaveInterval = 1 * time.Minute
+
+// resumePosition is the last read offset of a closed object and the time
+// its chunks are protected till
+type resumePosition struct {
+	Offset int64     `json:"offset"`
+	Until  time.Time `json:"until"`
+}
+
+var resume = struct {
+	lock      sync.Mutex
+	window    int64
+	retention time.Duration
+	path      string
+	objects   map[string]resumePosition
+	changed   bool
+}{
+	objects: make(map[string]resumePosition),
+}
+
+// SetResumeWindow keeps the chunks within window bytes around the last
+// read offset of a closed object for the retention time (0 = disabled), so
+// that a player resuming the playback starts right away. The chunks are
+// only evicted if no other chunk is left.
+func SetResumeWindow(window int64, retention time.Duration) {
+	resume.lock.Lock()
+	defer resume.lock.Unlock()
+
+	resume.window = window
+	resume.retention = retention
+}
+
+// LoadResumePositions restores the resume positions from the given file
+// and keeps the file up to date
+func LoadResumePositions(path string) error {
+	resume.lock.Lock()
+	resume.path = path
+	resume.lock.Unlock()
+	go saveResumeLoop()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read resume positions %v", path)
+	}
+
+	var objects map[string]resumePosition
+	if err := json.Unmarshal(data, &objects); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not decode resume positions %v", path)
+	}
+
+	resume.lock.Lock()
+	defer resume.lock.Unlock()
+	now := time.Now()
+	for objectID, position := range objects {
+		if position.Until.After(now) {
+			resume.objects[objectID] = position
+		}
+	}
+	return nil
+}
+
+// SaveResumePositions writes the resume positions that did not expire yet
+func SaveResumePositions() error {
+	resume.lock.Lock()
+	path := resume.path
+	now := time.Now()
+	for objectID, position := range resume.objects {
+		if !position.Until.After(now) {
+			delete(resume.objects, objectID)
+		}
+	}
+	data, err := json.Marshal(resume.objects)
+	resume.changed = false
+	resume.lock.Unlock()
+
+	if "" == path {
+		return nil
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not encode resume positions")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write resume positions %v", path)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), path)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write resume positions %v", path)
+	}
+	return nil
+}
+
+// recordResumePosition protects the chunks around the last read offset of
+// a buffer that is closed
+func (b *Buffer) recordResumePosition() {
+	b.lock.Lock()
+	offset := b.lastOffset
+	b.lock.Unlock()
+	read := atomic.LoadInt64(&b.requestedBytes) > 0
+
+	resume.lock.Lock()
+	defer resume.lock.Unlock()
+
+	if resume.window <= 0 || resume.retention <= 0 || !read {
+		return
+	}
+	Log.Debugf("Keeping the chunks of object %v around offset %v for %v", b.object.ObjectID, offset, resume.retention)
+	resume.objects[b.object.ObjectID] = resumePosition{
+		Offset: offset,
+		Until:  time.Now().Add(resume.retention),
+	}
+	resume.changed = true
+}
+
+// isResumeChunk checks if the chunk stored under the given path holds bytes
+// within the window around the resume position of its object
+func isResumeChunk(path string) bool {
+	resume.lock.Lock()
+	defer resume.lock.Unlock()
+
+	if resume.window <= 0 || 0 == len(resume.objects) {
+		return false
+	}
+	objectID, _, size, offset, ok := parseChunkPath(path)
+	if !ok || sparseOffset == offset {
+		return false
+	}
+	position, exists := resume.objects[objectID]
+	if !exists || !time.Now().Before(position.Until) {
+		return false
+	}
+	start := position.Offset - resume.window/2
+	return offset+size > start && offset < start+resume.window
+}
+
+// saveResumeLoop writes the resume positions whenever they changed
+func saveResumeLoop() {
+	for range time.Tick(resumeSaveInterval) {
+		resume.lock.Lock()
+		changed := resume.changed
+		resume.lock.Unlock()
+
+		if changed {
+			if err := SaveResumePositions(); nil != err {
+				Log.Warningf("%v", err)
+			}
+		}
+	}
+}
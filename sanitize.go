@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strconv"
+	"unicode"
+)
+
+// safeName escapes control characters like newlines in a file name, so
+// that a crafted name can't forge log lines. Names without control
+// characters are returned as they are.
+func safeName(name string) string {
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			quoted := strconv.Quote(name)
+			return quoted[1 : len(quoted)-1]
+		}
+	}
+	return name
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// maliciousName is a file name that tries to forge log lines and escape
+// the chunk directory
+const maliciousName = "../../evil\n2017/01/01 00:00:00 [INFO] forged\r\x1b[31mred\x00.mkv"
+
+func TestSafeNameEscapesControlCharacters(t *testing.T) {
+	escaped := safeName(maliciousName)
+	for _, r := range escaped {
+		if r < 0x20 || 0x7f == r {
+			t.Fatalf("escaped name %q still holds control character %q", escaped, r)
+		}
+	}
+	if !strings.Contains(escaped, `evil\n2017`) || !strings.Contains(escaped, "forged") {
+		t.Fatalf("escaped name %q is not readable anymore", escaped)
+	}
+	if "Movie (2017) ünïcode.mkv" != safeName("Movie (2017) ünïcode.mkv") {
+		t.Fatalf("changed a name without control characters")
+	}
+}
+
+func TestChunkPathsIgnoreTheName(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	server := newTestServer(2*testChunkSize, nil)
+	defer server.Close()
+	object := server.object("malicious")
+	object.Name = maliciousName
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if got := readAll(t, buffer, 10000); !bytes.Equal(server.content, got) {
+		t.Fatalf("read %v bytes that don't match the content", len(got))
+	}
+	if filepath.Join(dir, "malicious") != buffer.tempDir {
+		t.Fatalf("chunk directory %v is not named by the object id", buffer.tempDir)
+	}
+	eventually(func() bool { return 2*testChunkSize == chunks.cachedBytes("malicious", 2*testChunkSize) })
+
+	// nothing outside of the directory of the object id was written
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if nil == err && !info.IsDir() && filepath.Join(dir, "malicious") != filepath.Dir(path) {
+			t.Errorf("wrote %v outside of the chunk directory of the object", path)
+		}
+		return err
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, parent := range []string{filepath.Dir(dir), filepath.Dir(filepath.Dir(dir))} {
+		if matches, _ := filepath.Glob(filepath.Join(parent, "evil*")); 0 != len(matches) {
+			t.Fatalf("wrote %v named by the object name", matches)
+		}
+	}
+}
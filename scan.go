@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// scanWindow is the time brief accesses are counted in, a scan ends once
+// there was no brief access for this time
+const scanWindow = 1 * time.Minute
+
+var scanDetection = struct {
+	lock      sync.Mutex
+	threshold int
+	readSize  int64
+	openTime  time.Duration
+	brief     []time.Time
+	scanning  bool
+}{}
+
+// SetScanDetection suppresses preloads while a library scan opens many
+// files briefly (0 = disabled). An access is brief if the file was closed
+// within openTime with less than readSize bytes read. Once threshold brief
+// accesses happened within a minute, files are not preloaded till they
+// were read like a playback, i.e. longer or more than that. The scan ends
+// once there was no brief access for a minute.
+func SetScanDetection(threshold int, readSize int64, openTime time.Duration) {
+	scanDetection.lock.Lock()
+	defer scanDetection.lock.Unlock()
+
+	scanDetection.threshold = threshold
+	scanDetection.readSize = readSize
+	scanDetection.openTime = openTime
+}
+
+// isBriefAccess checks if the buffer was read like a scan so far
+func (b *Buffer) isBriefAccess() bool {
+	return time.Since(b.created) < scanDetection.openTime &&
+		atomic.LoadInt64(&b.requestedBytes) < scanDetection.readSize
+}
+
+// recordAccess counts the access of a buffer that was closed
+func (b *Buffer) recordAccess() {
+	scanDetection.lock.Lock()
+	defer scanDetection.lock.Unlock()
+
+	if scanDetection.threshold <= 0 || !b.isBriefAccess() {
+		return
+	}
+	now := time.Now()
+	scanDetection.brief = append(recentAccesses(now), now)
+	if !scanDetection.scanning && len(scanDetection.brief) >= scanDetection.threshold {
+		Log.Infof("Detected a library scan, preloading only files that are played")
+		scanDetection.scanning = true
+	}
+}
+
+// recentAccesses drops the brief accesses outside of the window, the lock
+// must be held
+func recentAccesses(now time.Time) []time.Time {
+	recent := scanDetection.brief[:0]
+	for _, access := range scanDetection.brief {
+		if now.Sub(access) < scanWindow {
+			recent = append(recent, access)
+		}
+	}
+	return recent
+}
+
+// suppressPreload checks if the buffer must not preload, because a scan is
+// running and it was not read like a playback yet
+func (b *Buffer) suppressPreload() bool {
+	scanDetection.lock.Lock()
+	defer scanDetection.lock.Unlock()
+
+	if !scanDetection.scanning {
+		return false
+	}
+	scanDetection.brief = recentAccesses(time.Now())
+	if 0 == len(scanDetection.brief) {
+		Log.Infof("Library scan is over, preloading all files again")
+		scanDetection.scanning = false
+		return false
+	}
+	return b.isBriefAccess()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPreloadDepth is the number of chunks preloaded outside of all
+// preload windows
+const defaultPreloadDepth = 1
+
+var preloadSchedule []preloadWindow
+var preloadRampInitial = 1
+var preloadRampMax int
+var preloadMaxAhead int64
+
+// SetPreloadRamp enables the preload ramp. The preload depth of a file
+// starts at the initial depth and doubles with every sequentially read
+// chunk up to the maximum (0 = disabled), a seek starts over.
+func SetPreloadRamp(initial, max int) {
+	if initial < 1 {
+		initial = 1
+	}
+	preloadRampInitial = initial
+	preloadRampMax = max
+}
+
+// SetPreloadMaxAhead sets the maximum number of bytes preloaded past the
+// read position (0 = unlimited). It caps the preload depth, the ramp and
+// all windows, so that abandoned playback doesn't waste the quota. The
+// chunk following the read position is always preloaded.
+func SetPreloadMaxAhead(max int64) {
+	preloadMaxAhead = max
+}
+
+// preloadWindow is a daily time window with its own preload depth
+type preloadWindow struct {
+	start int
+	end   int
+	depth int
+}
+
+// SetPreloadSchedule sets the preload windows from a comma separated list
+// of HH:MM-HH:MM=depth entries (e.g. 01:00-06:00=8). Windows may span
+// midnight, outside of all windows one chunk is preloaded.
+func SetPreloadSchedule(schedule string) error {
+	var windows []preloadWindow
+	for _, entry := range strings.Split(schedule, ",") {
+		entry = strings.TrimSpace(entry)
+		if "" == entry {
+			continue
+		}
+
+		window, err := parsePreloadWindow(entry)
+		if nil != err {
+			return err
+		}
+		windows = append(windows, window)
+	}
+	preloadSchedule = windows
+	return nil
+}
+
+// parsePreloadWindow parses one HH:MM-HH:MM=depth entry
+func parsePreloadWindow(entry string) (preloadWindow, error) {
+	invalid := fmt.Errorf("Invalid preload window %v (expected HH:MM-HH:MM=depth)", entry)
+
+	parts := strings.Split(entry, "=")
+	if 2 != len(parts) {
+		return preloadWindow{}, invalid
+	}
+	times := strings.Split(parts[0], "-")
+	if 2 != len(times) {
+		return preloadWindow{}, invalid
+	}
+
+	start, err := parseMinuteOfDay(times[0])
+	if nil != err {
+		return preloadWindow{}, invalid
+	}
+	end, err := parseMinuteOfDay(times[1])
+	if nil != err {
+		return preloadWindow{}, invalid
+	}
+	depth, err := strconv.Atoi(parts[1])
+	if nil != err || depth < 0 {
+		return preloadWindow{}, invalid
+	}
+
+	return preloadWindow{
+		start: start,
+		end:   end,
+		depth: depth,
+	}, nil
+}
+
+// parseMinuteOfDay converts HH:MM to the minutes since midnight
+func parseMinuteOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if nil != err {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains checks if the minute of the day lies within the window
+func (w preloadWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// preloadDepth returns the number of chunks to preload at the given time.
+// The first matching window wins.
+func preloadDepth(now time.Time) int {
+	if depth, scheduled := scheduledDepth(now); scheduled {
+		return depth
+	}
+	return defaultPreloadDepth
+}
+
+// scheduledDepth returns the preload depth of the first window matching
+// the given time, if any
+func scheduledDepth(now time.Time) (int, bool) {
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range preloadSchedule {
+		if window.contains(minute) {
+			return window.depth, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SelfTestResult is the outcome of one self test check
+type SelfTestResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BufferSelfTest exercises the chunk cache on the configured chunk path.
+// A synthetic object is served by a local HTTP server, so that the real
+// filesystem and its permissions are tested without accessing Google Drive.
+func BufferSelfTest() []SelfTestResult {
+	var results []SelfTestResult
+	check := func(name string, fn func() error) bool {
+		err := fn()
+		result := SelfTestResult{
+			Name:   name,
+			Passed: nil == err,
+		}
+		if nil != err {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+		return nil == err
+	}
+
+	// two and a half chunks of deterministic content
+	size := currentChunkSize()
+	content := make([]byte, 2*size+size/2)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	var listener net.Listener
+	if !check("start local test server", func() error {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		listener = l
+		return err
+	}) {
+		return results
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+
+	object := &APIObject{
+		ObjectID:    fmt.Sprintf("plexdrive-selftest-%v", time.Now().UnixNano()),
+		Name:        "plexdrive self test",
+		Size:        uint64(len(content)),
+		DownloadURL: fmt.Sprintf("http://%v/", listener.Addr()),
+	}
+
+	var buffer *Buffer
+	if !check("create chunk directory", func() error {
+		b, err := newBuffer(http.DefaultClient, object)
+		if nil != err {
+			return err
+		}
+		if _, err := os.Stat(b.tempDir); nil != err {
+			return err
+		}
+		buffer = b
+		return nil
+	}) {
+		return results
+	}
+	buffer.preload = false
+	defer func() {
+		buffer.shutdown()
+		os.RemoveAll(buffer.tempDir)
+	}()
+
+	expect := func(start, size int64) error {
+		var data []byte
+		for int64(len(data)) < size {
+			chunk, err := buffer.ReadBytes(start+int64(len(data)), size-int64(len(data)), ReadForeground)
+			if nil != err {
+				return err
+			}
+			if 0 == len(chunk) {
+				return fmt.Errorf("Empty read at offset %v", start+int64(len(data)))
+			}
+			data = append(data, chunk...)
+		}
+		if !bytes.Equal(data[:size], content[start:start+size]) {
+			return fmt.Errorf("Read bytes %v - %v do not match", start, start+size)
+		}
+		return nil
+	}
+	filename := filepath.Join(buffer.tempDir, chunkName(chunks.generation(object.ObjectID), buffer.chunkSize, 0))
+
+	check("download first chunk", func() error {
+		return expect(0, 1024)
+	})
+	check("write chunk to cache", func() error {
+		_, err := buffer.store.Read(filename, 0, 1)
+		return err
+	})
+	check("read chunk from cache", func() error {
+		return expect(512, 1024)
+	})
+	check("read across chunk boundary", func() error {
+		return expect(buffer.chunkSize-512, 1024)
+	})
+	check("read last partial chunk", func() error {
+		return expect(int64(len(content))-1024, 1024)
+	})
+	check("evict chunk", func() error {
+		if err := removeChunk(filename); nil != err {
+			return err
+		}
+		if _, err := buffer.store.Read(filename, 0, 1); nil == err {
+			return fmt.Errorf("Chunk %v still exists after eviction", filename)
+		}
+		return nil
+	})
+	check("read chunk after eviction", func() error {
+		return expect(0, 1024)
+	})
+
+	return results
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sync"
+)
+
+var serialPolicies struct {
+	lock     sync.Mutex
+	policies []SerialPolicy
+}
+
+// SerialPolicy decides if an object is streamed in serial mode. Objects
+// in serial mode are not preloaded and only one chunk is downloaded at a
+// time, for files that only stream reliably without parallel requests.
+type SerialPolicy func(object *APIObject) bool
+
+// RegisterSerialPolicy adds a policy, an object is streamed in serial mode
+// if any registered policy matches it
+func RegisterSerialPolicy(policy SerialPolicy) {
+	serialPolicies.lock.Lock()
+	defer serialPolicies.lock.Unlock()
+
+	serialPolicies.policies = append(serialPolicies.policies, policy)
+}
+
+// SerialBySize matches objects of at least the given size
+func SerialBySize(minSize uint64) SerialPolicy {
+	return func(object *APIObject) bool {
+		return object.Size >= minSize
+	}
+}
+
+// SerialByPattern matches objects whose name matches the shell pattern
+func SerialByPattern(pattern string) (SerialPolicy, error) {
+	if _, err := path.Match(pattern, ""); nil != err {
+		return nil, fmt.Errorf("Invalid serial pattern %v", pattern)
+	}
+
+	return func(object *APIObject) bool {
+		matched, _ := path.Match(pattern, object.Name)
+		return matched
+	}, nil
+}
+
+// isSerial checks if the object has to be streamed in serial mode
+func isSerial(object *APIObject) bool {
+	serialPolicies.lock.Lock()
+	defer serialPolicies.lock.Unlock()
+
+	for _, policy := range serialPolicies.policies {
+		if policy(object) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/sys/unix"
+)
+
+var sharedCache bool
+
+// SetSharedCache enables locking the chunk directory against other
+// plexdrive instances writing to the same chunk directory. Sparse chunk
+// files are written in place and can not be shared.
+func SetSharedCache(enabled bool) error {
+	if enabled && "sparse" == chunkStoreName {
+		return fmt.Errorf("Sparse chunk files can not be shared with other instances")
+	}
+	sharedCache = enabled
+	return nil
+}
+
+// lockChunkDir locks the chunk directory against other instances sharing
+// it and returns the function releasing the lock. Chunk writes hold a
+// shared lock, evictions and cleanings an exclusive one, so that no
+// instance deletes the temporary file or the directory of a chunk that
+// another instance is writing. Every lock opens the lock file again,
+// because flock locks of one open file don't exclude each other.
+func lockChunkDir(exclusive bool) func() {
+	if !sharedCache {
+		return func() {}
+	}
+
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	f, err := os.OpenFile(chunkPath+".lock", os.O_RDONLY|os.O_CREATE, 0666)
+	if nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not lock chunk directory %v", chunkPath)
+		return func() {}
+	}
+	if err := retryFS(func() error {
+		return unix.Flock(int(f.Fd()), how)
+	}); nil != err {
+		f.Close()
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not lock chunk directory %v", chunkPath)
+		return func() {}
+	}
+	return func() {
+		f.Close()
+	}
+}
+
+// vanished checks if a walked file was deleted in the meantime, e.g. by
+// another instance sharing the chunk directory
+func vanished(info os.FileInfo, err error) bool {
+	return nil == info && os.IsNotExist(err)
+}
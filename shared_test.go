@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSharedChunkDirWriters(t *testing.T) {
+	dir, cleanup := setupChunkDir(t)
+	defer cleanup()
+	if err := SetSharedCache(true); nil != err {
+		t.Fatal(err)
+	}
+	defer SetSharedCache(false)
+
+	// two instances write the same chunk while a third one cleans the
+	// chunk directory
+	objectDir := filepath.Join(dir, "shared")
+	filename := filepath.Join(objectDir, chunkName(0, testChunkSize, 0))
+	versions := [][]byte{testContent(testChunkSize), testContent(testChunkSize - 1)}
+	var errors []error
+	var lock sync.Mutex
+	var writers sync.WaitGroup
+	for _, version := range versions {
+		writers.Add(1)
+		go func(store ChunkStore, data []byte) {
+			defer writers.Done()
+			for n := 0; n < 50; n++ {
+				if err := store.Write(filename, data); nil != err {
+					lock.Lock()
+					errors = append(errors, err)
+					lock.Unlock()
+				}
+			}
+		}(newFileStore(objectDir), version)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 20; n++ {
+			clearByInterval(dir, 0)
+		}
+	}()
+	writers.Wait()
+	<-done
+
+	if 0 != len(errors) {
+		t.Fatalf("%v chunk writes failed next to the other instances, e.g. %v", len(errors), errors[0])
+	}
+	files, _ := ioutil.ReadDir(objectDir)
+	for _, file := range files {
+		if strings.Contains(file.Name(), "-") {
+			t.Fatalf("left the temporary file %v", file.Name())
+		}
+	}
+	if data, err := ioutil.ReadFile(filename); nil == err && !bytes.Equal(versions[0], data) && !bytes.Equal(versions[1], data) {
+		t.Fatalf("chunk of %v bytes is no version that was written", len(data))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var slowReadThreshold = 2 * time.Second
+
+// SetSlowReadThreshold sets the duration reads are logged as slow after
+// (0 = disabled), so that stutter can be investigated without debug logs
+func SetSlowReadThreshold(threshold time.Duration) {
+	slowReadThreshold = threshold
+}
+
+// chunkCached checks if the chunk holding the given offset is cached
+func (b *Buffer) chunkCached(start int64) bool {
+	return chunks.has(b.object.ObjectID, b.cacheGeneration(), start-start%b.chunkSize)
+}
+
+// logSlowRead logs a read that took longer than the slow read threshold and
+// adds it to the stall report
+func (b *Buffer) logSlowRead(start, size int64, cached bool, started time.Time) {
+	if elapsed := time.Since(started); elapsed > slowReadThreshold {
+		b.recordStall(start, cached, elapsed)
+		Log.Warningf("Slow read of object %v bytes %v - %v took %v (cache hit: %v)",
+			b.object.ObjectID, start, start+size, elapsed, cached)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var smallObjectMaxSize int64
+var smallObjects = newSmallObjectCache()
+
+// smallObjectCache keeps small objects like posters and fanart in memory,
+// separate from the chunk cache so that media chunks never evict them.
+// The least recently read objects are evicted first.
+type smallObjectCache struct {
+	lock     sync.Mutex
+	maxSize  int64
+	size     int64
+	order    *list.List
+	objects  map[string]*list.Element
+	inFlight map[string]chan struct{}
+}
+
+// smallObject is a cached small object
+type smallObject struct {
+	objectID     string
+	lastModified time.Time
+	chunkSize    int64
+	data         []byte
+}
+
+// SetSmallObjects enables the small object fast path. Objects up to the
+// maximum object size are downloaded in one request and served from a
+// memory cache of the given size (in byte, 0 = disabled).
+func SetSmallObjects(maxObjectSize, cacheSize int64) {
+	smallObjects.lock.Lock()
+	defer smallObjects.lock.Unlock()
+
+	if maxObjectSize <= 0 || cacheSize <= 0 {
+		smallObjectMaxSize = 0
+		smallObjects.maxSize = 0
+		return
+	}
+	if maxObjectSize > cacheSize {
+		Log.Warningf("The small object size %v exceeds the small object cache size, using %v", maxObjectSize, cacheSize)
+		maxObjectSize = cacheSize
+	}
+	smallObjectMaxSize = maxObjectSize
+	smallObjects.maxSize = cacheSize
+}
+
+// isSmallObject checks if the object is served by the small object fast path
+func isSmallObject(object *APIObject) bool {
+	return smallObjectMaxSize > 0 && !object.IsDir && !object.Encrypted && int64(object.Size) <= smallObjectMaxSize
+}
+
+// newSmallObjectCache creates an empty small object cache
+func newSmallObjectCache() *smallObjectCache {
+	return &smallObjectCache{
+		order:    list.New(),
+		objects:  make(map[string]*list.Element),
+		inFlight: make(map[string]chan struct{}),
+	}
+}
+
+// ReadSmallObject reads bytes of a small object from the memory cache,
+// the whole object is downloaded in one request if it is not cached
+func (d *Drive) ReadSmallObject(object *APIObject, start, size int64) ([]byte, error) {
+	data, err := smallObjects.get(objectClient(object.ObjectID, d.getNativeClient()), object)
+	if nil != err {
+		return nil, err
+	}
+
+	if start >= int64(len(data)) {
+		return []byte{}, nil
+	}
+	end := start + size
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[start:end], nil
+}
+
+// get returns the data of a small object. Concurrent reads of an object
+// that is not cached wait for one download.
+func (c *smallObjectCache) get(client *http.Client, object *APIObject) ([]byte, error) {
+	for {
+		c.lock.Lock()
+		if element, exists := c.objects[object.ObjectID]; exists {
+			cached := element.Value.(*smallObject)
+			if cached.lastModified.Equal(object.LastModified) && uint64(len(cached.data)) == object.Size {
+				c.order.MoveToFront(element)
+				c.lock.Unlock()
+				return cached.data, nil
+			}
+			c.removeElement(element)
+		}
+
+		if done, loading := c.inFlight[object.ObjectID]; loading {
+			c.lock.Unlock()
+			<-done
+			continue
+		}
+		done := make(chan struct{})
+		c.inFlight[object.ObjectID] = done
+		c.lock.Unlock()
+
+		data, spilled := loadSpilledObject(object)
+		var err error
+		if !spilled {
+			data, err = downloadSmallObject(client, object)
+		}
+
+		var evicted []*smallObject
+		c.lock.Lock()
+		delete(c.inFlight, object.ObjectID)
+		close(done)
+		if nil == err {
+			evicted = c.add(object, data)
+		}
+		c.lock.Unlock()
+
+		for _, cached := range evicted {
+			go spillSmallObject(cached)
+		}
+		return data, err
+	}
+}
+
+// add caches a small object and evicts the least recently read objects
+// till the cache fits. It returns the evicted objects, the lock must be held.
+func (c *smallObjectCache) add(object *APIObject, data []byte) []*smallObject {
+	if int64(len(data)) > c.maxSize {
+		return nil
+	}
+
+	c.objects[object.ObjectID] = c.order.PushFront(&smallObject{
+		objectID:     object.ObjectID,
+		lastModified: object.LastModified,
+		chunkSize:    objectChunkSize(object),
+		data:         data,
+	})
+	c.size += int64(len(data))
+
+	var evicted []*smallObject
+	for c.size > c.maxSize {
+		evicted = append(evicted, c.removeElement(c.order.Back()))
+	}
+	return evicted
+}
+
+// remove drops a small object from the cache
+func (c *smallObjectCache) remove(objectID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exists := c.objects[objectID]; exists {
+		c.removeElement(element)
+	}
+}
+
+// removeElement drops a cached object, the lock must be held
+func (c *smallObjectCache) removeElement(element *list.Element) *smallObject {
+	cached := c.order.Remove(element).(*smallObject)
+	delete(c.objects, cached.objectID)
+	c.size -= int64(len(cached.data))
+	return cached
+}
+
+// downloadSmallObject downloads a whole small object in one request
+func downloadSmallObject(client *http.Client, object *APIObject) ([]byte, error) {
+	if isOffline() {
+		return nil, &OfflineError{ObjectID: object.ObjectID}
+	}
+	if quotaExceeded() {
+		return nil, &QuotaExceededError{ObjectID: object.ObjectID}
+	}
+
+	var lastErr error
+	for _, url := range object.DownloadURLs() {
+		if nil != urlRewriter {
+			url = urlRewriter(object, url)
+		}
+
+		data, err := downloadWhole(client, object, url)
+		if warning, ok := err.(*VirusScanWarningError); ok && "" != warning.Confirm {
+			Log.Debugf("%v", err)
+			data, err = downloadWhole(client, object, confirmURL(url, warning.Confirm))
+		}
+		if isAbuseFlagged(err) && retryAbuseFlagged(object) {
+			Log.Debugf("%v", err)
+			data, err = downloadWhole(client, object, acknowledgeURL(url))
+		}
+		updateOffline(err)
+		if nil == err {
+			accountDownload(int64(len(data)))
+			return data, nil
+		}
+		lastErr = err
+		if statusErr, ok := err.(*StatusError); !ok ||
+			(http.StatusForbidden != statusErr.StatusCode && http.StatusNotFound != statusErr.StatusCode) {
+			break
+		}
+		Log.Debugf("%v", err)
+	}
+	Log.Debugf("%v", lastErr)
+	return nil, fmt.Errorf("Could not download small object %v", object.ObjectID)
+}
+
+// downloadWhole downloads a whole object from one endpoint
+func downloadWhole(client *http.Client, object *APIObject, url string) ([]byte, error) {
+	if err := pace(context.Background()); nil != err {
+		return nil, err
+	}
+
+	Log.Debugf("Requesting small object %v from API", object.ObjectID)
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		return nil, err
+	}
+	addScanConfirmation(object.ObjectID, req)
+	addDownloadHeaders(req)
+	if readTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	res, err := client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if http.StatusOK != res.StatusCode {
+		return nil, &StatusError{ObjectID: object.ObjectID, StatusCode: res.StatusCode, Reason: errorReason(res.Body)}
+	}
+	if isInterstitial(res) {
+		return nil, readInterstitial(object.ObjectID, res)
+	}
+	if isLengthMismatch(res, int64(object.Size)) {
+		return nil, fmt.Errorf("Got content length %v for small object %v of size %v", res.ContentLength, object.ObjectID, object.Size)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(object.Size)+1))
+	if nil != err {
+		return nil, err
+	}
+	if uint64(len(data)) != object.Size {
+		return nil, fmt.Errorf("Got %v bytes for small object %v of size %v", len(data), object.ObjectID, object.Size)
+	}
+	return data, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// softStartMinPart is the minimum number of bytes read from a response at
+// once during the soft start
+const softStartMinPart = 32 * 1024
+
+var softStart = struct {
+	duration time.Duration
+	rate     int64
+}{}
+
+// SetSoftStart limits the downloads of a newly opened file to rate bytes
+// per second for the given time (0 = disabled), so that many streams
+// starting at once don't burst the API. Afterwards the file is downloaded
+// at full speed.
+func SetSoftStart(duration time.Duration, rate int64) {
+	softStart.duration = duration
+	softStart.rate = rate
+}
+
+// softStartReader throttles the body of a response during the soft start
+// of its buffer
+type softStartReader struct {
+	io.ReadCloser
+	buffer *Buffer
+}
+
+// softStartBody wraps the body of a response, if the soft start of the
+// buffer is still running
+func (b *Buffer) softStartBody(body io.ReadCloser) io.ReadCloser {
+	if softStart.duration <= 0 || softStart.rate <= 0 || time.Since(b.created) >= softStart.duration {
+		return body
+	}
+	return &softStartReader{ReadCloser: body, buffer: b}
+}
+
+func (r *softStartReader) Read(p []byte) (int, error) {
+	part := softStart.rate / 10
+	if part < softStartMinPart {
+		part = softStartMinPart
+	}
+	if int64(len(p)) > part {
+		p = p[:part]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.buffer.throttle(int64(n))
+	return n, err
+}
+
+// throttle waits till the bytes downloaded by all requests of the buffer
+// fit the soft start rate, at most till the soft start is over
+func (b *Buffer) throttle(n int64) {
+	b.lock.Lock()
+	elapsed := time.Since(b.created)
+	b.softStartBytes += n
+	due := time.Duration(float64(b.softStartBytes) / float64(softStart.rate) * float64(time.Second))
+	b.lock.Unlock()
+
+	wait := due - elapsed
+	if remaining := softStart.duration - elapsed; wait > remaining {
+		wait = remaining
+	}
+	if wait <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-b.ctx.Done():
+	}
+}
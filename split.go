@@ -0,0 +1,88 @@
+package main
+
+import . "github.com/claudetech/loggo/default"
+
+var downloadSplitFloor int64
+
+// subRange is a successfully downloaded part of a range that was split
+type subRange struct {
+	generation int64
+	end        int64
+	bytes      []byte
+}
+
+// SetDownloadSplitFloor retries a range that timed out or failed on the
+// network in two halves, recursively down to ranges of the given size
+// (0 = disabled). This helps large chunks on poor connections without
+// shrinking the chunk size of all downloads.
+func SetDownloadSplitFloor(floor int64) {
+	downloadSplitFloor = floor
+}
+
+// downloadSplit downloads a range and splits it into halves if it fails.
+// The halves that succeeded are kept till the whole range is downloaded,
+// so that a retried read only requests the missing parts.
+func (b *Buffer) downloadSplit(generation, offset, offsetEnd int64) ([]byte, error) {
+	if bytes, ok := b.subRange(generation, offset, offsetEnd); ok {
+		return bytes, nil
+	}
+
+	bytes, err := b.download(generation, offset, offsetEnd)
+	if nil == err || !isSplittable(err) || isOffline() || (offsetEnd-offset)/2 < downloadSplitFloor {
+		return bytes, err
+	}
+	Log.Debugf("%v", err)
+	Log.Debugf("Splitting object %v bytes %v - %v into halves", b.object.ObjectID, offset, offsetEnd)
+
+	half := offset + (offsetEnd-offset)/2
+	first, err := b.downloadSplit(generation, offset, half)
+	if nil != err {
+		return nil, err
+	}
+	b.keepSubRange(generation, offset, half, first)
+	second, err := b.downloadSplit(generation, half, offsetEnd)
+	if nil != err {
+		return nil, err
+	}
+	b.dropSubRange(offset)
+
+	result := make([]byte, 0, offsetEnd-offset)
+	result = append(result, first...)
+	return append(result, second...), nil
+}
+
+// isSplittable checks if a failed range could succeed in smaller parts
+func isSplittable(err error) bool {
+	return downloadSplitFloor > 0 && isTransientError(err)
+}
+
+// subRange returns a kept part of a split range
+func (b *Buffer) subRange(generation, offset, offsetEnd int64) ([]byte, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	kept, exists := b.subRanges[offset]
+	if !exists || kept.generation != generation || kept.end != offsetEnd {
+		return nil, false
+	}
+	return kept.bytes, true
+}
+
+// keepSubRange keeps a downloaded part of a split range
+func (b *Buffer) keepSubRange(generation, offset, offsetEnd int64, bytes []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if nil == b.subRanges {
+		b.subRanges = make(map[int64]subRange)
+	}
+	b.subRanges[offset] = subRange{generation: generation, end: offsetEnd, bytes: bytes}
+}
+
+// dropSubRange forgets a part of a split range once the range is complete
+func (b *Buffer) dropSubRange(offset int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.subRanges, offset)
+}
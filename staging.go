@@ -0,0 +1,181 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// chunkWriters is the number of goroutines writing staged chunks
+const chunkWriters = 2
+
+var chunkStagingSize int64
+
+// staging counts the bytes of all chunks that are written in the background
+// and queues them for the chunk writers
+var staging = struct {
+	lock      sync.Mutex
+	used      int64
+	queueSize int
+	queue     chan stagedWrite
+	once      sync.Once
+}{
+	queueSize: 16,
+}
+
+// stagedChunk is a downloaded chunk that is not written to disk yet
+type stagedChunk struct {
+	generation int64
+	bytes      []byte
+}
+
+// stagedWrite is a staged chunk waiting in the write queue
+type stagedWrite struct {
+	buffer     *Buffer
+	filename   string
+	generation int64
+	offset     int64
+	bytes      []byte
+}
+
+// StagingStats holds the chunks waiting to be written in the background
+type StagingStats struct {
+	Used      int64 `json:"used"`
+	Limit     int64 `json:"limit"`
+	Queued    int   `json:"queued"`
+	QueueSize int   `json:"queueSize"`
+}
+
+// SetChunkStaging writes downloaded chunks in the background while they are
+// served from memory, using up to the given number of bytes for chunks that
+// are not written yet (0 = write chunks before serving them). Reads of a
+// missing chunk don't wait for the disk that way.
+func SetChunkStaging(size int64) {
+	chunkStagingSize = size
+}
+
+// SetChunkWriteQueue sets the number of staged chunks that wait to be
+// written at most. Once the queue is full, chunks are written before they
+// are served again, so that a slow disk can't fill the memory.
+func SetChunkWriteQueue(size int) {
+	staging.lock.Lock()
+	defer staging.lock.Unlock()
+
+	if size < 1 {
+		size = 1
+	}
+	staging.queueSize = size
+}
+
+// GetStagingStats returns the memory and the queue of the staged chunks
+func GetStagingStats() StagingStats {
+	staging.lock.Lock()
+	defer staging.lock.Unlock()
+
+	return StagingStats{
+		Used:      staging.used,
+		Limit:     chunkStagingSize,
+		Queued:    len(staging.queue),
+		QueueSize: staging.queueSize,
+	}
+}
+
+// stageChunk serves a downloaded chunk from memory and queues it to be
+// written in the background. It returns false if the chunk has to be
+// written right away, because the staging memory is used up, the write
+// queue is full, the buffer memory budget is met or write failures fail
+// reads.
+func (b *Buffer) stageChunk(filename string, generation, offset int64, bytes []byte) bool {
+	if chunkStagingSize <= 0 || WriteFailureFail == chunkWriteFailure || chunkReadOnly {
+		return false
+	}
+	staging.once.Do(startChunkWriters)
+
+	size := int64(len(bytes))
+	if !reserveBufferMemory(size) {
+		return false
+	}
+	staging.lock.Lock()
+	if staging.used+size > chunkStagingSize {
+		staging.lock.Unlock()
+		atomic.AddInt64(&bufferMemory.used, -size)
+		return false
+	}
+	staging.used += size
+	staging.lock.Unlock()
+
+	b.lock.Lock()
+	if nil == b.staged {
+		b.staged = make(map[int64]stagedChunk)
+	}
+	b.staged[offset] = stagedChunk{generation: generation, bytes: bytes}
+	b.lock.Unlock()
+
+	select {
+	case staging.queue <- stagedWrite{buffer: b, filename: filename, generation: generation, offset: offset, bytes: bytes}:
+		return true
+	default:
+		Log.Debugf("Chunk write queue is full, writing chunk %v before serving it", filename)
+		b.unstage(generation, offset, size)
+		return false
+	}
+}
+
+// startChunkWriters creates the write queue and starts the chunk writers
+func startChunkWriters() {
+	staging.lock.Lock()
+	staging.queue = make(chan stagedWrite, staging.queueSize)
+	staging.lock.Unlock()
+
+	for i := 0; i < chunkWriters; i++ {
+		go chunkWriter()
+	}
+}
+
+// chunkWriter writes the queued chunks one after another
+func chunkWriter() {
+	for write := range staging.queue {
+		b := write.buffer
+		if err := b.storeChunk(write.filename, write.generation, write.offset, write.bytes); nil != err {
+			Log.Warningf("%v", err)
+		}
+		b.unstage(write.generation, write.offset, int64(len(write.bytes)))
+	}
+}
+
+// unstage drops a chunk from memory once it was written, reads of the chunk
+// are served from disk afterwards
+func (b *Buffer) unstage(generation, offset, size int64) {
+	b.lock.Lock()
+	if staged, exists := b.staged[offset]; exists && staged.generation == generation {
+		delete(b.staged, offset)
+	}
+	b.lock.Unlock()
+
+	staging.lock.Lock()
+	staging.used -= size
+	staging.lock.Unlock()
+	atomic.AddInt64(&bufferMemory.used, -size)
+}
+
+// readStaged reads from a chunk that is not written to disk yet
+func (b *Buffer) readStaged(generation, offset, fOffset, size int64) ([]byte, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	staged, exists := b.staged[offset]
+	if !exists || staged.generation != generation {
+		return nil, false
+	}
+	return staged.read(fOffset, size), true
+}
+
+// read returns the bytes of the chunk at the given offset within the chunk
+func (c stagedChunk) read(fOffset, size int64) []byte {
+	if fOffset >= int64(len(c.bytes)) {
+		return []byte{}
+	}
+	return c.bytes[fOffset:int64(math.Min(float64(fOffset+size), float64(len(c.bytes))))]
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// benchmarkDiskLatency is the time a chunk write takes on the simulated disk
+const benchmarkDiskLatency = 5 * time.Millisecond
+
+// slowDiskStore delays chunk writes like a busy disk
+type slowDiskStore struct {
+	ChunkStore
+}
+
+func (s *slowDiskStore) Write(filename string, data []byte) error {
+	time.Sleep(benchmarkDiskLatency)
+	return s.ChunkStore.Write(filename, data)
+}
+
+// BenchmarkStagingMissLatency measures the latency of reads of a chunk that
+// is not cached on a slow disk, with the chunk written before it is served
+// and with the chunk served from the staging memory while it is written in
+// the background
+func BenchmarkStagingMissLatency(b *testing.B) {
+	for _, stagingSize := range []int64{0, 64 * testChunkSize} {
+		b.Run(fmt.Sprintf("staging=%v", stagingSize), func(b *testing.B) {
+			benchmarkStagingMissLatency(b, stagingSize)
+		})
+	}
+}
+
+func benchmarkStagingMissLatency(b *testing.B, stagingSize int64) {
+	_, cleanup := setupChunkDir(b)
+	defer cleanup()
+	chunkStores["slowdisk"] = func(dir string) ChunkStore {
+		return &slowDiskStore{ChunkStore: newFileStore(dir)}
+	}
+	defer delete(chunkStores, "slowdisk")
+	name := chunkStoreName
+	if err := SetChunkStore("slowdisk"); nil != err {
+		b.Fatal(err)
+	}
+	defer SetChunkStore(name)
+	SetChunkStaging(stagingSize)
+	defer SetChunkStaging(0)
+	server := newTestServer(testChunkSize, nil)
+	defer server.Close()
+
+	p := make([]byte, 4096)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		buffer := openTestBuffer(b, server.object(fmt.Sprintf("miss%v", n)))
+		if _, err := buffer.ReadInto(p, 0); nil != err {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		buffer.Close()
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// stallWindow is the time a chunk stays in the stall report after its last
+// slow read
+const stallWindow = 1 * time.Hour
+
+// maxStalls is the maximum number of chunks in the stall report, the chunks
+// with the least stall time are dropped first
+const maxStalls = 100
+
+var stalls = struct {
+	lock   sync.Mutex
+	chunks map[stallKey]*StallStats
+}{
+	chunks: make(map[stallKey]*StallStats),
+}
+
+// stallKey identifies the chunk of a slow read
+type stallKey struct {
+	objectID string
+	offset   int64
+}
+
+// StallStats holds the slow reads of one chunk
+type StallStats struct {
+	ObjectID string        `json:"objectId"`
+	Name     string        `json:"name"`
+	Offset   int64         `json:"offset"`
+	Reads    int64         `json:"reads"`
+	Misses   int64         `json:"misses"`
+	Total    time.Duration `json:"total"`
+	Longest  time.Duration `json:"longest"`
+	Last     time.Time     `json:"last"`
+}
+
+// stallsByTotal sorts the stall report by the stall time, longest first
+type stallsByTotal []StallStats
+
+func (s stallsByTotal) Len() int           { return len(s) }
+func (s stallsByTotal) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s stallsByTotal) Less(i, j int) bool { return s[i].Total > s[j].Total }
+
+// recordStall adds a slow read to the stall report of its chunk
+func (b *Buffer) recordStall(start int64, cached bool, elapsed time.Duration) {
+	stalls.lock.Lock()
+	defer stalls.lock.Unlock()
+
+	now := time.Now()
+	pruneStalls(now)
+
+	key := stallKey{objectID: b.object.ObjectID, offset: start - start%b.chunkSize}
+	stall, exists := stalls.chunks[key]
+	if !exists {
+		if len(stalls.chunks) >= maxStalls {
+			dropShortestStall()
+		}
+		stall = &StallStats{ObjectID: key.objectID, Name: safeName(b.object.Name), Offset: key.offset}
+		stalls.chunks[key] = stall
+	}
+	stall.Reads++
+	if !cached {
+		stall.Misses++
+	}
+	stall.Total += elapsed
+	if elapsed > stall.Longest {
+		stall.Longest = elapsed
+	}
+	stall.Last = now
+}
+
+// pruneStalls drops the chunks without slow reads within the stall window,
+// the lock must be held
+func pruneStalls(now time.Time) {
+	for key, stall := range stalls.chunks {
+		if now.Sub(stall.Last) > stallWindow {
+			delete(stalls.chunks, key)
+		}
+	}
+}
+
+// dropShortestStall drops the chunk with the least stall time, the lock
+// must be held
+func dropShortestStall() {
+	var shortest *stallKey
+	for key, stall := range stalls.chunks {
+		if nil == shortest || stall.Total < stalls.chunks[*shortest].Total {
+			key := key
+			shortest = &key
+		}
+	}
+	if nil != shortest {
+		delete(stalls.chunks, *shortest)
+	}
+}
+
+// GetStallReport returns the chunks with slow reads within the last hour,
+// the chunks that stalled reads the longest first. A chunk that is missed
+// on every read, e.g. because it can't be cached, shows up with as many
+// misses as reads.
+func GetStallReport() []StallStats {
+	stalls.lock.Lock()
+	defer stalls.lock.Unlock()
+
+	pruneStalls(time.Now())
+	report := make([]StallStats, 0, len(stalls.chunks))
+	for _, stall := range stalls.chunks {
+		report = append(report, *stall)
+	}
+	sort.Sort(stallsByTotal(report))
+	return report
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// statsSaveInterval is the time between two writes of the stats file
+const statsSaveInterval = 1 * time.Minute
+
+var totals = struct {
+	lock       sync.Mutex
+	path       string
+	since      time.Time
+	downloaded int64
+	hits       int64
+	misses     int64
+	changed    bool
+}{}
+
+// TotalStats holds the counters kept across restarts, since the stats file
+// was created
+type TotalStats struct {
+	Since      time.Time `json:"since"`
+	Downloaded int64     `json:"downloaded"`
+	Hits       int64     `json:"hits"`
+	Misses     int64     `json:"misses"`
+	Ratio      float64   `json:"ratio"`
+}
+
+// LoadStats restores the total stats from the stats file and keeps the
+// file up to date. A missing or corrupt file starts the stats fresh.
+func LoadStats(path string) error {
+	totals.lock.Lock()
+	totals.path = path
+	totals.since = time.Now()
+	totals.lock.Unlock()
+	go saveStatsLoop()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read stats %v", path)
+	}
+
+	var stats TotalStats
+	if err := json.Unmarshal(data, &stats); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not decode stats %v, starting fresh", path)
+	}
+
+	totals.lock.Lock()
+	defer totals.lock.Unlock()
+	if !stats.Since.IsZero() {
+		totals.since = stats.Since
+	}
+	totals.downloaded += stats.Downloaded
+	totals.hits += stats.Hits
+	totals.misses += stats.Misses
+	return nil
+}
+
+// SaveStats writes the total stats to the stats file
+func SaveStats() error {
+	stats := GetTotalStats()
+	totals.lock.Lock()
+	path := totals.path
+	totals.changed = false
+	totals.lock.Unlock()
+
+	if "" == path {
+		return nil
+	}
+
+	data, err := json.Marshal(stats)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not encode stats")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write stats %v", path)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), path)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not write stats %v", path)
+	}
+	return nil
+}
+
+// GetTotalStats returns the bytes downloaded and the cache hits and misses
+// of all reads since the stats file was created
+func GetTotalStats() TotalStats {
+	totals.lock.Lock()
+	defer totals.lock.Unlock()
+
+	stats := TotalStats{
+		Since:      totals.since,
+		Downloaded: totals.downloaded,
+		Hits:       totals.hits,
+		Misses:     totals.misses,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.Ratio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// countDownload adds downloaded bytes to the total stats
+func countDownload(size int64) {
+	totals.lock.Lock()
+	defer totals.lock.Unlock()
+
+	totals.downloaded += size
+	totals.changed = true
+}
+
+// countRead adds a cache hit or miss to the total stats
+func countRead(hit bool) {
+	totals.lock.Lock()
+	defer totals.lock.Unlock()
+
+	if hit {
+		totals.hits++
+	} else {
+		totals.misses++
+	}
+	totals.changed = true
+}
+
+// saveStatsLoop writes the stats file whenever the stats changed
+func saveStatsLoop() {
+	for range time.Tick(statsSaveInterval) {
+		totals.lock.Lock()
+		changed := totals.changed
+		totals.lock.Unlock()
+
+		if changed {
+			if err := SaveStats(); nil != err {
+				Log.Warningf("%v", err)
+			}
+		}
+	}
+}
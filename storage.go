@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+const (
+	// ChunkStorageAuto detects if the chunk directory is on a tmpfs
+	ChunkStorageAuto = "auto"
+	// ChunkStorageTmpfs declares the chunk directory to be in memory
+	ChunkStorageTmpfs = "tmpfs"
+	// ChunkStorageDisk declares the chunk directory to be on a persistent
+	// disk
+	ChunkStorageDisk = "disk"
+)
+
+// tmpfsMaxSizeFraction is the fraction of a tmpfs the chunk directory may
+// fill, if its maximum size is not set
+const tmpfsMaxSizeFraction = 0.5
+
+var chunkStorage = ChunkStorageDisk
+
+// SetChunkStorage sets the medium of the chunk directory, auto detects a
+// tmpfs. On a persistent disk --chunk-fsync makes the chunks durable. On a
+// tmpfs chunks are never synced, because they don't survive a reboot
+// anyway, and without a maximum size the chunk directory fills at most half
+// of the tmpfs, so that its chunks don't take all memory. Chunks are still
+// renamed into place, so that a read never sees a partially written chunk.
+func SetChunkStorage(medium string) error {
+	switch medium {
+	case ChunkStorageAuto:
+		medium = ChunkStorageDisk
+		if isTmpfs(chunkPath) {
+			medium = ChunkStorageTmpfs
+		}
+	case ChunkStorageTmpfs, ChunkStorageDisk:
+	default:
+		return fmt.Errorf("Invalid chunk storage %v", medium)
+	}
+	chunkStorage = medium
+	if ChunkStorageTmpfs != medium {
+		return nil
+	}
+
+	Log.Infof("Chunk directory %v is on a tmpfs, chunks are not synced", chunkPath)
+	if currentChunkDirMaxSize() > 0 {
+		return nil
+	}
+	size, err := filesystemSize(chunkPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not get the size of the tmpfs of %v, the chunk directory is not limited", chunkPath)
+		return nil
+	}
+	SetChunkDirMaxSize(int64(float64(size) * tmpfsMaxSizeFraction))
+	Log.Infof("Limiting the chunk directory to %v bytes of the tmpfs", currentChunkDirMaxSize())
+	return nil
+}
+
+// syncChunks checks if written chunks are synced to disk
+func syncChunks() bool {
+	return chunkFsync && ChunkStorageTmpfs != chunkStorage
+}
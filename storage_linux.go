@@ -0,0 +1,26 @@
+package main
+
+import (
+	"syscall"
+)
+
+// tmpfsMagic is the filesystem type statfs reports for a tmpfs
+const tmpfsMagic = 0x01021994
+
+// isTmpfs checks if a path is on a tmpfs
+func isTmpfs(path string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); nil != err {
+		return false
+	}
+	return tmpfsMagic == stat.Type
+}
+
+// filesystemSize returns the total size of the filesystem of a path
+func filesystemSize(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); nil != err {
+		return 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// isTmpfs checks if a path is on a tmpfs, which only exists on linux
+func isTmpfs(path string) bool {
+	return false
+}
+
+// filesystemSize returns the total size of the filesystem of a path
+func filesystemSize(path string) (int64, error) {
+	return 0, fmt.Errorf("Could not get the filesystem size of %v on this platform", path)
+}
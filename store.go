@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// chunkStores holds the compiled in chunk store implementations. Additional
+// stores register themselves in build tag gated files.
+var chunkStores = map[string]func(dir string) ChunkStore{
+	"file": newFileStore,
+}
+var chunkStoreName = "file"
+var chunkFsync bool
+
+// ChunkStore reads and writes the cached chunks of one buffer
+type ChunkStore interface {
+	// Read reads up to size bytes of a cached chunk starting at offset
+	Read(filename string, offset, size int64) ([]byte, error)
+	// Write stores a downloaded chunk
+	Write(filename string, data []byte) error
+	// Release frees resources held for a chunk that is evicted
+	Release(filename string)
+	// Close frees all resources held by the store
+	Close() error
+}
+
+// ChunkReaderInto is implemented by chunk stores that can read a cached
+// chunk into a buffer of the caller instead of allocating one
+type ChunkReaderInto interface {
+	// ReadInto reads up to len(p) bytes of a cached chunk starting at offset
+	ReadInto(filename string, p []byte, offset int64) (int, error)
+}
+
+// ChunkReaderShared is implemented by chunk stores that can lend the
+// caller their own memory of a cached chunk instead of copying it
+type ChunkReaderShared interface {
+	// ReadShared reads up to size bytes of a cached chunk starting at
+	// offset. The bytes stay valid until release is called.
+	ReadShared(filename string, offset, size int64) (bytes []byte, release func(), err error)
+}
+
+// readShared reads from a cached chunk, without a copy if the store
+// supports it. The release func must be called once the bytes are used.
+func readShared(store ChunkStore, filename string, offset, size int64) ([]byte, func(), error) {
+	if shared, ok := store.(ChunkReaderShared); ok {
+		return shared.ReadShared(filename, offset, size)
+	}
+	bytes, err := store.Read(filename, offset, size)
+	return bytes, func() {}, err
+}
+
+// SetChunkStore selects the chunk store implementation
+func SetChunkStore(name string) error {
+	if _, exists := chunkStores[name]; !exists {
+		return fmt.Errorf("Chunk store %v is not compiled in", name)
+	}
+	chunkStoreName = name
+	return nil
+}
+
+// SetChunkFsync enables syncing chunk files and their directory to disk
+// after every write
+func SetChunkFsync(enabled bool) {
+	chunkFsync = enabled
+}
+
+// newChunkStore creates a chunk store of the selected implementation
+func newChunkStore(dir string) ChunkStore {
+	return chunkStores[chunkStoreName](dir)
+}
+
+// fileStore stores each chunk in a plain file. Open chunk files are shared
+// with all buffers through the chunk file pool, so that sequential playback
+// of a cached file doesn't need to open the chunk on every read.
+type fileStore struct {
+	dir string
+}
+
+// newFileStore creates a plain file chunk store
+func newFileStore(dir string) ChunkStore {
+	return &fileStore{
+		dir: dir,
+	}
+}
+
+// Read reads from a cached chunk file
+func (s *fileStore) Read(filename string, offset, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := s.ReadInto(filename, buf, offset)
+	if nil != err {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// ReadInto reads from a cached chunk file into p
+func (s *fileStore) ReadInto(filename string, p []byte, offset int64) (int, error) {
+	file, err := chunkFiles.borrow(filename)
+	if nil != err {
+		return 0, err
+	}
+	defer chunkFiles.giveBack(file)
+
+	var n int
+	err = retryFS(func() (err error) {
+		n, err = file.file.ReadAt(p, offset)
+		return err
+	})
+	// the last chunk of an object is shorter than the chunk size, reading
+	// past its end returns the tail together with io.EOF
+	if io.EOF == err && n > 0 {
+		err = nil
+	}
+	if nil != err {
+		return 0, err
+	}
+	if 0 == n {
+		return 0, fmt.Errorf("Chunk %v is empty at offset %v", filename, offset)
+	}
+	return n, nil
+}
+
+// Write writes the chunk to a temporary file and renames it afterwards,
+// so that an existing chunk file is never truncated while it is read and
+// a chunk file never contains partially written data. An interrupted write
+// starts over with a new temporary file.
+func (s *fileStore) Write(filename string, data []byte) error {
+	defer lockChunkDir(false)()
+
+	return retryFS(func() error {
+		return s.write(filename, data)
+	})
+}
+
+// write writes the chunk once
+func (s *fileStore) write(filename string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0777); nil != err {
+		return err
+	}
+
+	f, err := ioutil.TempFile(s.dir, filepath.Base(filename)+"-")
+	if nil != err {
+		return err
+	}
+
+	if _, err := f.Write(data); nil != err {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if syncChunks() {
+		if err := f.Sync(); nil != err {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+	}
+	if err := f.Close(); nil != err {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), filename); nil != err {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if syncChunks() {
+		return syncDir(s.dir)
+	}
+	return nil
+}
+
+// syncDir syncs a directory to disk, so that a rename within it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if nil != err {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Release closes the pooled file handle of the chunk
+func (s *fileStore) Release(filename string) {
+	chunkFiles.release(filename)
+}
+
+// Close closes the pooled file handles of all chunks of the store
+func (s *fileStore) Close() error {
+	chunkFiles.releaseDir(s.dir)
+	return nil
+}
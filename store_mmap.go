@@ -0,0 +1,203 @@
+//go:build mmap && (linux || darwin)
+// +build mmap
+// +build linux darwin
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	chunkStores["mmap"] = newMmapStore
+}
+
+// mmapStore serves cached chunks from read only memory mappings. Shared
+// reads return slices of the mappings and hold a reference, a mapping is
+// unmapped once its chunk was released, e.g. because its file is evicted,
+// and the last reference is gone. Writes are plain files.
+type mmapStore struct {
+	*fileStore
+	lock     sync.Mutex
+	mappings map[string]*mapping
+}
+
+// mapping is the memory mapping of a chunk file with its references
+type mapping struct {
+	data     []byte
+	refs     int
+	released bool
+}
+
+// newMmapStore creates a memory mapped chunk store
+func newMmapStore(dir string) ChunkStore {
+	return &mmapStore{
+		fileStore: &fileStore{
+			dir: dir,
+		},
+		mappings: make(map[string]*mapping),
+	}
+}
+
+// Read copies a range of the mapping of a cached chunk, callers of Read may
+// keep the bytes
+func (s *mmapStore) Read(filename string, offset, size int64) ([]byte, error) {
+	data, release, err := s.ReadShared(filename, offset, size)
+	if nil != err {
+		return nil, err
+	}
+	defer release()
+	return append(make([]byte, 0, len(data)), data...), nil
+}
+
+// ReadShared returns a range of the mapping of a cached chunk, it stays
+// mapped until release is called
+func (s *mmapStore) ReadShared(filename string, offset, size int64) ([]byte, func(), error) {
+	m, err := s.acquire(filename, offset)
+	if nil != err {
+		return nil, nil, err
+	}
+	end := int64(math.Min(float64(offset+size), float64(len(m.data))))
+	var once sync.Once
+	return m.data[offset:end], func() { once.Do(func() { s.unref(filename, m) }) }, nil
+}
+
+// ReadInto copies from the mapping of a cached chunk into p
+func (s *mmapStore) ReadInto(filename string, p []byte, offset int64) (int, error) {
+	m, err := s.acquire(filename, offset)
+	if nil != err {
+		return 0, err
+	}
+	defer s.unref(filename, m)
+	return copy(p, m.data[offset:]), nil
+}
+
+// Write replaces a chunk file, the mapping of the old file is dropped
+func (s *mmapStore) Write(filename string, data []byte) error {
+	s.Release(filename)
+	return s.fileStore.Write(filename, data)
+}
+
+// Release drops the mapping of a chunk, e.g. before its file is evicted. It
+// is unmapped once no read holds it anymore.
+func (s *mmapStore) Release(filename string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, exists := s.mappings[filename]
+	if !exists {
+		return
+	}
+	delete(s.mappings, filename)
+	m.released = true
+	if 0 == m.refs {
+		unmap(filename, m)
+	}
+}
+
+// Close drops all mappings, they are unmapped once no read holds them
+// anymore
+func (s *mmapStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for filename, m := range s.mappings {
+		m.released = true
+		if 0 == m.refs {
+			unmap(filename, m)
+		}
+	}
+	s.mappings = nil
+	return nil
+}
+
+// acquire returns the mapping of a chunk file holding the given offset
+// with a reference
+func (s *mmapStore) acquire(filename string, offset int64) (*mapping, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, err := s.mmap(filename)
+	if nil != err {
+		return nil, err
+	}
+	if offset >= int64(len(m.data)) {
+		return nil, fmt.Errorf("Chunk %v is empty at offset %v", filename, offset)
+	}
+	m.refs++
+	return m, nil
+}
+
+// unref drops a reference of a mapping, the last reference of a released
+// mapping unmaps it
+func (s *mmapStore) unref(filename string, m *mapping) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m.refs--
+	if m.released && 0 == m.refs {
+		unmap(filename, m)
+	}
+}
+
+// unmap unmaps the mapping of a chunk, the lock must be held
+func unmap(filename string, m *mapping) {
+	if err := unix.Munmap(m.data); nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not unmap chunk %v", filename)
+	}
+	m.data = nil
+}
+
+// mmap returns the mapping of a chunk file, mapping it if necessary. The
+// lock must be held.
+func (s *mmapStore) mmap(filename string) (*mapping, error) {
+	if nil == s.mappings {
+		return nil, fmt.Errorf("Chunk store for %v is already closed", s.dir)
+	}
+	if m, exists := s.mappings[filename]; exists {
+		return m, nil
+	}
+
+	var f *os.File
+	err := retryFS(func() (err error) {
+		f, err = os.Open(filename)
+		return err
+	})
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if nil != err {
+		return nil, err
+	}
+	if 0 == info.Size() {
+		return nil, fmt.Errorf("Could not map empty chunk %v", filename)
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if nil != err {
+		return nil, err
+	}
+	m := &mapping{data: data}
+	s.mappings[filename] = m
+
+	// update the last modified time for files that are often in use, the
+	// chunk index tracks the accesses itself
+	if !evictionIndexed() {
+		if err := os.Chtimes(filename, time.Now(), time.Now()); nil != err {
+			Log.Warningf("Could not update last modified time for %v", filename)
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,93 @@
+//go:build mmap && (linux || darwin)
+// +build mmap
+// +build linux darwin
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestMmapStore creates a memory mapped store with one chunk file and
+// returns the function removing it
+func newTestMmapStore(t testing.TB, content []byte) (*mmapStore, string, func()) {
+	dir, err := ioutil.TempDir("", "plexdrive-mmap")
+	if nil != err {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, chunkName(0, int64(len(content)), 0))
+	if err := ioutil.WriteFile(filename, content, 0644); nil != err {
+		t.Fatal(err)
+	}
+	store := newMmapStore(dir).(*mmapStore)
+	return store, filename, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMmapSharedReadOutlivesRelease(t *testing.T) {
+	content := testContent(testChunkSize)
+	store, filename, cleanup := newTestMmapStore(t, content)
+	defer cleanup()
+
+	data, release, err := store.ReadShared(filename, 100, 1000)
+	if nil != err {
+		t.Fatal(err)
+	}
+	m := store.mappings[filename]
+
+	// the chunk is evicted while the read still uses its mapping
+	store.Release(filename)
+	if nil == m.data {
+		t.Fatalf("released chunk was unmapped while a read holds it")
+	}
+	if !bytes.Equal(content[100:1100], data) {
+		t.Fatalf("shared read doesn't match the chunk")
+	}
+
+	release()
+	if nil != m.data {
+		t.Fatalf("released chunk is still mapped after its last read")
+	}
+	release()
+	if 0 != m.refs {
+		t.Fatalf("a repeated release dropped %v references", -m.refs)
+	}
+}
+
+func TestMmapReadCopies(t *testing.T) {
+	content := testContent(testChunkSize)
+	store, filename, cleanup := newTestMmapStore(t, content)
+	defer cleanup()
+
+	data, err := store.Read(filename, 0, testChunkSize)
+	if nil != err {
+		t.Fatal(err)
+	}
+	store.Release(filename)
+	if !bytes.Equal(content, data) {
+		t.Fatalf("read doesn't match the chunk after it was unmapped")
+	}
+}
+
+func BenchmarkReadInto(b *testing.B) {
+	content := testContent(10 * 1024 * 1024)
+	store, filename, cleanup := newTestMmapStore(b, content)
+	defer cleanup()
+
+	p := make([]byte, 128*1024)
+	b.SetBytes(int64(len(p)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		offset := int64(n*len(p)) % int64(len(content))
+		if _, err := store.ReadInto(filename, p, offset); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// sparseOffset is the offset parseChunkName returns for the files of the
+// sparse chunk store, which hold all chunks of an object
+const sparseOffset = -1
+
+func init() {
+	chunkStores["sparse"] = newSparseStore
+}
+
+// SetChunkSparse stores all chunks of an object in one sparse file instead
+// of one file per chunk
+func SetChunkSparse(enabled bool) {
+	if !enabled {
+		return
+	}
+	if "file" != chunkStoreName {
+		Log.Warningf("Sparse chunk files replace the %v chunk store", chunkStoreName)
+	}
+	SetChunkStore("sparse")
+}
+
+// sparseStore writes the chunks of an object at their offsets into one
+// sparse file per generation. The offsets of the chunks in the file are
+// appended to a map file next to it, so that holes are never served.
+//
+// Chunks can only be evicted per object, evicting a single chunk drops it
+// from the map but keeps its space allocated till the object is evicted.
+type sparseStore struct {
+	dir   string
+	lock  sync.Mutex
+	files map[string]*sparseFile
+}
+
+// sparseFile is an open sparse file with its chunk map
+type sparseFile struct {
+	file    *os.File
+	mapPath string
+	chunks  map[int64]int64
+}
+
+// newSparseStore creates a sparse file chunk store
+func newSparseStore(dir string) ChunkStore {
+	return &sparseStore{
+		dir:   dir,
+		files: make(map[string]*sparseFile),
+	}
+}
+
+// sparseName builds the file name of the sparse file of a generation
+func sparseName(generation, size int64) string {
+	return fmt.Sprintf("%v_%v_sparse", generation, size)
+}
+
+// sparseMapName builds the file name of the chunk map of a sparse file
+func sparseMapName(name string) string {
+	return name + ".map"
+}
+
+// Read reads from the chunk in the sparse file
+func (s *sparseStore) Read(filename string, offset, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := s.ReadInto(filename, buf, offset)
+	if nil != err {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// ReadInto reads from the chunk in the sparse file into p
+func (s *sparseStore) ReadInto(filename string, p []byte, offset int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, chunkOffset, err := s.open(filename, false)
+	if nil != err {
+		return 0, err
+	}
+
+	length, exists := file.chunks[chunkOffset]
+	if !exists || offset >= length {
+		return 0, fmt.Errorf("Chunk %v is not cached", filename)
+	}
+
+	if remaining := length - offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	var n int
+	err = retryFS(func() (err error) {
+		n, err = file.file.ReadAt(p, chunkOffset+offset)
+		if nil != err && n == len(p) {
+			err = nil
+		}
+		return err
+	})
+	if nil != err && n < len(p) {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Write writes the chunk at its offset into the sparse file and adds it to
+// the chunk map afterwards
+func (s *sparseStore) Write(filename string, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, chunkOffset, err := s.open(filename, true)
+	if nil != err {
+		return err
+	}
+
+	if err := retryFS(func() error {
+		_, err := file.file.WriteAt(data, chunkOffset)
+		return err
+	}); nil != err {
+		return err
+	}
+	if syncChunks() {
+		if err := file.file.Sync(); nil != err {
+			return err
+		}
+	}
+
+	if err := appendSparseMap(file.mapPath, fmt.Sprintf("%v %v", chunkOffset, len(data))); nil != err {
+		return err
+	}
+	file.chunks[chunkOffset] = int64(len(data))
+	return nil
+}
+
+// Release drops an evicted chunk from the chunk map, evicting the sparse
+// file or its map closes the sparse file
+func (s *sparseStore) Release(filename string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, _, offset, ok := parseChunkName(filepath.Base(filename))
+	if !ok {
+		return
+	}
+
+	if sparseOffset == offset {
+		name := strings.TrimSuffix(filepath.Base(filename), ".map")
+		if file, exists := s.files[name]; exists {
+			file.file.Close()
+			delete(s.files, name)
+		}
+		return
+	}
+
+	file, chunkOffset, err := s.open(filename, false)
+	if nil != err {
+		return
+	}
+	if _, exists := file.chunks[chunkOffset]; exists {
+		delete(file.chunks, chunkOffset)
+		if err := appendSparseMap(file.mapPath, fmt.Sprintf("-%v", chunkOffset)); nil != err {
+			Log.Debugf("%v", err)
+		}
+	}
+}
+
+// Close closes all sparse files
+func (s *sparseStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, file := range s.files {
+		if err := file.file.Close(); nil != err {
+			Log.Debugf("%v", err)
+		}
+		delete(s.files, name)
+	}
+	return nil
+}
+
+// open returns the sparse file of a chunk and the offset of the chunk, the
+// lock must be held
+func (s *sparseStore) open(filename string, create bool) (*sparseFile, int64, error) {
+	generation, size, chunkOffset, ok := parseChunkName(filepath.Base(filename))
+	if !ok || sparseOffset == chunkOffset {
+		return nil, 0, fmt.Errorf("Invalid chunk name %v", filename)
+	}
+
+	name := sparseName(generation, size)
+	if file, exists := s.files[name]; exists {
+		return file, chunkOffset, nil
+	}
+
+	path := filepath.Join(s.dir, name)
+	flags := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(s.dir, 0777); nil != err {
+			return nil, 0, err
+		}
+		flags |= os.O_CREATE
+	}
+	var f *os.File
+	err := retryFS(func() (err error) {
+		f, err = os.OpenFile(path, flags, 0666)
+		return err
+	})
+	if nil != err {
+		return nil, 0, err
+	}
+
+	mapPath := filepath.Join(s.dir, sparseMapName(name))
+	chunks, err := readSparseMap(mapPath)
+	if nil != err && !os.IsNotExist(err) {
+		f.Close()
+		return nil, 0, err
+	}
+
+	file := &sparseFile{
+		file:    f,
+		mapPath: mapPath,
+		chunks:  chunks,
+	}
+	s.files[name] = file
+	return file, chunkOffset, nil
+}
+
+// readSparseMap reads the offsets and lengths of the chunks in a sparse
+// file from its map file. Each line of the map adds a chunk as
+// "offset length" or removes it as "-offset".
+func readSparseMap(path string) (map[int64]int64, error) {
+	chunks := make(map[int64]int64)
+
+	f, err := os.Open(path)
+	if nil != err {
+		return chunks, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if 1 == len(fields) && strings.HasPrefix(fields[0], "-") {
+			if offset, err := strconv.ParseInt(fields[0][1:], 10, 64); nil == err {
+				delete(chunks, offset)
+			}
+			continue
+		}
+		if 2 != len(fields) {
+			continue
+		}
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if nil != err {
+			continue
+		}
+		length, err := strconv.ParseInt(fields[1], 10, 64)
+		if nil != err {
+			continue
+		}
+		chunks[offset] = length
+	}
+	return chunks, scanner.Err()
+}
+
+// appendSparseMap appends a line to a chunk map
+func appendSparseMap(path, line string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if nil != err {
+		return err
+	}
+	if _, err := f.WriteString(line + "\n"); nil != err {
+		f.Close()
+		return err
+	}
+	if syncChunks() {
+		if err := f.Sync(); nil != err {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
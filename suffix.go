@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// ReadTail reads the last n bytes of the object. If the size of the object
+// is not known, e.g. for an export that was not done yet, they are
+// requested with a suffix range (bytes=-n) and the size of the buffer is
+// taken from the total of the content range. Such a tail is not cached.
+func (b *Buffer) ReadTail(n int64) ([]byte, error) {
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	if size := int64(b.object.Size); size > 0 {
+		start := size - n
+		if start < 0 {
+			start = 0
+		}
+		return b.ReadBytes(start, size-start, ReadForeground)
+	}
+
+	if isOffline() {
+		return nil, &OfflineError{ObjectID: b.object.ObjectID, Offset: -n}
+	}
+	if quotaExceeded() {
+		return nil, &QuotaExceededError{ObjectID: b.object.ObjectID, Offset: -n}
+	}
+	if err := b.acquireDownload(b.ctx, -n, ReadForeground); nil != err {
+		return nil, err
+	}
+	bytes, total, err := b.downloadSuffix(n)
+	b.releaseDownload()
+	updateOffline(err)
+	if nil != err {
+		return nil, err
+	}
+	accountDownload(int64(len(bytes)))
+
+	b.lock.Lock()
+	if 0 == b.object.Size {
+		Log.Debugf("Got size %v of object %v from a suffix range", total, b.object.ObjectID)
+		sized := *b.object
+		sized.Size = uint64(total)
+		b.object = &sized
+	}
+	b.lock.Unlock()
+	return bytes, nil
+}
+
+// downloadSuffix requests the last n bytes of the object and returns them
+// with the total size of the object
+func (b *Buffer) downloadSuffix(n int64) ([]byte, int64, error) {
+	if err := pace(b.ctx); nil != err {
+		return nil, 0, &BufferClosedError{ObjectID: b.object.ObjectID}
+	}
+
+	source := b.source()
+	urls, err := identifiedURLs(source, source.DownloadURLs())
+	if nil != err {
+		return nil, 0, err
+	}
+	url := urls[0]
+	if nil != urlRewriter {
+		url = urlRewriter(source, url)
+	}
+	requestID := newRequestID()
+	Log.Debugf("Requesting the last %v bytes of object %v from API (request %v)", n, b.object.ObjectID, requestID)
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		return nil, 0, err
+	}
+	req.Header.Add("X-Request-Id", requestID)
+	addScanConfirmation(b.object.ObjectID, req)
+	addDownloadHeaders(req)
+	req.Header.Add("Range", fmt.Sprintf("bytes=-%v", n))
+	requestIdentity(req)
+
+	ctx, cancelRequest := context.WithCancel(b.ctx)
+	untrack := trackDownload(cancelRequest)
+	defer func() {
+		untrack()
+		cancelRequest()
+	}()
+
+	res, err := b.httpClient().Do(req.WithContext(ctx))
+	if nil != err {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if http.StatusPartialContent != res.StatusCode {
+		return nil, 0, &StatusError{ObjectID: b.object.ObjectID, StatusCode: res.StatusCode, Reason: errorReason(res.Body), RequestID: requestID}
+	}
+	contentRange := res.Header.Get("Content-Range")
+	start, end, total, err := parseContentRange(contentRange)
+	if nil != err || total < 0 || end != total-1 || end-start+1 > n || "" != contentEncoding(res) {
+		return nil, 0, &ContentRangeError{ObjectID: b.object.ObjectID, Offset: -n, ContentRange: contentRange}
+	}
+
+	expected := end - start + 1
+	bytes, err := ioutil.ReadAll(io.LimitReader(res.Body, expected))
+	if int64(len(bytes)) != expected {
+		if nil != err {
+			Log.Debugf("%v", err)
+		}
+		return nil, 0, &ShortBodyError{ObjectID: b.object.ObjectID, Offset: start, Received: int64(len(bytes)), Expected: expected}
+	}
+	return bytes, total, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveSuffix answers suffix ranges (bytes=-n) of the content only, like an
+// endpoint that is asked for the tail of an object of unknown size
+func serveSuffix(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		suffix := strings.TrimPrefix(r.Header.Get("Range"), "bytes=-")
+		n, err := strconv.Atoi(suffix)
+		if nil != err || n <= 0 {
+			http.Error(w, "suffix ranges only", http.StatusBadRequest)
+			return
+		}
+		if n > len(content) {
+			n = len(content)
+		}
+		start := len(content) - n
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, len(content)-1, len(content)))
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start:])
+	}
+}
+
+func TestReadTailOfUnknownSize(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(3*testChunkSize + 17)
+	server := newTestServer(0, serveSuffix(content))
+	defer server.Close()
+
+	object := server.object("tail")
+	object.Size = 0
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	tail, err := buffer.ReadTail(1000)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[len(content)-1000:], tail) {
+		t.Fatalf("read a tail of %v bytes that doesn't match the content", len(tail))
+	}
+	if uint64(len(content)) != buffer.object.Size {
+		t.Fatalf("took size %v from the content range instead of %v", buffer.object.Size, len(content))
+	}
+}
+
+func TestReadTailLongerThanObject(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(500)
+	server := newTestServer(0, serveSuffix(content))
+	defer server.Close()
+
+	object := server.object("short")
+	object.Size = 0
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	tail, err := buffer.ReadTail(1000)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, tail) {
+		t.Fatalf("read a tail of %v bytes instead of the whole object", len(tail))
+	}
+	if 500 != buffer.object.Size {
+		t.Fatalf("took size %v from the content range instead of 500", buffer.object.Size)
+	}
+}
+
+func TestReadTailRejectsWrongContentRange(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	content := testContent(5000)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		// a range that doesn't end at the end of the object
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-999/%v", len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[:1000])
+	})
+	defer server.Close()
+
+	object := server.object("wrong")
+	object.Size = 0
+	buffer := openTestBuffer(t, object)
+	defer buffer.Close()
+
+	if _, err := buffer.ReadTail(1000); nil == err {
+		t.Fatalf("accepted a content range that isn't the tail")
+	} else if _, ok := err.(*ContentRangeError); !ok {
+		t.Fatalf("failed with %v instead of a content range error", err)
+	}
+	if 0 != buffer.object.Size {
+		t.Fatalf("took size %v from a wrong content range", buffer.object.Size)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// tailPinDuration is the time the prefetched tail of an opened object is
+// only evicted if no other chunk is left
+const tailPinDuration = 10 * time.Minute
+
+var tailCacheSize int64
+
+// tailPins holds the start of the pinned tail of every opened object and
+// the time the pin ends
+var tailPins = struct {
+	lock    sync.Mutex
+	objects map[string]tailPin
+}{
+	objects: make(map[string]tailPin),
+}
+
+// tailPin is the pinned tail of an object
+type tailPin struct {
+	start int64
+	until time.Time
+}
+
+// SetTailCacheSize sets the number of bytes at the end of every opened
+// object that are downloaded right away (0 = disabled). Players of formats
+// with an index at the end, like MP4 with a trailing moov atom or MKV
+// cues, seek to the end of a file first.
+func SetTailCacheSize(size int64) {
+	tailCacheSize = size
+}
+
+// prefetchTail downloads the tail of a newly opened object and pins it
+// against eviction for a while
+func (b *Buffer) prefetchTail() {
+	if tailCacheSize <= 0 {
+		return
+	}
+	start := int64(b.object.Size) - tailCacheSize
+	if start < 0 {
+		start = 0
+	}
+
+	tailPins.lock.Lock()
+	tailPins.objects[b.object.ObjectID] = tailPin{
+		start: start - start%b.chunkSize,
+		until: time.Now().Add(tailPinDuration),
+	}
+	tailPins.lock.Unlock()
+
+	b.Prefetch(start, tailCacheSize)
+}
+
+// isTailChunk checks if the chunk stored under the given path holds bytes
+// of the pinned tail of its object
+func isTailChunk(path string) bool {
+	if tailCacheSize <= 0 {
+		return false
+	}
+	objectID, _, _, offset, ok := parseChunkPath(path)
+	if !ok || sparseOffset == offset {
+		return false
+	}
+
+	tailPins.lock.Lock()
+	defer tailPins.lock.Unlock()
+
+	pin, pinned := tailPins.objects[objectID]
+	if pinned && time.Now().After(pin.until) {
+		delete(tailPins.objects, objectID)
+		return false
+	}
+	return pinned && offset >= pin.start
+}
+
+// UnpinTail releases the pinned tail of an object, its chunks are evicted
+// like all others from now on
+func UnpinTail(objectID string) {
+	tailPins.lock.Lock()
+	defer tailPins.lock.Unlock()
+
+	delete(tailPins.objects, objectID)
+}
+
+// releaseOldestTailPin releases the tail pin that ends first and reports if
+// there was one
+func releaseOldestTailPin() bool {
+	tailPins.lock.Lock()
+	defer tailPins.lock.Unlock()
+
+	oldest := ""
+	for objectID, pin := range tailPins.objects {
+		if "" == oldest || pin.until.Before(tailPins.objects[oldest].until) {
+			oldest = objectID
+		}
+	}
+	if "" == oldest {
+		return false
+	}
+	Log.Debugf("Releasing the pinned tail of object %v", oldest)
+	delete(tailPins.objects, oldest)
+	return true
+}
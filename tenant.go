@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// clientTenants holds the hashed salts of the clients of other tenants,
+// e.g. of the accounts that shared objects with the mount
+var clientTenants = struct {
+	lock  sync.Mutex
+	salts map[*http.Client]string
+}{
+	salts: make(map[*http.Client]string),
+}
+
+// CacheSaltSuffix returns the suffix of the chunk directory and the chunk
+// index of a tenant ("" = no salt). Instances of different Google Drive
+// accounts in the same --temp directory cache their chunks in separate
+// directories, so that equal object ids never share chunks and cleaning
+// or purging one tenant leaves the chunks of the others alone. The salt is
+// hashed, so that it can't escape the temp directory.
+func CacheSaltSuffix(salt string) string {
+	if "" == salt {
+		return ""
+	}
+	sum := sha1.Sum([]byte(salt))
+	return "-" + hex.EncodeToString(sum[:8])
+}
+
+// SetClientTenant caches the objects downloaded with a client for the tenant
+// of the salt ("" = the tenant of the mount). Objects with the same id
+// downloaded for different tenants never serve the chunks of each other, a
+// buffer of another tenant drops the chunks of the object and caches it
+// again.
+func SetClientTenant(client *http.Client, salt string) {
+	clientTenants.lock.Lock()
+	defer clientTenants.lock.Unlock()
+
+	if "" == salt {
+		delete(clientTenants.salts, client)
+		return
+	}
+	clientTenants.salts[client] = CacheSaltSuffix(salt)
+}
+
+// clientTenant returns the hashed salt of the tenant of a client, "" for
+// the tenant of the mount
+func clientTenant(client *http.Client) string {
+	clientTenants.lock.Lock()
+	defer clientTenants.lock.Unlock()
+
+	return clientTenants.salts[client]
+}
+
+// claimTenant makes the cached chunks of an object belong to the tenant a
+// new buffer downloads for, the chunks of another tenant are dropped
+func claimTenant(objectID, tenant string) {
+	if !chunks.claimTenant(objectID, tenant) {
+		return
+	}
+	smallObjects.remove(objectID)
+	dropHotObject(objectID)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCacheSaltSuffix(t *testing.T) {
+	if "" != CacheSaltSuffix("") {
+		t.Fatalf("got suffix %v without a salt", CacheSaltSuffix(""))
+	}
+	family, work := CacheSaltSuffix("family"), CacheSaltSuffix("work")
+	if family == work || family != CacheSaltSuffix("family") {
+		t.Fatalf("got suffixes %v and %v for different salts", family, work)
+	}
+	if escaped := CacheSaltSuffix("../../etc"); strings.ContainsAny(escaped, "/.") {
+		t.Fatalf("suffix %v escapes the temp directory", escaped)
+	}
+}
+
+func TestTenantsDontShareChunks(t *testing.T) {
+	_, cleanup := setupChunkDir(t)
+	defer cleanup()
+	// two accounts have different files of the same id, size and time
+	mountServer := newTestServer(2*testChunkSize, nil)
+	defer mountServer.Close()
+	tenantServer := newTestServer(0, nil)
+	defer tenantServer.Close()
+	tenantServer.content = testContent(2*testChunkSize + 1)[1:]
+	mountClient, tenantClient := &http.Client{}, &http.Client{}
+	SetClientTenant(tenantClient, "family")
+	defer SetClientTenant(tenantClient, "")
+
+	read := func(client *http.Client, server *testServer) []byte {
+		buffer, err := GetBufferInstance(client, server.object("collision"))
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer buffer.Close()
+		return readAll(t, buffer, 10000)
+	}
+
+	if got := read(mountClient, mountServer); !bytes.Equal(mountServer.content, got) {
+		t.Fatalf("read %v bytes that don't match the content of the mount", len(got))
+	}
+	if got := read(tenantClient, tenantServer); !bytes.Equal(tenantServer.content, got) {
+		t.Fatalf("tenant read %v bytes that don't match its content", len(got))
+	}
+	if 0 == tenantServer.requestCount() {
+		t.Fatalf("tenant was served the chunks of the mount")
+	}
+
+	// the mount doesn't get the chunks of the tenant either
+	requests := mountServer.requestCount()
+	if got := read(mountClient, mountServer); !bytes.Equal(mountServer.content, got) {
+		t.Fatalf("read %v bytes that don't match the content of the mount after the tenant", len(got))
+	}
+	if mountServer.requestCount() == requests {
+		t.Fatalf("mount was served the chunks of the tenant")
+	}
+}
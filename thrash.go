@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// thrashWindow is the time evictions are counted in
+const thrashWindow = 1 * time.Minute
+
+// thrash detects a cache that is too small for the working set, i.e. that
+// evicts chunks about as fast as they are downloaded
+var thrash = struct {
+	lock        sync.Mutex
+	threshold   int
+	bypass      bool
+	windowStart time.Time
+	evictions   int
+	active      bool
+}{}
+
+// SetThrashThreshold sets the number of evicted chunks per minute the cache
+// is considered thrashing at (0 = disabled). With bypass enabled, chunks
+// downloaded while thrashing are streamed without caching them, till the
+// eviction rate dropped below half the threshold.
+func SetThrashThreshold(threshold int, bypass bool) {
+	thrash.lock.Lock()
+	defer thrash.lock.Unlock()
+
+	thrash.threshold = threshold
+	thrash.bypass = bypass
+}
+
+// recordEviction counts an evicted chunk
+func recordEviction() {
+	thrash.lock.Lock()
+	defer thrash.lock.Unlock()
+
+	if thrash.threshold <= 0 {
+		return
+	}
+	updateThrash(time.Now())
+	thrash.evictions++
+	if !thrash.active && thrash.evictions >= thrash.threshold {
+		thrash.active = true
+		if thrash.bypass {
+			Log.Warningf("Evicted %v chunks within %v, the cache is too small, streaming downloads without caching them", thrash.evictions, thrashWindow)
+		} else {
+			Log.Warningf("Evicted %v chunks within %v, the cache is too small", thrash.evictions, thrashWindow)
+		}
+	}
+}
+
+// updateThrash starts a new window once the current one passed, the lock
+// must be held
+func updateThrash(now time.Time) {
+	if now.Sub(thrash.windowStart) < thrashWindow {
+		return
+	}
+	if thrash.active && (thrash.evictions < thrash.threshold/2 || now.Sub(thrash.windowStart) >= 2*thrashWindow) {
+		thrash.active = false
+		Log.Infof("Eviction rate dropped, caching downloads again")
+	}
+	thrash.windowStart = now
+	thrash.evictions = 0
+}
+
+// bypassCache checks if downloaded chunks are streamed without caching them
+func bypassCache() bool {
+	if memoryOnly() {
+		return true
+	}
+
+	thrash.lock.Lock()
+	defer thrash.lock.Unlock()
+
+	if thrash.threshold <= 0 || !thrash.bypass {
+		return false
+	}
+	updateThrash(time.Now())
+	return thrash.active
+}
+
+// streamChunk keeps the last chunk that was downloaded without caching it,
+// so that the following reads of the chunk don't download it again
+func (b *Buffer) streamChunk(generation, offset int64, bytes []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.streamed = stagedChunk{generation: generation, bytes: bytes}
+	b.streamedOffset = offset
+}
+
+// readStreamed reads from the last chunk that was downloaded without
+// caching it
+func (b *Buffer) readStreamed(generation, offset, fOffset, size int64) ([]byte, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if nil == b.streamed.bytes || b.streamedOffset != offset || b.streamed.generation != generation {
+		return nil, false
+	}
+	return b.streamed.read(fOffset, size), true
+}
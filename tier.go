@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// CacheTierStats holds the budget and usage of one cache tier
+type CacheTierStats struct {
+	Budget int64 `json:"budget"`
+	Used   int64 `json:"used"`
+}
+
+// CacheStats holds the usage of the memory and the disk cache tier
+type CacheStats struct {
+	Memory CacheTierStats `json:"memory"`
+	Disk   CacheTierStats `json:"disk"`
+}
+
+// SetCacheBudget limits the memory and the disk cache together. The memory
+// fraction of the total size goes to the small object cache in memory, the
+// rest to the chunk directory. Small objects evicted from memory spill to
+// the chunk directory, where they are evicted with the other chunks.
+// It replaces the sizes of the small object cache and the chunk directory.
+func SetCacheBudget(total int64, memoryFraction float64) error {
+	if total <= 0 {
+		return nil
+	}
+	if memoryFraction < 0 || memoryFraction >= 1 {
+		return fmt.Errorf("Invalid memory fraction %v (expected 0.0 - 1.0)", memoryFraction)
+	}
+
+	memory := int64(float64(total) * memoryFraction)
+	SetSmallObjects(smallObjectMaxSize, memory)
+	SetChunkDirMaxSize(total - memory)
+	Log.Infof("Caching up to %v bytes in memory and %v bytes on disk", memory, currentChunkDirMaxSize())
+	return nil
+}
+
+// GetCacheStats returns the current usage of the cache tiers. The usage of
+// the disk tier is only tracked if its size is limited.
+func GetCacheStats() CacheStats {
+	smallObjects.lock.Lock()
+	memory := CacheTierStats{
+		Budget: smallObjects.maxSize,
+		Used:   smallObjects.size,
+	}
+	smallObjects.lock.Unlock()
+
+	return CacheStats{
+		Memory: memory,
+		Disk: CacheTierStats{
+			Budget: currentChunkDirMaxSize(),
+			Used:   atomic.LoadInt64(&evictor.size),
+		},
+	}
+}
+
+// spillSmallObject writes a small object evicted from memory to the chunk
+// directory
+func spillSmallObject(cached *smallObject) {
+	if chunkReadOnly || !chunkWrites.shouldTry() {
+		return
+	}
+
+	chunks.setChunkSize(cached.objectID, cached.chunkSize)
+	chunks.load(cached.objectID)
+	generation := chunks.generation(cached.objectID)
+	dir := filepath.Join(chunkPath, cached.objectID)
+	store := newChunkStore(dir)
+	defer store.Close()
+
+	Log.Debugf("Spilling small object %v to the chunk directory", cached.objectID)
+	for offset := int64(0); offset < int64(len(cached.data)); offset += cached.chunkSize {
+		if chunks.has(cached.objectID, generation, offset) {
+			continue
+		}
+		if currentChunkDirMaxSize() > 0 {
+			if err := reserveChunkSpace(cached.chunkSize); nil != err {
+				Log.Debugf("%v", err)
+				return
+			}
+		}
+
+		end := offset + cached.chunkSize
+		if end > int64(len(cached.data)) {
+			end = int64(len(cached.data))
+		}
+		filename := filepath.Join(dir, chunkName(generation, cached.chunkSize, offset))
+		if err := store.Write(filename, cached.data[offset:end]); nil != err {
+			Log.Debugf("%v", err)
+			chunkWrites.failed()
+			return
+		}
+		chunkWritten(end - offset)
+		chunks.add(cached.objectID, generation, offset, end-offset)
+	}
+}
+
+// loadSpilledObject reads a small object from the chunk directory, if all
+// of its chunks are cached
+func loadSpilledObject(object *APIObject) ([]byte, bool) {
+	objectChunk := objectChunkSize(object)
+	chunks.setChunkSize(object.ObjectID, objectChunk)
+	chunks.load(object.ObjectID)
+	generation := chunks.generation(object.ObjectID)
+	size := int64(object.Size)
+	for offset := int64(0); offset < size; offset += objectChunk {
+		if !chunks.has(object.ObjectID, generation, offset) {
+			return nil, false
+		}
+	}
+
+	dir := filepath.Join(chunkPath, object.ObjectID)
+	store := newChunkStore(dir)
+	defer store.Close()
+
+	data := make([]byte, 0, size)
+	for offset := int64(0); offset < size; offset += objectChunk {
+		length := objectChunk
+		if remaining := size - offset; remaining < length {
+			length = remaining
+		}
+		filename := filepath.Join(dir, chunkName(generation, objectChunk, offset))
+		info, cached := chunks.info(filename)
+		if !cached {
+			return nil, false
+		}
+		bytes, err := readChunkFile(store, filename, length, info.Compressed)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, false
+		}
+		chunks.touch(object.ObjectID, generation, offset)
+		data = append(data, bytes...)
+	}
+	if int64(len(data)) != size {
+		return nil, false
+	}
+	return data, true
+}
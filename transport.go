@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// downloadTransport is the transport of the download client, nil uses the
+// default transport
+var downloadTransport http.RoundTripper
+
+// transportConfig holds the settings the download transport is built from
+var transportConfig = struct {
+	readBuffer int
+	proxy      *url.URL
+	plain      bool
+	rootCAs    *x509.CertPool
+}{}
+
+// SetReadBufferSize sets the socket receive buffer of download connections
+// (0 = the default of the OS). The TCP window can only grow up to it, so a
+// larger buffer raises the throughput of one connection on links with a
+// high latency. The OS caps the size, e.g. Linux at net.core.rmem_max, and
+// setting it disables the automatic tuning of the buffer on Linux. The
+// connections use HTTP/1.1, so that every download has its own window.
+func SetReadBufferSize(size int) {
+	transportConfig.readBuffer = size
+	buildDownloadTransport()
+}
+
+// SetCacheProxy sends the download requests through a caching forward
+// proxy, e.g. squid, so that several instances or repeated plays are served
+// from the cache of the proxy ("" = the proxy of the environment). HTTPS is
+// tunneled with CONNECT, which the proxy can't cache. A proxy re-signing
+// TLS needs its CA certificate in caFile. With plain the GET requests are
+// sent as HTTP to the proxy, which has to forward them as HTTPS.
+func SetCacheProxy(proxy string, plain bool, caFile string) error {
+	if "" != proxy {
+		proxyURL, err := url.Parse(proxy)
+		if nil != err || "" == proxyURL.Scheme || "" == proxyURL.Host {
+			return fmt.Errorf("Invalid cache proxy %v", proxy)
+		}
+		transportConfig.proxy = proxyURL
+	}
+	if plain && nil == transportConfig.proxy {
+		return fmt.Errorf("Plain requests need a cache proxy")
+	}
+	transportConfig.plain = plain
+
+	if "" != caFile {
+		pem, err := ioutil.ReadFile(caFile)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return fmt.Errorf("Could not read the CA certificate %v of the cache proxy", caFile)
+		}
+		pool, err := x509.SystemCertPool()
+		if nil != err {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Could not parse the CA certificate %v of the cache proxy", caFile)
+		}
+		transportConfig.rootCAs = pool
+	}
+
+	buildDownloadTransport()
+	return nil
+}
+
+// buildDownloadTransport builds the download transport from the read buffer
+// and proxy settings
+func buildDownloadTransport() {
+	config := transportConfig
+	if config.readBuffer <= 0 && nil == config.proxy && nil == config.rootCAs {
+		downloadTransport = nil
+		return
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if nil != config.proxy {
+		proxy = http.ProxyURL(config.proxy)
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if nil != err || config.readBuffer <= 0 {
+				return conn, err
+			}
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				if err := tcp.SetReadBuffer(config.readBuffer); nil != err {
+					Log.Debugf("%v", err)
+					Log.Warningf("Could not set the read buffer of the connection to %v", address)
+				}
+			}
+			return conn, nil
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if nil != config.rootCAs {
+		transport.TLSClientConfig = &tls.Config{RootCAs: config.rootCAs}
+	}
+
+	downloadTransport = transport
+	if config.plain {
+		downloadTransport = &plainProxyTransport{base: transport}
+	}
+}
+
+// plainProxyTransport sends GET requests for HTTPS urls as HTTP, so that a
+// proxy forwarding them as HTTPS sees and caches the responses
+type plainProxyTransport struct {
+	base http.RoundTripper
+}
+
+func (t *plainProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if "GET" != req.Method || "https" != req.URL.Scheme {
+		return t.base.RoundTrip(req)
+	}
+
+	plain := new(http.Request)
+	*plain = *req
+	u := *req.URL
+	u.Scheme = "http"
+	plain.URL = &u
+	return t.base.RoundTrip(plain)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// benchmarkLatency is the round trip time of the simulated link
+const benchmarkLatency = 50 * time.Millisecond
+
+// BenchmarkHighLatencyDownload measures the throughput of buffer downloads
+// over a link answering every request after the round trip time, with the
+// default and a large socket read buffer. Loopback has no window limit, so
+// the gain of the read buffer only shows on a real link or with a link
+// emulated by the kernel, e.g. with tc netem delay on Linux.
+func BenchmarkHighLatencyDownload(b *testing.B) {
+	for _, readBuffer := range []int{0, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("readbuffer=%v", readBuffer), func(b *testing.B) {
+			benchmarkHighLatencyDownload(b, readBuffer)
+		})
+	}
+}
+
+func benchmarkHighLatencyDownload(b *testing.B, readBuffer int) {
+	_, cleanup := setupChunkDir(b)
+	defer cleanup()
+	SetReadBufferSize(readBuffer)
+	defer SetReadBufferSize(0)
+	content := testContent(16 * testChunkSize)
+	server := newTestServer(0, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(benchmarkLatency)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	defer server.Close()
+	client := http.DefaultClient
+	if nil != downloadTransport {
+		client = &http.Client{Transport: downloadTransport}
+	}
+
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		object := server.object(fmt.Sprintf("latency%v", n))
+		object.Size = uint64(len(content))
+		buffer, err := GetBufferInstance(client, object)
+		if nil != err {
+			b.Fatal(err)
+		}
+		readAll(b, buffer, 128*1024)
+		buffer.Close()
+	}
+}
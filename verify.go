@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var verifyMD5 bool
+
+// SetVerifyMD5 enables the md5 verification of fully cached objects
+func SetVerifyMD5(enabled bool) {
+	verifyMD5 = enabled
+}
+
+// VerifyObject checks the cached chunks of an opened object against the
+// md5 checksum reported by Google Drive
+func VerifyObject(objectID string) error {
+	instance, exists := instances.Get(objectID)
+	if !exists {
+		return fmt.Errorf("Object %v is not opened", objectID)
+	}
+	return instance.(*Buffer).Verify()
+}
+
+// IntegrityCheck returns the offsets of the chunks of an object that are
+// not cached. It only consults the chunk index and downloads nothing, an
+// object that is believed to be fully cached should return no offsets.
+func (d *Drive) IntegrityCheck(objectID string) ([]int64, error) {
+	object, err := d.GetObject(objectID)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not find object %v", objectID)
+	}
+
+	chunks.load(objectID)
+	missing, expected := chunks.missing(objectID, int64(object.Size))
+	if len(missing) > 0 {
+		Log.Debugf("Object %v has %v of %v chunks cached", objectID, expected-len(missing), expected)
+	}
+	return missing, nil
+}
+
+// Verify checks the cached chunks against the md5 checksum of the object.
+// On a mismatch the cache of the object is invalidated, so that all chunks
+// are downloaded again.
+func (b *Buffer) Verify() error {
+	if "" == b.object.MD5Checksum {
+		return fmt.Errorf("Object %v has no md5 checksum", b.object.ObjectID)
+	}
+
+	generation := b.cacheGeneration()
+	hash := md5.New()
+	for offset := int64(0); uint64(offset) < b.object.Size; offset += b.chunkSize {
+		length := int64(b.object.Size) - offset
+		if length > b.chunkSize {
+			length = b.chunkSize
+		}
+
+		filename := filepath.Join(b.tempDir, chunkName(generation, b.chunkSize, offset))
+		b.decompress(filename, generation, offset)
+		data, release, err := readShared(b.store, filename, 0, length)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return fmt.Errorf("Object %v is not fully cached", b.object.ObjectID)
+		}
+		if int64(len(data)) != length {
+			release()
+			return fmt.Errorf("Could not read chunk %v", filename)
+		}
+		hash.Write(data)
+		release()
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != b.object.MD5Checksum {
+		Log.Warningf("Cached object %v has md5 %v, expected %v, invalidating cache",
+			b.object.ObjectID, checksum, b.object.MD5Checksum)
+		if generation == chunks.generation(b.object.ObjectID) {
+			InvalidateObject(b.object.ObjectID)
+		}
+		b.renewGeneration(generation)
+		return fmt.Errorf("Checksum mismatch for object %v", b.object.ObjectID)
+	}
+
+	Log.Debugf("Verified md5 of cached object %v", b.object.ObjectID)
+	return nil
+}
+
+// cacheGeneration returns the cache generation the buffer reads and writes
+func (b *Buffer) cacheGeneration() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.generation
+}
+
+// renewGeneration moves the buffer from a corrupt generation to the current
+// generation of the object, so that its readers don't keep reading the
+// corrupt chunks but download them again
+func (b *Buffer) renewGeneration(corrupt int64) {
+	generation := chunks.pin(b.object.ObjectID)
+
+	b.lock.Lock()
+	if b.closed || corrupt != b.generation || generation == corrupt {
+		b.lock.Unlock()
+		chunks.unpin(b.object.ObjectID, generation)
+		return
+	}
+	b.generation = generation
+	b.lock.Unlock()
+
+	chunks.unpin(b.object.ObjectID, corrupt)
+	Log.Debugf("Object %v moved from generation %v to %v", b.object.ObjectID, corrupt, generation)
+}
+
+// verifyIfCached verifies the object once per generation, as soon as it
+// is fully cached
+func (b *Buffer) verifyIfCached(generation int64) {
+	if !verifyMD5 || "" == b.object.MD5Checksum || b.CachedFraction() < 1 {
+		return
+	}
+
+	b.lock.Lock()
+	verified := b.verifiedGeneration == generation
+	b.verifiedGeneration = generation
+	b.lock.Unlock()
+	if verified {
+		return
+	}
+
+	go func() {
+		if err := b.Verify(); nil != err {
+			Log.Warningf("%v", err)
+		}
+	}()
+}
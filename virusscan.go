@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxInterstitialSize is the maximum number of bytes of an HTML page
+// searched for the confirm token
+const maxInterstitialSize = 256 * 1024
+
+// interstitialPeekSize is the number of bytes at the start of an HTML
+// response that are searched for the virus scan warning, the page is small
+const interstitialPeekSize = 32 * 1024
+
+// scanConfirmationAge is the time the cookies of a virus scan warning page
+// are sent with the requests of its object
+const scanConfirmationAge = time.Hour
+
+// interstitialMarker is part of the download link on the virus scan warning
+// page, next to the confirm token
+var interstitialMarker = []byte("export=download")
+
+// confirmPattern matches the confirm token in the links of the virus scan
+// warning page of Google Drive
+var confirmPattern = regexp.MustCompile(`confirm=([0-9A-Za-z_-]+)`)
+
+// scanConfirmations keeps the cookies of the virus scan warning pages, which
+// have to be sent together with the confirm token
+var scanConfirmations = struct {
+	lock    sync.Mutex
+	cookies map[string]scanConfirmation
+}{
+	cookies: make(map[string]scanConfirmation),
+}
+
+// scanConfirmation holds the cookies of a virus scan warning page and the
+// time they were received
+type scanConfirmation struct {
+	cookies  []*http.Cookie
+	received time.Time
+}
+
+// VirusScanWarningError is returned if Google Drive answered with the page
+// warning that a large file can't be scanned for viruses instead of the
+// file content
+type VirusScanWarningError struct {
+	ObjectID string
+	Confirm  string
+}
+
+func (e *VirusScanWarningError) Error() string {
+	return fmt.Sprintf("Got virus scan warning instead of content for object %v", e.ObjectID)
+}
+
+// isInterstitial checks if a response is the virus scan warning page
+// instead of the content of the object. HTML files are served as HTML by
+// Google Drive too, so the page is recognized by its warning cookie or by
+// the confirmed download link at its start. The peeked bytes stay in the
+// body of the response.
+func isInterstitial(res *http.Response) bool {
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		return false
+	}
+	for _, cookie := range res.Cookies() {
+		if strings.HasPrefix(cookie.Name, "download_warning") {
+			return true
+		}
+	}
+
+	reader := bufio.NewReaderSize(res.Body, interstitialPeekSize)
+	res.Body = &peekedBody{Reader: reader, Closer: res.Body}
+	start, _ := reader.Peek(interstitialPeekSize)
+	return bytes.Contains(start, interstitialMarker) && confirmPattern.Match(start)
+}
+
+// peekedBody is a response body whose start was read ahead
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// readInterstitial extracts the confirm token of a virus scan warning page
+// and keeps the cookies of the page for the confirmed request
+func readInterstitial(objectID string, res *http.Response) *VirusScanWarningError {
+	warning := &VirusScanWarningError{ObjectID: objectID}
+
+	for _, cookie := range res.Cookies() {
+		if strings.HasPrefix(cookie.Name, "download_warning") && "" == warning.Confirm {
+			warning.Confirm = cookie.Value
+		}
+	}
+	if body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxInterstitialSize)); nil == err && "" == warning.Confirm {
+		if match := confirmPattern.FindSubmatch(body); nil != match {
+			warning.Confirm = string(match[1])
+		}
+	}
+
+	scanConfirmations.lock.Lock()
+	for id, confirmation := range scanConfirmations.cookies {
+		if time.Since(confirmation.received) > scanConfirmationAge {
+			delete(scanConfirmations.cookies, id)
+		}
+	}
+	scanConfirmations.cookies[objectID] = scanConfirmation{cookies: res.Cookies(), received: time.Now()}
+	scanConfirmations.lock.Unlock()
+
+	return warning
+}
+
+// addScanConfirmation adds the cookies of a virus scan warning page of the
+// object to a request
+func addScanConfirmation(objectID string, req *http.Request) {
+	scanConfirmations.lock.Lock()
+	defer scanConfirmations.lock.Unlock()
+
+	confirmation, exists := scanConfirmations.cookies[objectID]
+	if !exists {
+		return
+	}
+	if time.Since(confirmation.received) > scanConfirmationAge {
+		delete(scanConfirmations.cookies, objectID)
+		return
+	}
+	for _, cookie := range confirmation.cookies {
+		req.AddCookie(cookie)
+	}
+}
+
+// confirmURL appends the confirm token of a virus scan warning to a url
+func confirmURL(url, confirm string) string {
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	return url + separator + "confirm=" + confirm
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var warmQueue = struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	workers  int
+	started  bool
+	sequence int64
+	pending  warmHeap
+	queued   map[string]*warmRequest
+}{
+	workers: 2,
+	queued:  make(map[string]*warmRequest),
+}
+
+func init() {
+	warmQueue.cond = sync.NewCond(&warmQueue.lock)
+}
+
+// warmRequest is an object waiting to be warmed
+type warmRequest struct {
+	objectID string
+	priority int
+	sequence int64
+	index    int
+}
+
+// warmHeap orders the queued objects by priority, objects of the same
+// priority in the order they were queued
+type warmHeap []*warmRequest
+
+func (h warmHeap) Len() int {
+	return len(h)
+}
+
+func (h warmHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].sequence < h[j].sequence
+}
+
+func (h warmHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *warmHeap) Push(x interface{}) {
+	request := x.(*warmRequest)
+	request.index = len(*h)
+	*h = append(*h, request)
+}
+
+func (h *warmHeap) Pop() interface{} {
+	old := *h
+	request := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return request
+}
+
+// SetWarmWorkers sets the number of objects that are warmed at the same
+// time by WarmWithPriority. It has to be set before the first object is
+// queued.
+func SetWarmWorkers(workers int) {
+	warmQueue.lock.Lock()
+	defer warmQueue.lock.Unlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+	warmQueue.workers = workers
+}
+
+// WarmWithPriority queues an object to be downloaded into the cache. Queued
+// objects are warmed highest priority first, so a higher priority request
+// overtakes the queued ones of lower priority, but not the objects being
+// warmed. Queuing an object again updates its priority. The downloads use
+// the global download slots like all other reads.
+func (d *Drive) WarmWithPriority(objectID string, priority int) {
+	warmQueue.lock.Lock()
+	defer warmQueue.lock.Unlock()
+
+	if !warmQueue.started {
+		warmQueue.started = true
+		for i := 0; i < warmQueue.workers; i++ {
+			go d.warmWorker()
+		}
+	}
+
+	if request, exists := warmQueue.queued[objectID]; exists {
+		request.priority = priority
+		heap.Fix(&warmQueue.pending, request.index)
+		return
+	}
+
+	warmQueue.sequence++
+	request := &warmRequest{objectID: objectID, priority: priority, sequence: warmQueue.sequence}
+	warmQueue.queued[objectID] = request
+	heap.Push(&warmQueue.pending, request)
+	warmQueue.cond.Signal()
+}
+
+// warmWorker warms the queued objects one after another
+func (d *Drive) warmWorker() {
+	for {
+		warmQueue.lock.Lock()
+		for 0 == warmQueue.pending.Len() {
+			warmQueue.cond.Wait()
+		}
+		request := heap.Pop(&warmQueue.pending).(*warmRequest)
+		delete(warmQueue.queued, request.objectID)
+		warmQueue.lock.Unlock()
+
+		if err := d.warmObject(request.objectID); nil != err {
+			Log.Warningf("%v", err)
+		}
+	}
+}
+
+// warmObject downloads all chunks of an object that are not cached
+func (d *Drive) warmObject(objectID string) error {
+	object, err := d.GetObject(objectID)
+	if nil != err {
+		return err
+	}
+	if object.IsDir || chunkReadOnly {
+		return nil
+	}
+
+	buffer, err := d.Open(object)
+	if nil != err {
+		return err
+	}
+	defer buffer.Close()
+
+	Log.Debugf("Warming object %v", objectID)
+	buffer.warm(0, int64(object.Size))
+	return nil
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/net/webdav"
+)
+
+// ServeWebDAV serves the files read-only over WebDAV on the given address,
+// e.g. for devices that can't mount the drive. Reads go through the chunk
+// cache like reads of the mount. An address without host listens on the
+// loopback interface only. Requests have to authenticate with the user and
+// password of auth (user:password, "" = no authentication).
+func ServeWebDAV(address, auth string, drive *Drive) error {
+	host, port, err := net.SplitHostPort(address)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Invalid WebDAV address %v", address)
+	}
+	if "" == host {
+		address = net.JoinHostPort("127.0.0.1", port)
+	}
+	var user, password string
+	if "" != auth {
+		credentials := strings.SplitN(auth, ":", 2)
+		if 2 != len(credentials) || "" == credentials[0] {
+			return fmt.Errorf("Invalid WebDAV authentication, expected user:password")
+		}
+		user, password = credentials[0], credentials[1]
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not listen for WebDAV on %v", address)
+	}
+	Log.Infof("Serving WebDAV on %v", listener.Addr())
+	if ip := net.ParseIP(host); "" == auth && "" != host && (nil == ip || !ip.IsLoopback()) {
+		Log.Warningf("WebDAV on %v is not authenticated, everyone who can reach it can read all files", listener.Addr())
+	}
+
+	handler := &webdav.Handler{
+		FileSystem: &davFS{drive: drive},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if nil != err {
+				Log.Debugf("WebDAV %v %v: %v", r.Method, safeName(r.URL.Path), err)
+			}
+		},
+	}
+	go func() {
+		var served http.Handler = davReadOnly(handler)
+		if "" != auth {
+			served = davAuthenticated(served, user, password)
+		}
+		if err := http.Serve(listener, served); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Stopped serving WebDAV")
+		}
+	}()
+	return nil
+}
+
+// davReadSize is the size of the first read of a response, which is read
+// before the headers are written to report its cache status
+const davReadSize = 32 * 1024
+
+// davPrefetchChunks is the number of chunks after the first read of a
+// response that are prefetched while the response is sent
+const davPrefetchChunks = 2
+
+// davHoldTime is the time the buffer of an object is kept open after a
+// response. Browsers and HTML5 players send many small, often overlapping
+// Range requests, each of them would otherwise start and stop the buffer
+// with its preloads.
+const davHoldTime = 30 * time.Second
+
+// davStatusKey is the context key of the response writer of a request
+type davStatusKey struct{}
+
+// davHolds holds the timers that release the buffers kept open
+var davHolds = struct {
+	lock    sync.Mutex
+	buffers map[*Buffer]*time.Timer
+}{
+	buffers: make(map[*Buffer]*time.Timer),
+}
+
+// holdDavBuffer keeps a buffer open till no request used it for the hold
+// time. Requests of overlapping ranges share its cached chunks and wait for
+// its running downloads instead of downloading the same chunks again.
+func holdDavBuffer(b *Buffer) {
+	davHolds.lock.Lock()
+	defer davHolds.lock.Unlock()
+
+	if timer, held := davHolds.buffers[b]; held && timer.Stop() {
+		timer.Reset(davHoldTime)
+		return
+	}
+	b.attach()
+	var timer *time.Timer
+	timer = time.AfterFunc(davHoldTime, func() {
+		davHolds.lock.Lock()
+		if davHolds.buffers[b] == timer {
+			delete(davHolds.buffers, b)
+		}
+		davHolds.lock.Unlock()
+		b.Close()
+	})
+	davHolds.buffers[b] = timer
+}
+
+// davAuthenticated rejects requests without the given basic authentication
+// credentials
+func davAuthenticated(handler http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestUser, requestPassword, ok := r.BasicAuth()
+		// both are compared, so that the time doesn't tell which one is wrong
+		userOK := 1 == subtle.ConstantTimeCompare([]byte(user), []byte(requestUser))
+		passwordOK := 1 == subtle.ConstantTimeCompare([]byte(password), []byte(requestPassword))
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="plexdrive"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// davReadOnly rejects all WebDAV methods that would modify the drive
+func davReadOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			status := &davStatusWriter{ResponseWriter: w}
+			handler.ServeHTTP(status, r.WithContext(context.WithValue(r.Context(), davStatusKey{}, status)))
+		case "HEAD", "OPTIONS", "PROPFIND":
+			handler.ServeHTTP(w, r)
+		default:
+			http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// davFS maps WebDAV paths to the objects of the drive
+type davFS struct {
+	drive *Drive
+	lock  sync.Mutex
+	root  *APIObject
+}
+
+// resolve finds the object of a path by looking up every path segment
+func (fs *davFS) resolve(name string) (*APIObject, error) {
+	fs.lock.Lock()
+	if nil == fs.root {
+		root, err := fs.drive.GetRoot()
+		if nil != err {
+			fs.lock.Unlock()
+			return nil, err
+		}
+		fs.root = root
+	}
+	object := fs.root
+	fs.lock.Unlock()
+
+	for _, part := range strings.Split(path.Clean("/"+name), "/") {
+		if "" == part {
+			continue
+		}
+		child, err := fs.drive.GetObjectByParentAndName(object.ObjectID, part)
+		if nil != err {
+			Log.Tracef("%v", err)
+			return nil, os.ErrNotExist
+		}
+		object = child
+	}
+	return object, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return webdav.ErrForbidden
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	return webdav.ErrForbidden
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return webdav.ErrForbidden
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	object, err := fs.resolve(name)
+	if nil != err {
+		return nil, err
+	}
+	return &davInfo{object: object}, nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if 0 != flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) {
+		return nil, webdav.ErrForbidden
+	}
+	object, err := fs.resolve(name)
+	if nil != err {
+		return nil, err
+	}
+	file := &davFile{drive: fs.drive, object: object}
+	if status, ok := ctx.Value(davStatusKey{}).(*davStatusWriter); ok && !object.IsDir {
+		status.file = file
+	}
+	return file, nil
+}
+
+// davStatusWriter adds the cache status of the first read to the headers
+// of a response: X-Cache (HIT or MISS), X-Cache-Chunk (the offset of the
+// chunk that served the first byte) and X-Cache-Latency on misses
+type davStatusWriter struct {
+	http.ResponseWriter
+	file        *davFile
+	wroteHeader bool
+}
+
+func (w *davStatusWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if nil != w.file && (http.StatusOK == code || http.StatusPartialContent == code) {
+		if status, read := w.file.readAhead(); read {
+			header := w.Header()
+			header.Set("X-Cache-Chunk", strconv.FormatInt(status.Chunk, 10))
+			if status.Hit {
+				header.Set("X-Cache", "HIT")
+			} else {
+				header.Set("X-Cache", "MISS")
+				header.Set("X-Cache-Latency", status.Latency.String())
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *davStatusWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// davInfo describes an object to WebDAV
+type davInfo struct {
+	object *APIObject
+}
+
+func (i *davInfo) Name() string {
+	return i.object.Name
+}
+
+func (i *davInfo) Size() int64 {
+	if i.object.IsDir {
+		return 0
+	}
+	return int64(i.object.ContentSize())
+}
+
+func (i *davInfo) Mode() os.FileMode {
+	if i.object.IsDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i *davInfo) ModTime() time.Time {
+	return i.object.LastModified
+}
+
+func (i *davInfo) IsDir() bool {
+	return i.object.IsDir
+}
+
+func (i *davInfo) Sys() interface{} {
+	return nil
+}
+
+// ContentType returns the content type by the file extension, so that
+// listing a directory doesn't download the beginning of every file
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(i.object.Name)); "" != contentType {
+		return contentType, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// davFile reads an object through its buffer, which is opened on the
+// first read
+type davFile struct {
+	drive    *Drive
+	object   *APIObject
+	buffer   *Buffer
+	offset   int64
+	children []os.FileInfo
+	// pending holds the bytes at offset read ahead of the response
+	pending []byte
+	// prefetch downloads the chunks after the first read, it is canceled
+	// once the response ended, e.g. because the client closed it
+	prefetch *PrefetchHandle
+}
+
+// open opens the buffer of the object on the first read
+func (f *davFile) open() error {
+	if nil != f.buffer {
+		return nil
+	}
+	buffer, err := f.drive.Open(f.object)
+	if nil != err {
+		return err
+	}
+	holdDavBuffer(buffer)
+	f.buffer = buffer
+	return nil
+}
+
+// readAhead reads the first bytes of a response before its headers are
+// written and returns how they were served. Small objects are served from
+// memory and report no status.
+func (f *davFile) readAhead() (ReadStatus, bool) {
+	if uint64(f.offset) >= f.object.ContentSize() || isSmallObject(f.object) || nil != f.open() {
+		return ReadStatus{}, false
+	}
+	p := make([]byte, davReadSize)
+	n, status, err := f.buffer.ReadIntoStatus(p, f.offset)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return ReadStatus{}, false
+	}
+	f.pending = p[:n]
+	f.prefetch = f.buffer.PrefetchAsync(f.offset+int64(n), davPrefetchChunks*f.buffer.chunkSize)
+	return status, true
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.object.IsDir {
+		return 0, fmt.Errorf("Object %v is a directory", f.object.ObjectID)
+	}
+	if uint64(f.offset) >= f.object.ContentSize() {
+		return 0, io.EOF
+	}
+
+	if isSmallObject(f.object) {
+		data, err := f.drive.ReadSmallObject(f.object, f.offset, int64(len(p)))
+		if nil != err {
+			return 0, err
+		}
+		n := copy(p, data)
+		f.offset += int64(n)
+		return n, nil
+	}
+
+	if len(f.pending) > 0 {
+		n := copy(p, f.pending)
+		f.pending = f.pending[n:]
+		f.offset += int64(n)
+		return n, nil
+	}
+
+	if err := f.open(); nil != err {
+		return 0, err
+	}
+	n, err := readWindowed(f.buffer, p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.readTail(offset)
+		offset += int64(f.object.ContentSize())
+	default:
+		return 0, fmt.Errorf("Invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid offset %v", offset)
+	}
+	if offset != f.offset {
+		f.pending = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// readTail learns the size of an object of unknown size when seeking from
+// its end, e.g. to serve a range request or to find the size of the
+// response. The tail is read with a suffix range and kept as the pending
+// bytes if the seek lands in it. Empty objects stay empty.
+func (f *davFile) readTail(offset int64) {
+	if f.object.IsDir || f.object.Encrypted || 0 != f.object.Size || nil != f.open() {
+		return
+	}
+	n := int64(davReadSize)
+	if -offset > n {
+		n = -offset
+	}
+	tail, err := f.buffer.ReadTail(n)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return
+	}
+	f.object = f.buffer.object
+	start := int64(f.object.Size) - int64(len(tail))
+	if seeked := int64(f.object.Size) + offset; seeked >= start {
+		f.pending = tail[seeked-start:]
+		f.offset = seeked
+	}
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.object.IsDir {
+		return nil, fmt.Errorf("Object %v is not a directory", f.object.ObjectID)
+	}
+	if nil == f.children {
+		objects, err := f.drive.GetObjectsByParent(f.object.ObjectID)
+		if nil != err {
+			return nil, err
+		}
+		f.children = []os.FileInfo{}
+		for _, object := range objects {
+			f.children = append(f.children, &davInfo{object: object})
+		}
+	}
+
+	if count <= 0 {
+		children := f.children
+		f.children = children[len(children):]
+		return children, nil
+	}
+	if 0 == len(f.children) {
+		return nil, io.EOF
+	}
+	if count > len(f.children) {
+		count = len(f.children)
+	}
+	children := f.children[:count]
+	f.children = f.children[count:]
+	return children, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return &davInfo{object: f.object}, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, webdav.ErrForbidden
+}
+
+func (f *davFile) Close() error {
+	if nil != f.prefetch {
+		f.prefetch.Cancel()
+	}
+	if nil != f.buffer {
+		return f.buffer.Close()
+	}
+	return nil
+}
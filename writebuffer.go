@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+var uploadPath string
+
+// SetUploadPath sets the global path for buffered uploads
+func SetUploadPath(path string) {
+	uploadPath = path
+}
+
+// WriteBuffer buffers written data in chunk files of the upload directory
+// and uploads the whole object to Google Drive when it is flushed.
+//
+// Writes may happen at any offset, gaps are uploaded as zeros. The object
+// is always uploaded as a whole, so existing objects can only be written
+// after truncating them. A failed upload keeps the data, so that the next
+// flush retries it.
+type WriteBuffer struct {
+	client    *Drive
+	object    *APIObject
+	tempDir   string
+	chunkSize int64
+	lock      sync.Mutex
+	size      int64
+	dirty     bool
+}
+
+// NewWriteBuffer creates a new write buffer. The object is created on
+// the first upload if it has no id yet. The buffer works on a copy of the
+// object, the object itself may be shared with other nodes and buffers.
+func NewWriteBuffer(client *Drive, object *APIObject) (*WriteBuffer, error) {
+	Log.Debugf("Creating write buffer for object %v", safeName(object.Name))
+
+	tempDir, err := ioutil.TempDir(uploadPath, "upload-")
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not create upload path for object %v", safeName(object.Name))
+	}
+
+	copied := *object
+	return &WriteBuffer{
+		client:    client,
+		object:    &copied,
+		tempDir:   tempDir,
+		chunkSize: currentChunkSize(),
+		dirty:     true,
+	}, nil
+}
+
+// Write writes the data at the given offset into the chunk files
+func (w *WriteBuffer) Write(offset int64, data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	written := 0
+	for written < len(data) {
+		position := offset + int64(written)
+		fOffset := position % w.chunkSize
+		chunkOffset := position - fOffset
+		length := int(math.Min(float64(w.chunkSize-fOffset), float64(len(data)-written)))
+
+		f, err := os.OpenFile(filepath.Join(w.tempDir, strconv.FormatInt(chunkOffset, 10)), os.O_RDWR|os.O_CREATE, 0600)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return written, fmt.Errorf("Could not open upload chunk of object %v", safeName(w.object.Name))
+		}
+		_, err = f.WriteAt(data[written:written+length], fOffset)
+		f.Close()
+		if nil != err {
+			Log.Debugf("%v", err)
+			return written, fmt.Errorf("Could not write upload chunk of object %v", safeName(w.object.Name))
+		}
+
+		written += length
+	}
+
+	if end := offset + int64(written); end > w.size {
+		w.size = end
+	}
+	w.dirty = true
+
+	return written, nil
+}
+
+// Size returns the size of the written object
+func (w *WriteBuffer) Size() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return uint64(w.size)
+}
+
+// Object returns a copy of the object as of the last upload
+func (w *WriteBuffer) Object() *APIObject {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	object := *w.object
+	return &object
+}
+
+// Flush uploads the object if it was written since the last upload
+func (w *WriteBuffer) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+
+	Log.Infof("Uploading %v (%v bytes)", safeName(w.object.Name), w.size)
+
+	var readers []io.Reader
+	for offset := int64(0); offset < w.size; offset += w.chunkSize {
+		length := int64(math.Min(float64(w.chunkSize), float64(w.size-offset)))
+
+		available := int64(0)
+		f, err := os.Open(filepath.Join(w.tempDir, strconv.FormatInt(offset, 10)))
+		if nil == err {
+			defer f.Close()
+			if info, err := f.Stat(); nil == err {
+				available = int64(math.Min(float64(info.Size()), float64(length)))
+			}
+			readers = append(readers, io.NewSectionReader(f, 0, available))
+		}
+		readers = append(readers, io.LimitReader(zeroReader{}, length-available))
+	}
+
+	object, err := w.client.Upload(w.object, io.MultiReader(readers...))
+	if nil != err {
+		return err
+	}
+
+	*w.object = *object
+	w.dirty = false
+	return nil
+}
+
+// Close removes the buffered data, unflushed data is lost
+func (w *WriteBuffer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	Log.Debugf("Closing write buffer for object %v", safeName(w.object.Name))
+	if err := os.RemoveAll(w.tempDir); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not delete upload path of object %v", safeName(w.object.Name))
+	}
+	return nil
+}
+
+// zeroReader reads an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}